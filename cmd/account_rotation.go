@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadLimitWindow is how long drive refuses the uploads of an account which exhausted its daily upload quota.
+const uploadLimitWindow = 24 * time.Hour
+
+// FallbackAccount is an account uploads switch to once gd_account_name, and the fallback accounts before it, have
+// exhausted their daily upload quota. It needs the same access to the remote folders.
+type FallbackAccount struct {
+	// Name is the gdrive account with drive_client "gdrive", a label for the output and the upload accounting with
+	// "api"
+	Name         string `yaml:"name"`
+	APITokenFile string `yaml:"api_token_file"`
+}
+
+// gdriveUploadLimitOutput matches what the gdrive binary prints once the daily upload quota is exhausted.
+var gdriveUploadLimitOutput = regexp.MustCompile(`(?i)uploadLimitExceeded|upload limit`)
+
+// isUploadLimitError reports the error drive fails uploads with once the account uploaded 750 GB in a day.
+func isUploadLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code != http.StatusForbidden {
+			return false
+		}
+		for _, e := range apiErr.Errors {
+			if e.Reason == "uploadLimitExceeded" {
+				return true
+			}
+		}
+		return false
+	}
+	return err != nil && gdriveUploadLimitOutput.MatchString(err.Error())
+}
+
+// validFallbackAccounts checks every fallback account is named, once, and has its own token with drive_client "api".
+func validFallbackAccounts(cfg *Config) error {
+	if len(cfg.GDFallbackAccounts) != 0 && cfg.GDServiceAccountFile != "" {
+		return errors.New("gd_fallback_accounts can't be used with gd_service_account_file, every account would be the service account")
+	}
+	names := map[string]bool{cfg.GDAccountName: true}
+	for i, a := range cfg.GDFallbackAccounts {
+		switch {
+		case a.Name == "":
+			return fmt.Errorf("gd_fallback_accounts[%v]: name is required", i)
+		case names[a.Name]:
+			return fmt.Errorf("gd_fallback_accounts[%v]: account %q is used twice", i, a.Name)
+		case cfg.DriveClient == driveClientAPI && !cfg.TestMode && a.APITokenFile == "":
+			return fmt.Errorf("gd_fallback_accounts[%v]: api_token_file is required with drive_client %q", i, driveClientAPI)
+		case cfg.DriveClient == driveClientAPI && !cfg.TestMode && a.APITokenFile == cfg.GDAPITokenFile:
+			return fmt.Errorf("gd_fallback_accounts[%v]: api_token_file is gd_api_token_file, the account of gd_account_name", i)
+		}
+		names[a.Name] = true
+	}
+	return nil
+}
+
+// accountRotation is which of gd_account_name and gd_fallback_accounts uploads go through.
+type accountRotation struct {
+	mu     sync.Mutex
+	names  []string
+	active int
+	// exhausted is when each account was found out of upload quota
+	exhausted map[int]time.Time
+}
+
+var (
+	accountRotationsMu = &sync.Mutex{}
+	accountRotations   = map[string]*accountRotation{}
+)
+
+// accountRotationFor returns the rotation of the accounts of cfg, nil without gd_fallback_accounts. Targets with the
+// same accounts share one, the quota being per account.
+func accountRotationFor(cfg *Config) *accountRotation {
+	if len(cfg.GDFallbackAccounts) == 0 || cfg.TestMode {
+		return nil
+	}
+	names := []string{cfg.GDAccountName}
+	for _, a := range cfg.GDFallbackAccounts {
+		names = append(names, a.Name)
+	}
+	key := strings.Join(names, "\x00")
+	accountRotationsMu.Lock()
+	defer accountRotationsMu.Unlock()
+	r, ok := accountRotations[key]
+	if !ok {
+		r = &accountRotation{names: names, exhausted: map[int]time.Time{}}
+		accountRotations[key] = r
+	}
+	return r
+}
+
+// current returns the index of the active account.
+func (r *accountRotation) current() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active
+}
+
+func (r *accountRotation) name(i int) string {
+	if r.names[i] == "" {
+		return "(default)"
+	}
+	return r.names[i]
+}
+
+// exhaust records the account i as out of upload quota and switches to the next account which isn't, going back to
+// the first ones a day after they ran out. It reports false when every account is out of quota.
+func (r *accountRotation) exhaust(i int, reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if _, ok := r.exhausted[i]; !ok {
+		r.exhausted[i] = now
+	}
+	if r.active != i {
+		return true // switched by another upload meanwhile
+	}
+	for n := 1; n < len(r.names); n++ {
+		next := (i + n) % len(r.names)
+		if at, ok := r.exhausted[next]; ok && now.Sub(at) < uploadLimitWindow {
+			continue
+		}
+		delete(r.exhausted, next)
+		r.active = next
+		printOp("switched", "uploads to account "+r.name(next), fmt.Sprintf("account %v %v", r.name(i), reason))
+		return true
+	}
+	return false
+}
+
+// rotatingDriveClient goes through the client of the active account of a rotation, and switches to the next account
+// when an upload fails for lack of daily upload quota.
+type rotatingDriveClient struct {
+	clients  []DriveClient
+	rotation *accountRotation
+}
+
+// newRotatingDriveClient builds a client per fallback account of cfg, next to primary which is the client of
+// gd_account_name.
+func newRotatingDriveClient(cfg *Config, primary DriveClient) (DriveClient, error) {
+	clients := []DriveClient{primary}
+	for _, a := range cfg.GDFallbackAccounts {
+		acfg := *cfg
+		acfg.GDAccountName, acfg.GDAPITokenFile = a.Name, a.APITokenFile
+		client, err := newAccountDriveClient(&acfg)
+		if err != nil {
+			return nil, fmt.Errorf("account %v: %v", a.Name, err)
+		}
+		if api, ok := client.(*apiDriveClient); ok {
+			// upload_sessions.json is written by one of them, the session urls don't depend on the account
+			api.sessions = primary.(*apiDriveClient).sessions
+		}
+		clients = append(clients, client)
+	}
+	return &rotatingDriveClient{clients: clients, rotation: accountRotationFor(cfg)}, nil
+}
+
+func (c *rotatingDriveClient) active() DriveClient {
+	return c.clients[c.rotation.current()]
+}
+
+// withUploadQuota runs the upload do with the client of the active account, again with the next account when that
+// one is out of upload quota.
+func withUploadQuota[T any](c *rotatingDriveClient, do func(DriveClient) (T, error)) (T, error) {
+	for {
+		i := c.rotation.current()
+		v, err := do(c.clients[i])
+		if !isUploadLimitError(err) || !c.rotation.exhaust(i, "exhausted its daily upload quota") {
+			return v, err
+		}
+	}
+}
+
+func (c *rotatingDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	return withUploadQuota(c, func(d DriveClient) (*RemoteFile, error) { return d.Upload(parentID, loc) })
+}
+
+func (c *rotatingDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	return withUploadQuota(c, func(d DriveClient) (*RemoteFile, error) { return d.Update(id, loc) })
+}
+
+func (c *rotatingDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	return withUploadQuota(c, func(d DriveClient) (*RemoteFile, error) { return d.Import(parentID, id, loc, mimeType) })
+}
+
+func (c *rotatingDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	return withUploadQuota(c, func(d DriveClient) (*RemoteFile, error) { return d.Copy(id, parentID, name) })
+}
+
+func (c *rotatingDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	var files []*RemoteFile
+	id, err := withUploadQuota(c, func(d DriveClient) (string, error) {
+		id, f, err := d.UploadFolder(parentID, name, locs)
+		files = f
+		return id, err
+	})
+	return id, files, err
+}
+
+func (c *rotatingDriveClient) Mkdir(parentID, name string) (string, error) {
+	return c.active().Mkdir(parentID, name)
+}
+
+func (c *rotatingDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	return c.active().Move(id, oldParentID, newParentID, name)
+}
+
+func (c *rotatingDriveClient) Delete(id string) error { return c.active().Delete(id) }
+func (c *rotatingDriveClient) Trash(id string) error  { return c.active().Trash(id) }
+
+func (c *rotatingDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	return c.active().List(parentID, nameContains)
+}
+
+func (c *rotatingDriveClient) Download(id, loc string) error { return c.active().Download(id, loc) }
+
+func (c *rotatingDriveClient) Share(id, email, role string) error {
+	return c.active().Share(id, email, role)
+}
+
+func (c *rotatingDriveClient) Export(id, mimeType, loc string) error {
+	return c.active().Export(id, mimeType, loc)
+}
+
+func (c *rotatingDriveClient) StartPageToken() (string, error) {
+	return c.clients[0].StartPageToken()
+}
+
+// Changes always reads the feed of gd_account_name, a position in the feed of an account is meaningless to another.
+func (c *rotatingDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	return c.clients[0].Changes(pageToken)
+}
+
+// uploadAccount is the account uploads currently go through, for the upload accounting.
+func (om *ObjectManager) uploadAccount() string {
+	if r := om.accounts; r != nil {
+		return r.names[r.current()]
+	}
+	return om.cfg.GDAccountName
+}
+
+// reserveUpload reserves size bytes of the daily_upload_cap of the account uploading. With gd_fallback_accounts, the
+// uploads switch to the next account once the cap of the current one is reached, instead of pausing until it frees
+// up.
+func (om *ObjectManager) reserveUpload(size int64) (func(), error) {
+	if r := om.accounts; r != nil {
+		for i := r.current(); !om.uploads.fits(r.names[i], size); i = r.current() {
+			if !r.exhaust(i, "reached daily_upload_cap") {
+				break
+			}
+		}
+	}
+	return om.uploads.reserve(om.uploadAccount(), size)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// workerWindow is how long the governor observes the drive operations before resizing.
+const workerWindow = 10 * time.Second
+
+// loadAdaptiveWorkers validates sync_worker_min and sync_worker_max. Adaptive sizing is on when sync_worker_max is set.
+func loadAdaptiveWorkers(cfg *Config) error {
+	if cfg.SyncWorkerMax == 0 {
+		if cfg.SyncWorkerMin != 0 {
+			return errors.New("sync_worker_min: requires sync_worker_max")
+		}
+		return nil
+	}
+	if cfg.SyncWorkerMin == 0 {
+		cfg.SyncWorkerMin = 1
+	}
+	if cfg.SyncWorkerMin < 0 || cfg.SyncWorkerMax < cfg.SyncWorkerMin {
+		return fmt.Errorf("sync_worker_min and sync_worker_max: expected 1 <= %v <= %v", cfg.SyncWorkerMin, cfg.SyncWorkerMax)
+	}
+	return nil
+}
+
+// poolWorkers is the size of the worker pools of a cycle. With adaptive sizing the pools run up to sync_worker_max
+// and the governor decides how many of them talk to drive at once.
+func (cfg *Config) poolWorkers() int {
+	if cfg.SyncWorkerMax > 0 {
+		return cfg.SyncWorkerMax
+	}
+	return cfg.SyncWorker
+}
+
+// workerGovernor bounds the drive operations running at once between min and max. Every workerWindow the bound is
+// halved when drive answered with rate limits, grown while every slot stayed busy and the throughput kept up, and
+// stepped back when growing made the throughput drop.
+type workerGovernor struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	min, max int
+	limit    int
+	active   int
+
+	windowStart time.Time
+	ops         int
+	bytes       int64
+	rateLimited int
+	saturated   bool
+	lastOps     float64
+	lastBytes   float64
+	grew        bool
+}
+
+var (
+	workerGovernorMu      sync.Mutex
+	processWorkerGovernor *workerGovernor
+)
+
+// sharedWorkerGovernor returns the governor of the process. Targets share it since drive rate limits the account
+// (or oauth client) rather than a folder.
+func sharedWorkerGovernor(cfg *Config) *workerGovernor {
+	workerGovernorMu.Lock()
+	defer workerGovernorMu.Unlock()
+	if processWorkerGovernor == nil {
+		g := &workerGovernor{min: cfg.SyncWorkerMin, max: cfg.SyncWorkerMax, windowStart: time.Now()}
+		g.limit = min(max(cfg.SyncWorker, g.min), g.max)
+		g.cond = sync.NewCond(&g.mu)
+		processWorkerGovernor = g
+	}
+	return processWorkerGovernor
+}
+
+func (g *workerGovernor) acquire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.active >= g.limit {
+		g.saturated = true
+		g.cond.Wait()
+	}
+	g.active++
+	if g.active == g.limit {
+		g.saturated = true
+	}
+}
+
+// release ends an operation which transferred n bytes and failed with err, nil on success.
+func (g *workerGovernor) release(n int64, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	switch {
+	case err == nil:
+		g.ops++
+		g.bytes += n
+	case isRateLimitError(err):
+		g.rateLimited++
+	}
+	if elapsed := time.Since(g.windowStart); elapsed >= workerWindow {
+		g.resize(elapsed.Seconds())
+	}
+	g.cond.Broadcast()
+}
+
+// resize adjusts the limit to the window that just ended, lasting seconds.
+func (g *workerGovernor) resize(seconds float64) {
+	ops, bytes := float64(g.ops)/seconds, float64(g.bytes)/seconds
+	prev := g.limit
+	var reason string
+	switch {
+	case g.rateLimited > 0:
+		g.limit = max(g.limit/2, g.min)
+		reason = fmt.Sprintf("%v rate limited operations", g.rateLimited)
+	case g.grew && ops < g.lastOps*0.8 && (g.lastBytes == 0 || bytes < g.lastBytes*0.8):
+		g.limit = max(g.limit-max(g.limit/5, 1), g.min)
+		reason = "throughput dropped"
+	case g.saturated:
+		g.limit = min(g.limit+max(g.limit/4, 1), g.max)
+		reason = "every worker busy"
+	}
+	g.grew = g.limit > prev
+	g.lastOps, g.lastBytes = ops, bytes
+	g.windowStart, g.ops, g.bytes, g.rateLimited, g.saturated = time.Now(), 0, 0, 0, g.active >= g.limit
+	if g.limit != prev {
+		printOp("workers", fmt.Sprintf("%v -> %v", prev, g.limit),
+			fmt.Sprintf("%v, %.1f ops/s, %v/s", reason, ops, getFileSizeFormatted(int64(bytes))))
+	}
+}
+
+// governedDriveClient runs the operations of a DriveClient under the workerGovernor of the process.
+type governedDriveClient struct {
+	DriveClient
+	g *workerGovernor
+}
+
+// withWorkerGovernor returns client governed by the adaptive worker sizing, client itself when it is off.
+func withWorkerGovernor(cfg *Config, client DriveClient) DriveClient {
+	if cfg.SyncWorkerMax == 0 {
+		return client
+	}
+	return &governedDriveClient{DriveClient: client, g: sharedWorkerGovernor(cfg)}
+}
+
+// governed runs op as one operation, counting the size of the file at loc as transferred when it succeeds.
+func governed[T any](g *workerGovernor, loc string, op func() (T, error)) (T, error) {
+	g.acquire()
+	v, err := op()
+	var n int64
+	if err == nil && loc != "" {
+		if info, statErr := os.Stat(loc); statErr == nil {
+			n = info.Size()
+		}
+	}
+	g.release(n, err)
+	return v, err
+}
+
+func (c *governedDriveClient) Mkdir(parentID, name string) (string, error) {
+	return governed(c.g, "", func() (string, error) { return c.DriveClient.Mkdir(parentID, name) })
+}
+
+func (c *governedDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	return governed(c.g, loc, func() (*RemoteFile, error) { return c.DriveClient.Upload(parentID, loc) })
+}
+
+func (c *governedDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	return governed(c.g, loc, func() (*RemoteFile, error) { return c.DriveClient.Update(id, loc) })
+}
+
+func (c *governedDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	return governed(c.g, loc, func() (*RemoteFile, error) { return c.DriveClient.Import(parentID, id, loc, mimeType) })
+}
+
+func (c *governedDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	return governed(c.g, "", func() (*RemoteFile, error) { return c.DriveClient.Copy(id, parentID, name) })
+}
+
+func (c *governedDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	var files []*RemoteFile
+	id, err := governed(c.g, "", func() (string, error) {
+		id, f, err := c.DriveClient.UploadFolder(parentID, name, locs)
+		files = f
+		return id, err
+	})
+	return id, files, err
+}
+
+func (c *governedDriveClient) Share(id, email, role string) error {
+	_, err := governed(c.g, "", func() (struct{}, error) { return struct{}{}, c.DriveClient.Share(id, email, role) })
+	return err
+}
+
+func (c *governedDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	_, err := governed(c.g, "", func() (struct{}, error) {
+		return struct{}{}, c.DriveClient.Move(id, oldParentID, newParentID, name)
+	})
+	return err
+}
+
+func (c *governedDriveClient) Delete(id string) error {
+	_, err := governed(c.g, "", func() (struct{}, error) { return struct{}{}, c.DriveClient.Delete(id) })
+	return err
+}
+
+func (c *governedDriveClient) Trash(id string) error {
+	_, err := governed(c.g, "", func() (struct{}, error) { return struct{}{}, c.DriveClient.Trash(id) })
+	return err
+}
+
+func (c *governedDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	return governed(c.g, "", func() ([]*RemoteFile, error) { return c.DriveClient.List(parentID, nameContains) })
+}
+
+func (c *governedDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	var next string
+	changes, err := governed(c.g, "", func() ([]*RemoteChange, error) {
+		changes, n, err := c.DriveClient.Changes(pageToken)
+		next = n
+		return changes, err
+	})
+	return changes, next, err
+}
+
+func (c *governedDriveClient) Download(id, loc string) error {
+	_, err := governed(c.g, loc, func() (struct{}, error) { return struct{}{}, c.DriveClient.Download(id, loc) })
+	return err
+}
+
+func (c *governedDriveClient) Export(id, mimeType, loc string) error {
+	_, err := governed(c.g, loc, func() (struct{}, error) { return struct{}{}, c.DriveClient.Export(id, mimeType, loc) })
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bearaujus/bworker/pool"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// adoptRemote seeds the object map with the folders and files under the remote root which already exist in the
+// local tree, so the first sync of a folder already on drive doesn't upload it again. Files are matched by name and
+// size, and by md5 when the client reports it. A file whose content differs is adopted too, and updated from the
+// local side by the next sync instead of being uploaded as a second copy. Only paths the sync would walk are
+// adopted, tracked ones are left alone.
+func adoptRemote(cfg *Config, om *ObjectManager) error {
+	local := map[string]os.FileInfo{}
+	skipped, err := walkSource(cfg, cfg.SyncTargetPath, "", func(loc string, info os.FileInfo) error {
+		local[loc] = info
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, sp := range skipped {
+		printOp("skipped", strings.TrimPrefix(sp.Loc, cfg.SyncTargetPath), sp.String())
+	}
+
+	var erw error
+	bw := pool.NewBWorkerPool(cfg.poolWorkers(), pool.WithError(&erw))
+	defer bw.Shutdown()
+	var matched, differing, folders atomic.Int64
+
+	var walk func(loc, folderID string) error
+	walk = func(loc, folderID string) error {
+		files, err := om.drive.List(folderID, "")
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if loc == cfg.SyncTargetPath && isRemoteMetaName(f.Name) {
+				continue
+			}
+			childLoc := filepath.Join(loc, f.Name)
+			rel := strings.TrimPrefix(childLoc, cfg.SyncTargetPath)
+			info, ok := local[childLoc]
+			if !ok || info.IsDir() != f.IsDir || f.IsGoogleNative() {
+				continue
+			}
+			if _, tracked := om.loadObject(childLoc); tracked {
+				printOp("kept", rel, "already tracked")
+				if f.IsDir {
+					if err = walk(childLoc, f.ID); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if f.IsDir {
+				om.storeObject(childLoc, &Object{GDId: f.ID, GDPId: folderID, Size: info.Size()})
+				folders.Add(1)
+				if err = walk(childLoc, f.ID); err != nil {
+					return err
+				}
+				continue
+			}
+
+			object := &Object{GDId: f.ID, GDPId: folderID, LastMod: info.ModTime().Unix(), Size: info.Size(),
+				RemoteMod: remoteModUnix(f), Inode: fileInode(info)}
+			if !om.storeObject(childLoc, object) {
+				continue // a second remote file of the same name
+			}
+			fCp := f
+			bw.Do(func() error {
+				same := fCp.Size == info.Size()
+				if same && fCp.MD5 != "" {
+					sum, err := om.hashes.md5(childLoc)
+					if err != nil {
+						om.deleteObject(childLoc)
+						return err
+					}
+					same = strings.EqualFold(sum, fCp.MD5)
+					om.updateStoredObject(object, func(o *Object) { o.MD5 = sum })
+				}
+				if !same {
+					// older and of another size than the local file: the next sync updates drive
+					om.updateStoredObject(object, func(o *Object) {
+						o.LastMod, o.Size, o.MD5 = 1, -1, ""
+					})
+					differing.Add(1)
+					printOp("adopted", rel, "differs from the local file, updated by the next sync")
+					return nil
+				}
+				matched.Add(1)
+				printOp("adopted", rel, getFileSizeFormatted(info.Size()))
+				return nil
+			})
+		}
+		return nil
+	}
+
+	err = walk(cfg.SyncTargetPath, om.rootID())
+	bw.Wait()
+	if err == nil {
+		err = erw
+	}
+	if saveErr := om.SaveToFile(); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vadopted %v folders and %v files, %v of them differing, the first sync uploads the rest\n",
+		cfg.targetLabel(), folders.Load(), matched.Load()+differing.Load(), differing.Load())
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+func newAuthCmd(cf *configFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "auth",
+		Short: "Authorize drive_client \"api\" to access drive",
+		Args:  cobra.NoArgs,
+	}
+	var device bool
+	login := &cobra.Command{
+		Use:   "login [account]",
+		Short: "Run the oauth flow and store the token in gd_api_token_file",
+		Long: "Authorize bgdrive-sync with the oauth client of gd_api_credentials_file and store the token in\n" +
+			"gd_api_token_file, or in the api_token_file of account when it names one of gd_fallback_accounts. The\n" +
+			"token is refreshed into the same file while syncing, so neither the gdrive binary nor a browser is needed\n" +
+			"afterwards. By default the printed url is opened in a browser of this machine, with --device a code is\n" +
+			"entered at google.com/device from any other device instead, e.g. on a headless server. Google only grants\n" +
+			"the drive.file scope to the device flow: bgdrive-sync then sees the files it created, not the others.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			cfg := *targets[0] // every target authorizes with the same token
+			if cfg.GDServiceAccountFile != "" {
+				return errors.New("gd_service_account_file is set, a service account needs no login")
+			}
+			if len(args) == 1 {
+				if cfg.GDAPITokenFile, err = fallbackTokenFile(&cfg, args[0]); err != nil {
+					return err
+				}
+			}
+			oauthCfg, err := newOAuthConfig(&cfg)
+			if err != nil {
+				return err
+			}
+
+			var token *oauth2.Token
+			if device {
+				token, err = authorizeOnDevice(proxyContext(context.Background(), &cfg), oauthCfg)
+			} else {
+				token, err = authorizeInBrowser(proxyContext(context.Background(), &cfg), oauthCfg)
+			}
+			if err != nil {
+				return err
+			}
+			if err = writeOAuthToken(cfg.GDAPITokenFile, token); err != nil {
+				return err
+			}
+			fmt.Println(colorize(colorGreen, "Authorized!") + " token stored in " + cfg.GDAPITokenFile)
+			if cfg.DriveClient != driveClientAPI {
+				fmt.Printf("set drive_client to %q to sync with it instead of the gdrive binary\n", driveClientAPI)
+			}
+			return nil
+		},
+	}
+	login.Flags().BoolVar(&device, "device", false, "authorize by entering a code from another device, without a browser on this machine")
+	cmd.AddCommand(login)
+	return cmd
+}
+
+// fallbackTokenFile returns the api_token_file of the fallback account named name.
+func fallbackTokenFile(cfg *Config, name string) (string, error) {
+	for _, a := range cfg.GDFallbackAccounts {
+		if a.Name != name {
+			continue
+		}
+		if a.APITokenFile == "" {
+			return "", fmt.Errorf("account %q has no api_token_file", name)
+		}
+		return a.APITokenFile, nil
+	}
+	return "", fmt.Errorf("no account %q in gd_fallback_accounts", name)
+}
+
+// authorizeOnDevice runs the oauth device flow: the user enters the printed code at the printed url from any device
+// while the token is polled for. The oauth client must be of the "TVs and Limited Input devices" type.
+func authorizeOnDevice(ctx context.Context, oauthCfg *oauth2.Config) (*oauth2.Token, error) {
+	cfgCp := *oauthCfg
+	cfgCp.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	cfgCp.Scopes = []string{drive.DriveFileScope} // the only drive scope the device flow is allowed
+	da, err := cfgCp.DeviceAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Open %v on any device and enter the code %v to authorize bgdrive-sync\n", da.VerificationURI, da.UserCode)
+	return cfgCp.DeviceAccessToken(ctx, da)
+}
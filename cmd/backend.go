@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	backendDrive  = "drive"
+	backendLocal  = "local"
+	backendS3     = "s3"
+	backendRclone = "rclone"
+)
+
+// Backend stores the synced files somewhere else than drive. Its files and folders are addressed by their slash
+// separated path under the root of the backend, "" being the root.
+type Backend interface {
+	// Mkdir creates the folder p, and its missing parents.
+	Mkdir(p string) error
+	// Put writes the local file at loc to p, replacing the file there, and returns what was written.
+	Put(p, loc string) (*RemoteFile, error)
+	// Get writes the content of the file p to the local file at loc.
+	Get(p, loc string) error
+	// Copy copies the file from to to on the backend's side and returns the copy.
+	Copy(from, to string) (*RemoteFile, error)
+	// Rename moves the file, or with dir the folder and its children, from to to.
+	Rename(from, to string, dir bool) error
+	// Remove deletes the file, or with dir the folder and its children, p.
+	Remove(p string, dir bool) error
+	// List returns the children of the folder p, without their ids.
+	List(p string) ([]*RemoteFile, error)
+}
+
+// newBackend builds the backend selected by backend, nil for drive.
+func newBackend(cfg *Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", backendDrive:
+		return nil, nil
+	case backendLocal:
+		return &localBackend{root: cfg.BackendPath}, nil
+	case backendS3:
+		return newS3Backend(cfg.S3)
+	case backendRclone:
+		return newRcloneBackend(cfg)
+	default:
+		return nil, fmt.Errorf("backend: unknown backend %q, expected %q, %q, %q or %q", cfg.Backend, backendDrive, backendLocal,
+			backendS3, backendRclone)
+	}
+}
+
+// validBackend checks the settings of backend and refuses the features only drive has.
+func validBackend(cfg *Config) error {
+	switch cfg.Backend {
+	case "", backendDrive:
+		return nil
+	case backendLocal:
+		if cfg.BackendPath == "" {
+			return fmt.Errorf("backend %q requires backend_path", backendLocal)
+		}
+	case backendS3:
+		if cfg.S3.Bucket == "" || cfg.S3.Endpoint == "" {
+			return fmt.Errorf("backend %q requires s3.endpoint and s3.bucket", backendS3)
+		}
+	case backendRclone:
+		if cfg.Rclone.Remote == "" {
+			return fmt.Errorf("backend %q requires rclone.remote", backendRclone)
+		}
+	default:
+		_, err := newBackend(cfg)
+		return err
+	}
+	var unsupported string
+	switch {
+	case cfg.GDRootFolderID != "" || cfg.GDRootFolderName != "" || cfg.GDRootPath != "" || cfg.GDDriveID != "":
+		unsupported = "gd_root_folder_id, gd_root_folder_name, gd_root_path and gd_drive_id"
+	case len(cfg.GDFallbackAccounts) != 0:
+		unsupported = "gd_fallback_accounts"
+	case cfg.RemoteChanges:
+		unsupported = "remote_changes"
+	case cfg.DeleteMode == deleteModeTrash:
+		unsupported = "delete_mode " + deleteModeTrash
+	case cfg.KeepRevisions != 0:
+		unsupported = "keep_revisions"
+	case len(cfg.GoogleConvert) != 0:
+		unsupported = "google_convert"
+	case len(cfg.Sharing) != 0:
+		unsupported = "sharing"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%v can't be used with backend %q, only with drive", unsupported, cfg.Backend)
+}
+
+// backendDriveClient goes to a backend, the ids of its files and folders being kept in an index.
+type backendDriveClient struct {
+	name    string
+	backend Backend
+	index   *backendIndex
+}
+
+func newBackendDriveClient(cfg *Config, backend Backend) (*backendDriveClient, error) {
+	index, err := backendIndexFor(cfg.statePath("backend_index.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	return &backendDriveClient{name: cfg.Backend, backend: backend, index: index}, nil
+}
+
+func (c *backendDriveClient) unsupported(op string) error {
+	return fmt.Errorf("%v isn't supported by backend %q", op, c.name)
+}
+
+// child returns the path of name in the folder parentID.
+func (c *backendDriveClient) child(parentID, name string) (string, error) {
+	parent, dir, err := c.index.pathOf(parentID)
+	if err != nil {
+		return "", err
+	}
+	if !dir {
+		return "", fmt.Errorf("%v: not a folder", parent)
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return path.Join(parent, name), nil
+}
+
+// withID returns f, found at p, with its id.
+func (c *backendDriveClient) withID(p string, f *RemoteFile) (*RemoteFile, error) {
+	id, err := c.index.id(p, f.IsDir)
+	if err != nil {
+		return nil, err
+	}
+	f.ID, f.Name = id, path.Base(p)
+	return f, nil
+}
+
+func (c *backendDriveClient) Mkdir(parentID, name string) (string, error) {
+	p, err := c.child(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	if err = c.backend.Mkdir(p); err != nil {
+		return "", err
+	}
+	return c.index.id(p, true)
+}
+
+func (c *backendDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	p, err := c.child(parentID, filepath.Base(loc))
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.backend.Put(p, loc)
+	if err != nil {
+		return nil, err
+	}
+	return c.withID(p, f)
+}
+
+func (c *backendDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	p, _, err := c.index.pathOf(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.backend.Put(p, loc)
+	if err != nil {
+		return nil, err
+	}
+	return c.withID(p, f)
+}
+
+func (c *backendDriveClient) Move(id, _, newParentID, name string) error {
+	from, dir, err := c.index.pathOf(id)
+	if err != nil {
+		return err
+	}
+	to, err := c.child(newParentID, name)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if err = c.backend.Rename(from, to, dir); err != nil {
+		return err
+	}
+	return c.index.move(from, to)
+}
+
+func (c *backendDriveClient) Delete(id string) error {
+	p, dir, err := c.index.pathOf(id)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("the root can't be deleted")
+	}
+	if err = c.backend.Remove(p, dir); err != nil {
+		return err
+	}
+	return c.index.remove(p)
+}
+
+func (c *backendDriveClient) Trash(_ string) error { return c.unsupported("trash") }
+
+func (c *backendDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	parent, _, err := c.index.pathOf(parentID)
+	if err != nil {
+		return nil, err
+	}
+	children, err := c.backend.List(parent)
+	if err != nil {
+		return nil, err
+	}
+	var files []*RemoteFile
+	for _, f := range children {
+		if !strings.Contains(f.Name, nameContains) {
+			continue
+		}
+		if f, err = c.withID(path.Join(parent, f.Name), f); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (c *backendDriveClient) Download(id, loc string) error {
+	p, _, err := c.index.pathOf(id)
+	if err != nil {
+		return err
+	}
+	return c.backend.Get(p, loc)
+}
+
+func (c *backendDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	from, _, err := c.index.pathOf(id)
+	if err != nil {
+		return nil, err
+	}
+	to, err := c.child(parentID, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.backend.Copy(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return c.withID(to, f)
+}
+
+func (c *backendDriveClient) Import(_, _, _, _ string) (*RemoteFile, error) {
+	return nil, c.unsupported("converting to google documents")
+}
+
+func (c *backendDriveClient) Export(_, _, _ string) error {
+	return c.unsupported("exporting google documents")
+}
+
+func (c *backendDriveClient) Share(_, _, _ string) error { return c.unsupported("sharing") }
+
+func (c *backendDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	return uploadFolderOneByOne(c, parentID, name, locs)
+}
+
+func (c *backendDriveClient) StartPageToken() (string, error) {
+	return "", c.unsupported("the changes feed")
+}
+
+func (c *backendDriveClient) Changes(_ string) ([]*RemoteChange, string, error) {
+	return nil, "", c.unsupported("the changes feed")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// backend index ops
+const (
+	backendIndexAdd    = "add"
+	backendIndexMove   = "move"
+	backendIndexRemove = "remove"
+)
+
+// backendIndexRecord is one line of a backend index.
+type backendIndexRecord struct {
+	Op   string `json:"op"`
+	ID   string `json:"id,omitempty"`
+	Path string `json:"path"`
+	To   string `json:"to,omitempty"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+// backendIndex gives the files and folders of a backend, which are addressed by path, the ids of drive files: they
+// keep their id when they or the folders they are in are moved, as the object map expects. It is kept as a journal
+// of the changes, compacted when opened.
+type backendIndex struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	ids   map[string]string // id to path
+	paths map[string]string // path to id
+	dirs  map[string]bool
+}
+
+var (
+	backendIndexesMu = &sync.Mutex{}
+	backendIndexes   = map[string]*backendIndex{}
+)
+
+// backendIndexFor returns the index stored at path, opened once per process for every client of the target to share.
+func backendIndexFor(path string) (*backendIndex, error) {
+	backendIndexesMu.Lock()
+	defer backendIndexesMu.Unlock()
+	if idx, ok := backendIndexes[path]; ok {
+		return idx, nil
+	}
+	idx, err := openBackendIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	backendIndexes[path] = idx
+	return idx, nil
+}
+
+func openBackendIndex(path string) (*backendIndex, error) {
+	idx := &backendIndex{path: path, ids: map[string]string{}, paths: map[string]string{}, dirs: map[string]bool{}}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var lines int
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var r backendIndexRecord
+		if err = json.Unmarshal(sc.Bytes(), &r); err != nil {
+			break // torn by a crash, nothing after it was written
+		}
+		idx.apply(r)
+		lines++
+	}
+	if lines > 2*len(idx.ids)+1024 {
+		if err = idx.compact(); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	if idx.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// compact rewrites the journal as one add per entry.
+func (idx *backendIndex) compact() error {
+	var buf bytes.Buffer
+	for id, p := range idx.ids {
+		line, err := json.Marshal(backendIndexRecord{Op: backendIndexAdd, ID: id, Path: p, Dir: idx.dirs[p]})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+func (idx *backendIndex) apply(r backendIndexRecord) {
+	switch r.Op {
+	case backendIndexAdd:
+		if old, ok := idx.paths[r.Path]; ok {
+			delete(idx.ids, old) // replaced, e.g. a file by a folder
+		}
+		idx.ids[r.ID], idx.paths[r.Path], idx.dirs[r.Path] = r.Path, r.ID, r.Dir
+	case backendIndexMove:
+		moved := map[string]string{}
+		for p, id := range idx.paths {
+			if p == r.Path || strings.HasPrefix(p, r.Path+"/") {
+				moved[p] = id
+			}
+		}
+		for p, id := range moved {
+			np := r.To + strings.TrimPrefix(p, r.Path)
+			dir := idx.dirs[p]
+			delete(idx.paths, p)
+			delete(idx.dirs, p)
+			idx.ids[id], idx.paths[np], idx.dirs[np] = np, id, dir
+		}
+	case backendIndexRemove:
+		for p, id := range idx.paths {
+			if p == r.Path || strings.HasPrefix(p, r.Path+"/") {
+				delete(idx.paths, p)
+				delete(idx.dirs, p)
+				delete(idx.ids, id)
+			}
+		}
+	}
+}
+
+// record applies r and appends it to the journal.
+func (idx *backendIndex) record(r backendIndexRecord) error {
+	idx.apply(r)
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = idx.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("%v: %v", idx.path, err)
+	}
+	return nil
+}
+
+// id returns the id of the file or folder at p, giving it one when it has none yet. The root is ".".
+func (idx *backendIndex) id(p string, dir bool) (string, error) {
+	if p == "" {
+		return ".", nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if id, ok := idx.paths[p]; ok && idx.dirs[p] == dir {
+		return id, nil
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	return id, idx.record(backendIndexRecord{Op: backendIndexAdd, ID: id, Path: p, Dir: dir})
+}
+
+// pathOf returns the path of the file or folder id and whether it is a folder.
+func (idx *backendIndex) pathOf(id string) (string, bool, error) {
+	if id == "." || id == "" {
+		return "", true, nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	p, ok := idx.ids[id]
+	if !ok {
+		return "", false, fmt.Errorf("%v: no such file or folder", id)
+	}
+	return p, idx.dirs[p], nil
+}
+
+// move records the file or folder at from, with its children, as moved to to.
+func (idx *backendIndex) move(from, to string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.paths[to]; ok {
+		if err := idx.record(backendIndexRecord{Op: backendIndexRemove, Path: to}); err != nil {
+			return err
+		}
+	}
+	return idx.record(backendIndexRecord{Op: backendIndexMove, Path: from, To: to})
+}
+
+// remove forgets the file or folder at p, with its children.
+func (idx *backendIndex) remove(p string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.record(backendIndexRecord{Op: backendIndexRemove, Path: p})
+}
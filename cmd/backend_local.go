@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// localBackend mirrors the files into the local folder root, e.g. a mounted nas or usb drive.
+type localBackend struct {
+	root string
+}
+
+func (b *localBackend) loc(p string) string {
+	return longPath(filepath.Join(b.root, filepath.FromSlash(p)))
+}
+
+func (b *localBackend) Mkdir(p string) error {
+	return os.MkdirAll(b.loc(p), os.ModePerm)
+}
+
+// Put copies loc next to p first, so p is replaced at once, and gives it the modification time of loc.
+func (b *localBackend) Put(p, loc string) (*RemoteFile, error) {
+	src, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f, err := b.write(p, src)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chtimes(b.loc(p), info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	f.ModTime = info.ModTime()
+	return f, nil
+}
+
+// write writes the content of r to p through a temporary file and returns it with its md5.
+func (b *localBackend) write(p string, r io.Reader) (*RemoteFile, error) {
+	dst, err := os.CreateTemp(filepath.Dir(b.loc(p)), ".bgdrive-sync-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dst.Name())
+	h := md5.New()
+	size, err := io.Copy(io.MultiWriter(dst, h), r)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Rename(dst.Name(), b.loc(p)); err != nil {
+		return nil, err
+	}
+	return &RemoteFile{Name: path.Base(p), Size: size, MD5: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func (b *localBackend) Get(p, loc string) error {
+	src, err := os.Open(b.loc(p))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (b *localBackend) Copy(from, to string) (*RemoteFile, error) {
+	src, err := os.Open(b.loc(from))
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	f, err := b.write(to, src)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(b.loc(to))
+	if err != nil {
+		return nil, err
+	}
+	f.ModTime = info.ModTime()
+	return f, nil
+}
+
+func (b *localBackend) Rename(from, to string, _ bool) error {
+	if err := os.MkdirAll(filepath.Dir(b.loc(to)), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(b.loc(from), b.loc(to))
+}
+
+func (b *localBackend) Remove(p string, dir bool) error {
+	if dir {
+		return os.RemoveAll(b.loc(p))
+	}
+	return os.Remove(b.loc(p))
+}
+
+// List leaves out the temporary files of the uploads in progress.
+func (b *localBackend) List(p string) ([]*RemoteFile, error) {
+	entries, err := os.ReadDir(b.loc(p))
+	if err != nil {
+		return nil, err
+	}
+	var files []*RemoteFile
+	for _, e := range entries {
+		if ok, _ := path.Match(".bgdrive-sync-*.tmp", e.Name()); ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		f := &RemoteFile{Name: e.Name(), IsDir: e.IsDir(), ModTime: info.ModTime()}
+		if !f.IsDir {
+			f.Size = info.Size()
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// RcloneConfig is the remote of backend "rclone", any of the storages rclone supports.
+type RcloneConfig struct {
+	// Remote is a remote of the rclone config with the folder to sync into, e.g. "b2:bucket/laptop"
+	Remote string `yaml:"remote"`
+	// Binary is the rclone binary, found in the PATH when empty
+	Binary string `yaml:"binary"`
+	// Flags are passed to every rclone command, e.g. ["--config", "/etc/rclone.conf"]
+	Flags []string `yaml:"flags"`
+}
+
+// rcloneBackend runs the rclone binary for every operation.
+type rcloneBackend struct {
+	cfg RcloneConfig
+	env []string
+}
+
+func newRcloneBackend(cfg *Config) (*rcloneBackend, error) {
+	rcfg := cfg.Rclone
+	if rcfg.Binary == "" {
+		rcfg.Binary = "rclone"
+	}
+	if _, err := exec.LookPath(rcfg.Binary); err != nil {
+		return nil, fmt.Errorf("backend %q: %v", backendRclone, err)
+	}
+	return &rcloneBackend{cfg: rcfg, env: proxyEnv(cfg)}, nil
+}
+
+// target returns p on the remote as rclone addresses it.
+func (b *rcloneBackend) target(p string) string {
+	if p == "" || strings.HasSuffix(b.cfg.Remote, ":") {
+		return b.cfg.Remote + p
+	}
+	return strings.TrimSuffix(b.cfg.Remote, "/") + "/" + p
+}
+
+// run runs an rclone command, quiet for its output to be the json of lsjson alone.
+func (b *rcloneBackend) run(arg ...string) (string, error) {
+	out, err := runCommandIn("", b.env, b.cfg.Binary, append(append([]string{"--quiet"}, b.cfg.Flags...), arg...)...)
+	if err != nil {
+		return "", fmt.Errorf("rclone %v: %v", arg[0], err)
+	}
+	return out, nil
+}
+
+// rcloneEntry is an entry of rclone lsjson.
+type rcloneEntry struct {
+	Name    string    `json:"Name"`
+	Size    int64     `json:"Size"`
+	ModTime time.Time `json:"ModTime"`
+	IsDir   bool      `json:"IsDir"`
+}
+
+func (e *rcloneEntry) remoteFile() *RemoteFile {
+	f := &RemoteFile{Name: e.Name, IsDir: e.IsDir, ModTime: e.ModTime}
+	if !f.IsDir {
+		f.Size = e.Size
+	}
+	return f
+}
+
+func (b *rcloneBackend) stat(p string) (*RemoteFile, error) {
+	out, err := b.run("lsjson", "--stat", b.target(p))
+	if err != nil {
+		return nil, err
+	}
+	var e rcloneEntry
+	if err = json.Unmarshal([]byte(out), &e); err != nil {
+		return nil, fmt.Errorf("rclone lsjson: %v", err)
+	}
+	return e.remoteFile(), nil
+}
+
+func (b *rcloneBackend) Mkdir(p string) error {
+	_, err := b.run("mkdir", b.target(p))
+	return err
+}
+
+// Put keeps the modification time of loc, as rclone does.
+func (b *rcloneBackend) Put(p, loc string) (*RemoteFile, error) {
+	info, err := os.Stat(loc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = b.run("copyto", loc, b.target(p)); err != nil {
+		return nil, err
+	}
+	return &RemoteFile{Name: path.Base(p), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *rcloneBackend) Get(p, loc string) error {
+	_, err := b.run("copyto", b.target(p), loc)
+	return err
+}
+
+// Copy copies on the side of the remote when it can, through this machine otherwise.
+func (b *rcloneBackend) Copy(from, to string) (*RemoteFile, error) {
+	if _, err := b.run("copyto", b.target(from), b.target(to)); err != nil {
+		return nil, err
+	}
+	return b.stat(to)
+}
+
+func (b *rcloneBackend) Rename(from, to string, _ bool) error {
+	_, err := b.run("moveto", b.target(from), b.target(to))
+	return err
+}
+
+func (b *rcloneBackend) Remove(p string, dir bool) error {
+	if dir {
+		_, err := b.run("purge", b.target(p))
+		return err
+	}
+	_, err := b.run("deletefile", b.target(p))
+	return err
+}
+
+func (b *rcloneBackend) List(p string) ([]*RemoteFile, error) {
+	out, err := b.run("lsjson", b.target(p))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*rcloneEntry
+	if err = json.Unmarshal([]byte(out), &entries); err != nil {
+		return nil, fmt.Errorf("rclone lsjson: %v", err)
+	}
+	files := make([]*RemoteFile, len(entries))
+	for i, e := range entries {
+		files[i] = e.remoteFile()
+	}
+	return files, nil
+}
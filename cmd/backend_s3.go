@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload skips hashing the content of the requests, which S3 accepts in place of its sha256.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Config is the bucket of backend "s3", on aws or on any S3 compatible storage (minio, backblaze b2, cloudflare
+// r2, ...).
+type S3Config struct {
+	// Endpoint is the url of the storage, e.g. https://s3.eu-west-1.amazonaws.com, the bucket is addressed by path
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Prefix is the folder of the bucket the files go to, the whole bucket when empty
+	Prefix string `yaml:"prefix"`
+	// AccessKeyID and SecretAccessKey default to AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+}
+
+// s3Error is an error answered by S3.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %v", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %v: %v", e.Code, e.Message)
+}
+
+// s3Backend stores the files as the objects of a bucket. Folders are empty objects named after them with a trailing
+// slash, so empty folders are kept too. Files are uploaded in one request, up to the 5 GB S3 allows.
+type s3Backend struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3Backend(cfg S3Config) (*s3Backend, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3.endpoint: invalid url %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if cfg.SecretAccessKey == "" {
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("backend s3 requires s3.access_key_id and s3.secret_access_key, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &s3Backend{cfg: cfg, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// key returns the key of the object at p.
+func (b *s3Backend) key(p string) string {
+	return strings.TrimPrefix(path.Join(b.cfg.Prefix, p), "/")
+}
+
+// folderKey returns the prefix of the objects in the folder p.
+func (b *s3Backend) folderKey(p string) string {
+	if k := b.key(p); k != "" && k != "." {
+		return k + "/"
+	}
+	return ""
+}
+
+// s3Escape escapes s as the canonical requests of signature version 4 expect, slashes included unless path.
+func s3Escape(s string, path bool) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~',
+			path && c == '/':
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// do sends a request for the object key, the bucket when empty, signed with signature version 4.
+func (b *s3Backend) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	objectPath := strings.TrimSuffix(b.endpoint.Path, "/") + "/" + b.cfg.Bucket
+	if key != "" {
+		objectPath += "/" + key
+	}
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	u := *b.endpoint
+	u.Path, u.RawPath, u.RawQuery = objectPath, s3Escape(objectPath, true), strings.Join(params, "&")
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signed := []string{"host"}
+	canonicalHeaders := "host:" + u.Host + "\n"
+	var amzHeaders []string
+	for k := range req.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-") {
+			amzHeaders = append(amzHeaders, k)
+		}
+	}
+	sort.Slice(amzHeaders, func(i, j int) bool { return strings.ToLower(amzHeaders[i]) < strings.ToLower(amzHeaders[j]) })
+	for _, k := range amzHeaders {
+		signed = append(signed, strings.ToLower(k))
+		canonicalHeaders += strings.ToLower(k) + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n"
+	}
+	canonicalRequest := strings.Join([]string{method, u.RawPath, u.RawQuery, canonicalHeaders, strings.Join(signed, ";"),
+		s3UnsignedPayload}, "\n")
+	scope := now.Format("20060102") + "/" + b.cfg.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signingKey := []byte("AWS4" + b.cfg.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), b.cfg.Region, "s3", "aws4_request"} {
+		signingKey = s3HMAC(signingKey, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		b.cfg.AccessKeyID, scope, strings.Join(signed, ";"), hex.EncodeToString(s3HMAC(signingKey, stringToSign))))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		_ = xml.Unmarshal(data, s3Err)
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3MD5 returns the md5 of an object from its etag, which is only one for objects uploaded in a single request.
+func s3MD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") {
+		return ""
+	}
+	return etag
+}
+
+func (b *s3Backend) Mkdir(p string) error {
+	resp, err := b.do(http.MethodPut, b.folderKey(p), nil, nil, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *s3Backend) Put(p, loc string) (*RemoteFile, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(http.MethodPut, b.key(p), nil, http.Header{"Content-Type": {"application/octet-stream"}}, f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return &RemoteFile{Name: path.Base(p), Size: info.Size(), ModTime: info.ModTime(), MD5: s3MD5(resp.Header.Get("ETag"))}, nil
+}
+
+func (b *s3Backend) Get(p, loc string) error {
+	resp, err := b.do(http.MethodGet, b.key(p), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dst, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, resp.Body); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// s3CopyResult is the answer to a copy.
+type s3CopyResult struct {
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+func (b *s3Backend) copyKey(from, to string) (*s3CopyResult, error) {
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+b.cfg.Bucket+"/"+from, true)}}
+	resp, err := b.do(http.MethodPut, to, nil, header, http.NoBody, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &s3CopyResult{}
+	if err = xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("s3: copy %v: %v", from, err)
+	}
+	return result, nil
+}
+
+func (b *s3Backend) Copy(from, to string) (*RemoteFile, error) {
+	result, err := b.copyKey(b.key(from), b.key(to))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(http.MethodHead, b.key(to), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return &RemoteFile{Name: path.Base(to), Size: resp.ContentLength, ModTime: result.LastModified, MD5: s3MD5(result.ETag)}, nil
+}
+
+// Rename copies every object of the file or folder and deletes the originals, S3 can't rename them.
+func (b *s3Backend) Rename(from, to string, dir bool) error {
+	if !dir {
+		if _, err := b.copyKey(b.key(from), b.key(to)); err != nil {
+			return err
+		}
+		return b.deleteKey(b.key(from))
+	}
+	keys, err := b.keysUnder(b.folderKey(from))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err = b.copyKey(k, b.folderKey(to)+strings.TrimPrefix(k, b.folderKey(from))); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if err = b.deleteKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *s3Backend) deleteKey(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *s3Backend) Remove(p string, dir bool) error {
+	if !dir {
+		return b.deleteKey(b.key(p))
+	}
+	keys, err := b.keysUnder(b.folderKey(p))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = b.deleteKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3ListResult is a page of the objects of a bucket.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list calls do for every page of the objects whose key starts with prefix, only the direct children with delimiter.
+func (b *s3Backend) list(prefix string, delimiter bool, do func(*s3ListResult)) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter {
+		query.Set("delimiter", "/")
+	}
+	for {
+		resp, err := b.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		result := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: list %v: %v", prefix, err)
+		}
+		do(result)
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (b *s3Backend) keysUnder(prefix string) ([]string, error) {
+	var keys []string
+	err := b.list(prefix, false, func(result *s3ListResult) {
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+	})
+	return keys, err
+}
+
+func (b *s3Backend) List(p string) ([]*RemoteFile, error) {
+	prefix := b.folderKey(p)
+	var files []*RemoteFile
+	err := b.list(prefix, true, func(result *s3ListResult) {
+		for _, c := range result.Contents {
+			if c.Key == prefix {
+				continue // the folder itself
+			}
+			files = append(files, &RemoteFile{Name: strings.TrimPrefix(c.Key, prefix), Size: c.Size, ModTime: c.LastModified,
+				MD5: s3MD5(c.ETag)})
+		}
+		for _, cp := range result.CommonPrefixes {
+			files = append(files, &RemoteFile{Name: strings.TrimSuffix(strings.TrimPrefix(cp.Prefix, prefix), "/"), IsDir: true})
+		}
+	})
+	return files, err
+}
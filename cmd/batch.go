@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// smallFileBatchSize is the most files uploaded along with their new folder in one batch.
+const smallFileBatchSize = 100
+
+// errNoBatch is returned by uploadFolderBatch when the folder can't be uploaded as a batch this time.
+var errNoBatch = errors.New("folder not batchable")
+
+// loadSmallFiles parses small_file_threshold.
+func loadSmallFiles(cfg *Config) error {
+	threshold, err := parseByteSize(cfg.SmallFileThreshold)
+	if err != nil {
+		return fmt.Errorf("small_file_threshold: %v", err)
+	}
+	cfg.smallFileThreshold = threshold
+	return nil
+}
+
+// batchesSmallFiles reports whether the small files of new folders are uploaded along with their folder. Only the
+// gdrive client gains from it, and only when the files are uploaded as they are.
+func (cfg *Config) batchesSmallFiles() bool {
+	return cfg.smallFileThreshold > 0 && (cfg.TestMode || cfg.DriveClient == "" || cfg.DriveClient == driveClientGDrive) &&
+		cfg.encryption == nil && len(cfg.compressExts) == 0 && cfg.deltaMinSize == 0 && !cfg.Dedup && !cfg.RemoteSnapshots
+}
+
+// folderBatch is a new folder held back by the walk with the small new files it holds, uploaded together.
+type folderBatch struct {
+	dir   WalkResp
+	files []WalkResp
+}
+
+// accepts reports whether the untracked entry wr can join the batch.
+func (b *folderBatch) accepts(cfg *Config, wr WalkResp) bool {
+	if wr.isDir || filepath.Dir(wr.loc) != b.dir.loc || wr.size > cfg.smallFileThreshold || len(b.files) >= smallFileBatchSize {
+		return false
+	}
+	_, converted := googleConvertType(cfg, wr.loc)
+	return !converted
+}
+
+// uploadFolderBatch creates the new folder dir along with its small new files in one batch. Files which failed their
+// checksum verification are returned to be uploaded one by one. On error, nothing was created and every entry is left
+// to be synced one by one, errNoBatch telling the batch wasn't tried.
+func (om *ObjectManager) uploadFolderBatch(dir WalkResp, files []WalkResp) ([]WalkResp, error) {
+	pObj, ok := om.loadObject(filepath.Dir(dir.loc))
+	if !ok || om.isLocked(pObj) {
+		return nil, errNoBatch
+	}
+	dirObj := &Object{GDPId: pObj.GDId, Size: dir.size, Inode: dir.inode}
+	if !om.storeObject(dir.loc, dirObj) {
+		return nil, errNoBatch
+	}
+	stored := []string{dir.loc}
+	release := func() {
+		for _, loc := range stored {
+			om.deleteObject(loc)
+		}
+	}
+	objects := make([]*Object, len(files))
+	locs := make([]string, len(files))
+	var total int64
+	for i, f := range files {
+		objects[i] = &Object{LastMod: f.modTimeUnix, Size: f.size, Inode: f.inode}
+		if !om.storeObject(f.loc, objects[i]) {
+			release()
+			return nil, errNoBatch
+		}
+		stored = append(stored, f.loc)
+		locs[i] = om.sourceLoc(f.loc)
+		total += f.size
+	}
+
+	releaseQuota, err := om.reserveUpload(total)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	id, rfs, err := om.drive.UploadFolder(pObj.GDId, filepath.Base(dir.loc), locs)
+	if err != nil {
+		releaseQuota()
+		release()
+		return nil, err
+	}
+
+	om.updateStoredObject(dirObj, func(o *Object) { o.GDId = id })
+	om.recordOp("mkdir", dir.loc, id, dir.size)
+	printOp("mkdir", strings.TrimPrefix(dir.loc, om.cfg.SyncTargetPath), fmt.Sprintf("%v files uploaded with it in one batch", len(files)))
+	if len(om.cfg.Sharing) != 0 {
+		if err = om.shareFolder(dir.loc, id); err != nil {
+			fmt.Printf("failed to share %v: %v\n", strings.TrimPrefix(dir.loc, om.cfg.SyncTargetPath), err)
+		}
+	}
+
+	var retry []WalkResp
+	for i, f := range files {
+		rf, sum, err := om.verifyTransfer(f.loc, rfs[i])
+		if err != nil {
+			fmt.Printf("%v, uploading it again\n", err)
+			_ = om.drive.Delete(rfs[i].ID)
+			om.deleteObject(f.loc)
+			retry = append(retry, f)
+			continue
+		}
+		om.updateStoredObject(objects[i], func(o *Object) {
+			o.GDId, o.GDPId = rf.ID, id
+			o.RemoteMod = remoteModUnix(rf)
+			o.MD5 = sum
+		})
+		om.recordOp("created", f.loc, rf.ID, f.size)
+		printOp("created", strings.TrimPrefix(f.loc, om.cfg.SyncTargetPath), getFileSizeFormatted(f.size))
+	}
+	return retry, nil
+}
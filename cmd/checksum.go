@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumAttempts is how many times a transfer is made before a persistent md5 mismatch is reported.
+const checksumAttempts = 3
+
+const skipReasonChecksumMismatch = "checksum mismatch"
+
+func md5File(loc string) (string, error) {
+	f, err := os.Open(longPath(loc))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyTransfer compares the md5 drive reports for the just uploaded or updated rf with the local file at loc and
+// transfers the file again while they differ. It returns the final remote file and the local md5, which is empty
+// when the client doesn't report checksums and nothing could be verified.
+func (om *ObjectManager) verifyTransfer(loc string, rf *RemoteFile) (*RemoteFile, string, error) {
+	for attempt := 1; ; attempt++ {
+		if rf.MD5 == "" {
+			return rf, "", nil
+		}
+		sum, err := om.hashes.md5(om.sourceLoc(loc))
+		if err != nil {
+			return nil, "", err
+		}
+		if strings.EqualFold(rf.MD5, sum) {
+			return rf, sum, nil
+		}
+		if attempt == checksumAttempts {
+			return nil, "", fmt.Errorf("%v: remote md5 %v doesn't match local md5 %v after %v attempts", loc, rf.MD5, sum, attempt)
+		}
+
+		printOp("mismatch", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), fmt.Sprintf("remote md5 %v, local %v, transferring again", rf.MD5, sum))
+		if rf, err = om.drive.Update(rf.ID, om.sourceLoc(loc)); err != nil {
+			return nil, "", err
+		}
+	}
+}
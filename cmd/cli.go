@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// configFlags are accepted by every command and override the matching config.yaml values when given.
+type configFlags struct {
+	fs *pflag.FlagSet
+
+	config       string
+	noColor      bool
+	dryRun       bool
+	filterFrom   string
+	account      string
+	rootFolderID string
+	driveID      string
+	driveClient  string
+	targetPath   string
+	direction    string
+	workers      int
+	retry        int
+	delayMinute  int
+}
+
+func (f *configFlags) register(fs *pflag.FlagSet) {
+	f.fs = fs
+	fs.StringVar(&f.config, "config", "", "config file to read (default: the first of ./config.yaml, ~/.config/bgdrive-sync/config.yaml and /etc/bgdrive-sync/config.yaml)")
+	fs.BoolVar(&f.noColor, "no-color", false, "disable colored output")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "print the planned creates, updates and deletes without touching drive (overrides dry_run)")
+	fs.StringVar(&f.filterFrom, "filter-from", "", "read include/exclude rules from an rclone style filter file (overrides filter_from)")
+	fs.StringVar(&f.account, "account", "", "gdrive account to sync with (overrides gd_account_name)")
+	fs.StringVar(&f.rootFolderID, "root-folder-id", "", "drive folder the target is synced into (overrides gd_root_folder_id)")
+	fs.StringVar(&f.driveID, "drive-id", "", "shared drive to sync into (overrides gd_drive_id)")
+	fs.StringVar(&f.driveClient, "drive-client", "", `"gdrive" or "api" (overrides drive_client)`)
+	fs.StringVar(&f.targetPath, "target-path", "", "local folder to sync (overrides sync_target_path)")
+	fs.StringVar(&f.direction, "direction", "", `"push", "pull", "both" or "mirror" (overrides sync_direction)`)
+	fs.IntVar(&f.workers, "workers", 0, "concurrent drive operations (overrides sync_worker)")
+	fs.IntVar(&f.retry, "retry", 0, "retries of a failed drive operation (overrides sync_retry)")
+	fs.IntVar(&f.delayMinute, "delay-minute", 0, "minutes between two syncs (overrides sync_delay_minute and schedule)")
+}
+
+// reload reads the config again with the same flags.
+func (f *configFlags) reload() ([]*Config, error) {
+	return readConfig(f)
+}
+
+func (f *configFlags) changed(name string) bool {
+	return f.fs != nil && f.fs.Changed(name)
+}
+
+// apply overrides the values of cfg given on the command line.
+func (f *configFlags) apply(cfg *Config) {
+	if f.dryRun {
+		cfg.DryRun = true
+	}
+	if f.filterFrom != "" {
+		cfg.FilterFrom = f.filterFrom
+	}
+	if f.changed("account") {
+		cfg.GDAccountName = f.account
+	}
+	if f.changed("root-folder-id") {
+		cfg.GDRootFolderID = f.rootFolderID
+	}
+	if f.changed("drive-id") {
+		cfg.GDDriveID = f.driveID
+	}
+	if f.changed("drive-client") {
+		cfg.DriveClient = f.driveClient
+	}
+	if f.changed("target-path") {
+		cfg.SyncTargetPath = stripLongPathPrefix(f.targetPath)
+	}
+	if f.changed("direction") {
+		cfg.SyncDirection = f.direction
+	}
+	if f.changed("workers") {
+		cfg.SyncWorker = f.workers
+	}
+	if f.changed("retry") {
+		cfg.SyncRetry = f.retry
+	}
+	if f.changed("delay-minute") {
+		cfg.SyncDelayMinute = f.delayMinute
+		cfg.Schedule = ""
+	}
+}
+
+// syncFlags are accepted by the commands that sync.
+type syncFlags struct {
+	bootstrapState     bool
+	bootstrapStateHost string
+	tui                bool
+}
+
+func (f *syncFlags) register(fs *pflag.FlagSet) {
+	fs.BoolVar(&f.bootstrapState, "bootstrap-state", false, "replace the local object map with the encrypted state backup published to drive")
+	fs.StringVar(&f.bootstrapStateHost, "bootstrap-state-host", "", "host whose state backup is pulled by --bootstrap-state (default: this host)")
+	fs.BoolVar(&f.tui, "tui", false, "show a live dashboard of the targets instead of the log while syncing forever")
+}
+
+func newRootCmd() *cobra.Command {
+	cf := &configFlags{}
+	sf := &syncFlags{}
+
+	root := &cobra.Command{
+		Use:   "bgdrive-sync",
+		Short: "Replicate local folders to Google Drive",
+		Long: "Replicate local folders to Google Drive. Settings are read from --config, or the first config.yaml found in\n" +
+			"the current directory, ~/.config/bgdrive-sync and /etc/bgdrive-sync, and BGDRIVE_* environment variables,\n" +
+			"flags override them. Without a command, syncs forever like daemon.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+			cf.fs = cmd.Flags()
+			initOutput(cf.noColor)
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			return runDaemon(targets, sf, cf.reload)
+		},
+	}
+	cf.register(root.PersistentFlags())
+	sf.register(root.Flags())
+
+	root.AddCommand(newDaemonCmd(cf), newSyncCmd(cf), newStatusCmd(cf), newVerifyCmd(cf), newReconcileCmd(cf), newStateCmd(cf), newInitCmd(cf),
+		newPauseCmd(cf), newResumeCmd(cf), newRestoreCmd(cf), newAuthCmd(cf))
+	return root
+}
+
+func newDaemonCmd(cf *configFlags) *cobra.Command {
+	sf := &syncFlags{}
+	var watch bool
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Sync every target forever, on its schedule or as files change with --watch",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("watch") {
+				for _, tcfg := range targets {
+					tcfg.WatchMode = watch
+				}
+			}
+			return runDaemon(targets, sf, cf.reload)
+		},
+	}
+	sf.register(cmd.Flags())
+	cmd.Flags().BoolVar(&watch, "watch", false, "sync the touched paths as files change (overrides watch_mode)")
+	return cmd
+}
+
+func newSyncCmd(cf *configFlags) *cobra.Command {
+	sf := &syncFlags{}
+	var once bool
+	cmd := &cobra.Command{
+		Use:   "sync [path]",
+		Short: "Sync once with --once, or only path (relative to the target, or absolute) and exit",
+		Long: "Sync once with --once, or only path and exit. path is relative to the sync target path, or absolute\n" +
+			"(or relative to the current directory) when there are several targets. Without either, syncs forever.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				return runOnce(targets, sf, args[0])
+			}
+			if once {
+				return runOnce(targets, sf, "")
+			}
+			return runDaemon(targets, sf, cf.reload)
+		},
+	}
+	sf.register(cmd.Flags())
+	cmd.Flags().BoolVar(&once, "once", false, "run a single cycle of every target and exit")
+	return cmd
+}
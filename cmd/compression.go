@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// compressedSuffix is appended to the remote name of compressed files
+	compressedSuffix = ".gz"
+	// compressedComment marks the gzip streams written by bgdrive-sync, only those are decompressed when pulling
+	compressedComment = "bgdrive-sync"
+)
+
+// loadCompress prepares the compress extensions of cfg.
+func loadCompress(cfg *Config) error {
+	for _, ext := range cfg.Compress {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 || strings.ContainsAny(ext, `/\`) {
+			return fmt.Errorf("compress: %q is not a file extension such as \".log\"", ext)
+		}
+		if cfg.compressExts == nil {
+			cfg.compressExts = map[string]bool{}
+		}
+		cfg.compressExts[ext] = true
+	}
+	return nil
+}
+
+// compressedSize is the size on drive of the file at loc as just transferred to rf, 0 when it isn't compressed.
+func compressedSize(cfg *Config, loc string, rf *RemoteFile) int64 {
+	if !cfg.compressExts[strings.ToLower(filepath.Ext(loc))] {
+		return 0
+	}
+	return rf.Size
+}
+
+// compressingDriveClient gzips the files matching compress before uploading them, under their name with .gz
+// appended, and decompresses them when downloading, so the rest of the sync only deals with the original files.
+type compressingDriveClient struct {
+	DriveClient
+	exts map[string]bool
+}
+
+func (c *compressingDriveClient) compressible(name string) bool {
+	return c.exts[strings.ToLower(filepath.Ext(name))]
+}
+
+func (c *compressingDriveClient) remoteName(name string) string {
+	if c.compressible(name) {
+		return name + compressedSuffix
+	}
+	return name
+}
+
+// plain translates f as listed on drive to the original file. Its size and md5 are the ones of the compressed
+// content, they are left unknown.
+func (c *compressingDriveClient) plain(f *RemoteFile) *RemoteFile {
+	if f == nil || f.IsDir || !strings.HasSuffix(f.Name, compressedSuffix) ||
+		!c.compressible(strings.TrimSuffix(f.Name, compressedSuffix)) {
+		return f
+	}
+	p := *f
+	p.Name, p.Size, p.MD5 = strings.TrimSuffix(f.Name, compressedSuffix), 0, ""
+	return &p
+}
+
+// compressed gzips the file at loc into a temporary folder under its remote name. It returns the compressed file,
+// the md5 of the original and of the compressed content.
+func (c *compressingDriveClient) compressed(loc string) (string, string, string, func(), error) {
+	src, err := os.Open(loc)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	defer src.Close()
+	dir, err := os.MkdirTemp("", "bgdrive-sync-compress-")
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	dstLoc := filepath.Join(dir, c.remoteName(filepath.Base(loc)))
+	dst, err := os.Create(dstLoc)
+	if err != nil {
+		cleanup()
+		return "", "", "", nil, err
+	}
+	plainSum, compressedSum := md5.New(), md5.New()
+	zw := gzip.NewWriter(io.MultiWriter(dst, compressedSum))
+	zw.Comment = compressedComment
+	_, err = io.Copy(zw, io.TeeReader(src, plainSum))
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", "", "", nil, err
+	}
+	return dstLoc, sumHex(plainSum), sumHex(compressedSum), cleanup, nil
+}
+
+// upload runs transfer with the compressed file at loc when it is compressible. The returned file carries the size
+// of the compressed content, and its md5 is reported as the original one when it matches the compressed content.
+func (c *compressingDriveClient) upload(loc string, transfer func(loc string) (*RemoteFile, error)) (*RemoteFile, error) {
+	if !c.compressible(loc) {
+		return transfer(loc)
+	}
+	compressedLoc, plainSum, compressedSum, cleanup, err := c.compressed(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	info, err := os.Stat(compressedLoc)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := transfer(compressedLoc)
+	if err != nil {
+		return nil, err
+	}
+	p := *rf
+	p.Name, p.Size = filepath.Base(loc), info.Size()
+	if strings.EqualFold(rf.MD5, compressedSum) {
+		p.MD5 = plainSum
+	}
+	return &p, nil
+}
+
+func (c *compressingDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	return c.upload(loc, func(loc string) (*RemoteFile, error) { return c.DriveClient.Upload(parentID, loc) })
+}
+
+func (c *compressingDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	return c.upload(loc, func(loc string) (*RemoteFile, error) { return c.DriveClient.Update(id, loc) })
+}
+
+func (c *compressingDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	rf, err := c.DriveClient.Copy(id, parentID, c.remoteName(name))
+	return c.plain(rf), err
+}
+
+func (c *compressingDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	return c.DriveClient.Move(id, oldParentID, newParentID, c.remoteName(name))
+}
+
+// Changes reads the changed files back as they are locally.
+func (c *compressingDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	changes, next, err := c.DriveClient.Changes(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, ch := range changes {
+		ch.File = c.plain(ch.File)
+	}
+	return changes, next, nil
+}
+
+func (c *compressingDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	if nameContains != "" {
+		nameContains = c.remoteName(nameContains)
+	}
+	files, err := c.DriveClient.List(parentID, nameContains)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		files[i] = c.plain(f)
+	}
+	return files, nil
+}
+
+// Download decompresses the content of id into loc when it was compressed by bgdrive-sync, whatever its name.
+func (c *compressingDriveClient) Download(id, loc string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(loc), ".bgdrive-sync-decompress-*")
+	if err != nil {
+		return err
+	}
+	tmpLoc := tmp.Name()
+	_ = tmp.Close()
+	defer os.Remove(tmpLoc)
+	if err = c.DriveClient.Download(id, tmpLoc); err != nil {
+		return err
+	}
+
+	src, err := os.Open(tmpLoc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(src))
+	if err != nil || zr.Comment != compressedComment {
+		_ = src.Close()
+		return os.Rename(tmpLoc, loc)
+	}
+	dst, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, zr); err != nil {
+		_ = dst.Close()
+		return fmt.Errorf("%v: %v", loc, err)
+	}
+	return dst.Close()
+}
+
+// UploadFolder goes file by file, so every file is compressed like a single upload.
+func (c *compressingDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	return uploadFolderOneByOne(c, parentID, name, locs)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const defaultConfigPath = "config.yaml"
+
+// configPath is the config file every command reads, set once by loadConfig.
+var configPath = defaultConfigPath
+
+// configSearchPaths returns where the config file is looked for without --config, in order: the current directory,
+// the user config directory (~/.config/bgdrive-sync on linux) and /etc/bgdrive-sync.
+func configSearchPaths() []string {
+	paths := []string{defaultConfigPath}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "bgdrive-sync", defaultConfigPath))
+	}
+	return append(paths, filepath.Join("/etc", "bgdrive-sync", defaultConfigPath))
+}
+
+// resolveConfigPath returns the config file given with --config, which must exist, or else the first one found in
+// configSearchPaths. found is false when there is none, the config then comes from the environment alone.
+func resolveConfigPath(flag string) (path string, found bool, err error) {
+	if flag != "" {
+		if _, err = os.Stat(flag); err != nil {
+			return "", false, fmt.Errorf("--config: %w", err)
+		}
+		return flag, true, nil
+	}
+	for _, p := range configSearchPaths() {
+		_, err = os.Stat(p)
+		if err == nil {
+			return p, true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", false, err
+		}
+	}
+	return defaultConfigPath, false, nil
+}
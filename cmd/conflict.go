@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// conflict_policy values: how a file changed both locally and on drive, or present on both sides without being
+// tracked, is resolved while pulling.
+const (
+	conflictPolicySkip     = "skip"
+	conflictPolicyNewest   = "newest"
+	conflictPolicyLocal    = "local"
+	conflictPolicyRemote   = "remote"
+	conflictPolicyKeepBoth = "keep_both"
+)
+
+func validConflictPolicy(policy string) error {
+	switch policy {
+	case "", conflictPolicySkip, conflictPolicyNewest, conflictPolicyLocal, conflictPolicyRemote, conflictPolicyKeepBoth:
+		return nil
+	default:
+		return fmt.Errorf("conflict_policy: unknown policy %q, expected %q, %q, %q, %q or %q", policy, conflictPolicySkip,
+			conflictPolicyNewest, conflictPolicyLocal, conflictPolicyRemote, conflictPolicyKeepBoth)
+	}
+}
+
+// conflictDecisionPolicies are the policies the answers to the conflict prompt stand for.
+var conflictDecisionPolicies = map[string]string{
+	decisionKeepLocal:  conflictPolicyLocal,
+	decisionKeepRemote: conflictPolicyRemote,
+	decisionKeepBoth:   conflictPolicyKeepBoth,
+	decisionSkip:       conflictPolicySkip,
+}
+
+// resolveConflict applies conflict_policy to loc, which exists locally as localInfo and remotely as f. object is
+// its tracked state, nil when loc is not tracked. With the skip policy, the user is asked instead in an interactive
+// one-shot run, otherwise the conflict is reported as a SkippedPath.
+func (om *ObjectManager) resolveConflict(loc, parentID string, f *RemoteFile, localInfo os.FileInfo, object *Object, detail string) (*SkippedPath, error) {
+	rel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+	policy := om.cfg.ConflictPolicy
+	switch {
+	case om.cfg.SyncDirection == syncDirectionMirror:
+		policy = conflictPolicyRemote // drive is the source of truth of a mirror
+	case (policy == "" || policy == conflictPolicySkip) && om.cfg.interactive && !om.cfg.DryRun:
+		choice, err := om.decisions.askConflict(rel, detail)
+		if err != nil {
+			return nil, err
+		}
+		policy = conflictDecisionPolicies[choice]
+	}
+	if policy == conflictPolicyNewest {
+		policy = conflictPolicyRemote
+		if localInfo.ModTime().After(f.ModTime) {
+			policy = conflictPolicyLocal
+		}
+	}
+
+	switch policy {
+	case conflictPolicyLocal:
+		if om.cfg.DryRun {
+			printOp("conflict", rel, detail+", keeping local")
+			return nil, nil
+		}
+		return nil, om.resolveWithLocal(loc, parentID, f, localInfo, object, detail)
+	case conflictPolicyRemote:
+		if om.cfg.DryRun {
+			printOp("conflict", rel, detail+", keeping remote")
+			return nil, nil
+		}
+		return nil, om.resolveWithRemote(loc, parentID, f, object, detail+", kept remote")
+	case conflictPolicyKeepBoth:
+		return om.keepBoth(loc, parentID, f, localInfo, object, detail)
+	default:
+		return &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: detail}, nil
+	}
+}
+
+// resolveWithRemote downloads f over the local file at loc.
+func (om *ObjectManager) resolveWithRemote(loc, parentID string, f *RemoteFile, object *Object, detail string) error {
+	if object == nil {
+		object = &Object{GDPId: parentID}
+		if !om.storeObject(loc, object) {
+			return nil
+		}
+	}
+	info, err := om.download(loc, f)
+	if err != nil {
+		return err
+	}
+	om.updateStoredObject(object, func(o *Object) {
+		o.GDId = f.ID
+		o.LastMod = info.ModTime().Unix()
+		o.Size = info.Size()
+		o.RemoteMod = remoteModUnix(f)
+		o.MD5 = f.MD5
+		o.Inode = fileInode(info)
+	})
+	om.recordOp("downloaded", loc, f.ID, info.Size())
+	printOp("conflict", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), detail)
+	return nil
+}
+
+// resolveWithLocal uploads the local file at loc over f.
+func (om *ObjectManager) resolveWithLocal(loc, parentID string, f *RemoteFile, localInfo os.FileInfo, object *Object, detail string) error {
+	if object == nil {
+		object = &Object{GDPId: parentID}
+		if !om.storeObject(loc, object) {
+			return nil
+		}
+	}
+	releaseQuota, err := om.reserveUpload(localInfo.Size())
+	if err != nil {
+		return err
+	}
+	var sum string
+	rf, err := om.drive.Update(f.ID, loc)
+	if err == nil {
+		rf, sum, err = om.verifyTransfer(loc, rf)
+	}
+	if err != nil {
+		releaseQuota()
+		return err
+	}
+	om.updateStoredObject(object, func(o *Object) {
+		o.GDId = f.ID
+		o.LastMod = localInfo.ModTime().Unix()
+		o.Size = localInfo.Size()
+		o.RemoteMod = remoteModUnix(rf)
+		o.MD5 = sum
+		o.Inode = fileInode(localInfo)
+	})
+	om.recordOp("updated", loc, f.ID, localInfo.Size())
+	printOp("conflict", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), detail+", kept local")
+	return nil
+}
+
+// keepBoth resolves the conflict on loc by renaming the side modified first to a conflicted copy, keeping the other
+// at loc. Only when pushing too can the remote side win, pulling only renames the local file.
+func (om *ObjectManager) keepBoth(loc, parentID string, f *RemoteFile, localInfo os.FileInfo, object *Object, detail string) (*SkippedPath, error) {
+	rel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+	localWins := om.cfg.SyncDirection == syncDirectionBoth && localInfo.ModTime().After(f.ModTime)
+	host := hostname()
+	if localWins {
+		host = "drive"
+	}
+	copyLoc, err := conflictCopyPath(loc, host, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	copyRel := strings.TrimPrefix(copyLoc, om.cfg.SyncTargetPath)
+
+	if !localWins {
+		if om.cfg.DryRun {
+			printOp("conflict", rel, fmt.Sprintf("%v, keeping both, local copy as %v", detail, copyRel))
+			return nil, nil
+		}
+		if err = os.Rename(longPath(loc), longPath(copyLoc)); err != nil {
+			return nil, err
+		}
+		// the renamed local copy is uploaded as a new file by the push of the same cycle
+		return nil, om.resolveWithRemote(loc, parentID, f, object, fmt.Sprintf("%v, local copy kept as %v", detail, copyRel))
+	}
+
+	if om.cfg.DryRun {
+		printOp("conflict", rel, fmt.Sprintf("%v, keeping both, remote copy as %v", detail, copyRel))
+		return nil, nil
+	}
+	if err = om.drive.Move(f.ID, parentID, parentID, filepath.Base(copyLoc)); err != nil {
+		return nil, err
+	}
+	if object != nil {
+		// the local file is uploaded as a new file by the push of the same cycle
+		om.deleteObject(loc)
+	}
+	return nil, om.resolveWithRemote(copyLoc, parentID, f, nil, fmt.Sprintf("%v, remote copy of %v", detail, rel))
+}
+
+// conflictCopyPath returns a free path for the losing side of a conflict on loc, last modified on host, e.g. "report
+// (conflicted copy from laptop 2024-01-31).pdf", numbered when that one is taken too.
+func conflictCopyPath(loc, host string, now time.Time) (string, error) {
+	ext := filepath.Ext(loc)
+	base := strings.TrimSuffix(loc, ext) + fmt.Sprintf(" (conflicted copy from %v %v", host, now.Format(time.DateOnly))
+	for i := 1; ; i++ {
+		candidate := base + ")" + ext
+		if i > 1 {
+			candidate = fmt.Sprintf("%v %v)%v", base, i, ext)
+		}
+		_, err := os.Lstat(longPath(candidate))
+		if errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlStatus is the body of GET /status.
+type controlStatus struct {
+	UptimeSeconds int64           `json:"uptime_seconds"`
+	Targets       []controlTarget `json:"targets"`
+}
+
+type controlTarget struct {
+	Name     string          `json:"name,omitempty"`
+	Phase    string          `json:"phase"`
+	Paused   bool            `json:"paused"`
+	Pending  int64           `json:"pending"`
+	InFlight []inFlightOp    `json:"in_flight,omitempty"`
+	Cycles   int             `json:"cycles"`
+	Failures int             `json:"failures"`
+	NextSync *time.Time      `json:"next_sync,omitempty"`
+	LastSync *controlLastRun `json:"last_sync,omitempty"`
+}
+
+type controlLastRun struct {
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	Err              string    `json:"err,omitempty"`
+	Created          int       `json:"created"`
+	Updated          int       `json:"updated"`
+	Deleted          int       `json:"deleted"`
+	Skipped          int       `json:"skipped"`
+	BytesTransferred int64     `json:"bytes_transferred"`
+}
+
+// loadControlAPI reads control_api_token_file, and refuses a control_api_addr reachable from other hosts without it:
+// anyone reaching the control api could pause the sync.
+func loadControlAPI(cfg *Config) error {
+	if cfg.ControlAPITokenFile != "" {
+		data, err := os.ReadFile(cfg.ControlAPITokenFile)
+		if err != nil {
+			return fmt.Errorf("control_api_token_file: %w", err)
+		}
+		if cfg.controlAPIToken = strings.TrimSpace(string(data)); cfg.controlAPIToken == "" {
+			return fmt.Errorf("control_api_token_file: %v is empty", cfg.ControlAPITokenFile)
+		}
+	}
+	if cfg.ControlAPIAddr == "" || cfg.controlAPIToken != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(cfg.ControlAPIAddr)
+	if err != nil {
+		return fmt.Errorf("control_api_addr: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("control_api_addr: %v is reachable from other hosts, set control_api_token_file or listen on "+
+			"127.0.0.1", cfg.ControlAPIAddr)
+	}
+	return nil
+}
+
+// requireControlToken serves h only to the requests carrying token as their bearer token, or to every request with
+// an empty token.
+func requireControlToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startControlAPI serves the control API on addr until the returned func is called:
+//   - GET /status: phase, pending operations, last cycle result and next sync of every target, and the uptime
+//   - POST /sync: sync right away
+//   - POST /pause and POST /resume: stop and restart syncing, a running cycle finishes its in-flight operations and
+//     saves the state, then waits for the resume
+//   - GET /healthz: like health_addr
+//
+// The POST endpoints act on every target, or only on the one named by ?target=. With token, every request must
+// carry it as its bearer token.
+func startControlAPI(addr, token string, failedCycles int) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("control_api_addr: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleControlStatus)
+	mux.HandleFunc("/healthz", handleHealthz(failedCycles))
+	mux.HandleFunc("/sync", controlAction(func(s *targetState) { s.requestSync() }))
+	mux.HandleFunc("/pause", controlAction(func(s *targetState) { s.setPaused(true) }))
+	mux.HandleFunc("/resume", controlAction(func(s *targetState) { s.setPaused(false) }))
+	srv := &http.Server{Handler: requireControlToken(token, mux), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("control api: %v\n", err)
+		}
+	}()
+	fmt.Printf("control api listening on %v\n", l.Addr())
+	return func() { _ = srv.Close() }, nil
+}
+
+func handleControlStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	status := controlStatus{UptimeSeconds: int64(time.Since(processStart).Seconds()), Targets: []controlTarget{}}
+	for _, s := range allLiveStates() {
+		snap := s.snapshot()
+		t := controlTarget{Name: snap.Name, Phase: snap.Phase, Paused: snap.Paused, Pending: snap.Queued + int64(len(snap.InFlight)),
+			InFlight: snap.InFlight, Cycles: snap.Cycles, Failures: snap.Failures}
+		if !snap.Next.IsZero() {
+			t.NextSync = &snap.Next
+		}
+		if report := snap.Last; report != nil {
+			created, updated, deleted := report.Counts()
+			t.LastSync = &controlLastRun{Start: report.Start, End: report.End, Err: report.Err, Created: created, Updated: updated,
+				Deleted: deleted, Skipped: len(report.Skipped), BytesTransferred: report.BytesTransferred()}
+		}
+		status.Targets = append(status.Targets, t)
+	}
+	writeControlJSON(w, http.StatusOK, status)
+}
+
+// controlAction handles a POST applying action to the selected targets.
+func controlAction(action func(s *targetState)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		name, selected := r.URL.Query().Get("target"), r.URL.Query().Has("target")
+		var names []string
+		for _, s := range allLiveStates() {
+			if selected && s.name != name {
+				continue
+			}
+			action(s)
+			names = append(names, s.name)
+		}
+		if len(names) == 0 {
+			http.Error(w, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+			return
+		}
+		writeControlJSON(w, http.StatusAccepted, map[string][]string{"targets": names})
+	}
+}
+
+func writeControlJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadControlAPI(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "control.token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr, tokenFile string
+		ok              bool
+	}{
+		{addr: "127.0.0.1:8787", ok: true},
+		{addr: "[::1]:8787", ok: true},
+		{addr: "localhost:8787", ok: true},
+		{addr: ":8787"},
+		{addr: "0.0.0.0:8787"},
+		{addr: "192.168.1.2:8787"},
+		{addr: "0.0.0.0:8787", tokenFile: tokenFile, ok: true},
+	} {
+		cfg := &Config{ControlAPIAddr: tc.addr, ControlAPITokenFile: tc.tokenFile}
+		if err := loadControlAPI(cfg); (err == nil) != tc.ok {
+			t.Errorf("%v with token file %q: got %v", tc.addr, tc.tokenFile, err)
+		}
+	}
+	cfg := &Config{ControlAPIAddr: ":8787", ControlAPITokenFile: tokenFile}
+	if err := loadControlAPI(cfg); err != nil || cfg.controlAPIToken != "s3cret" {
+		t.Fatalf("got token %q, %v", cfg.controlAPIToken, err)
+	}
+}
+
+func TestRequireControlToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		token, header string
+		want          int
+	}{
+		{token: "", header: "", want: http.StatusOK},
+		{token: "s3cret", header: "", want: http.StatusUnauthorized},
+		{token: "s3cret", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{token: "s3cret", header: "s3cret", want: http.StatusUnauthorized},
+		{token: "s3cret", header: "Bearer s3cret", want: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pause", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		requireControlToken(tc.token, ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("token %q, Authorization %q: got %v, want %v", tc.token, tc.header, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dashboardLogSize = 200
+
+// dashboardLog keeps the last lines the sync engine printed while the dashboard owns the terminal.
+type dashboardLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *dashboardLog) add(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+	if len(l.lines) > dashboardLogSize {
+		l.lines = l.lines[len(l.lines)-dashboardLogSize:]
+	}
+}
+
+func (l *dashboardLog) last(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > len(l.lines) {
+		n = len(l.lines)
+	}
+	return append([]string{}, l.lines[len(l.lines)-n:]...)
+}
+
+// startDashboard takes over the terminal with a live view of every target: cycle phase, queue depth, in-flight
+// operations, recent operations, failures and the countdown to the next sync. What the engine prints meanwhile goes
+// to the log pane. Pressing q or ctrl+c shuts down like SIGINT. The returned func restores the terminal.
+func startDashboard() (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	term := os.Stdout
+	os.Stdout = w
+	colorEnabled = false // the log pane shows the lines as plain text
+
+	log := &dashboardLog{}
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			log.add(scanner.Text())
+		}
+	}()
+
+	p := tea.NewProgram(&dashboardModel{log: log}, tea.WithOutput(term), tea.WithAltScreen())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := p.Run(); err != nil {
+			fmt.Fprintf(term, "dashboard: %v\n", err)
+		}
+		requestShutdown()
+	}()
+
+	return func() {
+		p.Quit()
+		<-done
+		os.Stdout = term
+		_ = w.Close()
+		<-scanned
+		_ = r.Close()
+		// what was printed last is still worth seeing once the dashboard is gone
+		for _, line := range log.last(10) {
+			fmt.Println(line)
+		}
+	}, nil
+}
+
+type dashboardTick time.Time
+
+type dashboardModel struct {
+	log           *dashboardLog
+	width, height int
+}
+
+func (m *dashboardModel) Init() tea.Cmd {
+	return dashboardTickCmd()
+}
+
+func dashboardTickCmd() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return dashboardTick(t) })
+}
+
+func (m *dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		}
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case dashboardTick:
+		return m, dashboardTickCmd()
+	}
+	return m, nil
+}
+
+func (m *dashboardModel) View() string {
+	now := time.Now()
+	states := allLiveStates()
+	sb := &strings.Builder{}
+	lines := 0
+	add := func(format string, a ...any) {
+		line := fmt.Sprintf(format, a...)
+		if m.width > 0 && len(line) > m.width {
+			line = line[:m.width]
+		}
+		sb.WriteString(line + "\n")
+		lines++
+	}
+
+	add("bgdrive-sync   up %v   %v   [q] quit", now.Sub(processStart).Round(time.Second), now.Format(time.DateTime))
+	add("")
+	add("%-16v %-10v %8v %9v %8v  %-24v %v", "TARGET", "PHASE", "QUEUED", "IN FLIGHT", "FAILED", "LAST CYCLE", "NEXT SYNC")
+	var (
+		inFlight []string
+		recent   []Operation
+	)
+	for _, s := range states {
+		snap := s.snapshot()
+		name := snap.Name
+		if name == "" {
+			name = "-"
+		}
+		last := "never"
+		if snap.Last != nil {
+			last = "ok " + snap.Last.End.Format(time.TimeOnly)
+			if snap.Last.Failed() {
+				last = "failed " + snap.Last.End.Format(time.TimeOnly)
+			}
+		}
+		next := "-"
+		switch {
+		case snap.Paused:
+			next = "paused"
+		case snap.Phase == phaseIdle && !snap.Next.IsZero():
+			next = "in " + max(snap.Next.Sub(now), 0).Round(time.Second).String()
+		}
+		add("%-16v %-10v %8v %9v %5v/%-2v  %-24v %v", name, snap.Phase, snap.Queued, len(snap.InFlight), snap.Failures,
+			snap.Cycles, last, next)
+		if snap.Last != nil && snap.Last.Failed() {
+			add("  last error: %v", snap.Last.Err)
+		}
+
+		label := s.label()
+		for _, op := range snap.InFlight {
+			inFlight = append(inFlight, fmt.Sprintf("  %v%-8v %v (%v)", label, op.Op, op.Loc, now.Sub(op.Start).Round(time.Second)))
+		}
+		for _, op := range snap.Recent {
+			op.Path = label + op.Path
+			recent = append(recent, op)
+		}
+	}
+
+	add("")
+	add("In flight (%v):", len(inFlight))
+	for i, line := range inFlight {
+		if i == 10 {
+			add("  ... %v more", len(inFlight)-i)
+			break
+		}
+		add("%v", line)
+	}
+
+	add("")
+	add("Recent operations:")
+	sort.Slice(recent, func(i, j int) bool { return recent[i].Time.Before(recent[j].Time) })
+	start := max(len(recent)-8, 0)
+	for _, op := range recent[start:] {
+		add("  %v %-10v %v (%v)", op.Time.Format(time.TimeOnly), op.Op, op.Path, getFileSizeFormatted(op.Size))
+	}
+
+	add("")
+	add("Log:")
+	logLines := 10
+	if m.height > 0 {
+		logLines = max(m.height-lines-1, 3)
+	}
+	for _, line := range dashboardLogTail(m.log, logLines) {
+		add("  %v", line)
+	}
+	return sb.String()
+}
+
+func dashboardLogTail(log *dashboardLog, n int) []string {
+	var lines []string
+	for _, line := range log.last(n) {
+		if strings.Trim(line, "-") == "" {
+			continue // separators
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dedupSource is a tracked remote file whose content has a given md5.
+type dedupSource struct {
+	id  string
+	loc string
+}
+
+// dedupIndex maps the md5 of the content of tracked files to their remote copy, so a file with the same content
+// is copied on drive instead of uploaded again. Contents being uploaded are claimed, an identical file waits for
+// that upload to finish and copies it.
+type dedupIndex struct {
+	mu       sync.Mutex
+	bySum    map[string]dedupSource
+	sumByID  map[string]string
+	inFlight map[string]chan struct{}
+}
+
+// newDedupIndex indexes the files of objectMap whose md5 was verified against drive.
+func newDedupIndex(objectMap *objectTree) *dedupIndex {
+	d := &dedupIndex{bySum: map[string]dedupSource{}, sumByID: map[string]string{}, inFlight: map[string]chan struct{}{}}
+	objectMap.each(func(loc string, object *Object) {
+		if object.GDId != "" && object.LastMod != 0 && object.MD5 != "" && !object.Converted && !object.Exported {
+			d.add(object.MD5, object.GDId, loc)
+		}
+	})
+	return d
+}
+
+func (d *dedupIndex) add(sum, id, loc string) {
+	d.bySum[sum] = dedupSource{id: id, loc: loc}
+	d.sumByID[id] = sum
+}
+
+// acquire returns the remote file holding the content sum. When there is none, the content is claimed and done must
+// be called with the id it got uploaded as, or "" when the upload failed.
+func (d *dedupIndex) acquire(sum string) (source dedupSource, done func(id, loc string)) {
+	for {
+		d.mu.Lock()
+		if source, ok := d.bySum[sum]; ok {
+			d.mu.Unlock()
+			return source, nil
+		}
+		wait, ok := d.inFlight[sum]
+		if !ok {
+			release := make(chan struct{})
+			d.inFlight[sum] = release
+			d.mu.Unlock()
+			return dedupSource{}, func(id, loc string) {
+				d.mu.Lock()
+				defer d.mu.Unlock()
+				if id != "" {
+					d.add(sum, id, loc)
+				}
+				delete(d.inFlight, sum)
+				close(release)
+			}
+		}
+		d.mu.Unlock()
+		<-wait
+	}
+}
+
+// updated indexes the new content sum of the remote file id, tracked at loc. sum is empty when unknown.
+func (d *dedupIndex) updated(id, sum, loc string) {
+	d.forget(id)
+	if sum == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(sum, id, loc)
+}
+
+// forget drops the remote file id, deleted or with another content from now on.
+func (d *dedupIndex) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if sum, ok := d.sumByID[id]; ok {
+		delete(d.bySum, sum)
+		delete(d.sumByID, id)
+	}
+}
+
+// copyDuplicate copies the remote file holding the same content as the new local file at loc, whose placeholder
+// lockedNObj is stored already, under its parent pObj. When no tracked file has that content, it returns a nil object
+// and done, to be called once the upload of loc finished.
+func (om *ObjectManager) copyDuplicate(loc string, pObj, lockedNObj *Object) (*Object, func(id, loc string), error) {
+	sum, err := om.hashes.md5(om.sourceLoc(loc))
+	if err != nil {
+		return nil, nil, err
+	}
+	source, done := om.dedup.acquire(sum)
+	if done != nil {
+		return nil, done, nil
+	}
+	rf, err := om.drive.Copy(source.id, pObj.GDId, filepath.Base(loc))
+	if err != nil {
+		om.dedup.forget(source.id)
+		fmt.Printf("failed to copy %v to %v, uploading it instead: %v\n", strings.TrimPrefix(source.loc, om.cfg.SyncTargetPath),
+			strings.TrimPrefix(loc, om.cfg.SyncTargetPath), err)
+		return nil, nil, nil
+	}
+
+	var compressed int64
+	if src, ok := om.loadObject(source.loc); ok {
+		compressed = src.CompressedSize
+	}
+	nObject := om.updateStoredObject(lockedNObj, func(o *Object) {
+		o.GDId = rf.ID
+		o.RemoteMod = remoteModUnix(rf)
+		if strings.EqualFold(rf.MD5, sum) {
+			o.MD5 = sum
+		}
+		o.CompressedSize = compressed
+	})
+	om.recordOp("created", loc, rf.ID, 0)
+	printOp("copied", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "same content as "+strings.TrimPrefix(source.loc, om.cfg.SyncTargetPath))
+	return nObject, nil, nil
+}
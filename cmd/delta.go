@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// deltaSuffix is appended to the name of the remote folder holding the blocks of a file stored in blocks
+	deltaSuffix = ".bgdelta"
+
+	defaultDeltaBlockSize = 64 << 20
+)
+
+// loadDelta parses delta_min_size and delta_block_size.
+func loadDelta(cfg *Config) error {
+	minSize, err := parseByteSize(cfg.DeltaMinSize)
+	if err != nil {
+		return fmt.Errorf("delta_min_size: %v", err)
+	}
+	blockSize, err := parseByteSize(cfg.DeltaBlockSize)
+	if err != nil {
+		return fmt.Errorf("delta_block_size: %v", err)
+	}
+	if blockSize == 0 {
+		blockSize = defaultDeltaBlockSize
+	}
+	if minSize != 0 && blockSize < 1<<20 {
+		return errors.New("delta_block_size: must be at least 1MB")
+	}
+	cfg.deltaMinSize, cfg.deltaBlockSize = minSize, blockSize
+	return nil
+}
+
+// deltaBlock is one block of a file stored in blocks: the remote file holding it and the md5 of its content.
+type deltaBlock struct {
+	ID  string `json:"id"`
+	MD5 string `json:"md5"`
+}
+
+// deltaFile is a file stored in blocks, in the remote folder it is keyed by.
+type deltaFile struct {
+	BlockSize int64        `json:"block_size"`
+	Size      int64        `json:"size"`
+	Blocks    []deltaBlock `json:"blocks"`
+}
+
+// deltaStore persists the blocks of the files stored in blocks in delta_blocks.json, so an update only uploads the
+// blocks whose content changed.
+type deltaStore struct {
+	mu       *sync.Mutex
+	filePath string
+	files    map[string]*deltaFile
+}
+
+func newDeltaStore(filePath string) (*deltaStore, error) {
+	ds := &deltaStore{mu: &sync.Mutex{}, filePath: filePath, files: map[string]*deltaFile{}}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ds, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &ds.files); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return ds, nil
+}
+
+func (ds *deltaStore) get(id string) (*deltaFile, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	df, ok := ds.files[id]
+	return df, ok
+}
+
+func (ds *deltaStore) set(id string, df *deltaFile) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if df == nil {
+		if _, ok := ds.files[id]; !ok {
+			return nil
+		}
+		delete(ds.files, id)
+	} else {
+		ds.files[id] = df
+	}
+	data, err := json.MarshalIndent(ds.files, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ds.filePath, data, os.ModePerm)
+}
+
+// deltaDriveClient stores the files of delta_min_size and more as a folder of delta_block_size blocks, so updating
+// a large file that changed slightly only uploads the blocks that changed. The rest of the sync sees a plain file.
+type deltaDriveClient struct {
+	DriveClient
+	store      *deltaStore
+	minSize    int64
+	blockSize  int64
+	targetPath string
+}
+
+func deltaBlockName(i int) string {
+	return fmt.Sprintf("%06d", i)
+}
+
+// blockSums returns the md5 of every block of the file f.
+func (c *deltaDriveClient) blockSums(f *os.File, size int64) ([]string, error) {
+	var sums []string
+	for offset := int64(0); offset < size || offset == 0; offset += c.blockSize {
+		h := md5.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, offset, c.blockSize)); err != nil {
+			return nil, err
+		}
+		sums = append(sums, hex.EncodeToString(h.Sum(nil)))
+	}
+	return sums, nil
+}
+
+// sendBlock uploads block i of f as a new block under folderID, or over the existing block id.
+func (c *deltaDriveClient) sendBlock(f *os.File, i int, folderID, id string) (string, error) {
+	dir, err := os.MkdirTemp("", "bgdrive-sync-delta-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	blockLoc := filepath.Join(dir, deltaBlockName(i))
+	block, err := os.Create(blockLoc)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(block, io.NewSectionReader(f, int64(i)*c.blockSize, c.blockSize))
+	if closeErr := block.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var rf *RemoteFile
+	if id == "" {
+		rf, err = c.DriveClient.Upload(folderID, blockLoc)
+	} else {
+		rf, err = c.DriveClient.Update(id, blockLoc)
+	}
+	if err != nil {
+		return "", err
+	}
+	return rf.ID, nil
+}
+
+// sync uploads the blocks of the file at loc into the block folder folderID which differ from df, nil for a new
+// one, and returns the file as stored now.
+func (c *deltaDriveClient) sync(folderID, loc string, df *deltaFile) (*RemoteFile, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sums, err := c.blockSums(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	if df == nil || df.BlockSize != c.blockSize {
+		df = &deltaFile{BlockSize: c.blockSize}
+	}
+	next := &deltaFile{BlockSize: c.blockSize, Size: info.Size(), Blocks: make([]deltaBlock, len(sums))}
+	sent := 0
+	for i, sum := range sums {
+		var prev deltaBlock
+		if i < len(df.Blocks) {
+			prev = df.Blocks[i]
+		}
+		if prev.ID != "" && prev.MD5 == sum {
+			next.Blocks[i] = prev
+			continue
+		}
+		id, err := c.sendBlock(f, i, folderID, prev.ID)
+		if err != nil {
+			// keep the blocks sent so far, the next attempt only sends the rest
+			_ = c.store.set(folderID, mergeDeltaBlocks(df, next, i))
+			return nil, err
+		}
+		next.Blocks[i] = deltaBlock{ID: id, MD5: sum}
+		sent++
+	}
+	for _, b := range df.Blocks[min(len(df.Blocks), len(sums)):] {
+		if err = c.DriveClient.Delete(b.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.store.set(folderID, next); err != nil {
+		return nil, err
+	}
+	printOp("delta", strings.TrimPrefix(loc, c.targetPath), fmt.Sprintf("%v of %v blocks sent", sent, len(sums)))
+	return &RemoteFile{ID: folderID, Name: filepath.Base(loc), Size: info.Size()}, nil
+}
+
+// mergeDeltaBlocks returns the blocks of df with the first n blocks of next, sent before a failure.
+func mergeDeltaBlocks(df, next *deltaFile, n int) *deltaFile {
+	merged := &deltaFile{BlockSize: df.BlockSize, Size: df.Size, Blocks: append([]deltaBlock{}, df.Blocks...)}
+	for i := 0; i < n; i++ {
+		if i < len(merged.Blocks) {
+			merged.Blocks[i] = next.Blocks[i]
+		} else {
+			merged.Blocks = append(merged.Blocks, next.Blocks[i])
+		}
+	}
+	return merged
+}
+
+func (c *deltaDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	info, err := os.Stat(loc)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < c.minSize {
+		return c.DriveClient.Upload(parentID, loc)
+	}
+	folderID, err := c.DriveClient.Mkdir(parentID, filepath.Base(loc)+deltaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := c.sync(folderID, loc, nil)
+	if err != nil {
+		_ = c.DriveClient.Delete(folderID)
+		_ = c.store.set(folderID, nil)
+	}
+	return rf, err
+}
+
+// Update sends the changed blocks of a file stored in blocks. Other files are updated as a whole, even when they
+// grew past delta_min_size since their upload.
+func (c *deltaDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	df, ok := c.store.get(id)
+	if !ok {
+		return c.DriveClient.Update(id, loc)
+	}
+	return c.sync(id, loc, df)
+}
+
+func (c *deltaDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	if _, ok := c.store.get(id); ok {
+		name += deltaSuffix
+	}
+	return c.DriveClient.Move(id, oldParentID, newParentID, name)
+}
+
+func (c *deltaDriveClient) Delete(id string) error {
+	if err := c.DriveClient.Delete(id); err != nil {
+		return err
+	}
+	return c.store.set(id, nil)
+}
+
+func (c *deltaDriveClient) Trash(id string) error {
+	if err := c.DriveClient.Trash(id); err != nil {
+		return err
+	}
+	return c.store.set(id, nil)
+}
+
+// plain shows the block folder f as the file it holds, other files as they are.
+func (c *deltaDriveClient) plain(f *RemoteFile) *RemoteFile {
+	if f == nil || !f.IsDir || !strings.HasSuffix(f.Name, deltaSuffix) {
+		return f
+	}
+	p := *f
+	p.Name, p.IsDir, p.Size = strings.TrimSuffix(f.Name, deltaSuffix), false, 0
+	if df, ok := c.store.get(f.ID); ok {
+		p.Size = df.Size
+	}
+	return &p
+}
+
+// List shows the block folders as the files they hold.
+func (c *deltaDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	files, err := c.DriveClient.List(parentID, nameContains)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		files[i] = c.plain(f)
+	}
+	return files, nil
+}
+
+// Changes shows the changed block folders as the files they hold.
+func (c *deltaDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	changes, next, err := c.DriveClient.Changes(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, ch := range changes {
+		ch.File = c.plain(ch.File)
+	}
+	return changes, next, nil
+}
+
+// Download joins the blocks of a file stored in blocks, listed from drive so it works on a machine which didn't
+// upload it.
+func (c *deltaDriveClient) Download(id, loc string) error {
+	blocks, err := c.DriveClient.List(id, "")
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return c.DriveClient.Download(id, loc)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Name < blocks[j].Name })
+
+	dst, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	for _, b := range blocks {
+		blockLoc := loc + ".block"
+		if err = c.DriveClient.Download(b.ID, blockLoc); err != nil {
+			return err
+		}
+		err = appendFile(dst, blockLoc)
+		_ = os.Remove(blockLoc)
+		if err != nil {
+			return err
+		}
+	}
+	return dst.Close()
+}
+
+func appendFile(dst *os.File, loc string) error {
+	src, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// UploadFolder goes file by file, so the large files are still stored in blocks.
+func (c *deltaDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	return uploadFolderOneByOne(c, parentID, name, locs)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+const (
+	digestBiggestChanges = 10
+	digestDriftFindings  = 20
+
+	digestStateFile = "digest.json"
+)
+
+// Digest aggregates the cycle reports of one day or week.
+type Digest struct {
+	PeriodStart      time.Time   `json:"period_start"`
+	Cycles           int         `json:"cycles"`
+	FailedCycles     int         `json:"failed_cycles"`
+	Errors           []string    `json:"errors,omitempty"`
+	Created          int         `json:"created"`
+	Updated          int         `json:"updated"`
+	Deleted          int         `json:"deleted"`
+	BytesTransferred int64       `json:"bytes_transferred"`
+	BiggestChanges   []Operation `json:"biggest_changes,omitempty"`
+	// DriftFindings counts the differences between drive and the object map found by verify and reconcile, Drift
+	// holds the first digestDriftFindings of them
+	DriftFindings int      `json:"drift_findings"`
+	Drift         []string `json:"drift,omitempty"`
+}
+
+// digestAggregator accumulates cycle reports and drift findings into the current Digest and persists it, so a restart
+// in the middle of a day or week doesn't lose what was already aggregated.
+type digestAggregator struct {
+	period   string
+	filePath string
+	current  *Digest
+}
+
+func newDigestAggregator(period, filePath string) (*digestAggregator, error) {
+	if period != digestDaily && period != digestWeekly {
+		return nil, fmt.Errorf("digest: unknown period %q, expected %q or %q", period, digestDaily, digestWeekly)
+	}
+	da := &digestAggregator{period: period, filePath: filePath}
+	if err := da.load(); err != nil {
+		return nil, err
+	}
+	return da, nil
+}
+
+// load reads the current digest back, with what verify and reconcile, run on their own, added to it since.
+func (da *digestAggregator) load() error {
+	data, err := os.ReadFile(da.filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	da.current = nil
+	if len(data) != 0 {
+		da.current = &Digest{}
+		if err = json.Unmarshal(data, da.current); err != nil {
+			return fmt.Errorf("%v: %v", da.filePath, err)
+		}
+	}
+	return nil
+}
+
+// roll starts the period of t when the current digest is of an earlier one, and returns that finished digest.
+func (da *digestAggregator) roll(t time.Time) *Digest {
+	var done *Digest
+	start := da.periodStart(t)
+	if da.current != nil && da.current.PeriodStart.Before(start) {
+		done = da.current
+		da.current = nil
+	}
+	if da.current == nil {
+		da.current = &Digest{PeriodStart: start}
+	}
+	return done
+}
+
+func (da *digestAggregator) save() error {
+	data, err := json.MarshalIndent(da.current, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(da.filePath, data, os.ModePerm)
+}
+
+func (da *digestAggregator) periodStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	if da.period == digestWeekly {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7)) // back to monday
+	}
+	return start
+}
+
+// Add aggregates report and returns the finished digest of the previous period once a new period has started.
+func (da *digestAggregator) Add(report *CycleReport) (*Digest, error) {
+	if err := da.load(); err != nil {
+		return nil, err
+	}
+	done := da.roll(report.Start)
+
+	d := da.current
+	d.Cycles++
+	if report.Failed() {
+		d.FailedCycles++
+		d.Errors = append(d.Errors, fmt.Sprintf("%v: %v", report.Start.Format(time.DateTime), report.Err))
+	}
+	created, updated, deleted := report.Counts()
+	d.Created += created
+	d.Updated += updated
+	d.Deleted += deleted
+	d.BytesTransferred += report.BytesTransferred()
+	d.BiggestChanges = biggestOperations(append(d.BiggestChanges, report.Operations...), digestBiggestChanges)
+	return done, da.save()
+}
+
+// AddDrift aggregates the drift findings found at t and returns the finished digest of the previous period once a
+// new period has started.
+func (da *digestAggregator) AddDrift(t time.Time, findings []string) (*Digest, error) {
+	if err := da.load(); err != nil {
+		return nil, err
+	}
+	done := da.roll(t)
+
+	d := da.current
+	d.DriftFindings += len(findings)
+	if room := digestDriftFindings - len(d.Drift); room > 0 {
+		d.Drift = append(d.Drift, findings[:min(room, len(findings))]...)
+	}
+	return done, da.save()
+}
+
+// recordDrift adds findings to the digest of cfg, when it has one, and publishes the digest of the previous period
+// when they start a new one.
+func recordDrift(cfg *Config, findings []string) error {
+	if cfg.Digest == "" || cfg.DryRun || len(findings) == 0 {
+		return nil
+	}
+	da, err := newDigestAggregator(cfg.Digest, cfg.statePath(digestStateFile))
+	if err != nil {
+		return err
+	}
+	done, err := da.AddDrift(time.Now(), findings)
+	if done != nil {
+		publishDigest(cfg, da.period, done)
+	}
+	return err
+}
+
+// String renders the digest as plain text, suitable for terminals, emails and chat messages.
+func (d *Digest) String() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "bgdrive-sync digest for %v since %v\n", hostname(), d.PeriodStart.Format(time.DateOnly))
+	fmt.Fprintf(sb, "cycles: %v (%v failed)\n", d.Cycles, d.FailedCycles)
+	fmt.Fprintf(sb, "created: %v, updated: %v, deleted: %v\n", d.Created, d.Updated, d.Deleted)
+	fmt.Fprintf(sb, "transferred: %v\n", getFileSizeFormatted(d.BytesTransferred))
+	if d.DriftFindings != 0 {
+		fmt.Fprintf(sb, "drift: %v\n", d.DriftFindings)
+		for _, f := range d.Drift {
+			fmt.Fprintf(sb, "  %v\n", f)
+		}
+		if more := d.DriftFindings - len(d.Drift); more > 0 {
+			fmt.Fprintf(sb, "  and %v more\n", more)
+		}
+	}
+	if len(d.BiggestChanges) != 0 {
+		sb.WriteString("biggest changes:\n")
+		for _, op := range d.BiggestChanges {
+			fmt.Fprintf(sb, "  %v %v (%v)\n", op.Op, op.Path, getFileSizeFormatted(op.Size))
+		}
+	}
+	if len(d.Errors) != 0 {
+		sb.WriteString("errors:\n")
+		for _, e := range d.Errors {
+			fmt.Fprintf(sb, "  %v\n", e)
+		}
+	}
+	return sb.String()
+}
+
+// publishDigest prints the digest of the period that just closed, mails it to email_alert.to and posts it to the
+// selected notifiers, whatever outcome their on picks. A failing delivery is reported and doesn't stop the others.
+func publishDigest(cfg *Config, period string, d *Digest) {
+	text := d.String()
+	fmt.Print(text)
+	printSep()
+	if cfg.EmailAlert.enabled() {
+		subject := fmt.Sprintf("bgdrive-sync on %v: %v digest of %v since %v", hostname(), period, cfg.SyncTargetPath,
+			d.PeriodStart.Format(time.DateOnly))
+		if cfg.targetName != "" {
+			subject += " (" + cfg.targetName + ")"
+		}
+		if err := sendEmail(cfg.EmailAlert, subject, text); err != nil {
+			fmt.Printf("%vfailed to mail digest: %v\n", cfg.targetLabel(), err)
+		}
+	}
+	for _, n := range selectedNotifiers(cfg) {
+		if err := postNotifier(n, text); err != nil {
+			fmt.Printf("%vnotifier %v failed to post digest: %v\n", cfg.targetLabel(), n.Name, err)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	driveFolderMimeType = "application/vnd.google-apps.folder"
+	driveFileFields     = "id, name, mimeType, size, modifiedTime, md5Checksum"
+)
+
+// apiDriveClient talks to the drive v3 api directly, authenticated with an oauth token stored by the binary. Every
+// call supports shared drives, listings are scoped to driveID when set.
+type apiDriveClient struct {
+	srv        *drive.Service
+	httpClient *http.Client
+	driveID    string
+	sessions   *uploadSessions
+	// upLimit and downLimit throttle the transferred content, nil without max_upload_rate and max_download_rate
+	upLimit   *rateLimiter
+	downLimit *rateLimiter
+	// progressInterval is how often in-flight uploads report their progress, 0 when they don't
+	progressInterval time.Duration
+	targetPath       string
+	// keepRevisions is how many revisions of a file are kept forever, 0 leaves them to drive
+	keepRevisions int
+	// downloadAt has Download fetch the revision current at that time instead of the latest content when not zero
+	downloadAt time.Time
+
+	// rootID is the id of the root folder of my drive, which the changes feed reports instead of "root"
+	rootID     string
+	rootIDOnce sync.Once
+	rootIDErr  error
+}
+
+func newAPIDriveClient(cfg *Config) (*apiDriveClient, error) {
+	ctx := proxyContext(context.Background(), cfg)
+	httpClient, err := newOAuthHTTPClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := sharedRequestLimiter(cfg.MaxDriveQPS)
+	if err != nil {
+		return nil, err
+	}
+	if requests != nil {
+		httpClient.Transport = &requestLimitedTransport{base: httpClient.Transport, l: requests}
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(httpClient)}
+	if cfg.DriveEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.DriveEndpoint))
+	}
+	srv, err := drive.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := newUploadSessions(cfg.statePath("upload_sessions.json"))
+	if err != nil {
+		return nil, err
+	}
+	upLimit, err := sharedRateLimiter("upload", cfg.MaxUploadRate)
+	if err != nil {
+		return nil, fmt.Errorf("max_upload_rate: %v", err)
+	}
+	downLimit, err := sharedRateLimiter("download", cfg.MaxDownloadRate)
+	if err != nil {
+		return nil, fmt.Errorf("max_download_rate: %v", err)
+	}
+	return &apiDriveClient{srv: srv, httpClient: httpClient, driveID: cfg.GDDriveID, sessions: sessions, upLimit: upLimit,
+		downLimit: downLimit, progressInterval: time.Duration(cfg.ProgressIntervalSeconds) * time.Second,
+		targetPath: cfg.SyncTargetPath, keepRevisions: cfg.KeepRevisions, downloadAt: cfg.restoreAt}, nil
+}
+
+// loadDriveEndpoint checks drive_endpoint, which ends with a slash for the drive paths to resolve under it.
+func loadDriveEndpoint(cfg *Config) error {
+	if cfg.DriveEndpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.DriveEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("drive_endpoint: invalid url %q, expected e.g. http://localhost:8080/drive/v3/", cfg.DriveEndpoint)
+	}
+	if !strings.HasSuffix(cfg.DriveEndpoint, "/") {
+		cfg.DriveEndpoint += "/"
+	}
+	return nil
+}
+
+func apiParentID(parentID string) string {
+	if parentID == "" || parentID == "." {
+		return "root"
+	}
+	return parentID
+}
+
+func (c *apiDriveClient) Mkdir(parentID, name string) (string, error) {
+	f, err := c.srv.Files.Create(&drive.File{
+		Name:     name,
+		MimeType: driveFolderMimeType,
+		Parents:  []string{apiParentID(parentID)},
+	}).SupportsAllDrives(true).Fields("id").Do()
+	if err != nil {
+		return "", err
+	}
+	return f.Id, nil
+}
+
+func (c *apiDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() >= resumableUploadThreshold {
+		return c.resumableUpload(parentID, "", loc, info)
+	}
+
+	progress := newTransferProgress(c.progressLabel(loc), info.Size(), 0, c.progressInterval)
+	created, err := c.srv.Files.Create(&drive.File{
+		Name:         filepath.Base(loc),
+		Parents:      []string{apiParentID(parentID)},
+		ModifiedTime: driveTime(info.ModTime()),
+	}).Media(progress.reader(c.upLimit.reader(f))).KeepRevisionForever(c.keepRevisions != 0).SupportsAllDrives(true).
+		Fields(driveFileFields).Do()
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(created), nil
+}
+
+func (c *apiDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() >= resumableUploadThreshold {
+		rf, err := c.resumableUpload("", id, loc, info)
+		if err == nil {
+			c.pruneRevisions(id)
+		}
+		return rf, err
+	}
+
+	progress := newTransferProgress(c.progressLabel(loc), info.Size(), 0, c.progressInterval)
+	updated, err := c.srv.Files.Update(id, &drive.File{ModifiedTime: driveTime(info.ModTime())}).Media(progress.reader(c.upLimit.reader(f))).KeepRevisionForever(c.keepRevisions != 0).SupportsAllDrives(true).Fields(driveFileFields).Do()
+	if err != nil {
+		return nil, err
+	}
+	c.pruneRevisions(id)
+	return toRemoteFile(updated), nil
+}
+
+func (c *apiDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// drive converts the content to the type of the document, there is no resumable import
+	media := newTransferProgress(c.progressLabel(loc), info.Size(), 0, c.progressInterval).reader(c.upLimit.reader(f))
+	var imported *drive.File
+	if id == "" {
+		imported, err = c.srv.Files.Create(&drive.File{
+			Name:         convertedName(loc),
+			MimeType:     mimeType,
+			Parents:      []string{apiParentID(parentID)},
+			ModifiedTime: driveTime(info.ModTime()),
+		}).Media(media).SupportsAllDrives(true).Fields(driveFileFields).Do()
+	} else {
+		imported, err = c.srv.Files.Update(id, &drive.File{ModifiedTime: driveTime(info.ModTime())}).Media(media).SupportsAllDrives(true).Fields(driveFileFields).Do()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(imported), nil
+}
+
+// progressLabel is how loc is shown in progress lines, relative to the sync target like the other operations.
+func (c *apiDriveClient) progressLabel(loc string) string {
+	return strings.TrimPrefix(loc, c.targetPath)
+}
+
+// driveTime formats t for the modifiedTime of a drive file. Uploads carry the local modification time, so drive shows
+// and restores the time files were last changed rather than the time they were synced.
+func driveTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func toRemoteFile(f *drive.File) *RemoteFile {
+	rf := &RemoteFile{ID: f.Id, Name: f.Name, IsDir: f.MimeType == driveFolderMimeType, Size: f.Size, MimeType: f.MimeType,
+		MD5: f.Md5Checksum}
+	if t, err := time.Parse(time.RFC3339, f.ModifiedTime); err == nil {
+		rf.ModTime = t
+	}
+	return rf
+}
+
+func (c *apiDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	call := c.srv.Files.Update(id, &drive.File{Name: name}).SupportsAllDrives(true).Fields("id")
+	if newParentID != oldParentID {
+		call = call.AddParents(apiParentID(newParentID)).RemoveParents(apiParentID(oldParentID))
+	}
+	_, err := call.Do()
+	return err
+}
+
+func (c *apiDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	copied, err := c.srv.Files.Copy(id, &drive.File{
+		Name:    name,
+		Parents: []string{apiParentID(parentID)},
+	}).SupportsAllDrives(true).Fields(driveFileFields).Do()
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(copied), nil
+}
+
+func (c *apiDriveClient) Share(id, email, role string) error {
+	p := &drive.Permission{Type: "anyone", Role: role}
+	if email != "" {
+		p = &drive.Permission{Type: "user", Role: role, EmailAddress: email}
+	}
+	call := c.srv.Permissions.Create(id, p).SupportsAllDrives(true).Fields("id")
+	if email != "" {
+		call = call.SendNotificationEmail(false)
+	}
+	_, err := call.Do()
+	return err
+}
+
+func (c *apiDriveClient) Delete(id string) error {
+	return c.srv.Files.Delete(id).SupportsAllDrives(true).Do()
+}
+
+func (c *apiDriveClient) Trash(id string) error {
+	_, err := c.srv.Files.Update(id, &drive.File{Trashed: true}).SupportsAllDrives(true).Fields("id").Do()
+	return err
+}
+
+func (c *apiDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	query := fmt.Sprintf("'%v' in parents and trashed = false", apiParentID(parentID))
+	if nameContains != "" {
+		query += fmt.Sprintf(" and name contains '%v'", escapeQuery(nameContains))
+	}
+
+	call := c.srv.Files.List().Q(query).PageSize(1000).Fields("nextPageToken, files(" + driveFileFields + ")")
+	if c.driveID != "" {
+		call = call.Corpora("drive").DriveId(c.driveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+
+	var files []*RemoteFile
+	err := call.Pages(context.Background(), func(l *drive.FileList) error {
+		for _, f := range l.Files {
+			files = append(files, toRemoteFile(f))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (c *apiDriveClient) Download(id, loc string) error {
+	if !c.downloadAt.IsZero() {
+		return c.downloadRevisionAt(id, c.downloadAt, loc)
+	}
+	resp, err := c.srv.Files.Get(id).SupportsAllDrives(true).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.writeDownload(resp.Body, loc)
+}
+
+// writeDownload writes the downloaded content body to the local file at loc, within max_download_rate.
+func (c *apiDriveClient) writeDownload(body io.Reader, loc string) error {
+	f, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, c.downLimit.reader(body)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *apiDriveClient) Export(id, mimeType, loc string) error {
+	resp, err := c.srv.Files.Export(id, mimeType).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, c.downLimit.reader(resp.Body)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newOAuthHTTPClient returns an http client authorized with the token stored in gd_api_token_file. Refreshed tokens
+// are written back to that file. Without a stored token, the user is asked to authorize in the browser once.
+func newOAuthHTTPClient(ctx context.Context, cfg *Config) (*http.Client, error) {
+	if cfg.GDServiceAccountFile != "" {
+		return newServiceAccountHTTPClient(ctx, cfg)
+	}
+	if cfg.DriveEndpoint != "" && cfg.GDAPICredentialsFile == "" {
+		// a copy, the request limit is set on its transport
+		client := *oauth2.NewClient(ctx, nil)
+		return &client, nil
+	}
+	oauthCfg, err := newOAuthConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := readOAuthToken(cfg.GDAPITokenFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		fmt.Printf("No token in %v yet, `bgdrive-sync auth login --device` authorizes without a browser\n", cfg.GDAPITokenFile)
+		if token, err = authorizeInBrowser(ctx, oauthCfg); err != nil {
+			return nil, err
+		}
+		if err = writeOAuthToken(cfg.GDAPITokenFile, token); err != nil {
+			return nil, err
+		}
+	}
+
+	ts := &persistingTokenSource{
+		src:      oauthCfg.TokenSource(ctx, token),
+		filePath: cfg.GDAPITokenFile,
+		last:     token,
+	}
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// newServiceAccountHTTPClient authenticates as the service account of the json key gd_service_account_file,
+// impersonating gd_service_account_subject when set. Its tokens are fetched without any interaction.
+func newServiceAccountHTTPClient(ctx context.Context, cfg *Config) (*http.Client, error) {
+	key, err := os.ReadFile(cfg.GDServiceAccountFile)
+	if err != nil {
+		return nil, err
+	}
+	jwtCfg, err := google.JWTConfigFromJSON(key, drive.DriveScope)
+	if err != nil {
+		return nil, fmt.Errorf("gd_service_account_file: %v", err)
+	}
+	jwtCfg.Subject = cfg.GDServiceAccountSubject
+	return jwtCfg.Client(ctx), nil
+}
+
+// newOAuthConfig reads the oauth client of gd_api_credentials_file, whose tokens are stored in gd_api_token_file.
+func newOAuthConfig(cfg *Config) (*oauth2.Config, error) {
+	if cfg.GDAPICredentialsFile == "" || cfg.GDAPITokenFile == "" {
+		return nil, errors.New("drive_client api requires gd_api_credentials_file and gd_api_token_file, or gd_service_account_file")
+	}
+	credentials, err := os.ReadFile(cfg.GDAPICredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return google.ConfigFromJSON(credentials, drive.DriveScope)
+}
+
+// persistingTokenSource writes every newly refreshed token back to filePath.
+type persistingTokenSource struct {
+	mu       sync.Mutex
+	src      oauth2.TokenSource
+	filePath string
+	last     *oauth2.Token
+}
+
+func (ts *persistingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	token, err := ts.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if ts.last == nil || token.AccessToken != ts.last.AccessToken {
+		ts.last = token
+		if err = writeOAuthToken(ts.filePath, token); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+func readOAuthToken(filePath string) (*oauth2.Token, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	if err = json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return token, nil
+}
+
+func writeOAuthToken(filePath string, token *oauth2.Token) error {
+	data, err := json.MarshalIndent(token, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0o600)
+}
+
+// authorizeInBrowser runs the installed-app oauth flow with a loopback redirect: the user opens the printed url,
+// grants access and google redirects the authorization code back to a temporary local server.
+func authorizeInBrowser(ctx context.Context, oauthCfg *oauth2.Config) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	state := fmt.Sprintf("bgdrive-sync-%v", os.Getpid())
+	cfgCp := *oauthCfg
+	cfgCp.RedirectURL = fmt.Sprintf("http://%v", listener.Addr())
+
+	codeCh, errCh := make(chan string, 1), make(chan error, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			return
+		}
+		if e := r.URL.Query().Get("error"); e != "" {
+			errCh <- fmt.Errorf("authorization failed: %v", e)
+			http.Error(w, e, http.StatusBadRequest)
+			return
+		}
+		codeCh <- r.URL.Query().Get("code")
+		_, _ = fmt.Fprintln(w, "bgdrive-sync is authorized, you can close this tab.")
+	})}
+	go func() { _ = srv.Serve(listener) }()
+	defer srv.Close()
+
+	fmt.Printf("Open the following url in your browser to authorize bgdrive-sync:\n%v\n", cfgCp.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce))
+
+	select {
+	case code := <-codeCh:
+		return cfgCp.Exchange(ctx, code)
+	case err = <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// UploadFolder goes file by file, all the requests of the api client share one http session already.
+func (c *apiDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	return uploadFolderOneByOne(c, parentID, name, locs)
+}
+
+func (c *apiDriveClient) StartPageToken() (string, error) {
+	call := c.srv.Changes.GetStartPageToken().SupportsAllDrives(true)
+	if c.driveID != "" {
+		call = call.DriveId(c.driveID)
+	}
+	t, err := call.Do()
+	if err != nil {
+		return "", err
+	}
+	return t.StartPageToken, nil
+}
+
+func (c *apiDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	if c.driveID == "" {
+		c.rootIDOnce.Do(func() {
+			var root *drive.File
+			if root, c.rootIDErr = c.srv.Files.Get("root").Fields("id").Do(); c.rootIDErr == nil {
+				c.rootID = root.Id
+			}
+		})
+		if c.rootIDErr != nil {
+			return nil, "", c.rootIDErr
+		}
+	}
+
+	var changes []*RemoteChange
+	for {
+		call := c.srv.Changes.List(pageToken).PageSize(1000).IncludeRemoved(true).SupportsAllDrives(true).
+			Fields("nextPageToken, newStartPageToken, changes(changeType, fileId, removed, file(" + driveFileFields + ", parents, trashed))")
+		if c.driveID != "" {
+			call = call.DriveId(c.driveID).IncludeItemsFromAllDrives(true)
+		}
+		l, err := call.Do()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, ch := range l.Changes {
+			if ch.ChangeType != "" && ch.ChangeType != "file" {
+				continue // the shared drive itself changed
+			}
+			rc := &RemoteChange{ID: ch.FileId, Removed: ch.Removed || ch.File == nil || ch.File.Trashed}
+			if !rc.Removed {
+				rc.File = toRemoteFile(ch.File)
+				if len(ch.File.Parents) != 0 {
+					rc.Parent = ch.File.Parents[0]
+				}
+				if c.driveID == "" && rc.Parent == c.rootID {
+					rc.Parent = "."
+				}
+			}
+			changes = append(changes, rc)
+		}
+		if l.NewStartPageToken != "" {
+			return changes, l.NewStartPageToken, nil
+		}
+		pageToken = l.NextPageToken
+	}
+}
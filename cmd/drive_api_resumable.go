@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// resumableUploadThreshold is the size from which files go through a resumable session that survives failures
+	resumableUploadThreshold = 8 << 20
+	// resumableChunkSize must be a multiple of 256 KiB
+	resumableChunkSize = 8 << 20
+	// resumableSessionTTL stays below the week drive keeps an unfinished session
+	resumableSessionTTL = 6 * 24 * time.Hour
+)
+
+// uploadSession is a resumable upload in progress. It is only resumed for the same local content.
+type uploadSession struct {
+	URI     string    `json:"uri"`
+	Size    int64     `json:"size"`
+	ModTime int64     `json:"mod_time"`
+	Created time.Time `json:"created"`
+}
+
+// uploadSessions persists the resumable sessions of unfinished uploads, keyed by operation and local path, so a
+// transfer interrupted at 90% continues from its last confirmed chunk on the next attempt, even after a restart.
+type uploadSessions struct {
+	mu       *sync.Mutex
+	filePath string
+	Sessions map[string]*uploadSession `json:"sessions"`
+}
+
+func newUploadSessions(filePath string) (*uploadSessions, error) {
+	us := &uploadSessions{mu: &sync.Mutex{}, filePath: filePath, Sessions: map[string]*uploadSession{}}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return us, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, us); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	if us.Sessions == nil {
+		us.Sessions = map[string]*uploadSession{}
+	}
+	for key, s := range us.Sessions {
+		if time.Since(s.Created) > resumableSessionTTL {
+			delete(us.Sessions, key)
+		}
+	}
+	return us, nil
+}
+
+func (us *uploadSessions) get(key string, info os.FileInfo) *uploadSession {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	s, ok := us.Sessions[key]
+	if !ok || s.Size != info.Size() || s.ModTime != info.ModTime().Unix() || time.Since(s.Created) > resumableSessionTTL {
+		return nil
+	}
+	return s
+}
+
+// set stores s under key, nil removes it.
+func (us *uploadSessions) set(key string, s *uploadSession) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if s == nil {
+		delete(us.Sessions, key)
+	} else {
+		us.Sessions[key] = s
+	}
+	data, err := json.MarshalIndent(us, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(us.filePath, data, os.ModePerm)
+}
+
+// errSessionExpired is returned for a stored session drive no longer knows, the upload then starts over.
+var errSessionExpired = errors.New("upload session expired")
+
+// resumableUpload uploads the local file at loc through a resumable session. With id empty, a new file is created
+// under parentID, otherwise the content of the file id is replaced.
+func (c *apiDriveClient) resumableUpload(parentID, id, loc string, info os.FileInfo) (*RemoteFile, error) {
+	key := "upload " + parentID + " " + loc
+	if id != "" {
+		key = "update " + id + " " + loc
+	}
+
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if s := c.sessions.get(key, info); s != nil {
+		offset, done, err := c.sessionOffset(s)
+		if err == nil {
+			if done != nil {
+				_ = c.sessions.set(key, nil)
+				return done, nil
+			}
+			fmt.Printf("resuming upload of %v at %v of %v\n", loc, getFileSizeFormatted(offset), getFileSizeFormatted(info.Size()))
+			return c.uploadChunks(key, s, f, offset, c.progressLabel(loc))
+		}
+		if !errors.Is(err, errSessionExpired) {
+			return nil, err
+		}
+		_ = c.sessions.set(key, nil)
+	}
+
+	s, err := c.startSession(parentID, id, filepath.Base(loc), info)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.sessions.set(key, s); err != nil {
+		return nil, err
+	}
+	return c.uploadChunks(key, s, f, 0, c.progressLabel(loc))
+}
+
+func (c *apiDriveClient) startSession(parentID, id, name string, info os.FileInfo) (*uploadSession, error) {
+	// on the host of the api, googleapis.com unless drive_endpoint says otherwise
+	uploadURL := googleapi.ResolveRelative(c.srv.BasePath, "/upload/drive/v3/files")
+	method, target := http.MethodPost, uploadURL
+	meta := &drive.File{Name: name, Parents: []string{apiParentID(parentID)}, ModifiedTime: driveTime(info.ModTime())}
+	if id != "" {
+		method, target = http.MethodPatch, uploadURL+"/"+url.PathEscape(id)
+		meta = &drive.File{ModifiedTime: driveTime(info.ModTime())}
+	}
+	query := url.Values{"uploadType": {"resumable"}, "supportsAllDrives": {"true"}, "fields": {driveFileFields}}
+	if c.keepRevisions != 0 {
+		query.Set("keepRevisionForever", "true")
+	}
+
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, target+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(info.Size(), 10))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	uri := resp.Header.Get("Location")
+	if uri == "" {
+		return nil, errors.New("resumable upload: no session uri returned")
+	}
+	return &uploadSession{URI: uri, Size: info.Size(), ModTime: info.ModTime().Unix(), Created: time.Now()}, nil
+}
+
+// sessionOffset asks drive how many bytes of s it has. done is set when the upload already completed.
+func (c *apiDriveClient) sessionOffset(s *uploadSession) (int64, *RemoteFile, error) {
+	req, err := http.NewRequest(http.MethodPut, s.URI, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%v", s.Size))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	return sessionProgress(resp)
+}
+
+func (c *apiDriveClient) uploadChunks(key string, s *uploadSession, f *os.File, offset int64, label string) (*RemoteFile, error) {
+	progress := newTransferProgress(label, s.Size, offset, c.progressInterval)
+	for {
+		end := min(offset+resumableChunkSize, s.Size)
+		req, err := http.NewRequest(http.MethodPut, s.URI, progress.reader(c.upLimit.reader(io.NewSectionReader(f, offset, end-offset))))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = end - offset
+		if s.Size > 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, end-1, s.Size))
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err // the session is kept, the next attempt resumes from the last confirmed chunk
+		}
+		next, done, err := sessionProgress(resp)
+		resp.Body.Close()
+		if err != nil {
+			if errors.Is(err, errSessionExpired) {
+				_ = c.sessions.set(key, nil)
+			}
+			return nil, err
+		}
+		if done != nil {
+			_ = c.sessions.set(key, nil)
+			return done, nil
+		}
+		offset = next
+	}
+}
+
+// sessionProgress reads the response of a resumable session request: the next offset to send while incomplete
+// (308), or the uploaded file once complete.
+func sessionProgress(resp *http.Response) (int64, *RemoteFile, error) {
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		f := &drive.File{}
+		if err := json.NewDecoder(resp.Body).Decode(f); err != nil {
+			return 0, nil, err
+		}
+		return 0, toRemoteFile(f), nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		// Range: bytes=0-N is what drive has, no header means nothing yet
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return 0, nil, nil
+		}
+		_, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+		n, err := strconv.ParseInt(last, 10, 64)
+		if !ok || err != nil {
+			return 0, nil, fmt.Errorf("resumable upload: unexpected range %q", r)
+		}
+		return n + 1, nil, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return 0, nil, errSessionExpired
+	default:
+		return 0, nil, googleapi.CheckResponse(resp)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/api/drive/v3"
+	"time"
+)
+
+// maxKeptRevisions is how many revisions of a file drive keeps forever at most.
+const maxKeptRevisions = 200
+
+// pruneRevisions deletes the oldest revisions of the file id beyond keep_revisions. The revisions uploaded by the sync
+// are kept forever, drive would otherwise purge them after 30 days or 100 revisions. Failing to prune only delays it
+// to the next update, it is reported without failing the update.
+func (c *apiDriveClient) pruneRevisions(id string) {
+	if c.keepRevisions == 0 {
+		return
+	}
+	var revisions []*drive.Revision
+	err := c.srv.Revisions.List(id).Fields("nextPageToken, revisions(id)").Pages(context.Background(), func(l *drive.RevisionList) error {
+		revisions = append(revisions, l.Revisions...)
+		return nil
+	})
+	// revisions are listed oldest first, the last one being the content of the file
+	for i := 0; err == nil && i < len(revisions)-c.keepRevisions; i++ {
+		err = c.srv.Revisions.Delete(id, revisions[i].Id).Do()
+	}
+	if err != nil {
+		fmt.Printf("failed to prune the revisions of %v: %v\n", id, err)
+	}
+}
+
+// errNoRevisionAt is returned when downloading a file at a time before its first revision.
+var errNoRevisionAt = errors.New("no revision at that time")
+
+// revisionAt returns the revision of the file id current at time at, nil when the file had none yet. Drive only lists
+// the revisions it still keeps: without keep_revisions, those older than 30 days are gone.
+func (c *apiDriveClient) revisionAt(id string, at time.Time) (*drive.Revision, error) {
+	var found *drive.Revision
+	err := c.srv.Revisions.List(id).Fields("nextPageToken, revisions(id, modifiedTime)").Pages(context.Background(), func(l *drive.RevisionList) error {
+		for _, r := range l.Revisions {
+			if t, err := time.Parse(time.RFC3339, r.ModifiedTime); err == nil && !t.After(at) {
+				found = r // revisions are listed oldest first
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// downloadRevisionAt writes the content the file id had at time at to the local file at loc.
+func (c *apiDriveClient) downloadRevisionAt(id string, at time.Time, loc string) error {
+	r, err := c.revisionAt(id, at)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errNoRevisionAt
+	}
+	resp, err := c.srv.Revisions.Get(id, r.Id).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.writeDownload(resp.Body, loc)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	driveClientGDrive = "gdrive"
+	driveClientAPI    = "api"
+)
+
+const googleNativeMimeTypePrefix = "application/vnd.google-apps."
+
+// RemoteFile is a file or folder stored on drive. Fields the client can't provide are left zero.
+type RemoteFile struct {
+	ID       string
+	Name     string
+	IsDir    bool
+	Size     int64
+	MimeType string
+	ModTime  time.Time
+	MD5      string // hex md5 of the content, empty for folders, google native documents and when unknown
+}
+
+// RemoteChange is a change of a remote file read from the changes feed of drive.
+type RemoteChange struct {
+	ID string
+	// Removed is set when the file was deleted or trashed, File is nil then
+	Removed bool
+	File    *RemoteFile
+	// Parent is the id of the folder holding File, "." for the root of my drive
+	Parent string
+}
+
+// IsGoogleNative reports google docs, sheets, slides, ... which have no binary content to download.
+func (f *RemoteFile) IsGoogleNative() bool {
+	return !f.IsDir && strings.HasPrefix(f.MimeType, googleNativeMimeTypePrefix)
+}
+
+// DriveClient performs the remote operations of a sync. A parentID of "." refers to the root of My Drive. With
+// gd_drive_id, clients work inside that shared drive and its id is used as the root instead.
+type DriveClient interface {
+	// Mkdir creates a folder called name under parentID and returns its id.
+	Mkdir(parentID, name string) (string, error)
+	// Upload uploads the local file at loc under parentID, named after its base name.
+	Upload(parentID, loc string) (*RemoteFile, error)
+	// Update replaces the content of the remote file id with the local file at loc.
+	Update(id, loc string) (*RemoteFile, error)
+	// Move renames the remote file id to name and moves it from oldParentID to newParentID.
+	Move(id, oldParentID, newParentID, name string) error
+	// Delete permanently deletes the remote file or folder id, including its children.
+	Delete(id string) error
+	// Trash moves the remote file or folder id, including its children, to the drive trash.
+	Trash(id string) error
+	// List returns the non-trashed children of parentID whose name contains nameContains (all when empty). It fails
+	// rather than return part of them.
+	List(parentID, nameContains string) ([]*RemoteFile, error)
+	// Download writes the content of the remote file id to the local file at loc.
+	Download(id, loc string) error
+	// Import uploads the local file at loc converted to the google native mimeType under parentID, named after its
+	// base name without the extension, or with id set, replaces the content of the document id.
+	Import(parentID, id, loc, mimeType string) (*RemoteFile, error)
+	// Copy copies the remote file id under parentID as name on drive's side, without transferring its content.
+	Copy(id, parentID, name string) (*RemoteFile, error)
+	// Share grants role (reader, commenter or writer) on id to email, or to anyone with the link when email is empty.
+	Share(id, email, role string) error
+	// Export writes the google native document id converted to mimeType to the local file at loc, whose extension
+	// matches mimeType.
+	Export(id, mimeType, loc string) error
+	// UploadFolder creates a folder called name under parentID holding the local files at locs, which share the same
+	// local folder, in as few requests as the client can. It returns the folder id and the files in the order of
+	// locs. On failure nothing is left on drive.
+	UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error)
+	// StartPageToken returns the position of the changes feed of drive as of now.
+	StartPageToken() (string, error)
+	// Changes returns the changes made on drive since the position pageToken, oldest first, and the position to read
+	// the next changes from.
+	Changes(pageToken string) ([]*RemoteChange, string, error)
+}
+
+// newDriveClient builds the client selected by drive_client. Its operations are retried sync_retry times with
+// backoff when drive rate limits them or fails on its side. With compress and encryption_key_file, content is
+// compressed and encrypted on the way, with delta_min_size large files are split in blocks first.
+func newDriveClient(cfg *Config) (DriveClient, error) {
+	client, err := newPlainDriveClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.encryption != nil {
+		client = &encryptingDriveClient{DriveClient: client, keys: cfg.encryption, names: cfg.EncryptNames}
+	}
+	if len(cfg.compressExts) != 0 {
+		// compressed before encrypted, encrypted content doesn't compress
+		client = &compressingDriveClient{DriveClient: client, exts: cfg.compressExts}
+	}
+	if cfg.deltaMinSize != 0 {
+		store, err := newDeltaStore(cfg.statePath("delta_blocks.json"))
+		if err != nil {
+			return nil, err
+		}
+		client = &deltaDriveClient{DriveClient: client, store: store, minSize: cfg.deltaMinSize, blockSize: cfg.deltaBlockSize,
+			targetPath: cfg.SyncTargetPath}
+	}
+	return client, nil
+}
+
+func newPlainDriveClient(cfg *Config) (DriveClient, error) {
+	if cfg.TestMode && cfg.TestModeFakeDrive {
+		client, err := newFakeDriveClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return withWorkerGovernor(cfg, client), nil
+	}
+	if cfg.TestMode {
+		return withWorkerGovernor(cfg, &testModeClient{delay: time.Duration(cfg.TestModeOpDelayMillis) * time.Millisecond}), nil
+	}
+	backend, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var client DriveClient
+	if backend != nil {
+		client, err = newBackendDriveClient(cfg, backend)
+	} else {
+		client, err = newAccountDriveClient(cfg)
+	}
+	if err == nil && len(cfg.GDFallbackAccounts) != 0 {
+		client, err = newRotatingDriveClient(cfg, client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the retries go through the governor too, so a rate limited operation frees its slot while backing off
+	return &retryingDriveClient{DriveClient: withWorkerGovernor(cfg, client), retry: cfg.SyncRetry}, nil
+}
+
+// newAccountDriveClient builds the client selected by drive_client for gd_account_name.
+func newAccountDriveClient(cfg *Config) (DriveClient, error) {
+	var (
+		client DriveClient
+		err    error
+	)
+	switch cfg.DriveClient {
+	case "", driveClientGDrive:
+		client, err = newGDriveClient(cfg)
+	case driveClientAPI:
+		client, err = newAPIDriveClient(cfg)
+	default:
+		return nil, fmt.Errorf("drive_client: unknown client %q, expected %q or %q", cfg.DriveClient, driveClientGDrive, driveClientAPI)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// findChild returns the id of the child of parentID named exactly name, or an empty string when there is none.
+func findChild(drive DriveClient, parentID, name string) (string, error) {
+	files, err := drive.List(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if f.Name == name {
+			return f.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// uploadFolderOneByOne is UploadFolder for the clients without a batched upload: the folder, then every file.
+func uploadFolderOneByOne(client DriveClient, parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	id, err := client.Mkdir(parentID, name)
+	if err != nil {
+		return "", nil, err
+	}
+	files := make([]*RemoteFile, len(locs))
+	for i, loc := range locs {
+		if files[i], err = client.Upload(id, loc); err != nil {
+			_ = client.Delete(id)
+			return "", nil, err
+		}
+	}
+	return id, files, nil
+}
+
+// testModeClient pretends every operation succeeds after test_mode_op_delay_ms without touching drive.
+type testModeClient struct {
+	delay time.Duration
+	seq   atomic.Int64
+}
+
+func (c *testModeClient) op() string {
+	time.Sleep(c.delay)
+	return strconv.FormatInt(c.seq.Add(1), 10)
+}
+
+func (c *testModeClient) Mkdir(_, _ string) (string, error) { return c.op(), nil }
+func (c *testModeClient) Upload(_, _ string) (*RemoteFile, error) {
+	return &RemoteFile{ID: c.op()}, nil
+}
+func (c *testModeClient) Update(id, _ string) (*RemoteFile, error) {
+	c.op()
+	return &RemoteFile{ID: id}, nil
+}
+func (c *testModeClient) Move(_, _, _, _ string) error { c.op(); return nil }
+func (c *testModeClient) Delete(_ string) error        { c.op(); return nil }
+func (c *testModeClient) Trash(_ string) error         { c.op(); return nil }
+func (c *testModeClient) List(_, _ string) ([]*RemoteFile, error) {
+	c.op()
+	return nil, nil
+}
+func (c *testModeClient) Import(_, id, _, _ string) (*RemoteFile, error) {
+	if id == "" {
+		return &RemoteFile{ID: c.op()}, nil
+	}
+	c.op()
+	return &RemoteFile{ID: id}, nil
+}
+func (c *testModeClient) Copy(_, _, _ string) (*RemoteFile, error) {
+	return &RemoteFile{ID: c.op()}, nil
+}
+func (c *testModeClient) Share(_, _, _ string) error      { c.op(); return nil }
+func (c *testModeClient) Download(_, _ string) error      { c.op(); return nil }
+func (c *testModeClient) Export(_, _, _ string) error     { c.op(); return nil }
+func (c *testModeClient) StartPageToken() (string, error) { return "1", nil }
+func (c *testModeClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	c.op()
+	return nil, pageToken, nil
+}
+func (c *testModeClient) UploadFolder(_, _ string, locs []string) (string, []*RemoteFile, error) {
+	files := make([]*RemoteFile, len(locs))
+	for i := range files {
+		files[i] = &RemoteFile{ID: strconv.FormatInt(c.seq.Add(1), 10)}
+	}
+	return c.op(), files, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeDriveRootID is the id of the root of a fake drive, which "." and "" refer to.
+const fakeDriveRootID = "root"
+
+// fakeNode is a file or folder of a fake drive.
+type fakeNode struct {
+	file    RemoteFile
+	parent  string
+	content []byte
+	trashed bool
+}
+
+// fakeDrive is an in-memory drive: folders and files with ids, content, md5s and a changes feed. It lasts as long as
+// the process, every client of the same account working on the same one.
+type fakeDrive struct {
+	mu    sync.Mutex
+	seq   int64
+	nodes map[string]*fakeNode
+	// changes is the changes feed, a page token being an index in it
+	changes []*RemoteChange
+	// uploaded counts the bytes uploaded since the start of the process, for test_mode_upload_limit
+	uploaded int64
+}
+
+var (
+	fakeDrivesMu = &sync.Mutex{}
+	fakeDrives   = map[string]*fakeDrive{}
+)
+
+// fakeDriveFor returns the fake drive of the account of cfg.
+func fakeDriveFor(cfg *Config) *fakeDrive {
+	fakeDrivesMu.Lock()
+	defer fakeDrivesMu.Unlock()
+	d, ok := fakeDrives[cfg.GDAccountName]
+	if !ok {
+		d = &fakeDrive{nodes: map[string]*fakeNode{fakeDriveRootID: {file: RemoteFile{ID: fakeDriveRootID, IsDir: true}}}}
+		fakeDrives[cfg.GDAccountName] = d
+	}
+	return d
+}
+
+// fakeDriveClient goes to a fake drive, with test_mode_op_delay_ms of latency per operation. Once
+// test_mode_upload_limit bytes are uploaded, uploads fail as when the daily upload quota of drive runs out.
+type fakeDriveClient struct {
+	drive       *fakeDrive
+	delay       time.Duration
+	uploadLimit int64
+}
+
+func newFakeDriveClient(cfg *Config) (*fakeDriveClient, error) {
+	uploadLimit, err := parseByteSize(cfg.TestModeUploadLimit)
+	if err != nil {
+		return nil, fmt.Errorf("test_mode_upload_limit: %v", err)
+	}
+	return &fakeDriveClient{drive: fakeDriveFor(cfg), delay: time.Duration(cfg.TestModeOpDelayMillis) * time.Millisecond,
+		uploadLimit: uploadLimit}, nil
+}
+
+// op waits for the latency of an operation and locks the drive for it, the returned func unlocks it.
+func (c *fakeDriveClient) op() func() {
+	time.Sleep(c.delay)
+	c.drive.mu.Lock()
+	return c.drive.mu.Unlock
+}
+
+func fakeNotFound(id string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: "File not found: " + id,
+		Errors: []googleapi.ErrorItem{{Reason: "notFound", Message: "File not found: " + id}}}
+}
+
+func fakeParentID(parentID string) string {
+	if parentID == "" || parentID == "." {
+		return fakeDriveRootID
+	}
+	return parentID
+}
+
+// node returns the non-trashed node id, which must be a folder with dir.
+func (d *fakeDrive) node(id string, dir bool) (*fakeNode, error) {
+	n, ok := d.nodes[fakeParentID(id)]
+	if !ok || n.trashed || (dir && !n.file.IsDir) {
+		return nil, fakeNotFound(id)
+	}
+	return n, nil
+}
+
+// add stores a new node under parent and returns a copy of its file.
+func (d *fakeDrive) add(parent string, file RemoteFile, content []byte) *RemoteFile {
+	d.seq++
+	file.ID = "fake-" + strconv.FormatInt(d.seq, 10)
+	n := &fakeNode{file: file, parent: parent}
+	d.nodes[file.ID] = n
+	d.setContent(n, content)
+	return d.changed(n)
+}
+
+func (d *fakeDrive) setContent(n *fakeNode, content []byte) {
+	if n.file.IsDir {
+		return
+	}
+	n.content = content
+	n.file.Size = int64(len(content))
+	n.file.MD5 = ""
+	if !n.file.IsGoogleNative() {
+		sum := md5.Sum(content)
+		n.file.MD5 = hex.EncodeToString(sum[:])
+	}
+}
+
+// changed records n in the changes feed and returns a copy of its file.
+func (d *fakeDrive) changed(n *fakeNode) *RemoteFile {
+	f := n.file
+	parent := n.parent
+	if parent == fakeDriveRootID {
+		parent = "."
+	}
+	d.changes = append(d.changes, &RemoteChange{ID: f.ID, File: &f, Parent: parent})
+	return &f
+}
+
+// remove deletes or trashes id and its children, recording them as removed in the changes feed.
+func (d *fakeDrive) remove(id string, trash bool) {
+	for childID, child := range d.nodes {
+		if child.parent == id && !child.trashed {
+			d.remove(childID, trash)
+		}
+	}
+	if trash {
+		d.nodes[id].trashed = true
+	} else {
+		delete(d.nodes, id)
+	}
+	d.changes = append(d.changes, &RemoteChange{ID: id, Removed: true})
+}
+
+// reserveUpload counts size bytes as uploaded, failing as drive does once test_mode_upload_limit is reached.
+func (c *fakeDriveClient) reserveUpload(size int64) error {
+	if c.uploadLimit != 0 && c.drive.uploaded+size > c.uploadLimit {
+		const message = "The user has exceeded their Drive upload quota"
+		return &googleapi.Error{Code: http.StatusForbidden, Message: message,
+			Errors: []googleapi.ErrorItem{{Reason: "uploadLimitExceeded", Message: message}}}
+	}
+	c.drive.uploaded += size
+	return nil
+}
+
+// readLocal returns the content and the modification time of the local file at loc.
+func readLocal(loc string) ([]byte, time.Time, error) {
+	info, err := os.Stat(loc)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	content, err := os.ReadFile(loc)
+	return content, info.ModTime(), err
+}
+
+func (c *fakeDriveClient) Mkdir(parentID, name string) (string, error) {
+	defer c.op()()
+	if _, err := c.drive.node(parentID, true); err != nil {
+		return "", err
+	}
+	f := c.drive.add(fakeParentID(parentID), RemoteFile{Name: name, IsDir: true, MimeType: driveFolderMimeType,
+		ModTime: time.Now()}, nil)
+	return f.ID, nil
+}
+
+func (c *fakeDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	return c.create(parentID, filepath.Base(loc), loc, "application/octet-stream")
+}
+
+func (c *fakeDriveClient) create(parentID, name, loc, mimeType string) (*RemoteFile, error) {
+	content, modTime, err := readLocal(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer c.op()()
+	if _, err = c.drive.node(parentID, true); err != nil {
+		return nil, err
+	}
+	if err = c.reserveUpload(int64(len(content))); err != nil {
+		return nil, err
+	}
+	return c.drive.add(fakeParentID(parentID), RemoteFile{Name: name, MimeType: mimeType, ModTime: modTime}, content), nil
+}
+
+func (c *fakeDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	content, modTime, err := readLocal(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer c.op()()
+	n, err := c.drive.node(id, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.reserveUpload(int64(len(content))); err != nil {
+		return nil, err
+	}
+	n.file.ModTime = modTime
+	c.drive.setContent(n, content)
+	return c.drive.changed(n), nil
+}
+
+func (c *fakeDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	defer c.op()()
+	n, err := c.drive.node(id, false)
+	if err != nil {
+		return err
+	}
+	if n.parent != fakeParentID(oldParentID) {
+		return fmt.Errorf("%v is not in the folder %v", id, oldParentID)
+	}
+	if _, err = c.drive.node(newParentID, true); err != nil {
+		return err
+	}
+	n.parent, n.file.Name = fakeParentID(newParentID), name
+	c.drive.changed(n)
+	return nil
+}
+
+func (c *fakeDriveClient) Delete(id string) error {
+	defer c.op()()
+	if _, ok := c.drive.nodes[id]; !ok || id == fakeDriveRootID {
+		return fakeNotFound(id)
+	}
+	c.drive.remove(id, false)
+	return nil
+}
+
+func (c *fakeDriveClient) Trash(id string) error {
+	defer c.op()()
+	if _, err := c.drive.node(id, false); err != nil || id == fakeDriveRootID {
+		return fakeNotFound(id)
+	}
+	c.drive.remove(id, true)
+	return nil
+}
+
+func (c *fakeDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	defer c.op()()
+	if _, err := c.drive.node(parentID, true); err != nil {
+		return nil, err
+	}
+	var files []*RemoteFile
+	for _, n := range c.drive.nodes {
+		if n.parent == fakeParentID(parentID) && !n.trashed && strings.Contains(n.file.Name, nameContains) {
+			f := n.file
+			files = append(files, &f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (c *fakeDriveClient) Download(id, loc string) error {
+	defer c.op()()
+	n, err := c.drive.node(id, false)
+	if err != nil {
+		return err
+	}
+	if n.file.IsDir || n.file.IsGoogleNative() {
+		return fmt.Errorf("%v has no content to download", id)
+	}
+	return os.WriteFile(loc, n.content, 0644)
+}
+
+func (c *fakeDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	if id == "" {
+		name := strings.TrimSuffix(filepath.Base(loc), filepath.Ext(loc))
+		return c.create(parentID, name, loc, mimeType)
+	}
+	return c.Update(id, loc)
+}
+
+func (c *fakeDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	defer c.op()()
+	n, err := c.drive.node(id, false)
+	if err != nil {
+		return nil, err
+	}
+	if n.file.IsDir {
+		return nil, fmt.Errorf("%v is a folder, which can't be copied", id)
+	}
+	if _, err = c.drive.node(parentID, true); err != nil {
+		return nil, err
+	}
+	f := n.file
+	f.Name, f.ModTime = name, time.Now()
+	return c.drive.add(fakeParentID(parentID), f, n.content), nil
+}
+
+func (c *fakeDriveClient) Share(id, _, _ string) error {
+	defer c.op()()
+	_, err := c.drive.node(id, false)
+	return err
+}
+
+// Export writes the content the document was imported with, there is nothing to convert it with.
+func (c *fakeDriveClient) Export(id, _, loc string) error {
+	defer c.op()()
+	n, err := c.drive.node(id, false)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(loc, n.content, 0644)
+}
+
+func (c *fakeDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	return uploadFolderOneByOne(c, parentID, name, locs)
+}
+
+func (c *fakeDriveClient) StartPageToken() (string, error) {
+	defer c.op()()
+	return strconv.Itoa(len(c.drive.changes)), nil
+}
+
+func (c *fakeDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	defer c.op()()
+	i, err := strconv.Atoi(pageToken)
+	if err != nil || i < 0 || i > len(c.drive.changes) {
+		return nil, "", fmt.Errorf("invalid page token %q", pageToken)
+	}
+	changes := append([]*RemoteChange(nil), c.drive.changes[i:]...)
+	return changes, strconv.Itoa(len(c.drive.changes)), nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gdriveClient shells out to the gdrive cli (https://github.com/glotlabs/gdrive).
+type gdriveClient struct {
+	account string
+	driveID string // shared drive to list from, empty for my drive
+	// env is the environment of the gdrive commands, nil to inherit the one of the process
+	env []string
+	// requests throttles the gdrive commands to max_drive_qps, nil without a limit
+	requests *rateLimiter
+}
+
+// newGDriveClient switches gdrive to the configured account.
+func newGDriveClient(cfg *Config) (*gdriveClient, error) {
+	requests, err := sharedRequestLimiter(cfg.MaxDriveQPS)
+	if err != nil {
+		return nil, err
+	}
+	c := &gdriveClient{account: cfg.GDAccountName, driveID: cfg.GDDriveID, requests: requests, env: proxyEnv(cfg)}
+	if err := gdriveAccounts.acquire(c.account); err != nil {
+		return nil, err
+	}
+	gdriveAccounts.release()
+	return c, nil
+}
+
+// gdriveAccountSwitcher serializes the use of the account gdrive is switched to, which is global to the gdrive
+// config. Commands of the same account run concurrently, switching waits until the running ones are done.
+type gdriveAccountSwitcher struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	current string
+	active  int
+}
+
+var gdriveAccounts = newGDriveAccountSwitcher()
+
+func newGDriveAccountSwitcher() *gdriveAccountSwitcher {
+	s := &gdriveAccountSwitcher{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *gdriveAccountSwitcher) acquire(account string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.active > 0 && s.current != account {
+		s.cond.Wait()
+	}
+	if s.current != account {
+		cmd := exec.Command("gdrive", gdriveArgs([]string{"account", "switch"}, nil, account)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stdout
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+		s.current = account
+	}
+	s.active++
+	return nil
+}
+
+func (s *gdriveAccountSwitcher) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.active == 0 {
+		s.cond.Broadcast()
+	}
+}
+
+// run runs a command with gdrive switched to the account of c.
+func (c *gdriveClient) run(name string, arg ...string) (string, error) {
+	return c.runIn("", name, arg...)
+}
+
+// runIn is run from the working directory dir.
+func (c *gdriveClient) runIn(dir, name string, arg ...string) (string, error) {
+	if err := gdriveAccounts.acquire(c.account); err != nil {
+		return "", err
+	}
+	defer gdriveAccounts.release()
+	if c.requests != nil {
+		c.requests.wait(1) // a gdrive command mostly makes one request, listings of many pages make more
+	}
+	return runCommandIn(dir, c.env, name, arg...)
+}
+
+// gdriveArgs builds the arguments of a gdrive command. The operands (file names and ids) come after "--", so one
+// starting with a dash is never taken for an option.
+func gdriveArgs(command, options []string, operands ...string) []string {
+	args := append(append([]string{}, command...), options...)
+	return append(append(args, "--"), operands...)
+}
+
+func (c *gdriveClient) Mkdir(parentID, name string) (string, error) {
+	options := []string{"--print-only-id"}
+	if parentID != "." {
+		options = append(options, "--parent", parentID)
+	}
+	return c.run("gdrive", gdriveArgs([]string{"files", "mkdir"}, options, name)...)
+}
+
+func (c *gdriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	d, b := filepath.Dir(loc), filepath.Base(loc)
+	options := []string{"--print-only-id"}
+	if parentID != "." {
+		options = append(options, "--parent", parentID)
+	}
+	id, err := c.runIn(d, "gdrive", gdriveArgs([]string{"files", "upload"}, options, b)...)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(id, b)
+}
+
+// UploadFolder stages copies of the files in a temporary folder called name and uploads it with a single recursive
+// gdrive command, instead of two gdrive processes per file.
+func (c *gdriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	stage, err := os.MkdirTemp("", "bgdrive-sync-batch-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(stage)
+	if err = os.Mkdir(filepath.Join(stage, name), 0o755); err != nil {
+		return "", nil, err
+	}
+	for _, loc := range locs {
+		if err = linkOrCopy(loc, filepath.Join(stage, name, filepath.Base(loc))); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// the folder created is told apart from folders of the same name already there by its id
+	existing, err := c.List(parentID, name)
+	if err != nil {
+		return "", nil, err
+	}
+	options := []string{"--recursive"}
+	if parentID != "." {
+		options = append(options, "--parent", parentID)
+	}
+	_, uploadErr := c.runIn(stage, "gdrive", gdriveArgs([]string{"files", "upload"}, options, name)...)
+	id, err := c.createdFolder(parentID, name, existing)
+	if err != nil || uploadErr != nil {
+		if id != "" {
+			_ = c.Delete(id)
+		}
+		return "", nil, errors.Join(uploadErr, err)
+	}
+
+	children, err := c.List(id, "")
+	if err != nil {
+		_ = c.Delete(id)
+		return "", nil, err
+	}
+	byName := map[string]*RemoteFile{}
+	for _, f := range children {
+		byName[f.Name] = f
+	}
+	files := make([]*RemoteFile, len(locs))
+	for i, loc := range locs {
+		if files[i] = byName[filepath.Base(loc)]; files[i] == nil {
+			_ = c.Delete(id)
+			return "", nil, fmt.Errorf("%v missing from the uploaded folder %v", filepath.Base(loc), name)
+		}
+	}
+	return id, files, nil
+}
+
+// createdFolder returns the id of the folder called name under parentID which isn't one of existing, empty when
+// there is none.
+func (c *gdriveClient) createdFolder(parentID, name string, existing []*RemoteFile) (string, error) {
+	files, err := c.List(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	known := map[string]bool{}
+	for _, f := range existing {
+		known[f.ID] = true
+	}
+	for _, f := range files {
+		if f.IsDir && f.Name == name && !known[f.ID] {
+			return f.ID, nil
+		}
+	}
+	return "", fmt.Errorf("folder %v not found on drive after uploading it", name)
+}
+
+// linkOrCopy makes the file at loc available at dst, hard linked when both are on the same file system.
+func linkOrCopy(loc, dst string) error {
+	if os.Link(loc, dst) == nil {
+		return nil
+	}
+	src, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *gdriveClient) Update(id, loc string) (*RemoteFile, error) {
+	d, b := filepath.Dir(loc), filepath.Base(loc)
+	_, err := c.runIn(d, "gdrive", gdriveArgs([]string{"files", "update"}, nil, id, b)...)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(id, b)
+}
+
+// info reads the md5 checksum of the just transferred file id from "gdrive files info". A failure is not fatal,
+// the transfer itself succeeded and the checksum is left unknown.
+func (c *gdriveClient) info(id, name string) (*RemoteFile, error) {
+	rf := &RemoteFile{ID: id, Name: name}
+	out, err := c.run("gdrive", gdriveArgs([]string{"files", "info"}, nil, id)...)
+	if err != nil {
+		return rf, nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), "md5") {
+			rf.MD5 = strings.TrimSpace(v)
+		}
+	}
+	return rf, nil
+}
+
+func (c *gdriveClient) Move(id, oldParentID, newParentID, name string) error {
+	if _, err := c.run("gdrive", gdriveArgs([]string{"files", "rename"}, nil, id, name)...); err != nil {
+		return err
+	}
+	if newParentID == oldParentID {
+		return nil
+	}
+	if newParentID == "." {
+		newParentID = "root"
+	}
+	_, err := c.run("gdrive", gdriveArgs([]string{"files", "move"}, nil, id, newParentID)...)
+	return err
+}
+
+func (c *gdriveClient) Delete(id string) error {
+	_, err := c.run("gdrive", gdriveArgs([]string{"files", "delete"}, []string{"--recursive"}, id)...)
+	return err
+}
+
+func (c *gdriveClient) Share(id, email, role string) error {
+	options := []string{"--role", role, "--type", "anyone"}
+	if email != "" {
+		options = []string{"--role", role, "--type", "user", "--email", email}
+	}
+	_, err := c.run("gdrive", gdriveArgs([]string{"permissions", "share"}, options, id)...)
+	return err
+}
+
+// Copy is not offered in a usable form by the gdrive binary, dedup requires drive_client "api".
+func (c *gdriveClient) Copy(_, _, _ string) (*RemoteFile, error) {
+	return nil, errors.New("the gdrive client can't copy files")
+}
+
+// Trash is not offered by the gdrive binary, delete_mode "trash" requires drive_client "api".
+func (c *gdriveClient) Trash(_ string) error {
+	return errors.New("the gdrive client can't move files to the trash")
+}
+
+// StartPageToken is not offered by the gdrive binary, remote_changes requires drive_client "api".
+func (c *gdriveClient) StartPageToken() (string, error) {
+	return "", errors.New("the gdrive client can't read the changes of drive")
+}
+
+func (c *gdriveClient) Changes(_ string) ([]*RemoteChange, string, error) {
+	return nil, "", errors.New("the gdrive client can't read the changes of drive")
+}
+
+// gdriveListMax is the most children the gdrive client can list in a folder, the gdrive binary has no way to read the
+// pages past --max.
+const gdriveListMax = 1000
+
+// List asks for one child more than gdriveListMax, a listing which gets it is truncated and fails instead of passing
+// for the complete one, which would make the children past it look gone from drive.
+func (c *gdriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	if parentID == "" || parentID == "." {
+		parentID = "root"
+	}
+	query := fmt.Sprintf("'%v' in parents and trashed = false", parentID)
+	if nameContains != "" {
+		query += fmt.Sprintf(" and name contains '%v'", escapeQuery(nameContains))
+	}
+	args := []string{"files", "list", "--skip-header", "--full-name", "--max", strconv.Itoa(gdriveListMax + 1), "--field-separator", "\t", "--query", query}
+	if c.driveID != "" {
+		args = append(args, "--drive", c.driveID)
+	}
+	out, err := c.run("gdrive", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*RemoteFile
+	for _, line := range strings.Split(out, "\n") {
+		// columns: id, name, type, size, created
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		f := &RemoteFile{ID: fields[0], Name: fields[1], IsDir: fields[2] == "folder"}
+		if fields[2] != "folder" && fields[2] != "regular" {
+			f.MimeType = googleNativeMimeTypePrefix + fields[2]
+		}
+		files = append(files, f)
+	}
+	if len(files) > gdriveListMax {
+		return nil, fmt.Errorf("folder %v has more than %v children, which the gdrive client can't list, drive_client %q can", parentID, gdriveListMax, driveClientAPI)
+	}
+	return files, nil
+}
+
+func (c *gdriveClient) Download(id, loc string) error {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(loc), ".bgdrive-sync-download-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err = c.run("gdrive", gdriveArgs([]string{"files", "download"}, []string{"--destination", tmpDir, "--overwrite"}, id)...); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 {
+		return fmt.Errorf("download of %v produced %v files", id, len(entries))
+	}
+	return os.Rename(filepath.Join(tmpDir, entries[0].Name()), loc)
+}
+
+// Import can only create documents, the gdrive binary has no way to convert the content of an existing one.
+func (c *gdriveClient) Import(parentID, id, loc, _ string) (*RemoteFile, error) {
+	if id != "" {
+		return nil, fmt.Errorf("the gdrive client can't update a converted google document, google_convert requires drive_client %q to push changes", driveClientAPI)
+	}
+	d, b := filepath.Dir(loc), filepath.Base(loc)
+	options := []string{"--print-only-id"}
+	if parentID != "." {
+		options = append(options, "--parent", parentID)
+	}
+	id, err := c.runIn(d, "gdrive", gdriveArgs([]string{"files", "import"}, options, b)...)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteFile{ID: id, Name: convertedName(loc)}, nil
+}
+
+// Export lets gdrive pick the format from the extension of loc, mimeType is implied by it.
+func (c *gdriveClient) Export(id, _, loc string) error {
+	_, err := c.run("gdrive", gdriveArgs([]string{"files", "export"}, []string{"--overwrite"}, id, loc)...)
+	return err
+}
+
+func escapeQuery(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `'`, `\'`)
+}
+
+func runCommand(name string, arg ...string) (string, error) {
+	return runCommandIn("", nil, name, arg...)
+}
+
+// runCommandIn runs name with its arguments passed as is, no shell involved, from the working directory dir (the
+// current one when empty) with the environment env (the one of the process when nil). It returns the combined
+// output, which is the error message on failure.
+func runCommandIn(dir string, env []string, name string, arg ...string) (string, error) {
+	cmd := exec.Command(name, arg...)
+	cmd.Dir = dir
+	cmd.Env = env
+	stdout := bytes.NewBuffer(nil)
+	cmd.Stdout = stdout
+	cmd.Stderr = stdout
+
+	err := cmd.Run()
+	out := strings.TrimSpace(stdout.String())
+	if err != nil {
+		return "", errors.New(out)
+	}
+	return out, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeGDriveScript stands in for the gdrive binary: it records the working directory and the arguments of every
+// invocation, NUL separated, in a file of its own and prints an id.
+const fakeGDriveScript = `#!/bin/sh
+n=$(ls "$GDRIVE_ARGS_DIR" | wc -l)
+printf '%s\0' "$(pwd)" "$@" > "$GDRIVE_ARGS_DIR/$n"
+echo fake-id
+`
+
+// gdriveCall is an invocation of the fake gdrive binary.
+type gdriveCall struct {
+	dir  string
+	args []string
+}
+
+// recordGDrive puts the fake gdrive binary first in PATH and returns a func running op with a gdrive client and
+// returning the gdrive commands op ran, the account switch left out.
+func recordGDrive(t *testing.T) func(op func(c *gdriveClient) error) []gdriveCall {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake gdrive binary is a shell script")
+	}
+	bin, calls := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "gdrive"), []byte(fakeGDriveScript), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("GDRIVE_ARGS_DIR", calls)
+
+	return func(op func(c *gdriveClient) error) []gdriveCall {
+		t.Helper()
+		entries, err := os.ReadDir(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if err = os.Remove(filepath.Join(calls, e.Name())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = op(&gdriveClient{account: "test"}); err != nil {
+			t.Fatal(err)
+		}
+
+		var recorded []gdriveCall
+		for i := 0; ; i++ {
+			data, err := os.ReadFile(filepath.Join(calls, strconv.Itoa(i)))
+			if os.IsNotExist(err) {
+				return recorded
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+			if len(fields) >= 3 && fields[1] == "account" && fields[2] == "switch" {
+				continue
+			}
+			recorded = append(recorded, gdriveCall{dir: fields[0], args: fields[1:]})
+		}
+	}
+}
+
+// sameDir reports whether the folders a and b are the same one.
+func sameDir(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+func TestGDriveArgsHostileNames(t *testing.T) {
+	run := recordGDrive(t)
+	names := []string{
+		"my report (final).pdf",
+		"$HOME $(id) `id`.txt",
+		"a && rm -rf ~",
+		"a; echo injected",
+		`it's "quoted"`,
+		"-rf",
+		"--parent",
+		"line\nbreak",
+	}
+	for _, name := range names {
+		t.Run(strconv.Quote(name), func(t *testing.T) {
+			dir := t.TempDir()
+			cases := []struct {
+				op   string
+				run  func(c *gdriveClient) error
+				want []gdriveCall
+			}{
+				{
+					op: "mkdir",
+					run: func(c *gdriveClient) error {
+						_, err := c.Mkdir("parent-id", name)
+						return err
+					},
+					want: []gdriveCall{{args: []string{"files", "mkdir", "--print-only-id", "--parent", "parent-id", "--", name}}},
+				},
+				{
+					op: "upload",
+					run: func(c *gdriveClient) error {
+						_, err := c.Upload("parent-id", filepath.Join(dir, name))
+						return err
+					},
+					want: []gdriveCall{
+						{dir: dir, args: []string{"files", "upload", "--print-only-id", "--parent", "parent-id", "--", name}},
+						{args: []string{"files", "info", "--", "fake-id"}},
+					},
+				},
+				{
+					op: "update",
+					run: func(c *gdriveClient) error {
+						_, err := c.Update("file-id", filepath.Join(dir, name))
+						return err
+					},
+					want: []gdriveCall{
+						{dir: dir, args: []string{"files", "update", "--", "file-id", name}},
+						{args: []string{"files", "info", "--", "file-id"}},
+					},
+				},
+				{
+					op:  "move",
+					run: func(c *gdriveClient) error { return c.Move("file-id", "old-id", "new-id", name) },
+					want: []gdriveCall{
+						{args: []string{"files", "rename", "--", "file-id", name}},
+						{args: []string{"files", "move", "--", "file-id", "new-id"}},
+					},
+				},
+				{
+					op: "list",
+					run: func(c *gdriveClient) error {
+						_, err := c.List("parent-id", name)
+						return err
+					},
+					want: []gdriveCall{{args: []string{"files", "list", "--skip-header", "--full-name", "--max",
+						strconv.Itoa(gdriveListMax + 1), "--field-separator", "\t", "--query",
+						"'parent-id' in parents and trashed = false and name contains '" + escapeQuery(name) + "'"}}},
+				},
+			}
+			for _, tc := range cases {
+				got := run(tc.run)
+				if len(got) != len(tc.want) {
+					t.Errorf("%v: ran %q, want %q", tc.op, got, tc.want)
+					continue
+				}
+				for i, call := range got {
+					if !slices.Equal(call.args, tc.want[i].args) {
+						t.Errorf("%v: ran gdrive %q, want %q", tc.op, call.args, tc.want[i].args)
+					}
+					if tc.want[i].dir != "" && !sameDir(call.dir, tc.want[i].dir) {
+						t.Errorf("%v: ran in %v, want %v", tc.op, call.dir, tc.want[i].dir)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEscapeQuery(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"it's", `it\'s`},
+		{`back\slash`, `back\\slash`},
+		{`\'`, `\\\'`},
+	}
+	for _, tc := range cases {
+		if got := escapeQuery(tc.in); got != tc.want {
+			t.Errorf("escapeQuery(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
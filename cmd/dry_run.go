@@ -0,0 +1,72 @@
+package main
+
+import "fmt"
+
+// dryRunID is the id handed out for remote objects a dry run pretends to create.
+const dryRunID = "dry-run"
+
+// dryRunClient lets reads through to the real client but only pretends to perform changes, so a dry run plans the
+// same operations a real cycle would without touching drive.
+type dryRunClient struct {
+	DriveClient
+}
+
+func (c *dryRunClient) Mkdir(_, _ string) (string, error) {
+	return dryRunID, nil
+}
+
+func (c *dryRunClient) Upload(_, _ string) (*RemoteFile, error) {
+	return &RemoteFile{ID: dryRunID}, nil
+}
+
+func (c *dryRunClient) Update(id, _ string) (*RemoteFile, error) {
+	return &RemoteFile{ID: id}, nil
+}
+
+func (c *dryRunClient) Import(_, id, _, _ string) (*RemoteFile, error) {
+	if id == "" {
+		id = dryRunID
+	}
+	return &RemoteFile{ID: id}, nil
+}
+
+func (c *dryRunClient) Copy(_, _, _ string) (*RemoteFile, error) {
+	return &RemoteFile{ID: dryRunID}, nil
+}
+
+func (c *dryRunClient) UploadFolder(_, _ string, locs []string) (string, []*RemoteFile, error) {
+	files := make([]*RemoteFile, len(locs))
+	for i := range files {
+		files[i] = &RemoteFile{ID: dryRunID}
+	}
+	return dryRunID, files, nil
+}
+
+func (c *dryRunClient) Share(_, _, _ string) error {
+	return nil
+}
+
+func (c *dryRunClient) Move(_, _, _, _ string) error {
+	return nil
+}
+
+func (c *dryRunClient) Delete(_ string) error {
+	return nil
+}
+
+func (c *dryRunClient) Trash(_ string) error {
+	return nil
+}
+
+// restoreObjects replaces the object map, used to forget what a dry run pretended to do.
+func (om *ObjectManager) restoreObjects(objectMap *objectTree) {
+	om.objectMapRWMu.Lock()
+	defer om.objectMapRWMu.Unlock()
+	om.objectMap = objectMap
+}
+
+func printDryRunSummary(report *CycleReport) {
+	created, updated, deleted := report.Counts()
+	printOp("planned", "dry run, nothing was changed", fmt.Sprintf("%v created, %v updated, %v deleted, %v to transfer",
+		created, updated, deleted, getFileSizeFormatted(report.BytesTransferred())))
+}
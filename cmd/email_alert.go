@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEmailAlertAfterFailures = 3
+	defaultSMTPPort                = 587
+	smtpsPort                      = 465
+)
+
+// EmailAlertConfig is the email_alert section: who is mailed, and through which smtp server, once syncing has been
+// failing for AfterFailures cycles in a row.
+type EmailAlertConfig struct {
+	SMTPHost      string   `yaml:"smtp_host"`
+	SMTPPort      int      `yaml:"smtp_port"`
+	Username      string   `yaml:"username"`
+	PasswordFile  string   `yaml:"password_file"`
+	From          string   `yaml:"from"`
+	To            []string `yaml:"to"`
+	AfterFailures int      `yaml:"after_failures"`
+}
+
+func (c EmailAlertConfig) enabled() bool {
+	return len(c.To) != 0
+}
+
+func (c EmailAlertConfig) afterFailures() int {
+	if c.AfterFailures <= 0 {
+		return defaultEmailAlertAfterFailures
+	}
+	return c.AfterFailures
+}
+
+func validEmailAlert(c EmailAlertConfig) error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.SMTPHost == "" || c.From == "" {
+		return errors.New("email_alert: smtp_host and from are required")
+	}
+	if c.Username != "" && c.PasswordFile == "" {
+		return errors.New("email_alert: password_file is required with username")
+	}
+	return nil
+}
+
+// alertByEmail mails email_alert.to when the cycle of report is the after_failures-th failed one in a row, and once
+// more when syncing recovers from such a streak.
+func alertByEmail(cfg *Config, report *CycleReport, snap targetSnapshot, prevStreak int) {
+	after := cfg.EmailAlert.afterFailures()
+	var subject, body string
+	switch {
+	case report.Failed() && snap.FailStreak == after:
+		subject = fmt.Sprintf("bgdrive-sync on %v: syncing %v failed %v times in a row", hostname(), cfg.SyncTargetPath, after)
+		body = fmt.Sprintf("The last %v sync cycles of %v on %v failed. The last one started at %v and failed with:\n\n%v\n\n"+
+			"You will be mailed again once syncing recovers.\n", after, cfg.SyncTargetPath, hostname(),
+			report.Start.Format(time.DateTime), report.Err)
+	case !report.Failed() && prevStreak >= after:
+		subject = fmt.Sprintf("bgdrive-sync on %v: syncing %v recovered", hostname(), cfg.SyncTargetPath)
+		created, updated, deleted := report.Counts()
+		body = fmt.Sprintf("The cycle of %v on %v started at %v succeeded after %v failed ones: %v created, %v updated, "+
+			"%v deleted, %v transferred.\n", cfg.SyncTargetPath, hostname(), report.Start.Format(time.DateTime), prevStreak,
+			created, updated, deleted, getFileSizeFormatted(report.BytesTransferred()))
+	default:
+		return
+	}
+	if cfg.targetName != "" {
+		subject += " (" + cfg.targetName + ")"
+	}
+	if err := sendEmail(cfg.EmailAlert, subject, body); err != nil {
+		fmt.Printf("%vfailed to send email alert: %v\n", cfg.targetLabel(), err)
+	}
+}
+
+// sendEmail sends a plain text mail through the smtp server of c, over implicit tls on port 465 and with STARTTLS
+// when the server offers it otherwise.
+func sendEmail(c EmailAlertConfig, subject, body string) error {
+	port := c.SMTPPort
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	addr := net.JoinHostPort(c.SMTPHost, strconv.Itoa(port))
+
+	msg := bytes.NewBuffer(nil)
+	fmt.Fprintf(msg, "From: %v\r\n", c.From)
+	fmt.Fprintf(msg, "To: %v\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(msg, "Subject: %v\r\n", subject)
+	fmt.Fprintf(msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		password, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.Username, strings.TrimSpace(string(password)), c.SMTPHost)
+	}
+	if port != smtpsPort {
+		return smtp.SendMail(addr, auth, c.From, c.To, msg.Bytes())
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: c.SMTPHost})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, c.SMTPHost)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
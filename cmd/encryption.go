@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedMagic prefixes the content of every file encrypted by bgdrive-sync.
+const encryptedMagic = "BGDSENC1"
+
+const (
+	// encryptionSalt is fixed so every machine derives the same keys from the same key file
+	encryptionSalt = "bgdrive-sync content encryption"
+	// encryptedChunkSize is the plaintext sealed at once, files are streamed through chunk by chunk
+	encryptedChunkSize = 64 << 10
+	encryptedNonceSize = 8
+	encryptedTagSize   = 16
+	encryptedHeaderLen = len(encryptedMagic) + encryptedNonceSize
+)
+
+var encryptedNames = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// encryptionKeys seal file contents with AES-256-GCM and, with encrypt_names, names with a deterministic
+// AES-256-GCM whose nonce is derived from the name, so the same name always maps to the same remote one.
+type encryptionKeys struct {
+	content cipher.AEAD
+	names   cipher.AEAD
+	nameMAC []byte
+}
+
+// loadEncryption derives the keys of encryption_key_file. It must run once after the config is loaded.
+func loadEncryption(cfg *Config) error {
+	if cfg.EncryptionKeyFile == "" {
+		if cfg.EncryptNames {
+			return errors.New("encrypt_names requires encryption_key_file")
+		}
+		return nil
+	}
+	if len(cfg.GoogleConvert) != 0 {
+		return errors.New("google_convert can't be combined with encryption_key_file, drive can't convert encrypted files")
+	}
+	passphrase, err := os.ReadFile(cfg.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	passphrase = bytes.TrimSpace(passphrase)
+	if len(passphrase) == 0 {
+		return fmt.Errorf("%v is empty", cfg.EncryptionKeyFile)
+	}
+	key, err := scrypt.Key(passphrase, []byte(encryptionSalt), 1<<15, 8, 1, 96)
+	if err != nil {
+		return err
+	}
+	keys := &encryptionKeys{nameMAC: key[64:]}
+	for i, aead := range []*cipher.AEAD{&keys.content, &keys.names} {
+		block, err := aes.NewCipher(key[i*32 : (i+1)*32])
+		if err != nil {
+			return err
+		}
+		if *aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	cfg.encryption = keys
+	return nil
+}
+
+// chunkNonce is the nonce of chunk i of a file: its random prefix followed by the chunk index.
+func chunkNonce(prefix []byte, i uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedNonceSize:], i)
+	return nonce
+}
+
+// chunkAAD binds a chunk to its position and marks the last one, so chunks can't be reordered or cut off.
+func chunkAAD(i uint32, last bool) []byte {
+	aad := binary.BigEndian.AppendUint32([]byte(encryptedMagic), i)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// encrypt writes the content of r sealed to w. Layout: magic | nonce prefix | sealed chunks, the last one possibly
+// short or empty.
+func (k *encryptionKeys) encrypt(w io.Writer, r io.Reader) error {
+	prefix := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(r, encryptedChunkSize)
+	buf := make([]byte, encryptedChunkSize)
+	sealed := make([]byte, 0, encryptedChunkSize+encryptedTagSize)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		_, peekErr := br.Peek(1)
+		last := n < encryptedChunkSize || errors.Is(peekErr, io.EOF)
+		sealed = k.content.Seal(sealed[:0], chunkNonce(prefix, i), buf[:n], chunkAAD(i, last))
+		if _, err = w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decrypt writes the content sealed by encrypt read from r to w.
+func (k *encryptionKeys) decrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, encryptedHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte(encryptedMagic)) {
+		return errors.New("not encrypted by bgdrive-sync")
+	}
+	prefix := header[len(encryptedMagic):]
+	br := bufio.NewReaderSize(r, encryptedChunkSize+encryptedTagSize)
+	buf := make([]byte, encryptedChunkSize+encryptedTagSize)
+	plain := make([]byte, 0, encryptedChunkSize)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		_, peekErr := br.Peek(1)
+		last := errors.Is(peekErr, io.EOF)
+		if plain, err = k.content.Open(plain[:0], chunkNonce(prefix, i), buf[:n], chunkAAD(i, last)); err != nil {
+			return errors.New("cannot decrypt, wrong encryption_key_file or corrupted content")
+		}
+		if _, err = w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// plainSize is the size of the content encrypted into size bytes, or -1 when size can't be one of an encrypted file.
+func plainSize(size int64) int64 {
+	body := size - int64(encryptedHeaderLen)
+	if body < encryptedTagSize {
+		return -1
+	}
+	chunks, rem := body/(encryptedChunkSize+encryptedTagSize), body%(encryptedChunkSize+encryptedTagSize)
+	if rem == 0 {
+		return chunks * encryptedChunkSize
+	}
+	if rem < encryptedTagSize {
+		return -1
+	}
+	return chunks*encryptedChunkSize + rem - encryptedTagSize
+}
+
+func (k *encryptionKeys) encryptName(name string) string {
+	mac := hmac.New(sha256.New, k.nameMAC)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:k.names.NonceSize()]
+	return strings.ToLower(encryptedNames.EncodeToString(k.names.Seal(nonce, nonce, []byte(name), nil)))
+}
+
+// decryptName returns the name encrypted into name, or false when it wasn't encrypted with these keys.
+func (k *encryptionKeys) decryptName(name string) (string, bool) {
+	data, err := encryptedNames.DecodeString(strings.ToUpper(name))
+	if err != nil || len(data) < k.names.NonceSize() {
+		return "", false
+	}
+	plain, err := k.names.Open(nil, data[:k.names.NonceSize()], data[k.names.NonceSize():], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plain), true
+}
+
+// encryptingDriveClient encrypts the files it uploads and decrypts the ones it downloads, with encrypt_names their
+// names too, so the rest of the sync only deals with plaintext names, sizes and checksums.
+type encryptingDriveClient struct {
+	DriveClient
+	keys  *encryptionKeys
+	names bool
+}
+
+func (c *encryptingDriveClient) remoteName(name string) string {
+	if !c.names {
+		return name
+	}
+	return c.keys.encryptName(name)
+}
+
+// plain translates f as listed on drive to what it holds in plaintext. The md5 of drive is the one of the encrypted
+// content, it is left unknown.
+func (c *encryptingDriveClient) plain(f *RemoteFile) *RemoteFile {
+	if f == nil {
+		return nil
+	}
+	p := *f
+	if c.names {
+		if name, ok := c.keys.decryptName(f.Name); ok {
+			p.Name = name
+		}
+	}
+	if !f.IsDir && !f.IsGoogleNative() && f.Size > 0 {
+		if size := plainSize(f.Size); size >= 0 {
+			p.Size = size
+		}
+	}
+	p.MD5 = ""
+	return &p
+}
+
+// sealed encrypts the file at loc into a temporary folder, under its remote name since the gdrive client names
+// uploads after the local file. It returns the encrypted file, the md5 of the plaintext and of the encrypted content.
+func (c *encryptingDriveClient) sealed(loc string) (string, string, string, func(), error) {
+	src, err := os.Open(loc)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	defer src.Close()
+	dir, err := os.MkdirTemp("", "bgdrive-sync-encrypt-")
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	dstLoc := filepath.Join(dir, c.remoteName(filepath.Base(loc)))
+	dst, err := os.Create(dstLoc)
+	if err != nil {
+		cleanup()
+		return "", "", "", nil, err
+	}
+	plainSum, sealedSum := md5.New(), md5.New()
+	err = c.keys.encrypt(io.MultiWriter(dst, sealedSum), io.TeeReader(src, plainSum))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", "", "", nil, err
+	}
+	return dstLoc, sumHex(plainSum), sumHex(sealedSum), cleanup, nil
+}
+
+func sumHex(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// transferred translates the file returned by an upload of content encrypted to sealedSum from plainSum. The md5
+// of drive is reported as the plaintext one when it matches the encrypted content, and as is otherwise so the
+// transfer is found corrupted.
+func (c *encryptingDriveClient) transferred(rf *RemoteFile, plainSum, sealedSum string) *RemoteFile {
+	md5Sum := ""
+	if rf != nil && rf.MD5 != "" {
+		md5Sum = rf.MD5
+		if strings.EqualFold(rf.MD5, sealedSum) {
+			md5Sum = plainSum
+		}
+	}
+	p := c.plain(rf)
+	if p != nil {
+		p.MD5 = md5Sum
+	}
+	return p
+}
+
+func (c *encryptingDriveClient) Mkdir(parentID, name string) (string, error) {
+	return c.DriveClient.Mkdir(parentID, c.remoteName(name))
+}
+
+func (c *encryptingDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	sealedLoc, plainSum, sealedSum, cleanup, err := c.sealed(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	rf, err := c.DriveClient.Upload(parentID, sealedLoc)
+	if err != nil {
+		return nil, err
+	}
+	return c.transferred(rf, plainSum, sealedSum), nil
+}
+
+func (c *encryptingDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	sealedLoc, plainSum, sealedSum, cleanup, err := c.sealed(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	rf, err := c.DriveClient.Update(id, sealedLoc)
+	if err != nil {
+		return nil, err
+	}
+	return c.transferred(rf, plainSum, sealedSum), nil
+}
+
+func (c *encryptingDriveClient) Import(_, _, _, _ string) (*RemoteFile, error) {
+	return nil, errors.New("drive can't convert encrypted files")
+}
+
+func (c *encryptingDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	rf, err := c.DriveClient.Copy(id, parentID, c.remoteName(name))
+	return c.plain(rf), err
+}
+
+func (c *encryptingDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	return c.DriveClient.Move(id, oldParentID, newParentID, c.remoteName(name))
+}
+
+// Changes reads the changed files back as they are locally.
+func (c *encryptingDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	changes, next, err := c.DriveClient.Changes(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, ch := range changes {
+		ch.File = c.plain(ch.File)
+	}
+	return changes, next, nil
+}
+
+func (c *encryptingDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	if nameContains != "" {
+		nameContains = c.remoteName(nameContains)
+	}
+	files, err := c.DriveClient.List(parentID, nameContains)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		files[i] = c.plain(f)
+	}
+	return files, nil
+}
+
+// Download decrypts the content of id into loc. Files which weren't encrypted by bgdrive-sync, put on drive by
+// other means, are taken as they are.
+func (c *encryptingDriveClient) Download(id, loc string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(loc), ".bgdrive-sync-decrypt-*")
+	if err != nil {
+		return err
+	}
+	tmpLoc := tmp.Name()
+	_ = tmp.Close()
+	defer os.Remove(tmpLoc)
+	if err = c.DriveClient.Download(id, tmpLoc); err != nil {
+		return err
+	}
+
+	src, err := os.Open(tmpLoc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	magic := make([]byte, len(encryptedMagic))
+	if _, err = io.ReadFull(src, magic); err != nil || string(magic) != encryptedMagic {
+		_ = src.Close()
+		return os.Rename(tmpLoc, loc)
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dst, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if err = c.keys.decrypt(dst, src); err != nil {
+		_ = dst.Close()
+		return fmt.Errorf("%v: %v", loc, err)
+	}
+	return dst.Close()
+}
+
+// UploadFolder goes file by file, so every file is encrypted like a single upload.
+func (c *encryptingDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	return uploadFolderOneByOne(c, parentID, name, locs)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const configEnvPrefix = "BGDRIVE_"
+
+// applyEnvOverrides overrides the keys of cfg set in the environment as BGDRIVE_ followed by the upper cased key,
+// e.g. BGDRIVE_SYNC_TARGET_PATH or BGDRIVE_EMAIL_ALERT_SMTP_HOST for nested keys. Strings are taken as is, other
+// values are parsed as yaml, e.g. BGDRIVE_EXCLUDE='["*.tmp", "node_modules/"]'. It reports whether any was set.
+func applyEnvOverrides(cfg *Config) (bool, error) {
+	return applyEnvStruct(reflect.ValueOf(cfg).Elem(), configEnvPrefix)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string) (bool, error) {
+	var applied bool
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		fv := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			ok, err := applyEnvStruct(fv, name+"_")
+			if err != nil {
+				return false, err
+			}
+			applied = applied || ok
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		applied = true
+		if fv.Kind() == reflect.String {
+			fv.SetString(value)
+			continue
+		}
+		if err := yaml.Unmarshal([]byte(value), fv.Addr().Interface()); err != nil {
+			return false, fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return applied, nil
+}
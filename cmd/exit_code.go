@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"net/http"
+)
+
+// Exit codes of the process, so cron jobs and pipelines running "sync --once" can tell what happened.
+const (
+	exitOK = 0
+	// exitFatal: the config couldn't be loaded, drive refused the credentials or a target couldn't be set up
+	exitFatal = 1
+	// exitPartial: the targets were synced but at least one cycle failed partway, what succeeded is kept
+	exitPartial = 2
+	// exitFilesFailed: every cycle completed but some files failed to sync or are quarantined, listed with reason
+	// "failed" or "quarantined" among the skipped paths of the report
+	exitFilesFailed = 3
+	// exitInterrupted: SIGINT or SIGTERM stopped the run after the in-flight operations finished
+	exitInterrupted = 130
+)
+
+// exitError carries the exit code of the error ending the process.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitCode maps the error returned by a command to the exit code of the process.
+func exitCode(err error) int {
+	var ee *exitError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errShutdown):
+		return exitInterrupted
+	case errors.As(err, &ee):
+		return ee.code
+	default:
+		return exitFatal
+	}
+}
+
+// isAuthError reports errors no retry can fix: the oauth token can't be refreshed or drive rejects it.
+func isAuthError(err error) bool {
+	var (
+		retrieveErr *oauth2.RetrieveError
+		apiErr      *googleapi.Error
+	)
+	if errors.As(err, &retrieveErr) {
+		return true
+	}
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
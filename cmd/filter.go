@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	skipReasonFilter   = "filter match"
+	skipReasonTooLarge = "too large"
+)
+
+// loadFilters prepares the path filters configured in cfg. It must run once after the config is loaded.
+func loadFilters(cfg *Config) error {
+	if cfg.FilterFrom != "" {
+		rf, err := loadRcloneFilter(cfg.FilterFrom)
+		if err != nil {
+			return err
+		}
+		cfg.rcloneFilter = rf
+	}
+	for _, p := range cfg.Include {
+		p = path.Clean(strings.Trim(filepath.ToSlash(p), "/"))
+		if p == "." || p == ".." || strings.HasPrefix(p, "../") || filepath.IsAbs(p) {
+			return fmt.Errorf("include: %q is not a path inside the sync target", p)
+		}
+		cfg.includePaths = append(cfg.includePaths, p)
+	}
+	maxFileSize, err := parseByteSize(cfg.MaxFileSize)
+	if err != nil {
+		return fmt.Errorf("max_file_size: %v", err)
+	}
+	cfg.maxFileSize = maxFileSize
+	for _, pattern := range cfg.Exclude {
+		rule, err := parseGDriveIgnoreLine(pattern)
+		if err != nil {
+			return fmt.Errorf("exclude: %v", err)
+		}
+		if rule != nil {
+			cfg.excludeRules = append(cfg.excludeRules, rule)
+		}
+	}
+	return nil
+}
+
+// included reports whether rel is inside one of the include paths, or is a folder leading to one, which the walk
+// has to enter. Without include paths, everything is.
+func included(cfg *Config, rel string, isDir bool) bool {
+	if len(cfg.includePaths) == 0 {
+		return true
+	}
+	for _, p := range cfg.includePaths {
+		if rel == p || strings.HasPrefix(rel, p+"/") || isDir && strings.HasPrefix(p, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether rel matches the exclude patterns, which follow .gdriveignore semantics relative to the
+// sync target: the last matching pattern wins and a leading ! re-includes.
+func excluded(cfg *Config, rel string, isDir bool) (bool, string) {
+	var (
+		ignored bool
+		matched string
+	)
+	for _, rule := range cfg.excludeRules {
+		if rule.dirOnly && !isDir || !rule.re.MatchString(rel) {
+			continue
+		}
+		ignored, matched = !rule.negate, rule.pattern
+	}
+	return ignored, matched
+}
+
+// filterPath decides whether the walk leaves loc out. When it does, the returned SkippedPath carries the reason.
+// gi holds the .gdriveignore rules loaded so far, nil when they don't apply.
+func filterPath(cfg *Config, gi *gdriveIgnore, loc string, info os.FileInfo) (SkippedPath, bool) {
+	rel, err := filepath.Rel(cfg.SyncTargetPath, loc)
+	if err != nil || rel == "." {
+		return SkippedPath{}, false
+	}
+	rel = filepath.ToSlash(rel)
+
+	if routedAway(cfg, rel) {
+		return SkippedPath{Loc: loc, Reason: skipReasonFilter, Detail: "synced by its route"}, true
+	}
+	if cfg.rcloneFilter != nil {
+		if excluded, pattern := cfg.rcloneFilter.excluded(rel, info.IsDir()); excluded {
+			return SkippedPath{Loc: loc, Reason: skipReasonFilter, Detail: "filter-from " + pattern}, true
+		}
+	}
+	if !included(cfg, rel, info.IsDir()) {
+		return SkippedPath{Loc: loc, Reason: skipReasonFilter, Detail: "not in include"}, true
+	}
+	if ignored, pattern := excluded(cfg, rel, info.IsDir()); ignored {
+		return SkippedPath{Loc: loc, Reason: skipReasonFilter, Detail: "exclude " + pattern}, true
+	}
+	if gi != nil {
+		if ignored, rule := gi.ignored(rel, info.IsDir()); ignored {
+			return SkippedPath{Loc: loc, Reason: skipReasonFilter, Detail: rule}, true
+		}
+	}
+	if cfg.SkipHidden && (isHiddenName(info.Name()) || hasHiddenAttr(info)) {
+		return SkippedPath{Loc: loc, Reason: skipReasonFilter, Detail: "skip_hidden"}, true
+	}
+	if !info.IsDir() && cfg.maxFileSize > 0 && info.Size() > cfg.maxFileSize {
+		return SkippedPath{Loc: loc, Reason: skipReasonTooLarge, Detail: fmt.Sprintf("%v, max_file_size %v",
+			getFileSizeFormatted(info.Size()), cfg.MaxFileSize)}, true
+	}
+	return SkippedPath{}, false
+}
+
+// osNoiseNames are files and folders the os or desktop apps leave around which aren't dotfiles.
+var osNoiseNames = map[string]bool{
+	"thumbs.db":                 true,
+	"ehthumbs.db":               true,
+	"desktop.ini":               true,
+	"$recycle.bin":              true,
+	"system volume information": true,
+	"icon\r":                    true,
+}
+
+// isHiddenName reports the names skip_hidden leaves out: dotfiles (.DS_Store, .~lock.*# included), office lock files
+// (~$report.docx) and osNoiseNames.
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~$") || osNoiseNames[strings.ToLower(name)]
+}
+
+// printTooLargeSummary lists the files of report left out by max_file_size, which are easily missed among the other
+// skipped paths of a cycle.
+func printTooLargeSummary(cfg *Config, report *CycleReport) {
+	var locs []string
+	for _, sp := range report.Skipped {
+		if sp.Reason == skipReasonTooLarge {
+			locs = append(locs, strings.TrimPrefix(sp.Loc, cfg.SyncTargetPath))
+		}
+	}
+	if len(locs) == 0 {
+		return
+	}
+	printOp("warning", fmt.Sprintf("%v files over max_file_size %v were not synced", len(locs), cfg.MaxFileSize),
+		strings.Join(locs, ", "))
+}
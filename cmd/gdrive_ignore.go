@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const gdriveIgnoreFileName = ".gdriveignore"
+
+// gdriveIgnoreRule is a single line of a .gdriveignore file.
+type gdriveIgnoreRule struct {
+	negate  bool
+	dirOnly bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// gdriveIgnore holds the rules of every .gdriveignore file met during one walk, keyed by the slash separated
+// directory they live in relative to the sync target ("" for the root). Same as .gitignore, rules are relative to
+// their own directory, deeper files take precedence over shallower ones and within a file the last match wins.
+type gdriveIgnore struct {
+	rules map[string][]*gdriveIgnoreRule
+}
+
+func newGDriveIgnore() *gdriveIgnore {
+	return &gdriveIgnore{rules: map[string][]*gdriveIgnoreRule{}}
+}
+
+// load reads the .gdriveignore file of dir, known as relDir to the matcher. A missing file is not an error.
+func (gi *gdriveIgnore) load(cfg *Config, relDir, dir string) error {
+	f, err := withWalkRetry(cfg, func() (*os.File, error) { return os.Open(longPath(filepath.Join(dir, gdriveIgnoreFileName))) })
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var rules []*gdriveIgnoreRule
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		rule, err := parseGDriveIgnoreLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", filepath.Join(dir, gdriveIgnoreFileName), lineNo, err)
+		}
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(rules) != 0 {
+		gi.rules[relDir] = rules
+	}
+	return nil
+}
+
+func parseGDriveIgnoreLine(line string) (*gdriveIgnoreRule, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	rule := &gdriveIgnoreRule{pattern: line}
+	switch {
+	case strings.HasPrefix(line, "!"):
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, "\\!"), strings.HasPrefix(line, "\\#"):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	re, err := gitignoreGlobToRegexp(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", rule.pattern, err)
+	}
+	rule.re = re
+	return rule, nil
+}
+
+// gitignoreGlobToRegexp converts a .gitignore pattern (trailing slash already removed). A pattern with a slash
+// other than a trailing one is anchored to the directory of its file, otherwise it matches a name at any depth.
+// * and ? don't cross /, "**/", "/**/" and "/**" match across directories.
+func gitignoreGlobToRegexp(pattern string) (*regexp.Regexp, error) {
+	sb := &strings.Builder{}
+	if strings.Contains(pattern, "/") {
+		sb.WriteString("^")
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		sb.WriteString("(^|/)")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			i += 2
+			sb.WriteString("(.*/)?")
+		case pattern[i:] == "**" && i > 0 && pattern[i-1] == '/':
+			i++
+			sb.WriteString(".*")
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// ignored reports whether rel (slash separated, relative to the sync target) is excluded by the .gdriveignore files
+// of its ancestors, and by which rule. Only ancestors already loaded are consulted, which the walk guarantees since
+// it loads every directory's file before descending into it.
+func (gi *gdriveIgnore) ignored(rel string, isDir bool) (bool, string) {
+	var (
+		ignored bool
+		matched string
+	)
+	var dirs []string
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, "")
+	// shallowest first so deeper files override
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		sub := rel
+		if dir != "" {
+			sub = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, rule := range gi.rules[dir] {
+			if rule.dirOnly && !isDir || !rule.re.MatchString(sub) {
+				continue
+			}
+			ignored, matched = !rule.negate, path.Join(dir, gdriveIgnoreFileName)+" "+rule.pattern
+		}
+	}
+	return ignored, matched
+}
+
+// relDirKey turns a directory relative to the sync target into the key used by gdriveIgnore.
+func relDirKey(rel string) string {
+	if rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
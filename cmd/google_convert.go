@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// googleImportTypes maps the extensions of the files drive can convert on upload to the google native type they
+// become.
+var googleImportTypes = map[string]string{
+	".docx": googleNativeMimeTypePrefix + "document",
+	".doc":  googleNativeMimeTypePrefix + "document",
+	".odt":  googleNativeMimeTypePrefix + "document",
+	".rtf":  googleNativeMimeTypePrefix + "document",
+	".txt":  googleNativeMimeTypePrefix + "document",
+	".html": googleNativeMimeTypePrefix + "document",
+	".xlsx": googleNativeMimeTypePrefix + "spreadsheet",
+	".xls":  googleNativeMimeTypePrefix + "spreadsheet",
+	".ods":  googleNativeMimeTypePrefix + "spreadsheet",
+	".csv":  googleNativeMimeTypePrefix + "spreadsheet",
+	".tsv":  googleNativeMimeTypePrefix + "spreadsheet",
+	".pptx": googleNativeMimeTypePrefix + "presentation",
+	".ppt":  googleNativeMimeTypePrefix + "presentation",
+	".odp":  googleNativeMimeTypePrefix + "presentation",
+}
+
+// loadGoogleConvert parses the google_convert patterns of cfg.
+func loadGoogleConvert(cfg *Config) error {
+	for _, pattern := range cfg.GoogleConvert {
+		rule, err := parseGDriveIgnoreLine(pattern)
+		if err != nil {
+			return fmt.Errorf("google_convert: %v", err)
+		}
+		if rule != nil {
+			cfg.convertRules = append(cfg.convertRules, rule)
+		}
+	}
+	return nil
+}
+
+// googleConvertType returns the google native type the file at loc is converted to when uploaded, or false when
+// google_convert doesn't match it or drive can't convert it. Patterns follow the semantics of exclude.
+func googleConvertType(cfg *Config, loc string) (string, bool) {
+	mimeType, ok := googleImportTypes[strings.ToLower(filepath.Ext(loc))]
+	if !ok || len(cfg.convertRules) == 0 {
+		return "", false
+	}
+	rel, err := filepath.Rel(cfg.SyncTargetPath, loc)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	converted := false
+	for _, rule := range cfg.convertRules {
+		if !rule.dirOnly && rule.re.MatchString(rel) {
+			converted = !rule.negate
+		}
+	}
+	return mimeType, converted
+}
+
+// convertedName is the name on drive of the document converted from the file at loc: its base name without the
+// extension, which google_export appends again when pulling it.
+func convertedName(loc string) string {
+	b := filepath.Base(loc)
+	return strings.TrimSuffix(b, filepath.Ext(b))
+}
+
+// remoteName is the name on drive of object, tracked at loc.
+func remoteName(loc string, object *Object) string {
+	if object.Converted {
+		return convertedName(loc)
+	}
+	return filepath.Base(loc)
+}
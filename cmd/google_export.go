@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// googleExportFormats maps the kinds of google native documents to the formats drive can export them to, by file
+// extension.
+var googleExportFormats = map[string]map[string]string{
+	"document": {
+		"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"odt":  "application/vnd.oasis.opendocument.text",
+		"rtf":  "application/rtf",
+		"pdf":  "application/pdf",
+		"txt":  "text/plain",
+		"epub": "application/epub+zip",
+	},
+	"spreadsheet": {
+		"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"ods":  "application/vnd.oasis.opendocument.spreadsheet",
+		"pdf":  "application/pdf",
+		"csv":  "text/csv",
+	},
+	"presentation": {
+		"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"odp":  "application/vnd.oasis.opendocument.presentation",
+		"pdf":  "application/pdf",
+		"txt":  "text/plain",
+	},
+	"drawing": {
+		"png": "image/png",
+		"jpg": "image/jpeg",
+		"svg": "image/svg+xml",
+		"pdf": "application/pdf",
+	},
+}
+
+// validGoogleExport checks that google_export only maps known kinds to formats they can be exported to.
+func validGoogleExport(export map[string]string) error {
+	for kind, ext := range export {
+		formats, ok := googleExportFormats[kind]
+		if !ok {
+			return fmt.Errorf("google_export: unknown kind %q, expected %v", kind, strings.Join(sortedKeys(googleExportFormats), ", "))
+		}
+		if _, ok = formats[strings.ToLower(ext)]; !ok {
+			return fmt.Errorf("google_export: %v can't be exported as %q, expected %v", kind, ext, strings.Join(sortedKeys(formats), ", "))
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// googleExportFormat returns the local name f is exported to and the mime type to export it as, or false when
+// google_export doesn't cover its kind.
+func googleExportFormat(cfg *Config, f *RemoteFile) (string, string, bool) {
+	ext, ok := cfg.GoogleExport[strings.TrimPrefix(f.MimeType, googleNativeMimeTypePrefix)]
+	if !ok {
+		return "", "", false
+	}
+	ext = strings.ToLower(ext)
+	name := f.Name
+	if !strings.HasSuffix(strings.ToLower(name), "."+ext) {
+		name += "." + ext
+	}
+	return name, googleExportFormats[strings.TrimPrefix(f.MimeType, googleNativeMimeTypePrefix)][ext], true
+}
+
+// PullExport exports the google native document f to loc when it is new or changed remotely since the last export.
+// The local copy is read-only as far as syncing goes: local edits and deletions are never pushed to the document.
+func (om *ObjectManager) PullExport(loc, parentID string, f *RemoteFile, mimeType string) (*SkippedPath, error) {
+	object, tracked := om.loadObject(loc)
+	rel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+	remoteMod := remoteModUnix(f)
+	if tracked {
+		if object.GDId != f.ID || !object.Exported {
+			return &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "tracked as another remote file"}, nil
+		}
+		if _, err := os.Stat(longPath(loc)); err == nil && (remoteMod == 0 || remoteMod <= object.RemoteMod) {
+			return nil, nil
+		}
+	} else if _, err := os.Lstat(longPath(loc)); err == nil {
+		return &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "exists locally, not exported from drive"}, nil
+	}
+
+	if om.cfg.DryRun {
+		om.recordOp("exported", loc, f.ID, 0)
+		printOp("exported", rel, f.MimeType)
+		return nil, nil
+	}
+	if !tracked {
+		object = &Object{GDPId: parentID, Exported: true}
+		if !om.storeObject(loc, object) {
+			return nil, nil
+		}
+	}
+	info, err := fetch(loc, f, func(tmpLoc string) error { return om.drive.Export(f.ID, mimeType, tmpLoc) })
+	if err != nil {
+		if !tracked {
+			om.deleteObject(loc)
+		}
+		return nil, err
+	}
+	om.updateStoredObject(object, func(o *Object) {
+		o.GDId = f.ID
+		o.LastMod = info.ModTime().Unix()
+		o.Size = info.Size()
+		o.RemoteMod = remoteMod
+		o.MD5 = ""
+	})
+	om.recordOp("exported", loc, f.ID, info.Size())
+	printOp("exported", rel, getFileSizeFormatted(info.Size()))
+	return nil, nil
+}
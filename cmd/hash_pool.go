@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// hashQueueSize is how many files can wait to be hashed ahead before further ones are left to be hashed on demand.
+const hashQueueSize = 1024
+
+// loadHashWorkers validates hash_workers, defaulting it to the number of cpus.
+func loadHashWorkers(cfg *Config) error {
+	if cfg.HashWorkers < 0 {
+		return errors.New("hash_workers: expected a positive number")
+	}
+	if cfg.HashWorkers == 0 {
+		cfg.HashWorkers = runtime.NumCPU()
+	}
+	return nil
+}
+
+// hashPool hashes local files on hash_workers goroutines of its own, apart from the sync workers. Files about to be
+// uploaded are hashed ahead while they wait for, or go through, their transfer, so the checksum verification following
+// it doesn't hash them behind the network. Hashing on demand is bounded by the same workers.
+type hashPool struct {
+	slots chan struct{}
+	queue chan *pendingSum
+
+	mu   sync.Mutex
+	sums map[string]*pendingSum
+}
+
+// pendingSum is the md5 of a file hashed ahead, valid while the file keeps its size and modification time.
+type pendingSum struct {
+	loc     string
+	size    int64
+	modTime int64
+	done    chan struct{}
+	sum     string
+	err     error
+}
+
+var (
+	hashPoolMu      sync.Mutex
+	processHashPool *hashPool
+)
+
+// sharedHashPool returns the hash pool of the process. Targets share it since they share the cpus and disks.
+func sharedHashPool(cfg *Config) *hashPool {
+	hashPoolMu.Lock()
+	defer hashPoolMu.Unlock()
+	if processHashPool == nil {
+		p := &hashPool{
+			slots: make(chan struct{}, cfg.HashWorkers),
+			queue: make(chan *pendingSum, hashQueueSize),
+			sums:  map[string]*pendingSum{},
+		}
+		for i := 0; i < cfg.HashWorkers; i++ {
+			go p.work()
+		}
+		processHashPool = p
+	}
+	return processHashPool
+}
+
+func (p *hashPool) work() {
+	for ps := range p.queue {
+		ps.sum, ps.err = p.run(func() (string, error) { return md5File(ps.loc) })
+		close(ps.done)
+	}
+}
+
+// run runs the hashing hash once a hash worker is free.
+func (p *hashPool) run(hash func() (string, error)) (string, error) {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	return hash()
+}
+
+// prehash queues the file at loc to be hashed ahead. It doesn't block: when the queue is full, the file is hashed on
+// demand instead.
+func (p *hashPool) prehash(loc string) {
+	info, err := os.Stat(longPath(loc))
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.sums[loc]; ok {
+		return
+	}
+	ps := &pendingSum{loc: loc, size: info.Size(), modTime: info.ModTime().UnixNano(), done: make(chan struct{})}
+	select {
+	case p.queue <- ps:
+		p.sums[loc] = ps
+	default:
+	}
+}
+
+// md5 returns the md5 of the file at loc, waiting for it when the file is being hashed ahead and hashing it on a hash
+// worker otherwise. A sum hashed ahead is only used when the file didn't change since.
+func (p *hashPool) md5(loc string) (string, error) {
+	p.mu.Lock()
+	ps := p.sums[loc]
+	delete(p.sums, loc)
+	p.mu.Unlock()
+	if ps != nil {
+		<-ps.done
+		info, err := os.Stat(longPath(loc))
+		if ps.err == nil && err == nil && info.Size() == ps.size && info.ModTime().UnixNano() == ps.modTime {
+			return ps.sum, nil
+		}
+	}
+	return p.run(func() (string, error) { return md5File(loc) })
+}
+
+// sha256 returns the sha256 of the file at loc, hashed on a hash worker.
+func (p *hashPool) sha256(loc string) (string, error) {
+	return p.run(func() (string, error) { return sha256File(longPath(loc)) })
+}
+
+// sha256All hashes the files at locs on every hash worker at once, returning their sums in the same order.
+func (p *hashPool) sha256All(locs []string) ([]string, error) {
+	sums := make([]string, len(locs))
+	errs := make([]error, len(locs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(p.slots); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				sums[i], errs[i] = p.sha256(locs[i])
+			}
+		}()
+	}
+	for i := range locs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
+
+// forget drops the files hashed ahead and never asked for, such as those whose transfer failed, at the end of a cycle.
+func (p *hashPool) forget(locs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, loc := range locs {
+		delete(p.sums, loc)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthFailedCycles = 1
+	healthAuthCheckInterval   = 10 * time.Minute
+)
+
+// healthStatus is the body of /healthz and the content of health_file.
+type healthStatus struct {
+	Healthy bool           `json:"healthy"`
+	Time    time.Time      `json:"time"`
+	Targets []healthTarget `json:"targets"`
+}
+
+type healthTarget struct {
+	Name       string `json:"name,omitempty"`
+	Healthy    bool   `json:"healthy"`
+	FailStreak int    `json:"failed_cycles_in_a_row"`
+	LastError  string `json:"last_error,omitempty"`
+	AuthError  string `json:"auth_error,omitempty"`
+}
+
+// health tells whether every target of this process is healthy: its last failedCycles cycles did not all fail, and
+// drive did not reject its credentials since they last worked.
+func health(failedCycles int) healthStatus {
+	status := healthStatus{Healthy: true, Time: time.Now(), Targets: []healthTarget{}}
+	for _, s := range allLiveStates() {
+		snap := s.snapshot()
+		t := healthTarget{Name: snap.Name, FailStreak: snap.FailStreak, AuthError: snap.AuthErr}
+		if snap.Last != nil {
+			t.LastError = snap.Last.Err
+		}
+		t.Healthy = snap.FailStreak < failedCycles && snap.AuthErr == ""
+		status.Healthy = status.Healthy && t.Healthy
+		status.Targets = append(status.Targets, t)
+	}
+	return status
+}
+
+func healthFailedCycles(cfg *Config) int {
+	if cfg.HealthFailedCycles <= 0 {
+		return defaultHealthFailedCycles
+	}
+	return cfg.HealthFailedCycles
+}
+
+// handleHealthz answers 200 while healthy and 503 otherwise, for container liveness probes.
+func handleHealthz(failedCycles int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := health(failedCycles)
+		code := http.StatusOK
+		if !status.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+		writeControlJSON(w, code, status)
+	}
+}
+
+var healthFileMu sync.Mutex
+
+// updateHealthFile writes the health status to health_file while healthy and removes it otherwise, so a container
+// healthcheck only has to test that it exists.
+func updateHealthFile(cfg *Config) {
+	if cfg.HealthFile == "" {
+		return
+	}
+	healthFileMu.Lock()
+	defer healthFileMu.Unlock()
+	status := health(healthFailedCycles(cfg))
+	var err error
+	if status.Healthy {
+		var data []byte
+		if data, err = json.MarshalIndent(status, "", "  "); err == nil {
+			err = writeFileAtomic(cfg.HealthFile, data, 0644)
+		}
+	} else if err = os.Remove(cfg.HealthFile); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		fmt.Printf("failed to update health file: %v\n", err)
+	}
+}
+
+// recordCycleHealth updates the auth state of the target of om after a cycle ending with err, and health_file.
+func recordCycleHealth(cfg *Config, om *ObjectManager, err error) {
+	if err == nil || isAuthError(err) {
+		om.live.setAuthErr(err)
+	}
+	updateHealthFile(cfg)
+}
+
+// startHealth serves /healthz on health_addr and, when health_addr or health_file is set, rechecks the credentials
+// of the idle targets every healthAuthCheckInterval so an expired token shows between two cycles. The returned func
+// stops serving.
+func startHealth(cfg *Config, oms []*ObjectManager) (func(), error) {
+	if cfg.HealthAddr == "" && cfg.HealthFile == "" {
+		return func() {}, nil
+	}
+	updateHealthFile(cfg)
+
+	stop := func() {}
+	if cfg.HealthAddr != "" {
+		l, err := net.Listen("tcp", cfg.HealthAddr)
+		if err != nil {
+			return nil, fmt.Errorf("health_addr: %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", handleHealthz(healthFailedCycles(cfg)))
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Printf("health endpoint: %v\n", err)
+			}
+		}()
+		stop = func() { _ = srv.Close() }
+	}
+
+	go func() {
+		for sleepOrShutdown(healthAuthCheckInterval) {
+			for _, om := range oms {
+				if om.live.snapshot().Phase != phaseIdle {
+					continue // the running cycle tells
+				}
+				err := om.CheckAuth()
+				if err == nil || isAuthError(err) {
+					om.live.setAuthErr(err)
+				}
+			}
+			updateHealthFile(cfg)
+		}
+	}()
+	return stop, nil
+}
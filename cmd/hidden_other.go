@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// hasHiddenAttr returns false, outside windows a file is hidden by its name only.
+func hasHiddenAttr(_ os.FileInfo) bool {
+	return false
+}
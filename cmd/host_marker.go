@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	hostConflictCheckWarn  = "warn"
+	hostConflictCheckBlock = "block"
+)
+
+const hostMarkerPrefix = "host-"
+
+// hostMarker is published by every host into the remote metadata folder. It lists the remote objects the host
+// manages so other hosts syncing into the same remote tree can notice overlapping claims.
+type hostMarker struct {
+	Host       string              `json:"host"`
+	TargetPath string              `json:"target_path"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+	Objects    map[string][2]int64 `json:"objects"` // gd id -> [size, last mod]
+}
+
+func hostMarkerFileName(host string) string {
+	return fmt.Sprintf("%v%v.json", hostMarkerPrefix, host)
+}
+
+// PublishHostMarker stores the marker of this host into the remote metadata folder.
+func (om *ObjectManager) PublishHostMarker() error {
+	marker := hostMarker{
+		Host:       hostname(),
+		TargetPath: om.cfg.SyncTargetPath,
+		UpdatedAt:  time.Now(),
+		Objects:    map[string][2]int64{},
+	}
+	om.SnapshotObjects().each(func(_ string, object *Object) {
+		if object.GDId != "" {
+			marker.Objects[object.GDId] = [2]int64{object.Size, object.LastMod}
+		}
+	})
+
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	if err = om.putMetaFile(hostMarkerFileName(marker.Host), data); err != nil {
+		return fmt.Errorf("publish host marker: %v", err)
+	}
+	return nil
+}
+
+// loadOtherHostMarkers downloads the markers published by every host except this one.
+func (om *ObjectManager) loadOtherHostMarkers() ([]*hostMarker, error) {
+	folderID, err := om.metaFolderID()
+	if err != nil {
+		return nil, err
+	}
+	files, err := om.drive.List(folderID, hostMarkerPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	self := hostMarkerFileName(hostname())
+	var markers []*hostMarker
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, hostMarkerPrefix) || f.Name == self {
+			continue
+		}
+		data, err := om.downloadMetaFile(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		marker := &hostMarker{}
+		if err = json.Unmarshal(data, marker); err != nil {
+			return nil, fmt.Errorf("%v: %v", f.Name, err)
+		}
+		markers = append(markers, marker)
+	}
+	return markers, nil
+}
+
+// CheckHostConflicts warns about other hosts claiming remote objects this host manages, and returns the set of
+// remote ids claimed by other hosts so destructive operations on them can be held back.
+func (om *ObjectManager) CheckHostConflicts() (map[string]string, error) {
+	markers, err := om.loadOtherHostMarkers()
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := map[string]string{}
+	objects := om.SnapshotObjects()
+	for _, marker := range markers {
+		shared, diverging := 0, 0
+		for i := range objects {
+			object := &objects[i].object
+			theirs, ok := marker.Objects[object.GDId]
+			if !ok || object.GDId == "" {
+				continue
+			}
+			shared++
+			claimed[object.GDId] = marker.Host
+			if theirs != [2]int64{object.Size, object.LastMod} {
+				diverging++
+			}
+		}
+		if shared == 0 {
+			continue
+		}
+		printOp("warning", fmt.Sprintf("host %v (%v) also syncs %v of the remote objects managed here", marker.Host, marker.TargetPath, shared),
+			fmt.Sprintf("%v diverging, marker updated %v", diverging, marker.UpdatedAt.Format(time.DateTime)))
+	}
+	return claimed, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+const initConfigTemplate = `# written by bgdrive-sync init, see config.yaml.example for every setting
+gd_account_name: %q
+gd_root_folder_id: %q
+drive_client: %q
+
+sync_target_path: %q
+sync_delay_minute: %v
+sync_worker: %v
+sync_retry: %v
+sync_direction: %q
+`
+
+func newInitCmd(cf *configFlags) *cobra.Command {
+	var force, fromRemote bool
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Write a config.yaml (or --config) from the given flags, asking for the account and target path when missing",
+		Long: "Write a config.yaml (or --config) from the given flags, asking for the account and target path when missing.\n" +
+			"With --from-remote, the remote root is then listed and what already matches the local tree is tracked, so the\n" +
+			"first sync doesn't upload it again. An existing config is used as is unless --force is given.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			filePath := defaultConfigPath
+			if cf.config != "" {
+				filePath = cf.config
+			}
+			if _, err := os.Stat(filePath); err != nil || force || !fromRemote {
+				if err = initConfig(filePath, cf, force); err != nil {
+					return err
+				}
+			}
+			if !fromRemote {
+				return nil
+			}
+
+			cf.config = filePath
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			for _, tcfg := range targets {
+				om, err := NewObjectManager(tcfg)
+				if err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+				if err = adoptRemote(tcfg, om); err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite an existing config.yaml")
+	cmd.Flags().BoolVar(&fromRemote, "from-remote", false, "track the files already on drive that match the local ones instead of uploading them again")
+	return cmd
+}
+
+func initConfig(filePath string, cf *configFlags, force bool) error {
+	if _, err := os.Stat(filePath); err == nil && !force {
+		return fmt.Errorf("%v already exists, use --force to overwrite it", filePath)
+	}
+
+	cfg := &Config{DriveClient: driveClientGDrive, SyncDelayMinute: 300, SyncWorker: 50, SyncRetry: 5, SyncDirection: syncDirectionPush}
+	cf.apply(cfg)
+
+	var err error
+	if cfg.GDAccountName == "" && cfg.DriveClient == driveClientGDrive {
+		if cfg.GDAccountName, err = askValue("gdrive account (see gdrive account list)"); err != nil {
+			return err
+		}
+	}
+	if cfg.SyncTargetPath == "" {
+		if cfg.SyncTargetPath, err = askValue("local folder to sync"); err != nil {
+			return err
+		}
+	}
+
+	data := fmt.Sprintf(initConfigTemplate, cfg.GDAccountName, cfg.GDRootFolderID, cfg.DriveClient,
+		cfg.SyncTargetPath, cfg.SyncDelayMinute, cfg.SyncWorker, cfg.SyncRetry, cfg.SyncDirection)
+	if err = os.WriteFile(filePath, []byte(data), 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %v\n", filePath)
+	return nil
+}
+
+// askValue reads a required value from the terminal.
+func askValue(question string) (string, error) {
+	if !isInteractive() {
+		return "", fmt.Errorf("%v is required, pass it as a flag", question)
+	}
+	for {
+		fmt.Printf("%v: ", question)
+		line, err := stdinReader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if v := strings.TrimSpace(line); v != "" {
+			return v, nil
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// fileInode returns 0, os.FileInfo carries no file index on windows so renames are synced as delete + upload.
+func fileInode(_ os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errInstanceLocked is returned by lockFile when another process holds the lock.
+var errInstanceLocked = errors.New("locked by another process")
+
+var (
+	instanceLocksMu sync.Mutex
+	instanceLocks   = map[string]*os.File{} // held until the process exits
+)
+
+// acquireInstanceLock makes sure this is the only process syncing the state of cfg, by locking object_map.json.lock
+// (per target) next to its object map. It fails when another bgdrive-sync holds the lock, which the os releases when
+// that process exits, even after a crash.
+func acquireInstanceLock(cfg *Config) error {
+	path := cfg.statePath("object_map.json") + ".lock"
+	instanceLocksMu.Lock()
+	defer instanceLocksMu.Unlock()
+	if _, ok := instanceLocks[path]; ok {
+		return nil
+	}
+
+	f, err := lockFile(path)
+	if errors.Is(err, errInstanceLocked) {
+		holder := "another bgdrive-sync"
+		if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) != "" {
+			holder += " (pid " + strings.TrimSpace(string(data)) + ")"
+		}
+		return fmt.Errorf("%v is locked by %v syncing the same target, stop it first", path, holder)
+	}
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	instanceLocks[path] = f
+	return nil
+}
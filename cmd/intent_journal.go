@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// intent journal ops: the remote changes recorded before they are issued.
+const (
+	intentMkdir  = "mkdir"
+	intentUpload = "upload"
+	intentUpdate = "update"
+	intentMove   = "move"
+	intentDelete = "delete"
+	intentTrash  = "trash"
+)
+
+// intentRecord is one line of the intent journal: an operation about to be issued to drive, or with Done, the
+// outcome of the operation of the same Seq.
+type intentRecord struct {
+	Seq       int64  `json:"seq"`
+	Op        string `json:"op,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+	NewParent string `json:"new_parent,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Done      bool   `json:"done,omitempty"`
+	Failed    bool   `json:"failed,omitempty"`
+}
+
+// intentJournal is a write-ahead log of the remote operations issued since the object map was last saved. An intent
+// is synced to disk before its operation starts, so after a crash the journal tells which remote changes the saved
+// object map may not know about.
+type intentJournal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	seq     int64
+	records []intentRecord
+	pending map[int64]bool
+	// leftover holds the records found when the journal was opened, written by a process which didn't save its state
+	leftover []intentRecord
+}
+
+func openIntentJournal(path string) (*intentJournal, error) {
+	leftover, err := readIntentJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j := &intentJournal{path: path, f: f, records: leftover, pending: map[int64]bool{}, leftover: leftover}
+	for _, r := range leftover {
+		j.seq = max(j.seq, r.Seq)
+	}
+	return j, nil
+}
+
+func readIntentJournal(path string) ([]intentRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []intentRecord
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var r intentRecord
+		if err = json.Unmarshal(sc.Bytes(), &r); err != nil {
+			break // torn by the crash, nothing after it was synced
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// begin records the intent r and syncs it to disk, returning its seq.
+func (j *intentJournal) begin(r intentRecord) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	r.Seq = j.seq
+	if err := j.append(r); err != nil {
+		return 0, fmt.Errorf("intent journal: %w", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return 0, fmt.Errorf("intent journal: %w", err)
+	}
+	j.pending[r.Seq] = true
+	return r.Seq, nil
+}
+
+// end records the outcome of the intent seq. id is the id of the object it created, if any.
+func (j *intentJournal) end(seq int64, id string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.pending, seq)
+	_ = j.append(intentRecord{Seq: seq, ID: id, Done: true, Failed: err != nil})
+}
+
+func (j *intentJournal) append(r intentRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.records = append(j.records, r)
+	return nil
+}
+
+// mark returns the last seq and the intents still in flight, to be passed to compact once the object map as of now
+// is saved.
+func (j *intentJournal) mark() (int64, map[int64]bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	inFlight := make(map[int64]bool, len(j.pending))
+	for seq := range j.pending {
+		inFlight[seq] = true
+	}
+	return j.seq, inFlight
+}
+
+// snapshot returns the records of the journal, those the saved object map doesn't reflect yet.
+func (j *intentJournal) snapshot() []intentRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]intentRecord(nil), j.records...)
+}
+
+// adoptLeftover replaces the leftover of the journal with records, restored along with the object map they go with.
+func (j *intentJournal) adoptLeftover(records []intentRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.leftover = records
+}
+
+// compact drops the intents finished before the object map was saved at mark, which it now reflects.
+func (j *intentJournal) compact(seq int64, inFlight map[int64]bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var (
+		kept []intentRecord
+		buf  bytes.Buffer
+	)
+	for _, r := range j.records {
+		if r.Seq <= seq && !inFlight[r.Seq] {
+			continue
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+		kept = append(kept, r)
+	}
+	if len(kept) == len(j.records) {
+		return nil
+	}
+	if err := writeFileAtomic(j.path, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_ = j.f.Close()
+	j.f, j.records = f, kept
+	return nil
+}
+
+// journalingDriveClient records every remote change in the intent journal before issuing it.
+type journalingDriveClient struct {
+	DriveClient
+	journal *intentJournal
+}
+
+func (c *journalingDriveClient) Mkdir(parentID, name string) (string, error) {
+	seq, err := c.journal.begin(intentRecord{Op: intentMkdir, Parent: parentID, Name: name})
+	if err != nil {
+		return "", err
+	}
+	id, err := c.DriveClient.Mkdir(parentID, name)
+	c.journal.end(seq, id, err)
+	return id, err
+}
+
+func (c *journalingDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	seq, err := c.journal.begin(intentRecord{Op: intentUpload, Parent: parentID, Name: filepath.Base(loc)})
+	if err != nil {
+		return nil, err
+	}
+	rf, err := c.DriveClient.Upload(parentID, loc)
+	var id string
+	if rf != nil {
+		id = rf.ID
+	}
+	c.journal.end(seq, id, err)
+	return rf, err
+}
+
+func (c *journalingDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	seq, err := c.journal.begin(intentRecord{Op: intentUpdate, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	rf, err := c.DriveClient.Update(id, loc)
+	c.journal.end(seq, "", err)
+	return rf, err
+}
+
+func (c *journalingDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	intent := intentRecord{Op: intentUpload, Parent: parentID, Name: convertedName(loc)}
+	if id != "" {
+		intent = intentRecord{Op: intentUpdate, ID: id}
+	}
+	seq, err := c.journal.begin(intent)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := c.DriveClient.Import(parentID, id, loc, mimeType)
+	var createdID string
+	if rf != nil && id == "" {
+		createdID = rf.ID
+	}
+	c.journal.end(seq, createdID, err)
+	return rf, err
+}
+
+// UploadFolder records the batch as the mkdir of the folder followed by the uploads of its files, like the same
+// operations issued one by one.
+func (c *journalingDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	seq, err := c.journal.begin(intentRecord{Op: intentMkdir, Parent: parentID, Name: name})
+	if err != nil {
+		return "", nil, err
+	}
+	id, files, err := c.DriveClient.UploadFolder(parentID, name, locs)
+	c.journal.end(seq, id, err)
+	if err != nil {
+		return "", nil, err
+	}
+	for i, f := range files {
+		// done already, a file missing from the journal is at worst uploaded again after a crash
+		if seq, err := c.journal.begin(intentRecord{Op: intentUpload, Parent: id, Name: filepath.Base(locs[i])}); err == nil {
+			c.journal.end(seq, f.ID, nil)
+		}
+	}
+	return id, files, nil
+}
+
+func (c *journalingDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	seq, err := c.journal.begin(intentRecord{Op: intentUpload, Parent: parentID, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	rf, err := c.DriveClient.Copy(id, parentID, name)
+	var copiedID string
+	if rf != nil {
+		copiedID = rf.ID
+	}
+	c.journal.end(seq, copiedID, err)
+	return rf, err
+}
+
+func (c *journalingDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	seq, err := c.journal.begin(intentRecord{Op: intentMove, ID: id, Parent: oldParentID, NewParent: newParentID, Name: name})
+	if err != nil {
+		return err
+	}
+	err = c.DriveClient.Move(id, oldParentID, newParentID, name)
+	c.journal.end(seq, "", err)
+	return err
+}
+
+func (c *journalingDriveClient) Delete(id string) error {
+	seq, err := c.journal.begin(intentRecord{Op: intentDelete, ID: id})
+	if err != nil {
+		return err
+	}
+	err = c.DriveClient.Delete(id)
+	c.journal.end(seq, "", err)
+	return err
+}
+
+func (c *journalingDriveClient) Trash(id string) error {
+	seq, err := c.journal.begin(intentRecord{Op: intentTrash, ID: id})
+	if err != nil {
+		return err
+	}
+	err = c.DriveClient.Trash(id)
+	c.journal.end(seq, "", err)
+	return err
+}
+
+// replayIntentJournal brings the object map up to date with the remote changes a crashed process issued after it
+// last saved it, checking drive for the ones whose outcome wasn't recorded. Creations are left locked for
+// recoverStaleLocks to adopt or purge, so it must run right before it.
+func (om *ObjectManager) replayIntentJournal() error {
+	if om.journal == nil || len(om.journal.leftover) == 0 {
+		return nil
+	}
+	outcomes := map[int64]intentRecord{}
+	var intents []intentRecord
+	for _, r := range om.journal.leftover {
+		if r.Done {
+			outcomes[r.Seq] = r
+		} else {
+			intents = append(intents, r)
+		}
+	}
+	sort.Slice(intents, func(i, k int) bool { return intents[i].Seq < intents[k].Seq })
+
+	// the intents refer to drive ids, kept mapped to their location as the intents are applied
+	locByID := map[string]string{om.rootID(): om.cfg.SyncTargetPath}
+	om.SnapshotObjects().each(func(loc string, object *Object) {
+		if object.GDId != "" {
+			locByID[object.GDId] = loc
+		}
+	})
+	for _, intent := range intents {
+		outcome, done := outcomes[intent.Seq]
+		if done && outcome.Failed {
+			continue // drive refused it, nothing changed
+		}
+		if err := om.replayIntent(intent, done, locByID); err != nil {
+			return err
+		}
+	}
+	om.journal.leftover = nil
+	return om.SaveToFile()
+}
+
+// replayIntent applies intent to the object map, locByID mapping the drive ids of the tracked objects to their
+// location, and keeps locByID up to date with it.
+func (om *ObjectManager) replayIntent(intent intentRecord, done bool, locByID map[string]string) error {
+	rel := func(loc string) string {
+		return strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+	}
+
+	switch intent.Op {
+	case intentMkdir, intentUpload:
+		parentLoc, ok := locByID[intent.Parent]
+		if !ok || (parentLoc == om.cfg.SyncTargetPath && isRemoteMetaName(intent.Name)) {
+			return nil // the remote metadata folder or something in it, or a parent forgotten since
+		}
+		loc := filepath.Join(parentLoc, intent.Name)
+		if object, tracked := om.loadObject(loc); tracked && object.GDId != "" {
+			return nil
+		}
+		om.storeObject(loc, &Object{GDPId: intent.Parent})
+
+	case intentUpdate:
+		loc, ok := locByID[intent.ID]
+		if !ok || done {
+			return nil
+		}
+		// the content on drive is unknown, send it again
+		object, _ := om.loadObject(loc)
+		om.updateStoredObject(object, func(o *Object) { o.LastMod, o.Size, o.MD5 = 1, -1, "" })
+		printOp("replayed", rel(loc), "interrupted update, updated again by the next sync")
+
+	case intentMove:
+		loc, ok := locByID[intent.ID]
+		newParentLoc, newParentOK := locByID[intent.NewParent]
+		if !ok || !newParentOK {
+			return nil
+		}
+		if !done {
+			found, err := remoteChildExists(om.drive, intent.NewParent, intent.Name, intent.ID)
+			if err != nil || !found {
+				return err
+			}
+		}
+		newLoc := filepath.Join(newParentLoc, intent.Name)
+		if newLoc == loc {
+			return nil
+		}
+		if object, tracked := om.loadObject(newLoc); tracked && object.GDId == "" {
+			om.deleteObject(newLoc) // the placeholder the move was going to fill
+		}
+		for movedLoc, object := range om.rekeyObjects(loc, newLoc) {
+			if movedLoc == newLoc {
+				om.updateStoredObject(object, func(o *Object) { o.GDPId = intent.NewParent })
+			}
+			if object.GDId != "" {
+				locByID[object.GDId] = movedLoc
+			}
+		}
+		printOp("replayed", rel(newLoc), "interrupted move from "+rel(loc))
+
+	case intentDelete, intentTrash:
+		loc, ok := locByID[intent.ID]
+		if !ok {
+			return nil
+		}
+		if !done {
+			object, _ := om.loadObject(loc)
+			found, err := remoteChildExists(om.drive, object.GDPId, filepath.Base(loc), intent.ID)
+			if err != nil || found {
+				return err // still on drive, deleted again by the next sync
+			}
+		}
+		for oldLoc, object := range om.objectsBelow(loc) {
+			om.deleteObject(oldLoc)
+			delete(locByID, object.GDId)
+		}
+		printOp("replayed", rel(loc), "interrupted "+intent.Op+", forgotten")
+	}
+	return nil
+}
+
+// remoteChildExists reports whether parentID has a child called name of the given id.
+func remoteChildExists(drive DriveClient, parentID, name, id string) (bool, error) {
+	files, err := drive.List(parentID, name)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		if f.ID == id && f.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
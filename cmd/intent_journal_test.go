@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayIntentJournalChained(t *testing.T) {
+	cfg := newTestTarget(t)
+	now := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "docs/a.txt", "a", now)
+	writeTestFile(t, cfg, "docs/b.txt", "b", now)
+	writeTestFile(t, cfg, "archive/c.txt", "c", now)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	loc := func(rel string) string { return filepath.Join(cfg.SyncTargetPath, filepath.FromSlash(rel)) }
+	docs, _ := om.loadObject(loc("docs"))
+	archive, _ := om.loadObject(loc("archive"))
+	b, _ := om.loadObject(loc("docs/b.txt"))
+
+	// docs moved into archive, then b.txt deleted there, both done on drive before the crash
+	om.journal.leftover = []intentRecord{
+		{Seq: 1, Op: intentMove, ID: docs.GDId, Parent: docs.GDPId, NewParent: archive.GDId, Name: "docs"},
+		{Seq: 1, Done: true},
+		{Seq: 2, Op: intentDelete, ID: b.GDId},
+		{Seq: 2, Done: true},
+	}
+	if err := om.replayIntentJournal(); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]bool{
+		"docs":               false,
+		"docs/a.txt":         false,
+		"archive/docs":       true,
+		"archive/docs/a.txt": true,
+		"archive/docs/b.txt": false,
+		"archive/c.txt":      true,
+	} {
+		if _, ok := om.loadObject(loc(rel)); ok != want {
+			t.Errorf("%v tracked after the replay: %v, want %v", rel, ok, want)
+		}
+	}
+	if moved, _ := om.loadObject(loc("archive/docs")); moved.GDPId != archive.GDId {
+		t.Errorf("moved docs has parent %v, want %v", moved.GDPId, archive.GDId)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of a sync cycle, as shown by the dashboard.
+const (
+	phaseIdle      = "idle"
+	phasePulling   = "pulling"
+	phaseWalking   = "walking"
+	phaseSyncing   = "syncing"
+	phaseDeleting  = "deleting"
+	phaseSaving    = "saving"
+	phasePaused    = "paused" // in a cycle held by a pause
+	liveRecentSize = 50
+)
+
+// inFlightOp is a drive operation currently running.
+type inFlightOp struct {
+	Op    string    `json:"op"`
+	Loc   string    `json:"loc"`
+	Start time.Time `json:"start"`
+}
+
+// targetState is the live state of one target of this process, updated by the sync engine and read by the
+// dashboard and the control API, which can also request a sync or pause the target through it. Unlike the cycle
+// report, it is never persisted.
+type targetState struct {
+	mu            sync.Mutex
+	name          string
+	phase         string
+	queued        atomic.Int64
+	inFlight      map[int64]inFlightOp
+	nextOpID      int64
+	recent        []Operation
+	cycles        int
+	failures      int
+	failStreak    int
+	fileFailures  map[string]int
+	fileAlerts    []string
+	last          *CycleReport
+	next          time.Time
+	touched       time.Time
+	authErr       string
+	reloaded      *Config
+	paused        bool
+	syncRequested bool
+	cycleForced   bool
+	wake          chan struct{}
+}
+
+var (
+	liveStatesMu = &sync.Mutex{}
+	liveStates   = map[string]*targetState{}
+	processStart = time.Now()
+)
+
+// liveState returns the live state of the target of cfg.
+func liveState(cfg *Config) *targetState {
+	liveStatesMu.Lock()
+	defer liveStatesMu.Unlock()
+	s, ok := liveStates[cfg.targetName]
+	if !ok {
+		s = &targetState{name: cfg.targetName, phase: phaseIdle, inFlight: map[int64]inFlightOp{}, wake: make(chan struct{}, 1),
+			fileFailures: map[string]int{}}
+		liveStates[cfg.targetName] = s
+	}
+	return s
+}
+
+// allLiveStates returns the live state of every target, sorted by name.
+func allLiveStates() []*targetState {
+	liveStatesMu.Lock()
+	defer liveStatesMu.Unlock()
+	states := make([]*targetState, 0, len(liveStates))
+	for _, s := range liveStates {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].name < states[j].name })
+	return states
+}
+
+func (s *targetState) setPhase(phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phase
+	s.touched = time.Now()
+}
+
+// stalled reports a target busy in a cycle without any progress (phase change, drive operation starting or
+// ending) for d. A cycle held by a pause is waiting on purpose, not stalled.
+func (s *targetState) stalled(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase != phaseIdle && s.phase != phasePaused && time.Since(s.touched) > d
+}
+
+// pauseCycle moves the running cycle to phasePaused and returns the func moving it back to the phase it was in.
+func (s *targetState) pauseCycle() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	phase := s.phase
+	s.phase = phasePaused
+	s.touched = time.Now()
+	return func() { s.setPhase(phase) }
+}
+
+func (s *targetState) label() string {
+	if s.name == "" {
+		return ""
+	}
+	return "[" + s.name + "] "
+}
+
+func (s *targetState) setNext(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = next
+}
+
+// start registers a running drive operation and returns the func ending it.
+func (s *targetState) start(op, loc string) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextOpID++
+	id := s.nextOpID
+	s.touched = time.Now()
+	s.inFlight[id] = inFlightOp{Op: op, Loc: loc, Start: s.touched}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.inFlight, id)
+		s.touched = time.Now()
+	}
+}
+
+func (s *targetState) addRecent(op Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = append(s.recent, op)
+	if len(s.recent) > liveRecentSize {
+		s.recent = s.recent[len(s.recent)-liveRecentSize:]
+	}
+}
+
+// finishCycle records the finished report of a cycle and returns the target to idle.
+func (s *targetState) finishCycle(report *CycleReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phaseIdle
+	s.queued.Store(0)
+	s.cycles++
+	s.last = report
+	s.cycleForced = false
+	s.failStreak = 0
+	if report.Failed() {
+		s.failures++
+		s.failStreak++
+	}
+}
+
+// fileFailed counts a failed sync of loc. Once loc failed alertAfter times without syncing in between, it is
+// returned by the next takeFileAlerts.
+func (s *targetState) fileFailed(loc string, alertAfter int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fileFailures[loc]++
+	if s.fileFailures[loc] == alertAfter {
+		s.fileAlerts = append(s.fileAlerts, loc)
+	}
+}
+
+func (s *targetState) fileSynced(loc string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.fileFailures, loc)
+}
+
+func (s *targetState) takeFileAlerts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	alerts := s.fileAlerts
+	s.fileAlerts = nil
+	return alerts
+}
+
+// setAuthErr records whether drive accepted the credentials of the target last time it was asked.
+func (s *targetState) setAuthErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authErr = ""
+	if err != nil {
+		s.authErr = err.Error()
+	}
+}
+
+// reload hands the target the config it was reloaded with, applied before its next cycle.
+func (s *targetState) reload(cfg *Config) {
+	s.mu.Lock()
+	s.reloaded = cfg
+	s.mu.Unlock()
+	s.poke()
+}
+
+func (s *targetState) takeReload() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg := s.reloaded
+	s.reloaded = nil
+	return cfg
+}
+
+func (s *targetState) hasReload() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reloaded != nil
+}
+
+// lastCycleEnd returns when the last cycle ended, or now when there was none yet.
+func (s *targetState) lastCycleEnd() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return time.Now()
+	}
+	return s.last.End
+}
+
+// requestSync makes the target sync right away, even while paused.
+func (s *targetState) requestSync() {
+	s.mu.Lock()
+	s.syncRequested = true
+	s.mu.Unlock()
+	s.poke()
+}
+
+// setPaused pauses or resumes the syncs of the target. A cycle already running stops scheduling operations until
+// the resume, see ObjectManager.waitWhilePaused.
+func (s *targetState) setPaused(paused bool) {
+	s.mu.Lock()
+	s.paused = paused
+	if paused {
+		s.cycleForced = false
+	}
+	s.mu.Unlock()
+	s.poke()
+}
+
+func (s *targetState) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// takeSyncRequest reports whether a sync was requested since the last call. The cycle it starts runs through a
+// pause which was already on.
+func (s *targetState) takeSyncRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requested := s.syncRequested
+	s.syncRequested = false
+	if requested {
+		s.cycleForced = true
+	}
+	return requested
+}
+
+// holding reports whether the running cycle has to wait for the resume before its next operation.
+func (s *targetState) holding() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused && !s.cycleForced
+}
+
+func (s *targetState) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// waitNext blocks until next unless a sync is requested or the config reloaded sooner. While paused, a due sync
+// waits for the resume. It reports false when cut short by a shutdown.
+func (s *targetState) waitNext(next time.Time) bool {
+	for {
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-shutdown:
+			t.Stop()
+			return false
+		case <-s.wake:
+			t.Stop()
+		case <-t.C:
+		}
+		if s.hasReload() || s.takeSyncRequest() || (!s.isPaused() && !time.Now().Before(next)) {
+			return true
+		}
+	}
+}
+
+// targetSnapshot is a consistent copy of a targetState.
+type targetSnapshot struct {
+	Name       string
+	Phase      string
+	Queued     int64
+	InFlight   []inFlightOp
+	Recent     []Operation
+	Cycles     int
+	Failures   int
+	FailStreak int
+	Last       *CycleReport
+	AuthErr    string
+	Next       time.Time
+	Paused     bool
+}
+
+func (s *targetState) snapshot() targetSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := targetSnapshot{Name: s.name, Phase: s.phase, Queued: s.queued.Load(), Recent: append([]Operation{}, s.recent...),
+		Cycles: s.cycles, Failures: s.failures, FailStreak: s.failStreak, Last: s.last, AuthErr: s.authErr, Next: s.next, Paused: s.paused}
+	for _, op := range s.inFlight {
+		snap.InFlight = append(snap.InFlight, op)
+	}
+	sort.Slice(snap.InFlight, func(i, j int) bool { return snap.InFlight[i].Start.Before(snap.InFlight[j].Start) })
+	return snap
+}
+
+// liveDriveClient registers every call of a DriveClient changing drive or transferring content as in flight.
+type liveDriveClient struct {
+	DriveClient
+	state *targetState
+}
+
+func (c *liveDriveClient) Mkdir(parentID, name string) (string, error) {
+	defer c.state.start("mkdir", name)()
+	return c.DriveClient.Mkdir(parentID, name)
+}
+
+func (c *liveDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	defer c.state.start("upload", loc)()
+	return c.DriveClient.Upload(parentID, loc)
+}
+
+func (c *liveDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	defer c.state.start("update", loc)()
+	return c.DriveClient.Update(id, loc)
+}
+
+func (c *liveDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	defer c.state.start("import", loc)()
+	return c.DriveClient.Import(parentID, id, loc, mimeType)
+}
+
+func (c *liveDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	defer c.state.start("copy", name)()
+	return c.DriveClient.Copy(id, parentID, name)
+}
+
+func (c *liveDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	defer c.state.start("upload folder", name)()
+	return c.DriveClient.UploadFolder(parentID, name, locs)
+}
+
+func (c *liveDriveClient) Share(id, email, role string) error {
+	defer c.state.start("share", id)()
+	return c.DriveClient.Share(id, email, role)
+}
+
+func (c *liveDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	defer c.state.start("move", name)()
+	return c.DriveClient.Move(id, oldParentID, newParentID, name)
+}
+
+func (c *liveDriveClient) Delete(id string) error {
+	defer c.state.start("delete", id)()
+	return c.DriveClient.Delete(id)
+}
+
+func (c *liveDriveClient) Trash(id string) error {
+	defer c.state.start("trash", id)()
+	return c.DriveClient.Trash(id)
+}
+
+func (c *liveDriveClient) Download(id, loc string) error {
+	defer c.state.start("download", loc)()
+	return c.DriveClient.Download(id, loc)
+}
+
+func (c *liveDriveClient) Export(id, mimeType, loc string) error {
+	defer c.state.start("export", loc)()
+	return c.DriveClient.Export(id, mimeType, loc)
+}
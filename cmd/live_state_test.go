@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStalledWhilePaused(t *testing.T) {
+	s := &targetState{phase: phaseIdle}
+	s.setPhase(phaseSyncing)
+	s.touched = time.Now().Add(-time.Hour)
+	if !s.stalled(time.Minute) {
+		t.Fatal("a cycle without progress for an hour is not stalled")
+	}
+
+	resume := s.pauseCycle()
+	s.touched = time.Now().Add(-time.Hour)
+	if s.stalled(time.Minute) {
+		t.Error("a cycle paused for an hour is stalled")
+	}
+	resume()
+	if s.phase != phaseSyncing || s.stalled(time.Minute) {
+		t.Errorf("resumed cycle in phase %v, stalled %v, want syncing again and not stalled", s.phase, s.stalled(time.Minute))
+	}
+}
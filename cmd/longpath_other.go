@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+func longPath(p string) string {
+	return p
+}
+
+func stripLongPathPrefix(p string) string {
+	return p
+}
@@ -0,0 +1,36 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxShortPath is the longest path the classic win32 api accepts for directories (MAX_PATH minus 8.3 file name).
+const maxShortPath = 248
+
+// longPath returns p in its extended-length form (\\?\C:\... or \\?\UNC\server\share\...) when it is too long for
+// the classic win32 api, so deep trees can still be stat-ed, listed and opened.
+func longPath(p string) string {
+	if len(p) < maxShortPath || strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + strings.TrimPrefix(abs, `\\`)
+	}
+	return `\\?\` + abs
+}
+
+// stripLongPathPrefix turns an extended-length path back into its regular form. Object map keys never carry the
+// prefix so the same file always maps to the same key.
+func stripLongPathPrefix(p string) string {
+	if strings.HasPrefix(p, `\\?\UNC\`) {
+		return `\\` + strings.TrimPrefix(p, `\\?\UNC\`)
+	}
+	return strings.TrimPrefix(p, `\\?\`)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/bearaujus/bworker/pool"
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v2"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,56 +19,578 @@ type (
 	Config struct {
 		GDAccountName  string `yaml:"gd_account_name"`
 		GDRootFolderID string `yaml:"gd_root_folder_id"`
+		GDDriveID      string `yaml:"gd_drive_id"`
+		// GDRootFolderName is created on the first sync when GDRootFolderID is empty, e.g. "backups/{hostname}", and
+		// synced into from then on
+		GDRootFolderName string `yaml:"gd_root_folder_name"`
+		// GDRootPath is the remote root by its path in my drive, e.g. "Backups/laptop", looked up and created if missing
+		// at the start of every sync instead of GDRootFolderID
+		GDRootPath string `yaml:"gd_root_path"`
 
-		SyncTargetPath  string `yaml:"sync_target_path"`
-		SyncDelayMinute int    `yaml:"sync_delay_minute"`
-		SyncWorker      int    `yaml:"sync_worker"`
-		SyncRetry       int    `yaml:"sync_retry"`
+		GDFallbackAccounts []FallbackAccount `yaml:"gd_fallback_accounts"`
+
+		SyncTargetPath     string `yaml:"sync_target_path"`
+		SyncDelayMinute    int    `yaml:"sync_delay_minute"`
+		Schedule           string `yaml:"schedule"`
+		schedule           cron.Schedule
+		SyncWorker         int    `yaml:"sync_worker"`
+		SyncWorkerMin      int    `yaml:"sync_worker_min"`
+		SyncWorkerMax      int    `yaml:"sync_worker_max"`
+		SmallFileThreshold string `yaml:"small_file_threshold"`
+		smallFileThreshold int64
+		HashWorkers        int    `yaml:"hash_workers"`
+		SyncRetry          int    `yaml:"sync_retry"`
+		SyncDirection      string `yaml:"sync_direction"`
+		RemoteChanges      bool   `yaml:"remote_changes"`
+		RemoteMoves        string `yaml:"remote_moves"`
+		RemoteSnapshots    bool   `yaml:"remote_snapshots"`
+		DryRun             bool   `yaml:"dry_run"`
+
+		SnapshotRetention RetentionPolicy `yaml:"snapshot_retention"`
+
+		GoogleExport  map[string]string `yaml:"google_export"`
+		GoogleConvert []string          `yaml:"google_convert"`
+		convertRules  []*gdriveIgnoreRule
+
+		Sharing []SharingConfig `yaml:"sharing"`
+
+		EncryptionKeyFile string `yaml:"encryption_key_file"`
+		EncryptNames      bool   `yaml:"encrypt_names"`
+		encryption        *encryptionKeys
+		Compress          []string `yaml:"compress"`
+		Dedup             bool     `yaml:"dedup"`
+		DeltaMinSize      string   `yaml:"delta_min_size"`
+		DeltaBlockSize    string   `yaml:"delta_block_size"`
+		deltaMinSize      int64
+		deltaBlockSize    int64
+		compressExts      map[string]bool
+
+		Targets    []TargetConfig `yaml:"targets"`
+		targetName string
+		Routes     []RouteConfig `yaml:"routes"`
+		// routedPaths are the paths of the routes of the target, slash separated, which it leaves out
+		routedPaths []string
+		// routePath is the path of the route this target syncs inside the target it belongs to, empty for a target
+		routePath string
+		// restoreAt has the api drive client download the revisions files had at that time, set by restore --at
+		restoreAt time.Time
+		// interactive is set for the one-shot runs of sync on a terminal, whose cycles ask the user about conflicts and
+		// deletions past delete_confirm_threshold. Other runs never read stdin
+		interactive bool
+
+		WatchMode            bool `yaml:"watch_mode"`
+		WatchDebounceSeconds int  `yaml:"watch_debounce_seconds"`
+		ConfigWatch          bool `yaml:"config_watch"`
+
+		DailyUploadCap string `yaml:"daily_upload_cap"`
+
+		MaxUploadRate   string  `yaml:"max_upload_rate"`
+		MaxDownloadRate string  `yaml:"max_download_rate"`
+		MaxDriveQPS     float64 `yaml:"max_drive_qps"`
+
+		// Proxy is the http(s) or socks5 proxy url drive is reached through, with its credentials when it asks for any
+		Proxy    string `yaml:"proxy"`
+		proxyURL *url.URL
+
+		ProgressIntervalSeconds int `yaml:"progress_interval_seconds"`
+
+		ControlAPIAddr string `yaml:"control_api_addr"`
+		// ControlAPITokenFile holds the bearer token every request to the control api must carry, required unless
+		// it listens on a loopback address only
+		ControlAPITokenFile string `yaml:"control_api_token_file"`
+		controlAPIToken     string
+
+		WatchdogStallMinutes int `yaml:"watchdog_stall_minutes"`
+
+		HealthAddr         string `yaml:"health_addr"`
+		HealthFile         string `yaml:"health_file"`
+		HealthFailedCycles int    `yaml:"health_failed_cycles"`
+
+		StateBackend string `yaml:"state_backend"`
+
+		WalkRetry            int `yaml:"walk_retry"`
+		WalkRetryDelayMillis int `yaml:"walk_retry_delay_ms"`
+
+		IntegrityManifest bool `yaml:"integrity_manifest"`
+		UploadJournal     bool `yaml:"upload_journal"`
+
+		StateBackup        bool   `yaml:"state_backup"`
+		StateBackupKeyFile string `yaml:"state_backup_key_file"`
+
+		HostConflictCheck string `yaml:"host_conflict_check"`
+		ConflictPolicy    string `yaml:"conflict_policy"`
+
+		Digest         string `yaml:"digest"`
+		SkippedLogFile string `yaml:"skipped_log_file"`
+
+		DeleteMode             string `yaml:"delete_mode"`
+		DeleteConfirmThreshold int    `yaml:"delete_confirm_threshold"`
+		KeepRevisions          int    `yaml:"keep_revisions"`
+		PropagateDeletes       *bool  `yaml:"propagate_deletes"`
+		ArchiveRetentionDays   int    `yaml:"archive_retention_days"`
+
+		PushgatewayURL string `yaml:"pushgateway_url"`
+		PushgatewayJob string `yaml:"pushgateway_job"`
+
+		Webhooks  []WebhookConfig  `yaml:"webhooks"`
+		Notifiers []NotifierConfig `yaml:"notifiers"`
+		Notify    []string         `yaml:"notify"`
+
+		QuarantineAfterFailures int `yaml:"quarantine_after_failures"`
+
+		DesktopNotifications      bool `yaml:"desktop_notifications"`
+		DesktopNotifyFileFailures int  `yaml:"desktop_notify_file_failures"`
+
+		EmailAlert EmailAlertConfig `yaml:"email_alert"`
+
+		VSSSnapshot  bool               `yaml:"vss_snapshot"`
+		SnapshotHook SnapshotHookConfig `yaml:"snapshot_hook"`
+
+		FilterFrom   string `yaml:"filter_from"`
+		rcloneFilter *rcloneFilter
+		SkipHidden   bool   `yaml:"skip_hidden"`
+		MaxFileSize  string `yaml:"max_file_size"`
+		maxFileSize  int64
+		Include      []string `yaml:"include"`
+		includePaths []string
+		Exclude      []string `yaml:"exclude"`
+		excludeRules []*gdriveIgnoreRule
+
+		// Backend is where the files go, drive or another storage: a local folder at BackendPath, the bucket of S3 or a
+		// remote of rclone
+		Backend     string       `yaml:"backend"`
+		BackendPath string       `yaml:"backend_path"`
+		S3          S3Config     `yaml:"s3"`
+		Rclone      RcloneConfig `yaml:"rclone"`
+
+		DriveClient          string `yaml:"drive_client"`
+		GDAPICredentialsFile string `yaml:"gd_api_credentials_file"`
+		GDAPITokenFile       string `yaml:"gd_api_token_file"`
+		// GDServiceAccountFile authenticates drive_client "api" as a service account instead of with an oauth token,
+		// acting as GDServiceAccountSubject when set (domain-wide delegation of a Workspace domain)
+		GDServiceAccountFile    string `yaml:"gd_service_account_file"`
+		GDServiceAccountSubject string `yaml:"gd_service_account_subject"`
+		// DriveEndpoint is the base url of the drive api drive_client "api" talks to instead of googleapis.com, e.g. a
+		// fake drive server of integration tests. Without credentials, its requests aren't authenticated
+		DriveEndpoint string `yaml:"drive_endpoint"`
 
 		TestMode              bool `yaml:"test_mode"`
 		TestModeOpDelayMillis int  `yaml:"test_mode_op_delay_ms"`
+		// TestModeFakeDrive keeps the files of test_mode in an in-memory drive for the lifetime of the process instead of
+		// forgetting them, its uploads failing for lack of quota past TestModeUploadLimit
+		TestModeFakeDrive   bool   `yaml:"test_mode_fake_drive"`
+		TestModeUploadLimit string `yaml:"test_mode_upload_limit"`
 	}
 )
 
 func main() {
-	cfgRaw, err := os.ReadFile("config.yaml")
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// loadConfig reads the config file (--config, or the first one of configSearchPaths), applies the environment
+// (BGDRIVE_*) and the flags overriding it and returns the config of every sync target. Without a config file, the
+// config comes from the environment alone.
+func loadConfig(flags *configFlags) ([]*Config, error) {
+	path, found, err := resolveConfigPath(flags.config)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	configPath = path
+	if found {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		fmt.Fprintf(os.Stderr, "config: %v\n", path)
+	}
+
+	targets, err := readConfig(flags)
+	if err != nil {
+		return nil, err
+	}
+	dryRunOutput = targets[0].DryRun
+	return targets, nil
+}
+
+// readConfig is loadConfig without the process wide side effects, to reload the config of a running daemon.
+func readConfig(flags *configFlags) ([]*Config, error) {
+	cfgRaw, err := os.ReadFile(configPath)
+	missing := errors.Is(err, os.ErrNotExist)
+	if err != nil && !missing {
+		return nil, err
 	}
 
 	cfg := Config{}
 	err = yaml.Unmarshal(cfgRaw, &cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	fromEnv, err := applyEnvOverrides(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	if missing && !fromEnv {
+		return nil, fmt.Errorf("no config file found (looked for %v) and no BGDRIVE_* environment variable set",
+			strings.Join(configSearchPaths(), ", "))
+	}
+	cfg.SyncTargetPath = stripLongPathPrefix(cfg.SyncTargetPath)
+	flags.apply(&cfg)
+	err = loadFilters(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadWebhooks(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = validEmailAlert(cfg.EmailAlert)
+	if err != nil {
+		return nil, err
+	}
+	err = loadNotifiers(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = validGoogleExport(cfg.GoogleExport)
+	if err != nil {
+		return nil, err
+	}
+	err = loadGoogleConvert(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadSharing(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadEncryption(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadCompress(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadDelta(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadAdaptiveWorkers(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadSmallFiles(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadHashWorkers(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadProxy(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadDriveEndpoint(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = loadControlAPI(&cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	cmd := exec.Command("gdrive", "account", "switch", cfg.GDAccountName)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
-	err = cmd.Run()
+	targets, err := expandTargets(&cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if targets, err = expandRoutes(targets); err != nil {
+		return nil, err
+	}
+	if len(targets) > 1 && flags.changed("target-path") {
+		return nil, errors.New("--target-path can't be used with several targets")
 	}
+	for _, tcfg := range targets {
+		flags.apply(tcfg)
+		if err = loadRemoteRoot(tcfg); err != nil {
+			return nil, fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+		}
+		if tcfg.schedule, err = parseSchedule(tcfg.Schedule, tcfg.SyncDelayMinute); err != nil {
+			return nil, fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+		}
+	}
+	return targets, nil
+}
 
-	om, err := NewObjectManager(&cfg)
+// runDaemon syncs every target until SIGINT or SIGTERM. reload reads the config again on SIGHUP, or when it changes
+// with config_watch.
+func runDaemon(targets []*Config, sf *syncFlags, reload func() ([]*Config, error)) error {
+	handleShutdownSignals()
+	oms := make([]*ObjectManager, len(targets))
+	digests := make([]*digestAggregator, len(targets))
+	for i, tcfg := range targets {
+		var err error
+		oms[i], digests[i], err = setupTarget(tcfg, sf.bootstrapState, sf.bootstrapStateHost)
+		if err != nil {
+			return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+		}
+	}
+
+	stall := time.Duration(targets[0].WatchdogStallMinutes) * time.Minute
+	if stall <= 0 {
+		stall = defaultWatchdogStallMinutes * time.Minute
+	}
+	if err := notifySystemdReady(oms, stall); err != nil {
+		return err
+	}
+	stopHealth, err := startHealth(targets[0], oms)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer stopHealth()
+	if addr := targets[0].ControlAPIAddr; addr != "" {
+		stopControlAPI, err := startControlAPI(addr, targets[0].controlAPIToken, healthFailedCycles(targets[0]))
+		if err != nil {
+			return err
+		}
+		defer stopControlAPI()
+	}
+	if sf.tui {
+		stopDashboard, err := startDashboard()
+		if err != nil {
+			return err
+		}
+		defer stopDashboard()
+	}
+	watchConfigReloads(targets, reload)
+	watchPauseSignals()
+	wg := &sync.WaitGroup{}
+	errs := make([]error, len(targets))
+	for i, tcfg := range targets {
+		wg.Add(1)
+		go func(i int, tcfg *Config, om *ObjectManager, digests *digestAggregator) {
+			defer wg.Done()
+			// a target which can't go on stops alone, the others keep syncing
+			if err := runTarget(tcfg, om, digests); err != nil {
+				errs[i] = fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				fmt.Printf("%v%v err: (%v).\n", tcfg.targetLabel(), colorize(colorRed, "Stopped!"), err)
+			}
+		}(i, tcfg, oms[i], digests[i])
+	}
+	wg.Wait()
+	fmt.Println("Shut down, state saved.")
+	return errors.Join(errs...)
+}
 
-	for {
-		delay := time.Duration(cfg.SyncDelayMinute) * time.Minute
-		fmt.Println("Syncing...")
+// runOnce runs a single cycle of every target, or of the target containing subtreeArg limited to it. A failed cycle
+// makes the run exit with exitPartial, unless drive rejected the credentials which is fatal, and files failing in
+// completed cycles with exitFilesFailed.
+func runOnce(targets []*Config, sf *syncFlags, subtreeArg string) error {
+	var subtrees []string
+	if subtreeArg != "" {
+		tcfg, subtree, err := findTarget(targets, subtreeArg)
+		if err != nil {
+			return err
+		}
+		targets, subtrees = []*Config{tcfg}, []string{subtree}
+	} else {
+		subtrees = make([]string, len(targets))
+	}
 
-		err = syncFiles(&cfg, om)
-		t := time.Now().Add(delay).Format(time.DateTime)
-		msg := fmt.Sprintf("Synced! next schedule: %v", t)
+	handleShutdownSignals()
+	var (
+		failed      = 0
+		failedFiles = 0
+		fatalErr    error
+	)
+	interactive := isInteractive()
+	for i, tcfg := range targets {
+		if shuttingDown() {
+			return errShutdown
+		}
+		tcfg.interactive = interactive
+		om, digests, err := setupTarget(tcfg, sf.bootstrapState, sf.bootstrapStateHost)
 		if err != nil {
-			msg = fmt.Sprintf("Sync error! err: (%v). next schedule: %v", err, t)
+			return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
 		}
 
-		fmt.Println(msg)
-		printSep()
-		time.Sleep(delay)
+		fmt.Printf("%vSyncing %v...\n", tcfg.targetLabel(), filepath.Join(tcfg.SyncTargetPath, subtrees[i]))
+		err = runCycle(tcfg, om, subtrees[i], digests)
+		printCycleResult(tcfg, err, "")
+		if errors.Is(err, errShutdown) {
+			return errShutdown
+		}
+		if err != nil {
+			failed++
+			if isAuthError(err) && fatalErr == nil {
+				fatalErr = fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+			}
+		} else if last := om.live.snapshot().Last; last != nil {
+			failedFiles += last.failedFiles()
+		}
+	}
+	if fatalErr != nil {
+		return fatalErr
+	}
+	if failed != 0 {
+		return &exitError{code: exitPartial, err: fmt.Errorf("%v of %v targets failed to sync", failed, len(targets))}
+	}
+	if failedFiles != 0 {
+		return &exitError{code: exitFilesFailed, err: fmt.Errorf("%v files failed to sync or are quarantined", failedFiles)}
+	}
+	return nil
+}
+
+// setupTarget loads the local state of a sync target.
+func setupTarget(cfg *Config, bootstrapState bool, bootstrapStateHost string) (*ObjectManager, *digestAggregator, error) {
+	if err := preflightLocal(cfg); err != nil {
+		return nil, nil, err
+	}
+	om, err := NewObjectManager(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = preflightRemote(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	if bootstrapState {
+		err = om.BootstrapStateBackup(bootstrapStateHost)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = om.replayIntentJournal(); err != nil {
+		return nil, nil, err
+	}
+	if err = om.recoverStaleLocks(); err != nil {
+		return nil, nil, err
+	}
+	if err = om.shareRoot(); err != nil {
+		return nil, nil, err
+	}
+
+	var digests *digestAggregator
+	if cfg.Digest != "" {
+		digests, err = newDigestAggregator(cfg.Digest, cfg.statePath(digestStateFile))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return om, digests, nil
+}
+
+// runTarget syncs a target on its schedule, or as its files change in watch mode, until shutdown. With an interval
+// the first sync starts right away, with a cron schedule it waits for the first scheduled time. It fails when watch
+// mode can't watch the target.
+func runTarget(cfg *Config, om *ObjectManager, digests *digestAggregator) error {
+	if cfg.WatchMode {
+		return watchLoop(cfg, om, digests)
+	}
+
+	next := time.Now()
+	if cfg.Schedule != "" {
+		next = cfg.schedule.Next(next)
+		fmt.Printf("%vnext schedule: %v\n", cfg.targetLabel(), next.Format(time.DateTime))
+	}
+	for {
+		om.live.setNext(next)
+		if !om.live.waitNext(next) {
+			return nil
+		}
+		if applyReload(cfg, om) {
+			next = cfg.schedule.Next(om.live.lastCycleEnd())
+			fmt.Printf("%vconfig reloaded, next schedule: %v\n", cfg.targetLabel(), next.Format(time.DateTime))
+			continue
+		}
+		fmt.Printf("%vSyncing...\n", cfg.targetLabel())
+
+		err := runCycle(cfg, om, "", digests)
+		if shuttingDown() {
+			printCycleResult(cfg, err, "")
+			return nil
+		}
+		next = cfg.schedule.Next(time.Now())
+		printCycleResult(cfg, err, fmt.Sprintf("next schedule: %v", next.Format(time.DateTime)))
+	}
+}
+
+func printCycleResult(cfg *Config, err error, next string) {
+	msg := cfg.targetLabel() + colorize(colorGreen, "Synced!")
+	if errors.Is(err, errShutdown) {
+		msg = cfg.targetLabel() + colorize(colorYellow, "Interrupted!") + fmt.Sprintf(" (%v)", err)
+	} else if err != nil {
+		msg = cfg.targetLabel() + colorize(colorRed, "Sync error!") + fmt.Sprintf(" err: (%v).", err)
+	}
+	if next != "" {
+		msg += " " + next
+	}
+	fmt.Println(msg)
+	printSep()
+}
+
+// runCycle runs a single sync cycle limited to subtree (relative to the sync target, empty for the whole tree),
+// publishes its metadata, records its report and announces it.
+func runCycle(cfg *Config, om *ObjectManager, subtree string, digests *digestAggregator) error {
+	report := newCycleReport()
+	err := syncFiles(cfg, om, report, subtree)
+	if err == nil && !cfg.DryRun {
+		err = publishCycleMeta(cfg, om, report.Operations, report.Start)
+	}
+	recordCycle(cfg, om, report, err)
+	announceCycle(cfg, report, digests)
+	return err
+}
+
+// recordCycle finishes the report of a cycle which ended with err, saves and logs it and alerts on the failure
+// streaks it starts or ends.
+func recordCycle(cfg *Config, om *ObjectManager, report *CycleReport, err error) {
+	report.finish(err)
+	prevStreak := om.live.snapshot().FailStreak
+	om.live.finishCycle(report)
+	recordCycleHealth(cfg, om, err)
+	printTooLargeSummary(cfg, report)
+	if cfg.DryRun {
+		printDryRunSummary(report)
+	}
+	if err := saveReport(report, cfg.statePath("last_report.json")); err != nil {
+		fmt.Printf("failed to save cycle report: %v\n", err)
+	}
+	if cfg.SkippedLogFile != "" {
+		if err := appendSkippedLog(report, cfg.SkippedLogFile); err != nil {
+			fmt.Printf("failed to write skipped log: %v\n", err)
+		}
+	}
+	if cfg.PushgatewayURL != "" {
+		if err := pushMetrics(cfg, report); err != nil {
+			fmt.Printf("failed to push metrics: %v\n", err)
+		}
+	}
+	if fileAlerts := om.live.takeFileAlerts(); cfg.DesktopNotifications {
+		notifyCycleDesktop(cfg, report, om.live.snapshot(), fileAlerts)
+	}
+	if cfg.EmailAlert.enabled() {
+		alertByEmail(cfg, report, om.live.snapshot(), prevStreak)
+	}
+}
+
+// announceCycle fires the webhooks and notifiers with the report of a cycle and adds it to the digest.
+func announceCycle(cfg *Config, report *CycleReport, digests *digestAggregator) {
+	if len(cfg.Webhooks) != 0 {
+		fireWebhooks(cfg, report)
+	}
+	if len(cfg.Notifiers) != 0 {
+		notifyCycle(cfg, report)
+	}
+	if digests != nil {
+		digest, err := digests.Add(report)
+		if err != nil {
+			fmt.Printf("failed to aggregate digest: %v\n", err)
+		}
+		if digest != nil {
+			publishDigest(cfg, digests.period, digest)
+		}
 	}
 }
 
@@ -73,92 +599,491 @@ type WalkResp struct {
 	modTimeUnix int64
 	isDir       bool
 	size        int64
+	inode       uint64
+}
+
+// changedSince reports whether the file wr was modified since it was synced as object: it is newer, even when of the
+// same size, or its size differs.
+func (wr *WalkResp) changedSince(object *Object) bool {
+	return wr.modTimeUnix > object.LastMod || wr.size != object.Size
+}
+
+// walkQueueSize is how many walked entries may wait for a worker before the walk holds on.
+const walkQueueSize = 1024
+
+// folderSync is the sync of a folder in the current cycle, which what the folder holds waits for.
+type folderSync struct {
+	done   chan struct{}
+	synced bool
+}
+
+// finish records whether the folder got synced, with its remote id resolved, and releases its entries.
+func (f *folderSync) finish(synced bool) {
+	if f == nil {
+		return
+	}
+	f.synced = synced
+	close(f.done)
 }
 
-func syncFiles(cfg *Config, om *ObjectManager) error {
+// wait blocks until the folder is synced and reports whether it was. A folder not scheduled in this cycle, nil,
+// is taken as synced: its entries create it when needed.
+func (f *folderSync) wait() bool {
+	if f == nil {
+		return true
+	}
+	<-f.done
+	return f.synced
+}
+
+// syncFiles syncs subtree (relative to the sync target, empty for the whole tree) to drive. On shutdown, no new
+// operation is started and the state is saved once the running ones are done.
+func syncFiles(cfg *Config, om *ObjectManager, report *CycleReport, subtree string) (err error) {
 	var erw error
-	bw := pool.NewBWorkerPool(cfg.SyncWorker, pool.WithError(&erw), pool.WithRetry(cfg.SyncRetry))
+	bw := pool.NewBWorkerPool(cfg.poolWorkers(), pool.WithError(&erw))
 	defer bw.Shutdown()
-	ntrLock := sync.Mutex{}
+	defer func() {
+		if errors.Is(err, errShutdown) {
+			if saveErr := om.SaveToFile(); saveErr != nil {
+				err = fmt.Errorf("%w, saving state failed: %v", errShutdown, saveErr)
+			}
+		}
+	}()
+	skippedMu := sync.Mutex{}
+	cycleStart := report.Start
+	_ = om.TakeOperations() // drop leftovers of an aborted cycle
+	defer func() {
+		// keep what was done even when the cycle fails halfway
+		report.Operations = append(report.Operations, om.TakeOperations()...)
+	}()
+	if cfg.DryRun {
+		// forget the objects the dry run pretended to create, update or delete
+		defer om.restoreObjects(om.CloneObjects())
+	}
 
-	var tr []WalkResp
-	if err := filepath.Walk(cfg.SyncTargetPath, func(loc string, info os.FileInfo, err error) error {
+	// once its position is taken, the changes feed of drive stands in for listing every remote folder
+	pulled := false
+	if cfg.RemoteChanges && subtree == "" {
+		var err error
+		if pulled, err = om.applyRemoteChanges(report); err != nil {
+			return err
+		}
+	}
+
+	switch cfg.SyncDirection {
+	case "", syncDirectionPush:
+	case syncDirectionPull, syncDirectionBoth, syncDirectionMirror:
+		om.live.setPhase(phasePulling)
+		if !pulled {
+			if err := pullFiles(cfg, om, report, subtree); err != nil {
+				return err
+			}
+		}
+		if cfg.SyncDirection == syncDirectionMirror {
+			if err := om.removeUnmirrored(report, subtree); err != nil {
+				return err
+			}
+		}
+		if cfg.SyncDirection != syncDirectionBoth {
+			return om.SaveToFile()
+		}
+		printSep()
+	default:
+		return fmt.Errorf("sync_direction: unknown direction %q", cfg.SyncDirection)
+	}
+
+	if cfg.RemoteSnapshots {
+		// every cycle uploads to a new dated folder, starting from an empty object map
+		endRemoteSnapshot, err := om.beginRemoteSnapshot(cycleStart)
 		if err != nil {
 			return err
 		}
-		tr = append(tr, WalkResp{
-			loc:         loc,
-			modTimeUnix: info.ModTime().Unix(),
-			isDir:       info.IsDir(),
-			size:        info.Size(),
-		})
-		return nil
-	}); err != nil {
+		defer endRemoteSnapshot()
+	}
+
+	snap, err := createSnapshot(cfg)
+	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := snap.release(); err != nil {
+			fmt.Printf("failed to release snapshot: %v\n", err)
+		}
+	}()
+	om.SetSourceRoot(snap.path)
+	defer om.SetSourceRoot(cfg.SyncTargetPath)
 
-	for {
-		ntrLock.Lock()
-		ltr := len(tr)
-		ntrLock.Unlock()
-		if ltr == 0 {
-			break
+	// the walk feeds the workers as it goes, so the first upload starts right away and only the entries waiting for
+	// a worker are held in memory
+	om.live.setPhase(phaseWalking)
+	var fileSkipped []SkippedPath
+	// folders are synced before what they hold: an entry waits for the folder it is in, when scheduled in this
+	// cycle, and is left for the next cycle when that folder couldn't be synced
+	folders := map[string]*folderSync{}
+	// syncEntry syncs wr on the current worker and reports whether it got synced
+	syncEntry := func(wr WalkResp) (bool, error) {
+		_, _, locked, err := om.Sync(&wr)
+		if err != nil {
+			om.live.fileFailed(wr.loc, desktopNotifyFileFailures(cfg))
+			if !isFileError(err) {
+				return false, err
+			}
+			// a file failing on its own doesn't stop the others
+			sp := SkippedPath{Loc: wr.loc, Reason: skipReasonFailed, Detail: err.Error()}
+			if om.quarantine.failed(&wr, err, quarantineAfterFailures(cfg)) {
+				sp.Detail += fmt.Sprintf(", quarantined after %v failures", quarantineAfterFailures(cfg))
+			}
+			skippedMu.Lock()
+			fileSkipped = append(fileSkipped, sp)
+			skippedMu.Unlock()
+			return false, nil
 		}
-		var ntr []WalkResp
-		for _, wr := range tr {
-			wrCp := wr
-			bw.Do(func() error {
-				_, _, locked, err := om.Sync(&wrCp)
-				if err != nil {
+		if locked {
+			// only an object created by another operation of this process is locked, it isn't waited for
+			skippedMu.Lock()
+			fileSkipped = append(fileSkipped, SkippedPath{Loc: wr.loc, Reason: skipReasonFailed,
+				Detail: "still being created by another operation, retried next cycle"})
+			skippedMu.Unlock()
+			return false, nil
+		}
+		om.live.fileSynced(wr.loc)
+		om.quarantine.succeeded(wr.loc)
+		return true, nil
+	}
+	schedule := func(wr WalkResp) error {
+		if err := om.waitWhilePaused(bw.Wait); err != nil {
+			return err
+		}
+		parent := folders[filepath.Dir(wr.loc)]
+		var self *folderSync
+		if wr.isDir {
+			self = &folderSync{done: make(chan struct{})}
+			folders[wr.loc] = self
+		}
+		if qf := om.quarantine.quarantined(&wr); qf != nil {
+			self.finish(false)
+			skippedMu.Lock()
+			fileSkipped = append(fileSkipped, SkippedPath{Loc: wr.loc, Reason: skipReasonQuarantined,
+				Detail: fmt.Sprintf("failed %v times, last: %v", qf.Failures, qf.LastError)})
+			skippedMu.Unlock()
+			return nil
+		}
+		om.live.queued.Add(1)
+		bw.Do(func() (err error) {
+			defer om.live.queued.Add(-1)
+			synced := false
+			defer func() { self.finish(synced) }()
+			if !parent.wait() {
+				return nil // the folder failed and is reported, what it holds is unknown this cycle
+			}
+			synced, err = syncEntry(wr)
+			return err
+		})
+		return nil
+	}
+	// scheduleBatch uploads a new folder along with its small files on one worker, or falls back to syncing them
+	// one by one
+	scheduleBatch := func(b *folderBatch) error {
+		if len(b.files) == 0 || om.quarantine.quarantined(&b.dir) != nil {
+			for _, wr := range append([]WalkResp{b.dir}, b.files...) {
+				if err := schedule(wr); err != nil {
 					return err
 				}
-				if locked {
-					ntrLock.Lock()
-					ntr = append(ntr, wrCp)
-					ntrLock.Unlock()
-					return nil
+			}
+			return nil
+		}
+		if err := om.waitWhilePaused(bw.Wait); err != nil {
+			return err
+		}
+		parent := folders[filepath.Dir(b.dir.loc)]
+		self := &folderSync{done: make(chan struct{})}
+		folders[b.dir.loc] = self
+		om.live.queued.Add(int64(1 + len(b.files)))
+		bw.Do(func() (err error) {
+			defer om.live.queued.Add(-int64(1 + len(b.files)))
+			synced := false
+			defer func() { self.finish(synced) }()
+			if !parent.wait() {
+				return nil
+			}
+			retry, err := om.uploadFolderBatch(b.dir, b.files)
+			if err != nil {
+				if !errors.Is(err, errNoBatch) {
+					fmt.Printf("failed to upload %v in one batch, syncing its files one by one: %v\n",
+						strings.TrimPrefix(b.dir.loc, cfg.SyncTargetPath), err)
+				}
+				if synced, err = syncEntry(b.dir); err != nil || !synced {
+					return err
+				}
+				retry = b.files
+			} else {
+				synced = true
+				om.live.fileSynced(b.dir.loc)
+				om.quarantine.succeeded(b.dir.loc)
+				for _, wr := range b.files {
+					if !slices.ContainsFunc(retry, func(r WalkResp) bool { return r.loc == wr.loc }) {
+						om.live.fileSynced(wr.loc)
+						om.quarantine.succeeded(wr.loc)
+					}
+				}
+			}
+			for _, wr := range retry {
+				if _, err = syncEntry(wr); err != nil {
+					return err
 				}
+			}
+			return nil
+		})
+		return nil
+	}
+
+	// tracked files not walked yet may turn out renamed to one of the new paths. A new file with the identity of one
+	// of them waits for the end of the walk, when the files gone from their location are known
+	unseen := map[string]*Object{}
+	unseenIDs := map[fileIdentity]int{}
+	om.SnapshotObjects().each(func(loc string, object *Object) {
+		if object.Exported || !isInSubtree(cfg, loc, subtree) {
+			return
+		}
+		unseen[loc] = object
+		unseenIDs[fileIdentity{inode: object.Inode, size: object.Size, lastMod: object.LastMod}]++
+	})
+	var deferred []WalkResp
+	// new and changed files are hashed ahead for the checksum verification after their transfer
+	var prehashed []string
+	defer func() { om.hashes.forget(prehashed) }()
+
+	walked := make(chan WalkResp, walkQueueSize)
+	stopWalk := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(stopWalk) })
+	defer stop()
+	var (
+		walkSkipped []SkippedPath
+		walkErr     error
+	)
+	go func() {
+		defer close(walked)
+		walkSkipped, walkErr = walkSource(cfg, snap.path, subtree, func(loc string, info os.FileInfo) error {
+			select {
+			case walked <- WalkResp{loc: loc, modTimeUnix: info.ModTime().Unix(), isDir: info.IsDir(), size: info.Size(),
+				inode: fileInode(info)}:
 				return nil
-			})
+			case <-stopWalk:
+				return errShutdown
+			}
+		})
+	}()
+	// with small_file_threshold, a new folder is held back while the walk collects its small new files
+	var (
+		batch       *folderBatch
+		scheduleErr error
+	)
+	flush := func() error {
+		if batch == nil {
+			return nil
+		}
+		b := batch
+		batch = nil
+		return scheduleBatch(b)
+	}
+	for wr := range walked {
+		if scheduleErr != nil || shuttingDown() {
+			stop()
+			continue
+		}
+		object, tracked := unseen[wr.loc]
+		if tracked {
+			delete(unseen, wr.loc)
+			unseenIDs[fileIdentity{inode: object.Inode, size: object.Size, lastMod: object.LastMod}]--
+		} else if !wr.isDir && wr.inode != 0 && unseenIDs[fileIdentity{inode: wr.inode, size: wr.size, lastMod: wr.modTimeUnix}] > 0 {
+			deferred = append(deferred, wr)
+			continue
+		}
+		// files unchanged since the last remote snapshot are copied on drive's side, not transferred
+		if !wr.isDir && !cfg.DryRun && (!tracked || wr.changedSince(object)) &&
+			om.unchangedSinceLastSnapshot(wr.loc, wr.size, wr.modTimeUnix) == nil {
+			om.hashes.prehash(om.sourceLoc(wr.loc))
+			prehashed = append(prehashed, om.sourceLoc(wr.loc))
+		}
+		if batch != nil && !tracked && batch.accepts(cfg, wr) && om.quarantine.quarantined(&wr) == nil {
+			batch.files = append(batch.files, wr)
+			continue
+		}
+		if scheduleErr = flush(); scheduleErr != nil {
+			continue
 		}
+		if wr.isDir && !tracked && cfg.batchesSmallFiles() {
+			batch = &folderBatch{dir: wr}
+			continue
+		}
+		scheduleErr = schedule(wr)
+	}
+	if scheduleErr == nil {
+		scheduleErr = flush()
+	}
+	if scheduleErr == nil {
+		scheduleErr = walkErr
+	}
+	if scheduleErr != nil {
 		bw.Wait()
-		if erw != nil {
-			return erw
+		return scheduleErr
+	}
+	report.addSkipped(cfg, walkSkipped)
+
+	missing := map[string]*Object{}
+	for loc, object := range unseen {
+		if !isUnderAny(loc, report.Skipped) {
+			missing[loc] = object
 		}
+	}
+	om.SetMoveCandidates(missing)
+	defer om.SetMoveCandidates(nil)
 
-		ntrLock.Lock()
-		tr = ntr
-		ntrLock.Unlock()
-		printSep()
+	om.live.setPhase(phaseSyncing)
+	for _, wr := range deferred {
+		if shuttingDown() {
+			break
+		}
+		if err := schedule(wr); err != nil {
+			bw.Wait()
+			return err
+		}
+	}
+	bw.Wait()
+	report.addSkipped(cfg, fileSkipped)
+	if shuttingDown() {
+		return errShutdown
 	}
+	if erw != nil {
+		return erw
+	}
+	printSep()
 
+	om.live.setPhase(phaseDeleting)
 	deletedQueue := om.CopyObjects()
-	if err := filepath.Walk(cfg.SyncTargetPath, func(loc string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for loc := range deletedQueue {
+		if !isInSubtree(cfg, loc, subtree) {
+			delete(deletedQueue, loc)
 		}
+	}
+	deleteSkipped, err := walkSource(cfg, snap.path, subtree, func(loc string, _ os.FileInfo) error {
 		delete(deletedQueue, loc)
 		return nil
-	}); err != nil {
+	})
+	if err != nil {
 		return err
 	}
 
+	// skipped paths (e.g. subtrees that could not be read this cycle) are unknown rather than deleted
+	report.addSkipped(cfg, deleteSkipped)
+	for loc := range deletedQueue {
+		if isUnderAny(loc, report.Skipped) {
+			delete(deletedQueue, loc)
+		}
+	}
+
+	if cfg.HostConflictCheck != "" && cfg.propagatesDeletes() && len(deletedQueue) != 0 {
+		claimed, err := om.CheckHostConflicts()
+		if err != nil {
+			return err
+		}
+		for loc, object := range deletedQueue {
+			host, ok := claimed[object.GDId]
+			if !ok || cfg.HostConflictCheck != hostConflictCheckBlock {
+				continue
+			}
+			printOp("kept", strings.TrimPrefix(loc, cfg.SyncTargetPath), fmt.Sprintf("also managed by host %v", host))
+			delete(deletedQueue, loc)
+		}
+	}
+
+	if shuttingDown() {
+		return errShutdown
+	}
+	if !cfg.DryRun && cfg.propagatesDeletes() {
+		if err = confirmDeletions(cfg, om.decisions, deletedQueue); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DeleteMode != deleteModeKeep && cfg.propagatesDeletes() {
+		om.forgetNestedDeletions(deletedQueue)
+	}
 	if len(deletedQueue) != 0 {
+		// a deletion failing on drive leaves its path tracked and is tried again next cycle
+		var deleteFailed []SkippedPath
 		for loc, object := range deletedQueue {
+			if shuttingDown() {
+				break
+			}
+			if err := om.waitWhilePaused(bw.Wait); err != nil {
+				bw.Wait()
+				return err
+			}
 			locCp, objectCp := loc, object
 			bw.Do(func() error {
-				om.DeleteObjectGDrive(locCp, objectCp)
+				if err := om.DeleteObjectGDrive(locCp, objectCp); err != nil {
+					skippedMu.Lock()
+					deleteFailed = append(deleteFailed, SkippedPath{Loc: locCp, Reason: skipReasonFailed, Detail: err.Error()})
+					skippedMu.Unlock()
+				}
 				return nil
 			})
 		}
 		bw.Wait()
+		report.addSkipped(cfg, deleteFailed)
 		printSep()
+		if shuttingDown() {
+			return errShutdown
+		}
+	}
+
+	if cfg.RemoteSnapshots {
+		om.pruneRemoteSnapshots()
+	}
+	if cfg.DeleteMode == deleteModeArchive && cfg.ArchiveRetentionDays != 0 {
+		if err = om.purgeArchive(time.Now()); err != nil {
+			fmt.Printf("failed to purge %v: %v\n", remoteArchiveFolderName, err)
+		}
 	}
 
-	err := om.SaveToFile()
+	om.live.setPhase(phaseSaving)
+	err = om.SaveToFile()
 	if err != nil {
 		return err
 	}
+
+	if used, limit := om.uploads.Usage(om.uploadAccount()); limit > 0 {
+		printOp("quota", fmt.Sprintf("account %v", om.uploadAccount()), fmt.Sprintf("%v of %v uploaded in the last 24h", getFileSizeFormatted(used), getFileSizeFormatted(limit)))
+	}
+
+	report.Operations = om.TakeOperations()
+	return nil
+}
+
+// publishCycleMeta uploads the optional per-cycle metadata (manifest, journal, state backup, host marker) into the
+// remote metadata folder.
+func publishCycleMeta(cfg *Config, om *ObjectManager, ops []Operation, cycleStart time.Time) error {
+	if cfg.IntegrityManifest {
+		if err := uploadIntegrityManifest(om, ops, cycleStart); err != nil {
+			return err
+		}
+	}
+	if cfg.UploadJournal {
+		if err := uploadOperationJournal(om, ops, cycleStart); err != nil {
+			return err
+		}
+	}
+	if cfg.StateBackup {
+		if err := om.PublishStateBackup(); err != nil {
+			return err
+		}
+	}
+	if cfg.HostConflictCheck != "" {
+		if err := om.PublishHostMarker(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTarget returns the config of a sync target in a temporary folder syncing to a fake drive of its own, with
+// the state files of the test kept in that folder.
+func newTestTarget(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	cfg := &Config{
+		GDAccountName:     t.Name(),
+		SyncTargetPath:    filepath.Join(dir, "target"),
+		SyncWorker:        2,
+		HashWorkers:       2,
+		TestMode:          true,
+		TestModeFakeDrive: true,
+	}
+	if err = os.Mkdir(cfg.SyncTargetPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fakeDrivesMu.Lock()
+		defer fakeDrivesMu.Unlock()
+		delete(fakeDrives, cfg.GDAccountName)
+	})
+	return cfg
+}
+
+// newTestObjectManager returns the object manager of cfg.
+func newTestObjectManager(t *testing.T, cfg *Config) *ObjectManager {
+	t.Helper()
+	om, err := NewObjectManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return om
+}
+
+// writeTestFile writes content to the file at rel in the sync target of cfg, modified at modTime.
+func writeTestFile(t *testing.T, cfg *Config, rel, content string, modTime time.Time) {
+	t.Helper()
+	loc := filepath.Join(cfg.SyncTargetPath, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(loc), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(loc, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(loc, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTestCycle runs a sync cycle of cfg and fails the test when it fails.
+func runTestCycle(t *testing.T, cfg *Config, om *ObjectManager) *CycleReport {
+	t.Helper()
+	report := newCycleReport()
+	if err := syncFiles(cfg, om, report, ""); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	return report
+}
+
+// fakeTree returns the files on the fake drive of cfg as slash separated paths mapped to their content, folders
+// ending with a slash and mapped to "".
+func fakeTree(t *testing.T, cfg *Config) map[string]string {
+	t.Helper()
+	d := fakeDriveFor(cfg)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pathOf := func(n *fakeNode) string {
+		var parts []string
+		for ; n.parent != ""; n = d.nodes[n.parent] {
+			parts = append([]string{n.file.Name}, parts...)
+		}
+		return strings.Join(parts, "/")
+	}
+	tree := map[string]string{}
+	for id, n := range d.nodes {
+		if id == fakeDriveRootID || n.trashed {
+			continue
+		}
+		if n.file.IsDir {
+			tree[pathOf(n)+"/"] = ""
+		} else {
+			tree[pathOf(n)] = string(n.content)
+		}
+	}
+	return tree
+}
+
+// assertTree fails the test when got isn't want.
+func assertTree(t *testing.T, got, want map[string]string) {
+	t.Helper()
+	var diff []string
+	for p, content := range want {
+		if g, ok := got[p]; !ok {
+			diff = append(diff, "missing "+p)
+		} else if g != content {
+			diff = append(diff, "content of "+p+": "+g+", want "+content)
+		}
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			diff = append(diff, "unexpected "+p)
+		}
+	}
+	sort.Strings(diff)
+	if len(diff) != 0 {
+		t.Errorf("drive differs:\n%v", strings.Join(diff, "\n"))
+	}
+}
+
+func TestSyncFilesCreate(t *testing.T) {
+	cfg := newTestTarget(t)
+	now := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "a", now)
+	writeTestFile(t, cfg, "docs/b.txt", "bb", now)
+	writeTestFile(t, cfg, "docs/deep/c.txt", "ccc", now)
+	if err := os.Mkdir(filepath.Join(cfg.SyncTargetPath, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	om := newTestObjectManager(t, cfg)
+
+	runTestCycle(t, cfg, om)
+	assertTree(t, fakeTree(t, cfg), map[string]string{
+		"a.txt":           "a",
+		"docs/":           "",
+		"docs/b.txt":      "bb",
+		"docs/deep/":      "",
+		"docs/deep/c.txt": "ccc",
+		"empty/":          "",
+	})
+	for _, rel := range []string{"a.txt", "docs", "docs/b.txt", "docs/deep", "docs/deep/c.txt", "empty"} {
+		if object, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, filepath.FromSlash(rel))); !ok || object.GDId == "" {
+			t.Errorf("%v is not tracked after the sync", rel)
+		}
+	}
+
+	// nothing changed, the next cycle leaves drive alone
+	before := len(fakeDriveFor(cfg).changes)
+	runTestCycle(t, cfg, om)
+	if after := len(fakeDriveFor(cfg).changes); after != before {
+		t.Errorf("an unchanged tree made %v changes on drive", after-before)
+	}
+}
+
+func TestSyncFilesUpdate(t *testing.T) {
+	cfg := newTestTarget(t)
+	synced := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "docs/a.txt", "a", synced)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+	object, _ := om.loadObject(filepath.Join(cfg.SyncTargetPath, "docs", "a.txt"))
+	id := object.GDId
+
+	writeTestFile(t, cfg, "docs/a.txt", "modified", synced.Add(time.Minute))
+	runTestCycle(t, cfg, om)
+	assertTree(t, fakeTree(t, cfg), map[string]string{
+		"docs/":      "",
+		"docs/a.txt": "modified",
+	})
+	object, _ = om.loadObject(filepath.Join(cfg.SyncTargetPath, "docs", "a.txt"))
+	if object.GDId != id {
+		t.Errorf("the update uploaded a new file %v instead of updating %v", object.GDId, id)
+	}
+	if object.Size != int64(len("modified")) || object.LastMod != synced.Add(time.Minute).Unix() {
+		t.Errorf("tracked size %v and modification time %v, want those of the modified file", object.Size, object.LastMod)
+	}
+}
+
+func TestSyncFilesUpdateSameSize(t *testing.T) {
+	cfg := newTestTarget(t)
+	synced := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "old", synced)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	writeTestFile(t, cfg, "a.txt", "new", synced.Add(time.Minute))
+	runTestCycle(t, cfg, om)
+	assertTree(t, fakeTree(t, cfg), map[string]string{"a.txt": "new"})
+}
+
+// corruptingUpdateClient answers every update with an md5 which isn't the one of the file, as a corrupted transfer
+// does.
+type corruptingUpdateClient struct {
+	DriveClient
+}
+
+func (c *corruptingUpdateClient) Update(id, loc string) (*RemoteFile, error) {
+	rf, err := c.DriveClient.Update(id, loc)
+	if err != nil {
+		return nil, err
+	}
+	corrupted := *rf
+	corrupted.MD5 = "00000000000000000000000000000000"
+	return &corrupted, nil
+}
+
+func TestSyncFilesUpdateChecksumMismatch(t *testing.T) {
+	cfg := newTestTarget(t)
+	synced := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "a", synced)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	om.drive = &corruptingUpdateClient{DriveClient: om.drive}
+	writeTestFile(t, cfg, "a.txt", "modified", synced.Add(time.Minute))
+	report := runTestCycle(t, cfg, om)
+	if !report.hasSkipped(filepath.Join(cfg.SyncTargetPath, "a.txt")) {
+		t.Error("the update of a.txt whose checksum kept mismatching is not reported")
+	}
+	if object, _ := om.loadObject(filepath.Join(cfg.SyncTargetPath, "a.txt")); object.Size != 1 {
+		t.Error("a.txt is tracked as updated though its checksum kept mismatching")
+	}
+}
+
+func TestSyncFilesDelete(t *testing.T) {
+	cfg := newTestTarget(t)
+	now := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "keep.txt", "k", now)
+	writeTestFile(t, cfg, "gone.txt", "g", now)
+	writeTestFile(t, cfg, "old/x.txt", "x", now)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	for _, rel := range []string{"gone.txt", "old"} {
+		if err := os.RemoveAll(filepath.Join(cfg.SyncTargetPath, rel)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runTestCycle(t, cfg, om)
+	assertTree(t, fakeTree(t, cfg), map[string]string{"keep.txt": "k"})
+	for _, rel := range []string{"gone.txt", "old", "old/x.txt"} {
+		if _, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, filepath.FromSlash(rel))); ok {
+			t.Errorf("%v is still tracked after its deletion", rel)
+		}
+	}
+}
+
+// failingDeleteClient fails every deletion, trashing and move, as drive does when it is unreachable.
+type failingDeleteClient struct {
+	DriveClient
+}
+
+func (c *failingDeleteClient) Delete(string) error { return errors.New("drive unreachable") }
+
+func (c *failingDeleteClient) Trash(string) error { return errors.New("drive unreachable") }
+
+func (c *failingDeleteClient) Move(string, string, string, string) error {
+	return errors.New("drive unreachable")
+}
+
+func TestSyncFilesDeleteFailed(t *testing.T) {
+	for _, mode := range []string{deleteModePermanent, deleteModeTrash, deleteModeArchive} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := newTestTarget(t)
+			cfg.DeleteMode = mode
+			writeTestFile(t, cfg, "gone.txt", "g", time.Now().Add(-time.Hour))
+			om := newTestObjectManager(t, cfg)
+			runTestCycle(t, cfg, om)
+
+			if err := os.Remove(filepath.Join(cfg.SyncTargetPath, "gone.txt")); err != nil {
+				t.Fatal(err)
+			}
+			drive := om.drive
+			om.drive = &failingDeleteClient{DriveClient: drive}
+			report := runTestCycle(t, cfg, om)
+			if _, ok := fakeTree(t, cfg)["gone.txt"]; !ok {
+				t.Error("gone.txt was removed from drive though drive failed")
+			}
+			if _, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, "gone.txt")); !ok {
+				t.Error("gone.txt was forgotten though drive failed to remove it")
+			}
+			if !report.hasSkipped(filepath.Join(cfg.SyncTargetPath, "gone.txt")) {
+				t.Error("the failed removal of gone.txt is not reported")
+			}
+			for _, op := range report.Operations {
+				t.Errorf("recorded %v %v though drive failed", op.Op, op.Path)
+			}
+
+			// the next cycle tries again
+			om.drive = drive
+			runTestCycle(t, cfg, om)
+			if _, ok := fakeTree(t, cfg)["gone.txt"]; ok {
+				t.Error("gone.txt is still on drive after the next cycle")
+			}
+			if _, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, "gone.txt")); ok {
+				t.Error("gone.txt is still tracked after the next cycle")
+			}
+		})
+	}
+}
+
+func TestSyncFilesDeleteKept(t *testing.T) {
+	cfg := newTestTarget(t)
+	cfg.DeleteMode = deleteModeKeep
+	writeTestFile(t, cfg, "gone.txt", "g", time.Now().Add(-time.Hour))
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	if err := os.Remove(filepath.Join(cfg.SyncTargetPath, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	runTestCycle(t, cfg, om)
+	assertTree(t, fakeTree(t, cfg), map[string]string{"gone.txt": "g"})
+	if _, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, "gone.txt")); ok {
+		t.Error("gone.txt is still tracked after its deletion")
+	}
+}
+
+func TestSyncFilesUploadLimit(t *testing.T) {
+	cfg := newTestTarget(t)
+	cfg.TestModeUploadLimit = "4"
+	cfg.SyncWorker = 1
+	now := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "aaa", now)
+	writeTestFile(t, cfg, "b.txt", "bbb", now)
+	om := newTestObjectManager(t, cfg)
+
+	err := syncFiles(cfg, om, newCycleReport(), "")
+	if !isUploadLimitError(err) {
+		t.Fatalf("sync past the upload quota: got %v, want the upload limit error", err)
+	}
+	tree := fakeTree(t, cfg)
+	if len(tree) != 1 {
+		t.Fatalf("drive holds %v, want one of the files uploaded before the quota ran out", tree)
+	}
+	for p := range tree {
+		if object, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, p)); !ok || object.GDId == "" {
+			t.Errorf("the uploaded %v is not tracked", p)
+		}
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, uploaded := tree[name]; uploaded {
+			continue
+		}
+		if object, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, name)); ok && object.GDId != "" {
+			t.Errorf("%v is tracked though its upload failed", name)
+		}
+	}
+}
+
+// failingFileClient fails the uploads and updates of the files called name, as drive does for a file it refuses.
+type failingFileClient struct {
+	DriveClient
+	name string
+}
+
+func (c *failingFileClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	if filepath.Base(loc) == c.name {
+		return nil, errors.New("file refused")
+	}
+	return c.DriveClient.Upload(parentID, loc)
+}
+
+func (c *failingFileClient) Update(id, loc string) (*RemoteFile, error) {
+	if filepath.Base(loc) == c.name {
+		return nil, errors.New("file refused")
+	}
+	return c.DriveClient.Update(id, loc)
+}
+
+func TestSyncFilesRemoteFileFailure(t *testing.T) {
+	cfg := newTestTarget(t)
+	synced := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "bad.txt", "b", synced)
+	writeTestFile(t, cfg, "good.txt", "g", synced)
+	om := newTestObjectManager(t, cfg)
+	drive := om.drive
+	om.drive = &failingFileClient{DriveClient: drive, name: "bad.txt"}
+
+	// a new file drive refuses fails alone and is quarantined once it kept failing
+	bad := filepath.Join(cfg.SyncTargetPath, "bad.txt")
+	for i := 1; i <= defaultQuarantineAfterFailures; i++ {
+		report := runTestCycle(t, cfg, om)
+		if !report.hasSkipped(bad) || report.failedFiles() != 1 {
+			t.Fatalf("cycle %v: the refused bad.txt is not reported as failed", i)
+		}
+	}
+	assertTree(t, fakeTree(t, cfg), map[string]string{"good.txt": "g"})
+	if qf := om.quarantine.quarantined(&WalkResp{loc: bad, size: 1, modTimeUnix: synced.Unix()}); qf == nil {
+		t.Errorf("bad.txt is not quarantined after %v failures", defaultQuarantineAfterFailures)
+	}
+
+	// so does an update drive refuses
+	om.drive = &failingFileClient{DriveClient: drive, name: "good.txt"}
+	writeTestFile(t, cfg, "good.txt", "modified", synced.Add(time.Minute))
+	report := runTestCycle(t, cfg, om)
+	if !report.hasSkipped(filepath.Join(cfg.SyncTargetPath, "good.txt")) {
+		t.Error("the refused update of good.txt is not reported")
+	}
+	if object, _ := om.loadObject(filepath.Join(cfg.SyncTargetPath, "good.txt")); object.Size != 1 {
+		t.Error("good.txt is tracked as updated though drive refused the update")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// uploadIntegrityManifest hashes every file created or updated in ops and uploads the result as a SHA256SUMS style
+// manifest into the remote metadata folder, so restores and third-party tools (sha256sum -c) can verify the content.
+// The sums are of the local content as synced, which is what a restore writes back, not of the bytes stored on drive
+// with compress, encryption_key_file or delta_min_size. Files changed since their transfer are left out, their sum
+// would be of content drive doesn't hold; the next cycle transfers them again and lists them in its manifest.
+func uploadIntegrityManifest(om *ObjectManager, ops []Operation, cycleStart time.Time) error {
+	var paths, locs []string
+	for _, op := range ops {
+		if op.Op != "created" && op.Op != "updated" {
+			continue
+		}
+		paths = append(paths, op.Path)
+		locs = append(locs, om.sourceLoc(filepath.Join(om.cfg.SyncTargetPath, op.Path)))
+	}
+	sums, err := om.hashes.sha256All(locs)
+	if err != nil {
+		return err
+	}
+	changed := 0
+	for i, path := range paths {
+		// checked after hashing, a file changed before or while it was hashed differs from the synced one
+		if !om.unchangedSinceSync(filepath.Join(om.cfg.SyncTargetPath, path), locs[i]) {
+			sums[i] = ""
+			changed++
+		}
+	}
+	var lines []string
+	for i, path := range paths {
+		if sums[i] != "" {
+			lines = append(lines, fmt.Sprintf("%v  %v\n", sums[i], filepath.ToSlash(filepath.Clean("."+path))))
+		}
+	}
+	if changed != 0 {
+		printOp("manifest", fmt.Sprintf("%v files", changed), "changed since their transfer, left out")
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	sort.Strings(lines)
+
+	buf := bytes.NewBuffer(nil)
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+
+	name := fmt.Sprintf("SHA256SUMS-%v-%v", hostname(), cycleStart.UTC().Format("20060102T150405Z"))
+	if err := om.uploadMetaFile(name, buf.Bytes()); err != nil {
+		return fmt.Errorf("upload integrity manifest: %v", err)
+	}
+	printOp("manifest", remoteMetaFolderName+"/"+name, fmt.Sprintf("%v files", len(lines)))
+	return nil
+}
+
+// unchangedSinceSync reports whether the local file at src still has the size and modification time it was synced
+// with as the object loc.
+func (om *ObjectManager) unchangedSinceSync(loc, src string) bool {
+	object, ok := om.loadObject(loc)
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(longPath(src))
+	return err == nil && info.Size() == object.Size && info.ModTime().Unix() == object.LastMod
+}
+
+func sha256File(loc string) (string, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "unknown"
+	}
+	return h
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntegrityManifestLeavesOutChangedFiles(t *testing.T) {
+	cfg := newTestTarget(t)
+	synced := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "a", synced)
+	writeTestFile(t, cfg, "docs/b.txt", "b", synced)
+	om := newTestObjectManager(t, cfg)
+	report := runTestCycle(t, cfg, om)
+
+	// changed after its transfer, before the manifest is made
+	writeTestFile(t, cfg, "docs/b.txt", "changed", synced.Add(time.Minute))
+	cycleStart := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	if err := uploadIntegrityManifest(om, report.Operations, cycleStart); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest string
+	for p, content := range fakeTree(t, cfg) {
+		if strings.HasPrefix(p, remoteMetaFolderName+"/SHA256SUMS-") {
+			manifest = content
+		}
+	}
+	sum := sha256.Sum256([]byte("a"))
+	if want := hex.EncodeToString(sum[:]) + "  a.txt\n"; manifest != want {
+		t.Errorf("manifest:\n%v\nwant:\n%v", manifest, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With sync_direction "mirror", drive is the source of truth and the sync target a read-only copy of it: files new or
+// changed on drive are downloaded, local edits and deletions are undone by downloading the remote file again, and the
+// local files and folders which aren't on drive are deleted. Nothing is ever uploaded.
+
+// mirrored reports whether the local file info is the one last synced as object.
+func mirrored(info os.FileInfo, object *Object) bool {
+	return info != nil && info.Size() == object.Size && info.ModTime().Unix() == object.LastMod
+}
+
+// forgetVanished forgets the objects tracked below startLoc whose remote file wasn't listed in seen by the pull, and
+// deletes their local copies. The folders the pull skipped weren't listed, what is below them is left alone. It relies
+// on every listing of the pull being complete, a client which can't list all the children of a folder fails the pull
+// before this.
+func (om *ObjectManager) forgetVanished(startLoc string, seen map[string]bool, byID map[string]string, skipped []SkippedPath) error {
+	var gone []string
+	for loc, object := range om.objectsBelow(startLoc) {
+		if loc == startLoc || object.GDId == "" || seen[object.GDId] || isUnderAny(loc, skipped) {
+			continue
+		}
+		if rel, err := filepath.Rel(om.cfg.SyncTargetPath, loc); err == nil && routedAway(om.cfg, filepath.ToSlash(rel)) {
+			continue // not listed, pulled by its route
+		}
+		gone = append(gone, loc)
+	}
+	sort.Strings(gone) // folders before what they hold, which goes along with them
+	var last string
+	for _, loc := range gone {
+		if last != "" && strings.HasPrefix(loc, last+string(filepath.Separator)) {
+			continue
+		}
+		if err := om.forgetRemoved(loc, byID, false); err != nil {
+			return err
+		}
+		last = loc
+	}
+	return nil
+}
+
+// removeUnmirrored deletes the local files and folders of subtree (relative, empty for everything) which aren't
+// tracked, so aren't on drive. Those filtered out of the sync are left alone.
+func (om *ObjectManager) removeUnmirrored(report *CycleReport, subtree string) error {
+	cfg := om.cfg
+	if start, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, subtree)); !ok || om.isLocked(start) {
+		return nil // not pulled yet, nothing to compare with
+	}
+	var untracked []string
+	skipped, err := walkSource(cfg, cfg.SyncTargetPath, subtree, func(loc string, _ os.FileInfo) error {
+		if _, ok := om.loadObject(loc); !ok && loc != cfg.SyncTargetPath {
+			untracked = append(untracked, loc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report.addSkipped(cfg, skipped)
+
+	sort.Strings(untracked)
+	var last string
+	for _, loc := range untracked {
+		if last != "" && strings.HasPrefix(loc, last+string(filepath.Separator)) {
+			continue // deleted with its folder
+		}
+		last = loc
+		if !cfg.DryRun {
+			if err = os.RemoveAll(longPath(loc)); err != nil {
+				return err
+			}
+		}
+		om.recordOp("removed", loc, "", 0)
+		printOp("removed", strings.TrimPrefix(loc, cfg.SyncTargetPath), "not on drive")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingListClient fails the listings of the folder id, as a listing which can't be complete does.
+type failingListClient struct {
+	DriveClient
+	id string
+}
+
+func (c *failingListClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	if parentID == c.id {
+		return nil, errors.New("listing incomplete")
+	}
+	return c.DriveClient.List(parentID, nameContains)
+}
+
+// uploadTestFile uploads a file called name holding content under parentID with client.
+func uploadTestFile(t *testing.T, client DriveClient, parentID, name, content string) *RemoteFile {
+	t.Helper()
+	loc := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(loc, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Upload(parentID, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestMirrorRemovesVanished(t *testing.T) {
+	cfg := newTestTarget(t)
+	cfg.SyncDirection = syncDirectionMirror
+	client, err := newFakeDriveClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docsID, err := client.Mkdir(".", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadTestFile(t, client, docsID, "a.txt", "a")
+	b := uploadTestFile(t, client, docsID, "b.txt", "b")
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err = os.Stat(filepath.Join(cfg.SyncTargetPath, "docs", name)); err != nil {
+			t.Errorf("%v not mirrored: %v", name, err)
+		}
+	}
+
+	if err = client.Delete(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	runTestCycle(t, cfg, om)
+	if _, err = os.Stat(filepath.Join(cfg.SyncTargetPath, "docs", "b.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("b.txt deleted on drive is still mirrored: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(cfg.SyncTargetPath, "docs", "a.txt")); err != nil {
+		t.Errorf("a.txt still on drive is gone: %v", err)
+	}
+}
+
+func TestMirrorKeepsFilesOfIncompleteListing(t *testing.T) {
+	cfg := newTestTarget(t)
+	cfg.SyncDirection = syncDirectionMirror
+	client, err := newFakeDriveClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docsID, err := client.Mkdir(".", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadTestFile(t, client, docsID, "a.txt", "a")
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	om.drive = &failingListClient{DriveClient: om.drive, id: docsID}
+	if err = syncFiles(cfg, om, newCycleReport(), ""); err == nil {
+		t.Fatal("sync with an incomplete listing succeeded")
+	}
+	if _, err = os.Stat(filepath.Join(cfg.SyncTargetPath, "docs", "a.txt")); err != nil {
+		t.Errorf("a.txt left out of an incomplete listing was deleted: %v", err)
+	}
+	if _, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, "docs", "a.txt")); !ok {
+		t.Error("a.txt left out of an incomplete listing was forgotten")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+)
+
+// fileIdentity recognizes a file across renames: the same inode with an unchanged size and modification time.
+type fileIdentity struct {
+	inode   uint64
+	size    int64
+	lastMod int64
+}
+
+// SetMoveCandidates registers the tracked files of missing (location to object) as possible sources of a rename,
+// so a new path with the same identity is moved remotely instead of uploaded again. Files whose identity is shared
+// with another candidate are left out. nil clears the candidates.
+func (om *ObjectManager) SetMoveCandidates(missing map[string]*Object) {
+	om.movesMu.Lock()
+	defer om.movesMu.Unlock()
+	om.moveCandidates = nil
+	if len(missing) == 0 {
+		return
+	}
+
+	om.moveCandidates = map[fileIdentity]string{}
+	ambiguous := map[fileIdentity]bool{}
+	for loc, object := range missing {
+		if object.Inode == 0 || object.LastMod == 0 {
+			continue
+		}
+		id := fileIdentity{inode: object.Inode, size: object.Size, lastMod: object.LastMod}
+		if _, ok := om.moveCandidates[id]; ok {
+			ambiguous[id] = true
+		}
+		om.moveCandidates[id] = loc
+	}
+	for id := range ambiguous {
+		delete(om.moveCandidates, id)
+	}
+}
+
+// takeMoveCandidate returns and forgets the location of the missing file with identity id.
+func (om *ObjectManager) takeMoveCandidate(id fileIdentity) (string, bool) {
+	om.movesMu.Lock()
+	defer om.movesMu.Unlock()
+	loc, ok := om.moveCandidates[id]
+	if ok {
+		delete(om.moveCandidates, id)
+	}
+	return loc, ok
+}
+
+// moveObject moves the remote file tracked at oldLoc to loc, whose parent folder is pObj, and rekeys the object
+// map. lockedNObj is the placeholder already stored for loc.
+func (om *ObjectManager) moveObject(oldLoc, loc string, pObj, lockedNObj *Object) (*Object, error) {
+	object, ok := om.loadObject(oldLoc)
+	if !ok || om.isLocked(object) {
+		return nil, nil
+	}
+	if err := om.drive.Move(object.GDId, object.GDPId, pObj.GDId, remoteName(loc, object)); err != nil {
+		return nil, err
+	}
+
+	om.deleteObject(oldLoc)
+	nObject := om.updateStoredObject(lockedNObj, func(o *Object) {
+		o.GDId = object.GDId
+		o.RemoteMod = object.RemoteMod
+		o.MD5 = object.MD5
+		o.Converted = object.Converted
+	})
+	om.recordOp("moved", loc, object.GDId, object.Size)
+	printOp("moved", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "from "+strings.TrimPrefix(oldLoc, om.cfg.SyncTargetPath))
+	return nObject, nil
+}
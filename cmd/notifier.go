@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// notifiers type values.
+const (
+	notifierSlack    = "slack"
+	notifierDiscord  = "discord"
+	notifierTelegram = "telegram"
+
+	discordMaxContent  = 2000
+	telegramMaxContent = 4096
+)
+
+// NotifierConfig is one entry of notifiers: a chat service posted a summary of the cycles selected by On.
+type NotifierConfig struct {
+	Name       string `yaml:"name"`
+	Type       string `yaml:"type"`
+	WebhookURL string `yaml:"webhook_url"`
+	BotToken   string `yaml:"bot_token"`
+	ChatID     string `yaml:"chat_id"`
+	On         string `yaml:"on"`
+}
+
+// loadNotifiers validates the notifiers configured in cfg. It must run once after the config is loaded.
+func loadNotifiers(cfg *Config) error {
+	names := map[string]bool{}
+	for i, n := range cfg.Notifiers {
+		if n.Name == "" {
+			return fmt.Errorf("notifiers[%v]: name is required", i)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("notifiers[%v]: duplicate name %q", i, n.Name)
+		}
+		names[n.Name] = true
+		switch n.Type {
+		case notifierSlack, notifierDiscord:
+			if n.WebhookURL == "" {
+				return fmt.Errorf("notifiers[%v]: webhook_url is required for %v", i, n.Type)
+			}
+		case notifierTelegram:
+			if n.BotToken == "" || n.ChatID == "" {
+				return fmt.Errorf("notifiers[%v]: bot_token and chat_id are required for %v", i, n.Type)
+			}
+		default:
+			return fmt.Errorf("notifiers[%v]: unknown type %q, expected %q, %q or %q", i, n.Type, notifierSlack,
+				notifierDiscord, notifierTelegram)
+		}
+		switch n.On {
+		case "", webhookOnAlways, webhookOnFailure, webhookOnSuccess:
+		default:
+			return fmt.Errorf("notifiers[%v]: unknown on %q, expected %q, %q or %q", i, n.On, webhookOnAlways,
+				webhookOnFailure, webhookOnSuccess)
+		}
+	}
+	for _, name := range cfg.Notify {
+		if !names[name] {
+			return fmt.Errorf("notify: unknown notifier %q", name)
+		}
+	}
+	return nil
+}
+
+// selectedNotifiers returns the notifiers of cfg named by notify (by the targets entry, or the top level one), or
+// all of them when notify is empty.
+func selectedNotifiers(cfg *Config) []NotifierConfig {
+	if len(cfg.Notify) == 0 {
+		return cfg.Notifiers
+	}
+	var selected []NotifierConfig
+	for _, n := range cfg.Notifiers {
+		for _, name := range cfg.Notify {
+			if n.Name == name {
+				selected = append(selected, n)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// notifyCycle posts the summary of a finished cycle to the selected notifiers interested in its outcome. A failing
+// notifier is reported and doesn't stop the others.
+func notifyCycle(cfg *Config, report *CycleReport) {
+	e := newCycleEvent(cfg, report)
+	text := cycleSummary(e)
+	for _, n := range selectedNotifiers(cfg) {
+		if n.On != "" && n.On != webhookOnAlways && n.On != e.Status {
+			continue
+		}
+		if err := postNotifier(n, text); err != nil {
+			fmt.Printf("%vnotifier %v failed: %v\n", cfg.targetLabel(), n.Name, err)
+		}
+	}
+}
+
+// cycleSummary is the one line summary of e posted by notifiers.
+func cycleSummary(e *cycleEvent) string {
+	where := e.Host
+	if e.Target != "" {
+		where += " (" + e.Target + ")"
+	}
+	if e.Status == webhookOnFailure {
+		return fmt.Sprintf("bgdrive-sync on %v failed to sync %v: %v", where, e.Path, e.Error)
+	}
+	return fmt.Sprintf("bgdrive-sync on %v synced %v in %v: %v created, %v updated, %v deleted, %v skipped, "+
+		"%v transferred", where, e.Path, e.End.Sub(e.Start).Round(time.Second), e.Created, e.Updated, e.Deleted, e.Skipped,
+		getFileSizeFormatted(e.BytesTransferred))
+}
+
+func postNotifier(n NotifierConfig, text string) error {
+	var (
+		url     = n.WebhookURL
+		payload any
+	)
+	switch n.Type {
+	case notifierSlack:
+		payload = map[string]string{"text": text}
+	case notifierDiscord:
+		payload = map[string]string{"content": truncateText(text, discordMaxContent)}
+	case notifierTelegram:
+		url = fmt.Sprintf("https://api.telegram.org/bot%v/sendMessage", n.BotToken)
+		payload = map[string]string{"chat_id": n.ChatID, "text": truncateText(text, telegramMaxContent)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = postHook(url, "application/json", bytes.NewReader(body))
+	if err != nil && n.BotToken != "" {
+		// the token is part of the url, keep it out of the log
+		return fmt.Errorf("%v", strings.ReplaceAll(err.Error(), n.BotToken, "<bot_token>"))
+	}
+	return err
+}
+
+// truncateText cuts text to at most max runes.
+func truncateText(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultDesktopNotifyFileFailures = 3
+
+// notifyCycleDesktop raises a desktop notification when a cycle starts failing, and when a file failed to sync
+// desktop_notify_file_failures cycles in a row. A notification that can't be shown is only reported.
+func notifyCycleDesktop(cfg *Config, report *CycleReport, snap targetSnapshot, failedFiles []string) {
+	title := "bgdrive-sync"
+	if cfg.targetName != "" {
+		title += " (" + cfg.targetName + ")"
+	}
+	var messages []string
+	if report.Failed() && snap.FailStreak == 1 {
+		messages = append(messages, "sync failed: "+report.Err)
+	}
+	for _, loc := range failedFiles {
+		messages = append(messages, fmt.Sprintf("%v failed to sync %v times in a row",
+			strings.TrimPrefix(loc, cfg.SyncTargetPath), desktopNotifyFileFailures(cfg)))
+	}
+	for _, message := range messages {
+		if err := notifyDesktop(title, message); err != nil {
+			fmt.Printf("%vdesktop notification failed: %v\n", cfg.targetLabel(), err)
+		}
+	}
+}
+
+func desktopNotifyFileFailures(cfg *Config) int {
+	if cfg.DesktopNotifyFileFailures <= 0 {
+		return defaultDesktopNotifyFileFailures
+	}
+	return cfg.DesktopNotifyFileFailures
+}
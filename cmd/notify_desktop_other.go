@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// notifyDesktop shows a desktop notification with notify-send, or osascript on macOS.
+func notifyDesktop(title, message string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		// passed through the env, no quoting of the applescript string needed
+		cmd = exec.Command("osascript", "-e",
+			`display notification (system attribute "BGDRIVE_SYNC_MESSAGE") with title (system attribute "BGDRIVE_SYNC_TITLE")`)
+		cmd.Env = append(os.Environ(), "BGDRIVE_SYNC_TITLE="+title, "BGDRIVE_SYNC_MESSAGE="+message)
+	} else {
+		cmd = exec.Command("notify-send", "--app-name=bgdrive-sync", "--", title, message)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// notifyToastScript shows a toast through the windows runtime api, reading the text from the env.
+const notifyToastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:BGDRIVE_SYNC_TITLE)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode($env:BGDRIVE_SYNC_MESSAGE)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('bgdrive-sync').Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// notifyDesktop shows a toast notification through powershell.
+func notifyDesktop(title, message string) error {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", notifyToastScript)
+	cmd.Env = append(os.Environ(), "BGDRIVE_SYNC_TITLE="+title, "BGDRIVE_SYNC_MESSAGE="+message)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
-	"time"
+)
+
+// delete_mode values: what happens on drive to a file or folder deleted locally.
+const (
+	deleteModePermanent = "permanent"
+	deleteModeTrash     = "trash"
+	deleteModeKeep      = "keep"
+	deleteModeArchive   = "archive"
 )
 
 type Object struct {
@@ -19,23 +25,94 @@ type Object struct {
 	GDPId   string `json:"gdp_id"`   // parent id. if empty, it indicates parent directory
 	LastMod int64  `json:"last_mod"` // if not empty, it indicates the object is a file
 	Size    int64  `json:"size"`
+
+	// RemoteMod is the remote modification time as of the last sync, 0 when unknown
+	RemoteMod int64 `json:"remote_mod,omitempty"`
+	// Inode of the local file, used to detect renames. 0 when unknown
+	Inode uint64 `json:"inode,omitempty"`
+	// MD5 of the content as verified against drive after the last transfer, empty when unknown
+	MD5 string `json:"md5,omitempty"`
+	// Exported marks a local copy exported from a google native document, which is never pushed back
+	Exported bool `json:"exported,omitempty"`
+	// Converted marks a file uploaded as a google native document, named on drive without its extension
+	Converted bool `json:"converted,omitempty"`
+	// CompressedSize is the size on drive of a file compressed before upload, 0 when it isn't
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+}
+
+func remoteModUnix(rf *RemoteFile) int64 {
+	if rf.ModTime.IsZero() {
+		return 0
+	}
+	return rf.ModTime.Unix()
 }
 
 type ObjectManager struct {
-	cfg               *Config
-	ObjectMapFilePath string
-	objectMap         map[string]*Object
-	objectMapRWMu     *sync.RWMutex
+	cfg           *Config
+	state         StateStore
+	objectMap     *objectTree
+	objectMapRWMu *sync.RWMutex
+
+	// sourceRoot is where the current cycle reads local files from. It equals cfg.SyncTargetPath unless the
+	// cycle runs against a snapshot, in which case object map keys still use cfg.SyncTargetPath.
+	sourceRoot string
+
+	ops     []Operation
+	opsMu   *sync.Mutex
+	meta    *remoteMeta
+	uploads *uploadAccounting
+
+	decisions  *decisionStore
+	quarantine *quarantineStore
+
+	// moveCandidates maps the identity of tracked files missing from their location this cycle to that location
+	moveCandidates map[fileIdentity]string
+	movesMu        *sync.Mutex
+
+	drive DriveClient
+	// journal records the remote changes issued since the object map was last saved, nil in a dry run
+	journal *intentJournal
+	// live is what the dashboard shows of this target
+	live *targetState
+	// dedup indexes the content of the tracked files, nil without dedup
+	dedup *dedupIndex
+	// hashes hashes the local files apart from the sync workers
+	hashes *hashPool
+	// changes is the position in the changes feed of drive, nil without remote_changes
+	changes *remoteChangesStore
+	// archive caches the folders delete_mode "archive" moves deleted objects into
+	archive *remoteArchive
+	// accounts is the rotation of gd_account_name and gd_fallback_accounts, nil without fallback accounts
+	accounts *accountRotation
+	// snapshots lists the remote snapshots taken, nil without remote_snapshots. snapshotRun is the one being taken
+	snapshots   *remoteSnapshotStore
+	snapshotRun *remoteSnapshotRun
+}
+
+func (om *ObjectManager) SetSourceRoot(root string) {
+	om.sourceRoot = root
+}
+
+// sourceLoc maps a logical location (object map key) to the path the file is actually read from.
+func (om *ObjectManager) sourceLoc(loc string) string {
+	if om.sourceRoot == "" || om.sourceRoot == om.cfg.SyncTargetPath {
+		return loc
+	}
+	rel, err := filepath.Rel(om.cfg.SyncTargetPath, loc)
+	if err != nil {
+		return loc
+	}
+	return filepath.Join(om.sourceRoot, rel)
 }
 
 func (om *ObjectManager) storeObject(key string, object *Object) (stored bool) {
 	om.objectMapRWMu.Lock()
 	defer om.objectMapRWMu.Unlock()
-	_, loaded := om.objectMap[key]
+	_, loaded := om.objectMap.get(key)
 	if loaded {
 		return
 	}
-	om.objectMap[key] = object
+	om.objectMap.put(key, object)
 	stored = true
 	return
 }
@@ -57,42 +134,127 @@ func (om *ObjectManager) loadObject(key string) (*Object, bool) {
 	om.objectMapRWMu.RLock()
 	defer om.objectMapRWMu.RUnlock()
 	if strings.TrimPrefix(strings.TrimSuffix(key, "/"), "/") == strings.TrimPrefix(strings.TrimSuffix(om.cfg.SyncTargetPath, "/"), "/") {
-		if om.cfg.GDRootFolderID == "" {
-			om.cfg.GDRootFolderID = "."
-		}
-		return &Object{GDId: om.cfg.GDRootFolderID}, true
+		return &Object{GDId: om.remoteTargetID()}, true
+	}
+	return om.objectMap.get(key)
+}
+
+// CheckAuth makes a cheap request under the remote root, failing when the credentials are rejected or the root
+// can't be reached.
+func (om *ObjectManager) CheckAuth() error {
+	_, err := findChild(om.drive, om.rootID(), remoteMetaFolderName)
+	return err
+}
+
+func (om *ObjectManager) rootID() string {
+	return remoteRootID(om.cfg)
+}
+
+// remoteRootID is the id of the remote folder the sync target maps to: gd_root_folder_id, else the shared drive
+// root, else "." for the root of my drive.
+func remoteRootID(cfg *Config) string {
+	switch {
+	case cfg.GDRootFolderID != "":
+		return cfg.GDRootFolderID
+	case cfg.GDDriveID != "":
+		return cfg.GDDriveID
+	default:
+		return "."
 	}
-	object, loaded := om.objectMap[key]
-	return object, loaded
 }
 
 func (om *ObjectManager) deleteObject(key string) {
 	om.objectMapRWMu.Lock()
 	defer om.objectMapRWMu.Unlock()
-	delete(om.objectMap, key)
+	om.objectMap.delete(key)
 }
 
-func (om *ObjectManager) CopyObjects() map[string]*Object {
+// objectsBelow returns the object tracked at loc and the ones tracked below it, by location.
+func (om *ObjectManager) objectsBelow(loc string) map[string]*Object {
 	om.objectMapRWMu.RLock()
 	defer om.objectMapRWMu.RUnlock()
-	data, _ := json.MarshalIndent(om.objectMap, "", "\t")
-	objectMapCopy := make(map[string]*Object)
-	_ = json.Unmarshal(data, &objectMapCopy)
-	return objectMapCopy
+	objects := map[string]*Object{}
+	if object, ok := om.objectMap.get(loc); ok {
+		objects[loc] = object
+	}
+	om.objectMap.eachBelow(loc, func(l string, object *Object) {
+		objects[l] = object
+	})
+	return objects
+}
+
+// rekeyObjects moves the object tracked at oldLoc and the ones tracked below it to newLoc, returning them by their
+// new location.
+func (om *ObjectManager) rekeyObjects(oldLoc, newLoc string) map[string]*Object {
+	objects := om.objectsBelow(oldLoc)
+	moved := make(map[string]*Object, len(objects))
+	for loc, object := range objects {
+		moved[newLoc+strings.TrimPrefix(loc, oldLoc)] = object
+	}
+	om.objectMapRWMu.Lock()
+	defer om.objectMapRWMu.Unlock()
+	for loc := range objects {
+		om.objectMap.delete(loc)
+	}
+	for loc, object := range moved {
+		om.objectMap.put(loc, object)
+	}
+	return moved
+}
+
+// SnapshotObjects copies the tracked objects, to be iterated without holding up the cycle.
+func (om *ObjectManager) SnapshotObjects() objectSnapshot {
+	om.objectMapRWMu.RLock()
+	defer om.objectMapRWMu.RUnlock()
+	return om.objectMap.snapshot()
+}
+
+// CloneObjects copies the tracked objects into a tree of their own, used to put them back as they were.
+func (om *ObjectManager) CloneObjects() *objectTree {
+	om.objectMapRWMu.RLock()
+	defer om.objectMapRWMu.RUnlock()
+	return om.objectMap.clone()
+}
+
+// CopyObjects copies the tracked objects into a map keyed by path, for the callers looking objects up by path.
+func (om *ObjectManager) CopyObjects() map[string]*Object {
+	return om.SnapshotObjects().toMap()
 }
 
 func (om *ObjectManager) SaveToFile() error {
-	data, err := json.MarshalIndent(om.CopyObjects(), "", "\t")
-	if err != nil {
-		return err
+	if om.cfg.DryRun {
+		return nil
 	}
 
-	err = os.WriteFile(om.ObjectMapFilePath, data, os.ModePerm)
+	var (
+		seq      int64
+		inFlight map[int64]bool
+	)
+	if om.journal != nil {
+		seq, inFlight = om.journal.mark()
+	}
+	om.objectMapRWMu.RLock()
+	err := om.state.Save(om.objectMap)
+	om.objectMapRWMu.RUnlock()
 	if err != nil {
 		return err
 	}
+	if om.journal != nil {
+		if err = om.journal.compact(seq, inFlight); err != nil {
+			return err
+		}
+	}
+	if err = om.changes.save(); err != nil {
+		return err
+	}
+	if err = om.snapshots.save(); err != nil {
+		return err
+	}
 
-	return nil
+	if err = om.quarantine.save(); err != nil {
+		return err
+	}
+	return om.uploads.save()
 }
 
 func (om *ObjectManager) NewObject(loc string) (*Object, bool, bool, error) {
@@ -121,7 +283,7 @@ func (om *ObjectManager) NewObject(loc string) (*Object, bool, bool, error) {
 		return pObj, false, true, nil
 	}
 
-	wr, err := os.Stat(loc)
+	wr, err := os.Stat(longPath(om.sourceLoc(loc)))
 	if err != nil {
 		return nil, false, false, err
 	}
@@ -138,32 +300,112 @@ func (om *ObjectManager) NewObject(loc string) (*Object, bool, bool, error) {
 		GDPId:   pObj.GDId,
 		LastMod: lastMod,
 		Size:    wr.Size(),
+		Inode:   fileInode(wr),
 	}
 
 	stored := om.storeObject(loc, lockedNObj)
 	if !stored {
 		return pObj, false, true, nil
 	}
-	execArgs := fmt.Sprintf(`cd '%v' && gdrive files '%v' '%v' --parent '%v' --print-only-id`, d, op, b, pObj.GDId)
-	if pObj.GDId == "." {
-		execArgs = fmt.Sprintf("cd '%v' && gdrive files '%v' '%v' --print-only-id", d, op, b)
+	if op == "upload" && lockedNObj.Inode != 0 {
+		if oldLoc, ok := om.takeMoveCandidate(fileIdentity{inode: lockedNObj.Inode, size: wr.Size(), lastMod: lastMod}); ok {
+			nObject, err := om.moveObject(oldLoc, loc, pObj, lockedNObj)
+			if err != nil {
+				fmt.Printf("failed to move %v, uploading it instead: %v\n", strings.TrimPrefix(oldLoc, om.cfg.SyncTargetPath), err)
+			} else if nObject != nil {
+				return nObject, false, false, nil
+			}
+		}
+	}
+
+	if op == "upload" && om.snapshotRun != nil {
+		if nObject := om.copyFromLastSnapshot(loc, pObj, lockedNObj); nObject != nil {
+			return nObject, false, false, nil
+		}
+	}
+
+	releaseQuota := func() {}
+	if op == "upload" {
+		releaseQuota, err = om.reserveUpload(wr.Size())
+		if err != nil {
+			om.deleteObject(loc)
+			return nil, false, false, err
+		}
+	}
+
+	var dedupDone func(id, loc string)
+	if op == "upload" && om.dedup != nil {
+		nObject, done, err := om.copyDuplicate(loc, pObj, lockedNObj)
+		if err != nil || nObject != nil {
+			releaseQuota()
+			if err != nil {
+				om.deleteObject(loc)
+			}
+			return nObject, false, false, err
+		}
+		dedupDone = done
 	}
 
-	var nGDId string
-	nGDId, err = om.execCommand("sh", "-c", execArgs)
+	var (
+		nGDId      string
+		remoteMod  int64
+		sum        string
+		converted  bool
+		compressed int64
+	)
+	if dedupDone != nil {
+		defer func() { dedupDone(nGDId, loc) }()
+	}
+	if op == "mkdir" {
+		nGDId, err = om.drive.Mkdir(pObj.GDId, b)
+	} else {
+		var rf *RemoteFile
+		var mimeType string
+		if mimeType, converted = googleConvertType(om.cfg, loc); converted {
+			rf, err = om.drive.Import(pObj.GDId, "", om.sourceLoc(loc), mimeType)
+		} else {
+			rf, err = om.drive.Upload(pObj.GDId, om.sourceLoc(loc))
+		}
+		if err == nil {
+			uploadedID := rf.ID
+			if rf, sum, err = om.verifyTransfer(loc, rf); err != nil {
+				_ = om.drive.Delete(uploadedID)
+			} else {
+				nGDId, remoteMod, compressed = rf.ID, remoteModUnix(rf), compressedSize(om.cfg, loc, rf)
+			}
+		}
+	}
 	if err != nil {
+		releaseQuota()
 		om.deleteObject(loc)
-		return nil, false, false, err
+		return nil, false, false, asRemoteFileError(err)
 	}
 
 	nObject := om.updateStoredObject(lockedNObj, func(o *Object) {
 		o.GDId = nGDId
+		o.RemoteMod = remoteMod
+		o.MD5 = sum
+		o.Converted = converted
+		o.CompressedSize = compressed
 	})
 
 	if op == "upload" {
 		op = "created"
 	}
-	fmt.Printf("%v: %v (%v)\n", op, strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(wr.Size()))
+	detail := getFileSizeFormatted(wr.Size())
+	if converted {
+		detail += ", converted to a google document"
+	}
+	if compressed != 0 {
+		detail += ", compressed to " + getFileSizeFormatted(compressed)
+	}
+	om.recordOp(op, loc, nGDId, wr.Size())
+	printOp(op, strings.TrimPrefix(loc, om.cfg.SyncTargetPath), detail)
+	if op == "mkdir" && len(om.cfg.Sharing) != 0 {
+		if err = om.shareFolder(loc, nGDId); err != nil {
+			fmt.Printf("failed to share %v: %v\n", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), err)
+		}
+	}
 
 	return nObject, false, false, nil
 }
@@ -182,6 +424,13 @@ func (om *ObjectManager) Sync(wr *WalkResp) (created, updated, locked bool, err
 		return true, false, false, nil
 	}
 
+	if object.Exported {
+		return false, false, false, nil // exported from a google document, never pushed back
+	}
+	if wr.inode != 0 && !wr.isDir && object.Inode != wr.inode {
+		om.updateStoredObject(object, func(o *Object) { o.Inode = wr.inode })
+	}
+
 	updated, err = om.UpdateObjectIfModTimeChanged(wr, object)
 	return false, updated, false, err
 }
@@ -191,90 +440,352 @@ func (om *ObjectManager) UpdateObjectIfModTimeChanged(wr *WalkResp, object *Obje
 		return false, nil
 	}
 
-	currMod := wr.modTimeUnix
-	if currMod <= object.LastMod || wr.size == object.Size {
+	if !wr.changedSince(object) {
 		return false, nil
 	}
 
-	d, b := filepath.Dir(wr.loc), filepath.Base(wr.loc)
-	_, err := om.execCommand("sh", "-c", fmt.Sprintf("cd '%v' && gdrive files update '%v' '%v'", d, object.GDId, b))
+	releaseQuota, err := om.reserveUpload(wr.size)
 	if err != nil {
-		return false, nil
+		return false, err
+	}
+
+	var (
+		rf  *RemoteFile
+		sum string
+	)
+	if mimeType, ok := googleImportTypes[strings.ToLower(filepath.Ext(wr.loc))]; ok && object.Converted {
+		rf, err = om.drive.Import("", object.GDId, om.sourceLoc(wr.loc), mimeType)
+	} else {
+		rf, err = om.drive.Update(object.GDId, om.sourceLoc(wr.loc))
+	}
+	if err == nil {
+		rf, sum, err = om.verifyTransfer(wr.loc, rf)
+	}
+	if err != nil {
+		releaseQuota()
+		return false, asRemoteFileError(err)
 	}
 
 	originSize := object.Size
+	om.recordOp("updated", wr.loc, object.GDId, wr.size)
 	om.updateStoredObject(object, func(o *Object) {
-		o.LastMod = currMod
+		o.LastMod = wr.modTimeUnix
 		o.Size = wr.size
+		o.RemoteMod = remoteModUnix(rf)
+		o.MD5 = sum
+		o.CompressedSize = compressedSize(om.cfg, wr.loc, rf)
 	})
+	if om.dedup != nil {
+		om.dedup.updated(object.GDId, sum, wr.loc)
+	}
 
-	fmt.Printf("updated: %v (%v -> %v)\n", strings.TrimPrefix(wr.loc, om.cfg.SyncTargetPath), getFileSizeFormatted(originSize), getFileSizeFormatted(wr.size))
+	printOp("updated", strings.TrimPrefix(wr.loc, om.cfg.SyncTargetPath), fmt.Sprintf("%v -> %v", getFileSizeFormatted(originSize), getFileSizeFormatted(wr.size)))
 	return true, nil
 }
 
 func NewObjectManager(cfg *Config) (*ObjectManager, error) {
-	objectMapFilePath := "object_map.json"
-	objectMapRaw, err := readObjectMap(objectMapFilePath)
+	if err := acquireInstanceLock(cfg); err != nil {
+		return nil, err
+	}
+	state, err := openStateStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	objectMap, err := state.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	objectMap := map[string]*Object{}
-	err = json.Unmarshal(objectMapRaw, &objectMap)
+	dailyUploadCap, err := parseByteSize(cfg.DailyUploadCap)
+	if err != nil {
+		return nil, fmt.Errorf("daily_upload_cap: %v", err)
+	}
+	if cfg.DryRun {
+		dailyUploadCap = 0 // nothing is uploaded
+	}
+	uploads, err := openUploadAccounting(uploadAccountingFile, dailyUploadCap)
 	if err != nil {
 		return nil, err
 	}
 
+	switch cfg.DeleteMode {
+	case "", deleteModePermanent, deleteModeKeep, deleteModeArchive:
+	case deleteModeTrash:
+		if !cfg.TestMode && cfg.DriveClient != driveClientAPI {
+			return nil, fmt.Errorf("delete_mode %q requires drive_client %q", deleteModeTrash, driveClientAPI)
+		}
+	default:
+		return nil, fmt.Errorf("delete_mode: unknown mode %q, expected %q, %q, %q or %q", cfg.DeleteMode, deleteModeTrash,
+			deleteModePermanent, deleteModeKeep, deleteModeArchive)
+	}
+	if cfg.ArchiveRetentionDays < 0 {
+		return nil, errors.New("archive_retention_days: expected a positive number")
+	}
+
+	switch {
+	case cfg.KeepRevisions < 0 || cfg.KeepRevisions > maxKeptRevisions:
+		return nil, fmt.Errorf("keep_revisions: expected a number from 0 to %v", maxKeptRevisions)
+	case cfg.KeepRevisions != 0 && !cfg.TestMode && cfg.DriveClient != driveClientAPI:
+		return nil, fmt.Errorf("keep_revisions requires drive_client %q", driveClientAPI)
+	}
+
+	if cfg.Dedup && !cfg.TestMode && cfg.DriveClient != driveClientAPI {
+		return nil, fmt.Errorf("dedup requires drive_client %q", driveClientAPI)
+	}
+	var changes *remoteChangesStore
+	if cfg.RemoteChanges {
+		if !cfg.TestMode && cfg.DriveClient != driveClientAPI {
+			return nil, fmt.Errorf("remote_changes requires drive_client %q", driveClientAPI)
+		}
+		if changes, err = newRemoteChangesStore(cfg.statePath("remote_changes.json")); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.SyncDirection {
+	case "", syncDirectionPush, syncDirectionPull, syncDirectionBoth, syncDirectionMirror:
+	default:
+		return nil, fmt.Errorf("sync_direction: unknown direction %q", cfg.SyncDirection)
+	}
+	if err = validConflictPolicy(cfg.ConflictPolicy); err != nil {
+		return nil, err
+	}
+	if err = validFallbackAccounts(cfg); err != nil {
+		return nil, err
+	}
+	if err = validBackend(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.GDServiceAccountFile != "" && cfg.DriveClient != driveClientAPI && !cfg.TestMode {
+		return nil, fmt.Errorf("gd_service_account_file requires drive_client %q", driveClientAPI)
+	}
+	if cfg.GDServiceAccountSubject != "" && cfg.GDServiceAccountFile == "" {
+		return nil, errors.New("gd_service_account_subject requires gd_service_account_file")
+	}
+	if cfg.DriveEndpoint != "" && cfg.DriveClient != driveClientAPI && !cfg.TestMode {
+		return nil, fmt.Errorf("drive_endpoint requires drive_client %q", driveClientAPI)
+	}
+	if err = validRemoteMoves(cfg.RemoteMoves); err != nil {
+		return nil, err
+	}
+	if err = validRemoteSnapshots(cfg); err != nil {
+		return nil, err
+	}
+	var snapshots *remoteSnapshotStore
+	if cfg.RemoteSnapshots {
+		if snapshots, err = newRemoteSnapshotStore(cfg.statePath("remote_snapshots.json")); err != nil {
+			return nil, err
+		}
+	}
+
+	decisions, err := newDecisionStore(cfg.statePath("decisions.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	quarantine, err := newQuarantineStore(cfg.statePath("quarantine.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = resolveRemoteRoot(cfg); err != nil {
+		return nil, err
+	}
+	drive, err := newDriveClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var dedup *dedupIndex
+	if cfg.Dedup {
+		dedup = newDedupIndex(objectMap)
+	}
+	var journal *intentJournal
+	if cfg.DryRun {
+		drive = &dryRunClient{DriveClient: drive}
+	} else {
+		if journal, err = openIntentJournal(cfg.statePath("intent_journal.jsonl")); err != nil {
+			return nil, err
+		}
+		drive = &journalingDriveClient{DriveClient: drive, journal: journal}
+	}
+	live := liveState(cfg)
+	drive = &liveDriveClient{DriveClient: drive, state: live}
+
 	return &ObjectManager{
-		cfg:               cfg,
-		ObjectMapFilePath: objectMapFilePath,
-		objectMap:         objectMap,
-		objectMapRWMu:     &sync.RWMutex{},
+		cfg:           cfg,
+		state:         state,
+		objectMap:     objectMap,
+		objectMapRWMu: &sync.RWMutex{},
+		sourceRoot:    cfg.SyncTargetPath,
+		opsMu:         &sync.Mutex{},
+		movesMu:       &sync.Mutex{},
+		meta:          &remoteMeta{},
+		uploads:       uploads,
+		accounts:      accountRotationFor(cfg),
+		decisions:     decisions,
+		quarantine:    quarantine,
+		live:          live,
+		drive:         drive,
+		journal:       journal,
+		dedup:         dedup,
+		hashes:        sharedHashPool(cfg),
+		changes:       changes,
+		snapshots:     snapshots,
+		archive:       &remoteArchive{},
 	}, nil
 }
 
-func (om *ObjectManager) DeleteObjectGDrive(loc string, object *Object) {
-	defer om.deleteObject(loc)
-	_, _ = om.execCommand("gdrive", "files", "delete", object.GDId, "--recursive")
-	fmt.Printf("deleted: %v (%v)\n", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(object.Size))
+// propagatesDeletes reports whether local deletions reach drive, propagate_deletes defaulting to true. Without, the
+// deleted local paths are only forgotten.
+func (cfg *Config) propagatesDeletes() bool {
+	return cfg.PropagateDeletes == nil || *cfg.PropagateDeletes
+}
+
+// DeleteObjectGDrive removes the remote copy of the deleted local path loc as delete_mode says, and forgets it. When
+// drive fails, loc stays tracked so the next cycle tries again.
+func (om *ObjectManager) DeleteObjectGDrive(loc string, object *Object) (err error) {
+	defer func() {
+		if err != nil {
+			return
+		}
+		if om.dedup != nil {
+			om.dedup.forget(object.GDId)
+		}
+		om.deleteObject(loc)
+	}()
+	switch {
+	case object.Exported:
+		printOp("kept", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "exported google document, exported again by the next pull")
+	case !om.cfg.propagatesDeletes():
+		printOp("forgot", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "deleted locally, kept on drive")
+	case om.cfg.DeleteMode == deleteModeKeep:
+		printOp("kept", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "delete_mode keep, no longer synced")
+	case om.cfg.DeleteMode == deleteModeArchive:
+		if err = om.archiveObject(loc, object); err != nil {
+			return fmt.Errorf("failed to archive: %w", err)
+		}
+		om.recordOp("archived", loc, object.GDId, object.Size)
+		printOp("archived", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "moved to "+remoteArchiveFolderName)
+	case om.cfg.DeleteMode == deleteModeTrash:
+		if err = om.drive.Trash(object.GDId); err != nil {
+			return fmt.Errorf("failed to trash: %w", err)
+		}
+		om.recordOp("trashed", loc, object.GDId, object.Size)
+		printOp("trashed", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(object.Size))
+	default:
+		if err = om.drive.Delete(object.GDId); err != nil {
+			return fmt.Errorf("failed to delete: %w", err)
+		}
+		om.recordOp("deleted", loc, object.GDId, object.Size)
+		printOp("deleted", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(object.Size))
+	}
+	return nil
 }
 
-func readObjectMap(sourceLoc string) ([]byte, error) {
-	objectMapFile, err := os.OpenFile(sourceLoc, os.O_CREATE|os.O_RDWR, os.ModePerm)
+// loadObjectMap reads the object map stored at filePath, empty when there is none yet. When it is missing or can't
+// be parsed but the backup left by the previous save can, the backup is used instead.
+func loadObjectMap(filePath string) (*objectTree, error) {
+	objectMap, err := readObjectMapFile(filePath)
+	if err == nil && objectMap != nil {
+		return objectMap, nil
+	}
+
+	backupPath := filePath + objectMapBackupSuffix
+	backup, backupErr := readObjectMapFile(backupPath)
+	if backupErr == nil && backup != nil {
+		if err != nil {
+			fmt.Printf("%v, falling back to %v\n", err, backupPath)
+		} else {
+			fmt.Printf("%v is missing or empty, falling back to %v\n", filePath, backupPath)
+		}
+		return backup, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer objectMapFile.Close()
+	return newObjectTree(), nil
+}
 
-	data, err := io.ReadAll(objectMapFile)
+// readObjectMapFile reads a single object map file, nil when it doesn't exist or is empty. The file is decoded entry
+// by entry, straight into the tree.
+func readObjectMapFile(filePath string) (*objectTree, error) {
+	f, err := os.Open(filePath)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
 		return nil, err
 	}
-
-	if len(data) == 0 {
-		data = []byte("{}")
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
 	}
 
-	return data, nil
+	t := newObjectTree()
+	if err = decodeObjectMap(json.NewDecoder(bufio.NewReader(f)), t); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return t, nil
 }
 
-func (om *ObjectManager) execCommand(name string, arg ...string) (string, error) {
-	if om.cfg.TestMode {
-		time.Sleep(time.Millisecond * time.Duration(om.cfg.TestModeOpDelayMillis))
-		return "0", nil
+// decodeObjectMap decodes a json object of objects keyed by path into t.
+func decodeObjectMap(dec *json.Decoder, t *objectTree) error {
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return fmt.Errorf("expected an object, found %v", tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		loc, _ := tok.(string)
+		object := &Object{}
+		if err = dec.Decode(object); err != nil {
+			return err
+		}
+		t.put(loc, object)
 	}
-	cmd := exec.Command(name, arg...)
-	//fmt.Println(strings.Join(append([]string{name}, arg...), " "))
-	stdout := bytes.NewBuffer(nil)
-	cmd.Stdout = stdout
-	cmd.Stderr = stdout
+	_, err := dec.Token()
+	return err
+}
 
-	err := cmd.Run()
-	out := strings.TrimSpace(stdout.String())
+// encodeObjectMap encodes the objects of t as a json object keyed by path, indented like json.MarshalIndent does.
+func encodeObjectMap(t *objectTree) ([]byte, error) {
+	buf := bytes.NewBufferString("{")
+	var err error
+	t.each(func(loc string, object *Object) {
+		if err != nil {
+			return
+		}
+		var key, value []byte
+		if key, err = json.Marshal(loc); err != nil {
+			return
+		}
+		if value, err = json.MarshalIndent(object, "\t", "\t"); err != nil {
+			return
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("\n\t")
+		buf.Write(key)
+		buf.WriteString(": ")
+		buf.Write(value)
+	})
 	if err != nil {
-		return "", errors.New(out)
+		return nil, err
+	}
+	if buf.Len() > 1 {
+		buf.WriteByte('\n')
 	}
-	return out, nil
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
 }
 
 func getFileSizeFormatted(byteSize int64) string {
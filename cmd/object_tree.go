@@ -0,0 +1,328 @@
+package main
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// objectTree is the object map, held as a tree of folders rather than a map of absolute paths, so the folders shared
+// by millions of tracked files are stored once. Folder names are interned across trees, and an object stored under
+// its tracked parent folder shares the id string of that folder.
+type objectTree struct {
+	root  *objectNode
+	count int
+}
+
+// objectNode is a folder of an objectTree, holding the object tracked at its path, nil when it only leads to tracked
+// objects below it. The objects with nothing tracked below them, files mostly, are kept by name in leaves rather than
+// in nodes of their own.
+type objectNode struct {
+	name     string
+	parent   *objectNode
+	object   *Object
+	children map[string]*objectNode
+	leaves   map[string]*Object
+}
+
+var (
+	folderNamesMu sync.Mutex
+	folderNames   = map[string]string{}
+)
+
+// internFolderName returns the copy of the folder name shared by every tree. File names are not interned, they are
+// mostly unique and would only grow the table.
+func internFolderName(name string) string {
+	folderNamesMu.Lock()
+	defer folderNamesMu.Unlock()
+	if s, ok := folderNames[name]; ok {
+		return s
+	}
+	s := strings.Clone(name)
+	folderNames[s] = s
+	return s
+}
+
+func newObjectTree() *objectTree {
+	return &objectTree{root: &objectNode{}}
+}
+
+// objectTreeOf builds a tree of the objects of objectMap.
+func objectTreeOf(objectMap map[string]*Object) *objectTree {
+	t := newObjectTree()
+	for loc, object := range objectMap {
+		t.put(loc, object)
+	}
+	return t
+}
+
+// lookup returns the object tracked as name in n.
+func (n *objectNode) lookup(name string) *Object {
+	if object, ok := n.leaves[name]; ok {
+		return object
+	}
+	if child := n.children[name]; child != nil {
+		return child.object
+	}
+	return nil
+}
+
+// dir returns the node of the folder holding loc and the name of loc in it. Missing nodes are created when create is
+// set, nil is returned otherwise.
+func (t *objectTree) dir(loc string, create bool) (*objectNode, string) {
+	n := t.root
+	for rest := loc; ; {
+		name, tail, more := strings.Cut(rest, string(filepath.Separator))
+		if !more {
+			return n, name
+		}
+		child := n.children[name]
+		if child == nil {
+			if !create {
+				return nil, name
+			}
+			child = &objectNode{name: internFolderName(name), parent: n}
+			if object, ok := n.leaves[name]; ok {
+				// something is tracked below an object, which gets a node now
+				child.object = object
+				delete(n.leaves, name)
+			}
+			if n.children == nil {
+				n.children = map[string]*objectNode{}
+			}
+			n.children[child.name] = child
+		}
+		n = child
+		rest = tail
+	}
+}
+
+func (t *objectTree) get(loc string) (*Object, bool) {
+	dir, name := t.dir(loc, false)
+	if dir == nil {
+		return nil, false
+	}
+	object := dir.lookup(name)
+	return object, object != nil
+}
+
+func (t *objectTree) has(loc string) bool {
+	_, ok := t.get(loc)
+	return ok
+}
+
+// put stores object at loc, replacing the object stored there.
+func (t *objectTree) put(loc string, object *Object) {
+	dir, name := t.dir(loc, true)
+	if p := dir.object; p != nil && p.GDId == object.GDPId {
+		object.GDPId = p.GDId
+	}
+	if child := dir.children[name]; child != nil {
+		if child.object == nil {
+			t.count++
+		}
+		child.object = object
+		return
+	}
+	if _, ok := dir.leaves[name]; !ok {
+		t.count++
+		name = strings.Clone(name) // not to keep the whole of loc alive
+	}
+	if dir.leaves == nil {
+		dir.leaves = map[string]*Object{}
+	}
+	dir.leaves[name] = object
+}
+
+// delete forgets the object at loc, along with the nodes which only led to it.
+func (t *objectTree) delete(loc string) {
+	n, name := t.dir(loc, false)
+	if n == nil {
+		return
+	}
+	if _, ok := n.leaves[name]; ok {
+		delete(n.leaves, name)
+	} else if child := n.children[name]; child != nil && child.object != nil {
+		child.object = nil
+		n = child
+	} else {
+		return
+	}
+	t.count--
+	for n != t.root && n.object == nil && len(n.children) == 0 && len(n.leaves) == 0 {
+		delete(n.parent.children, n.name)
+		n = n.parent
+	}
+}
+
+func (t *objectTree) len() int {
+	return t.count
+}
+
+// join returns the path of name in the folder n.
+func (n *objectNode) join(name string) string {
+	if n.parent == nil {
+		return name
+	}
+	var names []string
+	for ; n.parent != nil; n = n.parent {
+		names = append(names, n.name)
+	}
+	var b strings.Builder
+	for i := len(names) - 1; i >= 0; i-- {
+		b.WriteString(names[i])
+		b.WriteByte(filepath.Separator)
+	}
+	b.WriteString(name)
+	return b.String()
+}
+
+// each calls f with every object of the tree in path order.
+func (t *objectTree) each(f func(loc string, object *Object)) {
+	t.eachFrom(t.root, "", f)
+}
+
+// eachBelow calls f with every object tracked below loc in path order.
+func (t *objectTree) eachBelow(loc string, f func(loc string, object *Object)) {
+	if dir, name := t.dir(loc, false); dir != nil && dir.children[name] != nil {
+		t.eachFrom(dir.children[name], loc, f)
+	}
+}
+
+func (t *objectTree) eachFrom(from *objectNode, fromLoc string, f func(loc string, object *Object)) {
+	var walk func(n *objectNode, loc string)
+	walk = func(n *objectNode, loc string) {
+		names := make([]string, 0, len(n.children)+len(n.leaves))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		for name := range n.leaves {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childLoc := name
+			if n != t.root {
+				childLoc = loc + string(filepath.Separator) + name
+			}
+			if object, ok := n.leaves[name]; ok {
+				f(childLoc, object)
+				continue
+			}
+			child := n.children[name]
+			if child.object != nil {
+				f(childLoc, child.object)
+			}
+			walk(child, childLoc)
+		}
+	}
+	walk(from, fromLoc)
+}
+
+// eachEntry calls f with every object of the tree along with its folder and name, in no particular order and
+// without building their paths.
+func (t *objectTree) eachEntry(f func(dir *objectNode, name string, object *Object)) {
+	var walk func(n *objectNode)
+	walk = func(n *objectNode) {
+		for name, object := range n.leaves {
+			f(n, name, object)
+		}
+		for name, child := range n.children {
+			if child.object != nil {
+				f(n, name, child.object)
+			}
+			walk(child)
+		}
+	}
+	walk(t.root)
+}
+
+// clone copies the tree and its objects, sharing the names.
+func (t *objectTree) clone() *objectTree {
+	copyObject := func(o *Object) *Object {
+		c := *o
+		return &c
+	}
+	var copyNode func(n, parent *objectNode) *objectNode
+	copyNode = func(n, parent *objectNode) *objectNode {
+		c := &objectNode{name: n.name, parent: parent}
+		if n.object != nil {
+			c.object = copyObject(n.object)
+		}
+		if len(n.children) != 0 {
+			c.children = make(map[string]*objectNode, len(n.children))
+			for name, child := range n.children {
+				c.children[name] = copyNode(child, c)
+			}
+		}
+		if len(n.leaves) != 0 {
+			c.leaves = make(map[string]*Object, len(n.leaves))
+			for name, object := range n.leaves {
+				c.leaves[name] = copyObject(object)
+			}
+		}
+		return c
+	}
+	return &objectTree{root: copyNode(t.root, nil), count: t.count}
+}
+
+// snapshot copies the objects of the tree. The copies keep to their folder and name instead of their path, which is
+// only built while iterating.
+func (t *objectTree) snapshot() objectSnapshot {
+	s := make(objectSnapshot, 0, t.count)
+	t.eachEntry(func(dir *objectNode, name string, object *Object) {
+		s = append(s, snapshotObject{dir: dir, name: name, object: *object})
+	})
+	return s
+}
+
+// toMap copies the objects of the tree into a map keyed by path.
+func (t *objectTree) toMap() map[string]*Object {
+	return t.snapshot().toMap()
+}
+
+// objectSnapshot is a copy of the objects of an objectTree at one point in time.
+type objectSnapshot []snapshotObject
+
+type snapshotObject struct {
+	dir    *objectNode
+	name   string
+	object Object
+}
+
+// each calls f with every object of the snapshot, in no particular order.
+func (s objectSnapshot) each(f func(loc string, object *Object)) {
+	for i := range s {
+		f(s[i].dir.join(s[i].name), &s[i].object)
+	}
+}
+
+func (s objectSnapshot) toMap() map[string]*Object {
+	objectMap := make(map[string]*Object, len(s))
+	s.each(func(loc string, object *Object) {
+		objectMap[loc] = object
+	})
+	return objectMap
+}
+
+// objectFingerprint hashes every field of o, telling whether an object changed since it was saved without keeping a
+// copy of it.
+func objectFingerprint(o *Object) uint64 {
+	h := fnv.New64a()
+	for _, s := range []string{o.GDId, o.GDPId, o.MD5} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	var b []byte
+	for _, n := range []int64{o.LastMod, o.Size, o.RemoteMod, int64(o.Inode), o.CompressedSize} {
+		b = strconv.AppendInt(b, n, 36)
+		b = append(b, 0)
+	}
+	b = strconv.AppendBool(b, o.Exported)
+	b = strconv.AppendBool(b, o.Converted)
+	h.Write(b)
+	return h.Sum64()
+}
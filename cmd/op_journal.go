@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type opJournalHeader struct {
+	Host       string    `json:"host"`
+	TargetPath string    `json:"target_path"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Operations int       `json:"operations"`
+}
+
+// uploadOperationJournal uploads the operations of a cycle as a JSON lines file (a header line followed by one line
+// per operation) into the remote metadata folder, so what a machine changed can be audited from the Drive side.
+func uploadOperationJournal(om *ObjectManager, ops []Operation, cycleStart time.Time) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(opJournalHeader{
+		Host:       hostname(),
+		TargetPath: om.cfg.SyncTargetPath,
+		Start:      cycleStart,
+		End:        time.Now(),
+		Operations: len(ops),
+	}); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf("journal-%v-%v.jsonl", hostname(), cycleStart.UTC().Format("20060102T150405Z"))
+	if err := om.uploadMetaFile(name, buf.Bytes()); err != nil {
+		return fmt.Errorf("upload operation journal: %v", err)
+	}
+	printOp("journal", remoteMetaFolderName+"/"+name, fmt.Sprintf("%v operations", len(ops)))
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Operation is a single remote change performed during a sync cycle.
+type Operation struct {
+	Op   string    `json:"op"`
+	Path string    `json:"path"` // relative to the sync target path
+	GDId string    `json:"gd_id"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+func (om *ObjectManager) recordOp(op, loc, gdId string, size int64) {
+	o := Operation{
+		Op:   op,
+		Path: strings.TrimPrefix(loc, om.cfg.SyncTargetPath),
+		GDId: gdId,
+		Size: size,
+		Time: time.Now(),
+	}
+	om.live.addRecent(o)
+	om.opsMu.Lock()
+	defer om.opsMu.Unlock()
+	om.ops = append(om.ops, o)
+}
+
+// TakeOperations returns the operations recorded since the last call and resets the list.
+func (om *ObjectManager) TakeOperations() []Operation {
+	om.opsMu.Lock()
+	defer om.opsMu.Unlock()
+	ops := om.ops
+	om.ops = nil
+	return ops
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+)
+
+// opLabelWidth is the width of the operation column so paths line up across lines
+const opLabelWidth = 10
+
+var (
+	colorEnabled bool
+	dryRunOutput bool
+	outputMu     = &sync.Mutex{}
+)
+
+// initOutput enables colored output only when stdout is an interactive terminal, NO_COLOR is not set and
+// the user did not pass --no-color.
+func initOutput(noColor bool) {
+	colorEnabled = !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func opColor(op string) string {
+	switch op {
+	case "mkdir", "created", "pulled", "downloaded", "adopted", "recovered", "exported", "shared", "copied", "restored":
+		return colorGreen
+	case "updated", "moved", "forgot", "reparented", "replayed", "delta":
+		return colorYellow
+	case "deleted", "trashed", "removed", "pruned", "archived":
+		return colorRed
+	default:
+		return colorCyan
+	}
+}
+
+func colorize(color, s string) string {
+	if !colorEnabled || color == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// printOp prints a single aligned operation line, e.g. "created  /foo/bar.txt (1.20 MB)".
+func printOp(op, loc, detail string) {
+	label := op + ":" + strings.Repeat(" ", max(opLabelWidth-len(op)-1, 1))
+	line := colorize(opColor(op), label) + loc
+	if detail != "" {
+		line += " (" + detail + ")"
+	}
+	if dryRunOutput {
+		line += " [dry-run]"
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Println(line)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// waitWhilePaused holds a running cycle before its next operation while the target is paused. drain waits for the
+// operations already scheduled, after which the state is saved, so the process can sit paused or be stopped without
+// losing anything. It returns errShutdown when the process shuts down meanwhile.
+func (om *ObjectManager) waitWhilePaused(drain func()) error {
+	if !om.live.holding() {
+		return nil
+	}
+	drain()
+	if err := om.SaveToFile(); err != nil {
+		return err
+	}
+	printOp("paused", om.cfg.SyncTargetPath, "in-flight operations finished, state saved")
+	resume := om.live.pauseCycle()
+	defer resume()
+	for om.live.holding() {
+		if !sleepOrShutdown(time.Second) {
+			return errShutdown
+		}
+	}
+	printOp("resumed", om.cfg.SyncTargetPath, "")
+	return nil
+}
+
+func newPauseCmd(cf *configFlags) *cobra.Command {
+	return newPauseResumeCmd(cf, true)
+}
+
+func newResumeCmd(cf *configFlags) *cobra.Command {
+	return newPauseResumeCmd(cf, false)
+}
+
+// newPauseResumeCmd builds the pause and resume commands, which drive the running daemon through control_api_addr
+// when set, or through SIGUSR1 and SIGUSR2 sent to the process holding the instance lock otherwise.
+func newPauseResumeCmd(cf *configFlags, pause bool) *cobra.Command {
+	var target string
+	cmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Make the running daemon sync again after a pause",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			if addr := targets[0].ControlAPIAddr; addr != "" {
+				path := "/resume"
+				if pause {
+					path = "/pause"
+				}
+				return controlAPIPost(addr, targets[0].controlAPIToken, path, target, cmd.Flags().Changed("target"))
+			}
+			if cmd.Flags().Changed("target") {
+				return errors.New("--target requires control_api_addr, the signals pause every target of the daemon")
+			}
+			return signalDaemon(targets[0], pause)
+		},
+	}
+	if pause {
+		cmd.Use = "pause"
+		cmd.Short = "Make the running daemon finish its in-flight operations, save its state and wait for resume"
+	}
+	cmd.Flags().StringVar(&target, "target", "", "only act on this target (requires control_api_addr)")
+	return cmd
+}
+
+// controlAPIPost calls the control api endpoint path of the daemon listening on addr, with token as the bearer token
+// when set.
+func controlAPIPost(addr, token, path, target string, selected bool) error {
+	u := "http://" + addr + path
+	if selected {
+		u += "?target=" + url.QueryEscape(target)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return fmt.Errorf("control api: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("control api: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("control api: %v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	return nil
+}
+
+// signalDaemon sends the pause or resume signal to the daemon syncing cfg, found by its instance lock.
+func signalDaemon(cfg *Config, pause bool) error {
+	path := cfg.statePath("object_map.json") + ".lock"
+	f, err := lockFile(path)
+	if err == nil {
+		_ = f.Close()
+		return fmt.Errorf("no bgdrive-sync is running for %v", cfg.SyncTargetPath)
+	}
+	if !errors.Is(err, errInstanceLocked) {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%v: no pid of the running bgdrive-sync", path)
+	}
+	if err = signalPause(pid, pause); err != nil {
+		return err
+	}
+	fmt.Printf("signaled bgdrive-sync (pid %v)\n", pid)
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchPauseSignals pauses every target on SIGUSR1 and resumes them on SIGUSR2.
+func watchPauseSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case <-shutdown:
+				return
+			case s := <-sig:
+				for _, state := range allLiveStates() {
+					state.setPaused(s == syscall.SIGUSR1)
+				}
+			}
+		}
+	}()
+}
+
+// signalPause sends SIGUSR1 (pause) or SIGUSR2 (resume) to the bgdrive-sync process pid.
+func signalPause(pid int, pause bool) error {
+	sig := syscall.SIGUSR2
+	if pause {
+		sig = syscall.SIGUSR1
+	}
+	return syscall.Kill(pid, sig)
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// watchPauseSignals does nothing, windows has no signals to pause with, the control api is used instead.
+func watchPauseSignals() {}
+
+func signalPause(int, bool) error {
+	return errors.New("pausing a running bgdrive-sync on windows requires control_api_addr")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// gdriveSupportedMajor is the major version of gdrive whose commands the gdrive client runs.
+const gdriveSupportedMajor = 3
+
+// preflightProbeName is the folder created and deleted again in the remote root to check it is writable.
+const preflightProbeName = ".bgdrive-sync-preflight"
+
+var gdriveVersionOutput = regexp.MustCompile(`gdrive v?(\d+)\.(\d+)`)
+
+// preflightLocal checks what a target needs before anything is opened: a readable sync_target_path and, with
+// drive_client "gdrive", a gdrive binary of the supported version.
+func preflightLocal(cfg *Config) error {
+	if err := checkTargetPath(cfg); err != nil {
+		return err
+	}
+	if cfg.TestMode || (cfg.Backend != "" && cfg.Backend != backendDrive) ||
+		(cfg.DriveClient != "" && cfg.DriveClient != driveClientGDrive) {
+		return nil
+	}
+	return checkGDriveBinary()
+}
+
+func checkTargetPath(cfg *Config) error {
+	info, err := os.Stat(longPath(cfg.SyncTargetPath))
+	if errors.Is(err, os.ErrNotExist) && (cfg.SyncDirection == syncDirectionPull || cfg.SyncDirection == syncDirectionMirror) {
+		return nil // created by the first pull
+	}
+	if err != nil {
+		return fmt.Errorf("sync_target_path: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("sync_target_path: %v is not a folder", cfg.SyncTargetPath)
+	}
+	f, err := os.Open(longPath(cfg.SyncTargetPath))
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		_ = f.Close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("sync_target_path: %v is not readable: %v", cfg.SyncTargetPath, err)
+	}
+	return nil
+}
+
+func checkGDriveBinary() error {
+	if _, err := exec.LookPath("gdrive"); err != nil {
+		return fmt.Errorf("gdrive binary not found in the PATH, install gdrive %v (https://github.com/glotlabs/gdrive) "+
+			"or set drive_client %q", gdriveSupportedMajor, driveClientAPI)
+	}
+	out, err := runCommand("gdrive", "version")
+	if err != nil {
+		return fmt.Errorf("gdrive version: %v", err)
+	}
+	m := gdriveVersionOutput.FindStringSubmatch(out)
+	if m == nil {
+		return fmt.Errorf("gdrive version: unexpected output %q, bgdrive-sync needs gdrive %v", out, gdriveSupportedMajor)
+	}
+	if major, _ := strconv.Atoi(m[1]); major != gdriveSupportedMajor {
+		return fmt.Errorf("gdrive %v.%v isn't supported, bgdrive-sync needs gdrive %v (https://github.com/glotlabs/gdrive)",
+			m[1], m[2], gdriveSupportedMajor)
+	}
+	return nil
+}
+
+// preflightRemote checks the account of the target is authenticated and its remote root exists and, unless it is
+// the root of my drive or a dry run, is writable.
+func preflightRemote(cfg *Config) error {
+	drive, err := newPlainDriveClient(cfg)
+	if err != nil {
+		return err
+	}
+	rootID := remoteRootID(cfg)
+	if _, err = drive.List(rootID, preflightProbeName); err != nil {
+		var apiErr *googleapi.Error
+		switch {
+		case cfg.Backend != "" && cfg.Backend != backendDrive:
+			return fmt.Errorf("backend %v: %v", cfg.Backend, err)
+		case isAuthError(err):
+			return fmt.Errorf("account %v isn't authenticated (`bgdrive-sync auth login` with drive_client %q): %v",
+				accountLabel(cfg), driveClientAPI, err)
+		case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			return fmt.Errorf("remote root %v not found, or not shared with account %v", rootID, accountLabel(cfg))
+		}
+		return fmt.Errorf("remote root %v can't be listed: %v", rootID, err)
+	}
+	if rootID == "." || cfg.DryRun {
+		return nil
+	}
+	probeID, err := drive.Mkdir(rootID, preflightProbeName)
+	if err != nil {
+		return fmt.Errorf("remote root %v isn't writable by account %v: %v", rootID, accountLabel(cfg), err)
+	}
+	if err = drive.Delete(probeID); err != nil {
+		return fmt.Errorf("remote root %v: deleting %v: %v", rootID, preflightProbeName, err)
+	}
+	return nil
+}
+
+func accountLabel(cfg *Config) string {
+	if cfg.GDAccountName == "" {
+		return "(default)"
+	}
+	return cfg.GDAccountName
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// transferProgress prints how far an upload got every interval: percentage, bytes transferred and the speed since
+// the previous line. Transfers finishing within the first interval print nothing.
+type transferProgress struct {
+	mu        *sync.Mutex
+	label     string
+	size      int64
+	interval  time.Duration
+	done      int64
+	lastPrint time.Time
+	lastDone  int64
+}
+
+// newTransferProgress starts tracking a transfer of size bytes, of which done are already transferred (a resumed
+// upload). It returns nil when interval disables the reporting.
+func newTransferProgress(label string, size, done int64, interval time.Duration) *transferProgress {
+	if interval <= 0 {
+		return nil
+	}
+	return &transferProgress{mu: &sync.Mutex{}, label: label, size: size, interval: interval, done: done,
+		lastPrint: time.Now(), lastDone: done}
+}
+
+// reader counts what is read from r as transferred, r itself when p is nil.
+func (p *transferProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+func (p *transferProgress) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += int64(n)
+	elapsed := time.Since(p.lastPrint)
+	if elapsed < p.interval {
+		return
+	}
+	speed := float64(p.done-p.lastDone) / elapsed.Seconds()
+	p.lastPrint, p.lastDone = time.Now(), p.done
+
+	percent := 100.0
+	if p.size > 0 {
+		percent = float64(p.done) * 100 / float64(p.size)
+	}
+	printOp("progress", p.label, fmt.Sprintf("%.1f%%, %v of %v, %v/s", percent, getFileSizeFormatted(p.done),
+		getFileSizeFormatted(p.size), getFileSizeFormatted(int64(speed))))
+}
+
+type progressReader struct {
+	r io.Reader
+	p *transferProgress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.p.add(n)
+	}
+	return n, err
+}
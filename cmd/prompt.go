@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	decisionDelete     = "delete"
+	decisionKeepLocal  = "keep_local"
+	decisionKeepRemote = "keep_remote"
+	decisionKeepBoth   = "keep_both"
+	decisionSkip       = "skip"
+)
+
+// Decision is the answer given to an interactive prompt about loc. It only applies while the remote object is
+// still GDId, so a changed object is asked about again.
+type Decision struct {
+	Choice    string    `json:"choice"`
+	GDId      string    `json:"gd_id"`
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+// decisionStore persists interactive decisions so the same question isn't asked every cycle.
+type decisionStore struct {
+	mu        *sync.Mutex
+	filePath  string
+	decisions map[string]*Decision
+
+	// conflictsMu serializes the conflict prompts of the pull workers, conflictsAll is the choice applied to all the
+	// remaining conflicts of the run
+	conflictsMu  *sync.Mutex
+	conflictsAll string
+}
+
+func newDecisionStore(filePath string) (*decisionStore, error) {
+	ds := &decisionStore{mu: &sync.Mutex{}, filePath: filePath, decisions: map[string]*Decision{}, conflictsMu: &sync.Mutex{}}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ds, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &ds.decisions); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return ds, nil
+}
+
+func (ds *decisionStore) get(loc, gdId string) (string, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	d, ok := ds.decisions[loc]
+	if !ok || d.GDId != gdId {
+		return "", false
+	}
+	return d.Choice, true
+}
+
+// record stores a decision. Skipping is never recorded so it is asked again next cycle, and deleting needs no
+// memory since the object is gone afterward.
+func (ds *decisionStore) record(loc, gdId, choice string) error {
+	if choice == decisionSkip || choice == decisionDelete {
+		return nil
+	}
+	ds.mu.Lock()
+	ds.decisions[loc] = &Decision{Choice: choice, GDId: gdId, DecidedAt: time.Now()}
+	data, err := json.MarshalIndent(ds.decisions, "", "\t")
+	ds.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ds.filePath, data, os.ModePerm)
+}
+
+type promptChoice struct {
+	key    string
+	label  string
+	choice string
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// isInteractive reports whether the user can answer prompts. Only sync --once and sync path ask them, see
+// Config.interactive.
+func isInteractive() bool {
+	return isTerminal(os.Stdin) && isTerminal(os.Stdout)
+}
+
+// prompt asks question until one of choices is picked. An upper-case key applies the choice to all remaining
+// questions of the same kind, which is reported through all.
+func prompt(question string, choices []promptChoice) (choice string, all bool, err error) {
+	var opts []string
+	for _, c := range choices {
+		opts = append(opts, fmt.Sprintf("[%v] %v", c.key, c.label))
+	}
+	for {
+		outputMu.Lock()
+		fmt.Printf("%v\n  %v (upper-case applies to all): ", question, strings.Join(opts, " "))
+		outputMu.Unlock()
+
+		line, err := stdinReader.ReadString('\n')
+		if err != nil {
+			return "", false, err
+		}
+		answer := strings.TrimSpace(line)
+		for _, c := range choices {
+			switch answer {
+			case c.key:
+				return c.choice, false, nil
+			case strings.ToUpper(c.key):
+				return c.choice, true, nil
+			}
+		}
+	}
+}
+
+// confirmDeletions asks the user about every pending deletion once their number exceeds the configured threshold.
+// Remote objects the user chose to keep stay in the object map and are not asked about again. Without a terminal
+// to ask on, or outside an interactive one-shot run, all deletions of the cycle are held back.
+func confirmDeletions(cfg *Config, ds *decisionStore, deletedQueue map[string]*Object) error {
+	for loc, object := range deletedQueue {
+		if choice, ok := ds.get(loc, object.GDId); ok && choice == decisionKeepRemote {
+			delete(deletedQueue, loc)
+		}
+	}
+	if cfg.DeleteConfirmThreshold <= 0 || len(deletedQueue) <= cfg.DeleteConfirmThreshold {
+		return nil
+	}
+
+	if !cfg.interactive {
+		printOp("warning", fmt.Sprintf("%v deletions exceed delete_confirm_threshold (%v)", len(deletedQueue), cfg.DeleteConfirmThreshold),
+			"held back, run sync --once on a terminal to confirm")
+		clear(deletedQueue)
+		return nil
+	}
+
+	choices := []promptChoice{
+		{key: "d", label: "delete remote", choice: decisionDelete},
+		{key: "k", label: "keep remote", choice: decisionKeepRemote},
+		{key: "s", label: "skip this cycle", choice: decisionSkip},
+	}
+	applyToAll := ""
+	for loc, object := range deletedQueue {
+		choice := applyToAll
+		if choice == "" {
+			var (
+				all bool
+				err error
+			)
+			choice, all, err = prompt(fmt.Sprintf("%v was removed locally (%v).", strings.TrimPrefix(loc, cfg.SyncTargetPath), getFileSizeFormatted(object.Size)), choices)
+			if err != nil {
+				return err
+			}
+			if all {
+				applyToAll = choice
+			}
+		}
+
+		if err := ds.record(loc, object.GDId, choice); err != nil {
+			return err
+		}
+		if choice != decisionDelete {
+			delete(deletedQueue, loc)
+		}
+	}
+	return nil
+}
+
+// askConflict asks the user how to resolve the conflict on rel: decisionKeepLocal, decisionKeepRemote,
+// decisionKeepBoth or decisionSkip. The answers aren't recorded, an answered conflict is resolved and a skipped one is
+// asked about again by the next run.
+func (ds *decisionStore) askConflict(rel, detail string) (string, error) {
+	ds.conflictsMu.Lock()
+	defer ds.conflictsMu.Unlock()
+	if ds.conflictsAll != "" {
+		return ds.conflictsAll, nil
+	}
+	choices := []promptChoice{
+		{key: "l", label: "keep local", choice: decisionKeepLocal},
+		{key: "r", label: "keep remote", choice: decisionKeepRemote},
+		{key: "b", label: "keep both", choice: decisionKeepBoth},
+		{key: "s", label: "skip this run", choice: decisionSkip},
+	}
+	choice, all, err := prompt(fmt.Sprintf("%v %v.", rel, detail), choices)
+	if err != nil {
+		return "", err
+	}
+	if all {
+		ds.conflictsAll = choice
+	}
+	return choice, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestConfirmDeletionsNotInteractive(t *testing.T) {
+	ds, err := newDecisionStore(filepath.Join(t.TempDir(), "decisions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ds.record("/target/kept", "id-kept", decisionKeepRemote); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{SyncTargetPath: "/target", DeleteConfirmThreshold: 2}
+
+	// under the threshold, only the deletions decided against before are dropped
+	queue := map[string]*Object{"/target/kept": {GDId: "id-kept"}, "/target/a": {GDId: "id-a"}, "/target/b": {GDId: "id-b"}}
+	if err = confirmDeletions(cfg, ds, queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue["/target/a"] == nil || queue["/target/b"] == nil {
+		t.Errorf("deletions under the threshold: %v, want /target/a and /target/b", queue)
+	}
+
+	// past it, without an interactive run to ask in, every deletion is held back instead of prompting
+	queue = map[string]*Object{"/target/a": {GDId: "id-a"}, "/target/b": {GDId: "id-b"}, "/target/c": {GDId: "id-c"}}
+	if err = confirmDeletions(cfg, ds, queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 0 {
+		t.Errorf("deletions past the threshold of a non-interactive run: %v, want none", queue)
+	}
+}
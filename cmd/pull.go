@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bearaujus/bworker/pool"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	syncDirectionPush = "push"
+	syncDirectionPull = "pull"
+	syncDirectionBoth = "both"
+	// syncDirectionMirror pulls only and keeps the local folder an exact copy of drive, see mirror.go
+	syncDirectionMirror = "mirror"
+)
+
+const skipReasonConflict = "conflict"
+
+// pullFiles mirrors folders and files created or modified on drive since the last sync into subtree (relative,
+// empty for everything) of the sync target. Remote modifications are detected from the remote modification time,
+// which only the api drive client provides; with the gdrive client only new remote files are pulled.
+func pullFiles(cfg *Config, om *ObjectManager, report *CycleReport, subtree string) error {
+	var erw error
+	bw := pool.NewBWorkerPool(cfg.poolWorkers(), pool.WithError(&erw))
+	defer bw.Shutdown()
+
+	var (
+		skipped   []SkippedPath
+		skippedMu sync.Mutex
+	)
+	skip := func(sp SkippedPath) {
+		skippedMu.Lock()
+		defer skippedMu.Unlock()
+		skipped = append(skipped, sp)
+	}
+
+	startLoc := filepath.Join(cfg.SyncTargetPath, subtree)
+	start, ok := om.loadObject(startLoc)
+	if !ok || om.isLocked(start) {
+		return nil // the subtree doesn't exist remotely yet, nothing to pull
+	}
+	converted := map[string]bool{}
+	byID := map[string]string{} // where the tracked objects are, to tell those moved on drive
+	seen := map[string]bool{}   // the remote files listed, to tell the tracked ones gone from drive
+	om.SnapshotObjects().each(func(loc string, object *Object) {
+		if object.Converted {
+			converted[object.GDId] = true
+		}
+		if object.GDId != "" {
+			byID[object.GDId] = loc
+		}
+	})
+
+	var walk func(loc, folderID string) error
+	walk = func(loc, folderID string) error {
+		if shuttingDown() {
+			return errShutdown
+		}
+		files, err := om.drive.List(folderID, "")
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if loc == startLoc && subtree == "" && isRemoteMetaName(f.Name) {
+				continue
+			}
+			if rel, err := filepath.Rel(cfg.SyncTargetPath, filepath.Join(loc, f.Name)); err == nil && routedAway(cfg, filepath.ToSlash(rel)) {
+				continue // pulled by its route
+			}
+			seen[f.ID] = true
+			if err = om.waitWhilePaused(bw.Wait); err != nil {
+				return err
+			}
+			childLoc := filepath.Join(loc, f.Name)
+			if oldLoc, ok := byID[f.ID]; ok {
+				newLoc, sp, err := om.followRemoteMove(oldLoc, loc, folderID, f)
+				if err != nil {
+					return err
+				}
+				if sp != nil {
+					skip(*sp)
+					continue
+				}
+				if newLoc == "" {
+					continue // left where it is tracked
+				}
+				if newLoc != oldLoc {
+					for l, o := range om.objectsBelow(newLoc) {
+						byID[o.GDId] = l
+					}
+				}
+			}
+			if f.IsGoogleNative() && converted[f.ID] {
+				continue // uploaded from a local file by google_convert
+			}
+			if !f.IsDir {
+				if shuttingDown() {
+					return errShutdown
+				}
+				fCp, parentID, dirLoc := f, folderID, loc
+				bw.Do(func() error {
+					sp, err := om.pullRemoteFile(dirLoc, parentID, fCp)
+					if sp != nil {
+						skip(*sp)
+					}
+					return err
+				})
+				continue
+			}
+
+			sp, err := om.PullFolder(childLoc, folderID, f)
+			if err != nil {
+				return err
+			}
+			if sp != nil {
+				skip(*sp)
+				continue
+			}
+			if err = walk(childLoc, f.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(startLoc, start.GDId)
+	bw.Wait()
+	if shuttingDown() {
+		return errShutdown
+	}
+	report.addSkipped(cfg, skipped)
+	if err != nil {
+		return err
+	}
+	if erw != nil {
+		return erw
+	}
+	if cfg.SyncDirection == syncDirectionMirror {
+		return om.forgetVanished(startLoc, seen, byID, skipped)
+	}
+	return nil
+}
+
+// followRemoteMove applies remote_moves to the object tracked at loc when the remote file f was found in the folder
+// dirLoc. It returns the location f is tracked at, or "" when f is left where it was tracked, such as when it was
+// moved back on drive.
+func (om *ObjectManager) followRemoteMove(loc, dirLoc, parentID string, f *RemoteFile) (string, *SkippedPath, error) {
+	object, ok := om.loadObject(loc)
+	if !ok || object.GDId != f.ID {
+		return loc, nil, nil
+	}
+	newLoc := filepath.Join(dirLoc, om.localName(f, object, loc))
+	if newLoc == loc {
+		return loc, nil, nil
+	}
+	moved, sp, err := om.applyRemoteMove(loc, newLoc, parentID, object)
+	if moved == loc {
+		return "", sp, err
+	}
+	return moved, sp, err
+}
+
+// pullRemoteFile pulls the remote file f of the folder dirLoc, exported when it is a google native one.
+func (om *ObjectManager) pullRemoteFile(dirLoc, parentID string, f *RemoteFile) (*SkippedPath, error) {
+	if !f.IsGoogleNative() {
+		return om.PullFile(filepath.Join(dirLoc, f.Name), parentID, f)
+	}
+	name, mimeType, ok := googleExportFormat(om.cfg, f)
+	if !ok {
+		return &SkippedPath{Loc: filepath.Join(dirLoc, f.Name), Reason: skipReasonGoogleNative, Detail: f.MimeType}, nil
+	}
+	return om.PullExport(filepath.Join(dirLoc, name), parentID, f, mimeType)
+}
+
+// PullFolder creates the local counterpart of the remote folder f and tracks it. A local folder of the same name
+// is adopted. It returns a SkippedPath when loc is already tracked as a different remote object.
+func (om *ObjectManager) PullFolder(loc, parentID string, f *RemoteFile) (*SkippedPath, error) {
+	if object, tracked := om.loadObject(loc); tracked {
+		if object.GDId != f.ID {
+			return &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "tracked as another remote folder"}, nil
+		}
+		if om.cfg.SyncDirection == syncDirectionMirror && !om.cfg.DryRun {
+			return nil, os.MkdirAll(loc, os.ModePerm) // deleted locally, the mirror brings it back
+		}
+		return nil, nil
+	}
+
+	var size int64
+	if !om.cfg.DryRun {
+		if err := os.MkdirAll(loc, os.ModePerm); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(loc)
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+	}
+	if !om.storeObject(loc, &Object{GDId: f.ID, GDPId: parentID, Size: size}) {
+		return nil, nil
+	}
+	om.recordOp("pulled", loc, f.ID, 0)
+	printOp("pulled", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "folder")
+	return nil, nil
+}
+
+// PullFile downloads the remote file f to loc when it is new or changed remotely since the last sync. When the local
+// side changed too, or loc holds a file unknown to the object map, the conflict is resolved by conflict_policy.
+func (om *ObjectManager) PullFile(loc, parentID string, f *RemoteFile) (*SkippedPath, error) {
+	object, tracked := om.loadObject(loc)
+	localInfo, statErr := os.Stat(longPath(loc))
+	localExists := statErr == nil
+
+	if !tracked {
+		if localExists {
+			if localInfo.IsDir() {
+				return &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "a folder locally, a file remotely"}, nil
+			}
+			return om.resolveConflict(loc, parentID, f, localInfo, nil, "exists locally and remotely but is not tracked")
+		}
+		if om.cfg.DryRun {
+			om.recordOp("downloaded", loc, f.ID, f.Size)
+			printOp("downloaded", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(f.Size))
+			return nil, nil
+		}
+		placeholder := &Object{GDPId: parentID}
+		if !om.storeObject(loc, placeholder) {
+			return nil, nil
+		}
+		info, err := om.download(loc, f)
+		if err != nil {
+			om.deleteObject(loc)
+			return nil, err
+		}
+		om.updateStoredObject(placeholder, func(o *Object) {
+			o.GDId = f.ID
+			o.LastMod = info.ModTime().Unix()
+			o.Size = info.Size()
+			o.RemoteMod = remoteModUnix(f)
+			o.MD5 = f.MD5
+		})
+		om.recordOp("downloaded", loc, f.ID, info.Size())
+		printOp("downloaded", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(info.Size()))
+		return nil, nil
+	}
+
+	if object.GDId != f.ID {
+		return &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "tracked as another remote file"}, nil
+	}
+	remoteMod := remoteModUnix(f)
+	if remoteMod == 0 || remoteMod <= object.RemoteMod {
+		if om.cfg.SyncDirection == syncDirectionMirror && !mirrored(localInfo, object) {
+			detail := "changed locally"
+			if !localExists {
+				detail = "deleted locally"
+			}
+			return om.resolveConflict(loc, parentID, f, localInfo, object, detail)
+		}
+		if f.MD5 != "" && object.MD5 != "" && !strings.EqualFold(f.MD5, object.MD5) {
+			// the content changed on drive without its modification time moving forward
+			return &SkippedPath{Loc: loc, Reason: skipReasonChecksumMismatch, Detail: fmt.Sprintf("remote md5 %v, last synced %v", f.MD5, object.MD5)}, nil
+		}
+		return nil, nil
+	}
+	if object.RemoteMod == 0 {
+		// first time the remote modification time is known, take it as the baseline
+		om.updateStoredObject(object, func(o *Object) { o.RemoteMod = remoteMod })
+		return nil, nil
+	}
+	if localExists && localInfo.ModTime().Unix() > object.LastMod {
+		return om.resolveConflict(loc, parentID, f, localInfo, object, "changed locally and remotely")
+	}
+	if om.cfg.DryRun {
+		om.recordOp("downloaded", loc, f.ID, f.Size)
+		printOp("downloaded", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), getFileSizeFormatted(f.Size))
+		return nil, nil
+	}
+
+	info, err := om.download(loc, f)
+	if err != nil {
+		return nil, err
+	}
+	originSize := object.Size
+	om.updateStoredObject(object, func(o *Object) {
+		o.LastMod = info.ModTime().Unix()
+		o.Size = info.Size()
+		o.RemoteMod = remoteMod
+		o.MD5 = f.MD5
+	})
+	om.recordOp("downloaded", loc, f.ID, info.Size())
+	printOp("downloaded", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), fmt.Sprintf("%v -> %v", getFileSizeFormatted(originSize), getFileSizeFormatted(info.Size())))
+	return nil, nil
+}
+
+// download fetches f next to loc and moves it in place once complete, carrying over the remote modification time.
+func (om *ObjectManager) download(loc string, f *RemoteFile) (os.FileInfo, error) {
+	return fetch(loc, f, func(tmpLoc string) error { return om.drive.Download(f.ID, tmpLoc) })
+}
+
+// fetch has get write the content of f to a temporary file next to loc, of the same extension, and moves it in place
+// once complete, carrying over the remote modification time.
+func fetch(loc string, f *RemoteFile, get func(tmpLoc string) error) (os.FileInfo, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(longPath(loc)), ".bgdrive-sync-download-*"+filepath.Ext(loc))
+	if err != nil {
+		return nil, err
+	}
+	tmpLoc := tmp.Name()
+	_ = tmp.Close()
+	defer os.Remove(tmpLoc)
+
+	if err = get(tmpLoc); err != nil {
+		return nil, err
+	}
+	if !f.ModTime.IsZero() {
+		if err = os.Chtimes(tmpLoc, f.ModTime, f.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	if err = os.Rename(tmpLoc, longPath(loc)); err != nil {
+		return nil, err
+	}
+	return os.Stat(longPath(loc))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultPushgatewayJob = "bgdrive-sync"
+
+// pushMetrics pushes the metrics of a finished cycle to a Prometheus Pushgateway, for short-lived runs that can't
+// be scraped. Pushing replaces the previous metrics of this job and instance (and target, when there are several).
+func pushMetrics(cfg *Config, report *CycleReport) error {
+	job := cfg.PushgatewayJob
+	if job == "" {
+		job = defaultPushgatewayJob
+	}
+	target := fmt.Sprintf("%v/metrics/job/%v/instance/%v", strings.TrimSuffix(cfg.PushgatewayURL, "/"),
+		url.PathEscape(job), url.PathEscape(hostname()))
+	if cfg.targetName != "" {
+		target += "/target/" + url.PathEscape(cfg.targetName)
+	}
+
+	success := 1
+	if report.Failed() {
+		success = 0
+	}
+	created, updated, deleted := report.Counts()
+
+	buf := bytes.NewBuffer(nil)
+	writeGauge := func(name, help string, v any) {
+		fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", name, help, name, name, v)
+	}
+	writeGauge("bgdrive_sync_last_cycle_success", "Whether the last sync cycle succeeded.", success)
+	writeGauge("bgdrive_sync_last_cycle_timestamp_seconds", "Unix time the last sync cycle finished.", report.End.Unix())
+	writeGauge("bgdrive_sync_last_cycle_duration_seconds", "Duration of the last sync cycle.", report.End.Sub(report.Start).Seconds())
+	writeGauge("bgdrive_sync_last_cycle_bytes_transferred", "Bytes uploaded during the last sync cycle.", report.BytesTransferred())
+	writeGauge("bgdrive_sync_last_cycle_created", "Objects created during the last sync cycle.", created)
+	writeGauge("bgdrive_sync_last_cycle_updated", "Objects updated during the last sync cycle.", updated)
+	writeGauge("bgdrive_sync_last_cycle_deleted", "Objects deleted during the last sync cycle.", deleted)
+	writeGauge("bgdrive_sync_last_cycle_skipped", "Paths skipped during the last sync cycle.", len(report.Skipped))
+	writeGauge("bgdrive_sync_last_cycle_errors", "Errors of the last sync cycle.", 1-success)
+
+	req, err := http.NewRequest(http.MethodPut, target, buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pushgateway responded %v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
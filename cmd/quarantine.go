@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQuarantineAfterFailures = 3
+
+	skipReasonFailed      = "failed"
+	skipReasonQuarantined = "quarantined"
+)
+
+func quarantineAfterFailures(cfg *Config) int {
+	if cfg.QuarantineAfterFailures <= 0 {
+		return defaultQuarantineAfterFailures
+	}
+	return cfg.QuarantineAfterFailures
+}
+
+// QuarantinedFile counts the consecutive failed syncs of a file. Once quarantined, the file is skipped until its size
+// or modification time changes, or it is released with state quarantine --clear.
+type QuarantinedFile struct {
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error"`
+	Size        int64      `json:"size"`
+	ModTime     int64      `json:"mod_time"`
+	Quarantined *time.Time `json:"quarantined,omitempty"`
+}
+
+// quarantineStore persists the failures of the files which keep failing to sync, in quarantine.json.
+type quarantineStore struct {
+	mu       *sync.Mutex
+	filePath string
+	files    map[string]*QuarantinedFile
+	dirty    bool
+}
+
+func newQuarantineStore(filePath string) (*quarantineStore, error) {
+	qs := &quarantineStore{mu: &sync.Mutex{}, filePath: filePath, files: map[string]*QuarantinedFile{}}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return qs, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &qs.files); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return qs, nil
+}
+
+// remoteFileError is drive failing the transfer of a single file for a reason of that file, such as a checksum
+// which keeps mismatching or a name drive refuses.
+type remoteFileError struct {
+	err error
+}
+
+func (e *remoteFileError) Error() string { return e.err.Error() }
+
+func (e *remoteFileError) Unwrap() error { return e.err }
+
+// asRemoteFileError marks the error drive failed the transfer of a file with as a remoteFileError, unless it fails
+// every transfer alike: an exhausted upload quota, rejected credentials, rate limits and network failures.
+func asRemoteFileError(err error) error {
+	if err == nil || isFileError(err) || errors.Is(err, errShutdown) || isUploadLimitError(err) || isAuthError(err) ||
+		isRetryableDriveError(err) {
+		return err
+	}
+	return &remoteFileError{err: err}
+}
+
+// isFileError reports errors of the file itself, locally (locked, unreadable, vanished) or on drive, which fail that
+// file alone instead of the whole cycle.
+func isFileError(err error) bool {
+	var (
+		pathErr   *fs.PathError
+		remoteErr *remoteFileError
+	)
+	return (errors.As(err, &pathErr) || errors.As(err, &remoteErr)) && !errors.Is(err, errShutdown)
+}
+
+// quarantined returns the quarantine of wr, or nil when it is not quarantined or changed since, which releases it.
+func (qs *quarantineStore) quarantined(wr *WalkResp) *QuarantinedFile {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qf, ok := qs.files[wr.loc]
+	if !ok || qf.Quarantined == nil {
+		return nil
+	}
+	if qf.Size != wr.size || qf.ModTime != wr.modTimeUnix {
+		delete(qs.files, wr.loc)
+		qs.dirty = true
+		return nil
+	}
+	return qf
+}
+
+// failed counts a failed sync of wr and reports whether it got quarantined by it.
+func (qs *quarantineStore) failed(wr *WalkResp, err error, after int) bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qf, ok := qs.files[wr.loc]
+	if !ok {
+		qf = &QuarantinedFile{}
+		qs.files[wr.loc] = qf
+	}
+	qf.Failures++
+	qf.LastError, qf.Size, qf.ModTime = err.Error(), wr.size, wr.modTimeUnix
+	qs.dirty = true
+	if qf.Failures < after || qf.Quarantined != nil {
+		return false
+	}
+	now := time.Now()
+	qf.Quarantined = &now
+	return true
+}
+
+func (qs *quarantineStore) succeeded(loc string) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if _, ok := qs.files[loc]; ok {
+		delete(qs.files, loc)
+		qs.dirty = true
+	}
+}
+
+// release forgets the failures of the files at or below loc, all of them when loc is empty, and returns how many.
+func (qs *quarantineStore) release(loc string) int {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	released := 0
+	for qLoc := range qs.files {
+		if loc == "" || isUnderAny(qLoc, []SkippedPath{{Loc: loc}}) {
+			delete(qs.files, qLoc)
+			released++
+		}
+	}
+	qs.dirty = qs.dirty || released != 0
+	return released
+}
+
+// list returns the quarantined files sorted by path.
+func (qs *quarantineStore) list() []string {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	var locs []string
+	for loc, qf := range qs.files {
+		if qf.Quarantined != nil {
+			locs = append(locs, loc)
+		}
+	}
+	sort.Strings(locs)
+	return locs
+}
+
+func (qs *quarantineStore) save() error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if !qs.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(qs.files, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(qs.filePath, data, os.ModePerm); err != nil {
+		return err
+	}
+	qs.dirty = false
+	return nil
+}
+
+// printQuarantine lists the quarantined files of cfg.
+func printQuarantine(cfg *Config, qs *quarantineStore) {
+	for _, loc := range qs.list() {
+		qf := qs.files[loc]
+		printOp(skipReasonQuarantined, strings.TrimPrefix(loc, cfg.SyncTargetPath),
+			fmt.Sprintf("%v failures since %v, last: %v", qf.Failures, qf.Quarantined.Format(time.DateTime), qf.LastError))
+	}
+}
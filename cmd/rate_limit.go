@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of bytes, refilled at rate bytes per second and holding at most one second worth.
+type rateLimiter struct {
+	mu     *sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+var (
+	rateLimitersMu = &sync.Mutex{}
+	rateLimiters   = map[string]*rateLimiter{}
+	// rateLimits is the rate every shared limiter was set up with, 0 for none, which a restart only changes
+	rateLimits = map[string]float64{}
+)
+
+// rateLimitSettings names the setting of every shared limiter, for the errors.
+var rateLimitSettings = map[string]string{"upload": "max_upload_rate", "download": "max_download_rate",
+	"requests": "max_drive_qps"}
+
+// parseRate parses a transfer rate such as "10MB/s" or "512KB". An empty string is no limit.
+func parseRate(s string) (int64, error) {
+	v, err := parseByteSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return v, nil
+}
+
+// sharedRateLimiter returns the limiter of the given direction, nil without a limit. Targets of the same process
+// share one limiter per direction since they share the same link, so it fails when the process already limits
+// that direction to another rate.
+func sharedRateLimiter(direction, rate string) (*rateLimiter, error) {
+	bps, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	if err = rateLimitMismatch(direction, float64(bps)); err != nil {
+		return nil, err
+	}
+	if _, ok := rateLimits[direction]; ok {
+		return rateLimiters[direction], nil
+	}
+	rateLimits[direction] = float64(bps)
+	if bps == 0 {
+		return nil, nil
+	}
+	l := &rateLimiter{mu: &sync.Mutex{}, rate: float64(bps), tokens: float64(bps), last: time.Now()}
+	rateLimiters[direction] = l
+	return l, nil
+}
+
+// rateLimitMismatch fails when the shared limiter of key is set up with another rate than rate. rateLimitersMu must
+// be held.
+func rateLimitMismatch(key string, rate float64) error {
+	inUse, ok := rateLimits[key]
+	if !ok || inUse == rate {
+		return nil
+	}
+	format := func(r float64) string {
+		switch {
+		case r == 0:
+			return "no limit"
+		case key == "requests":
+			return fmt.Sprintf("%v requests/s", r)
+		default:
+			return getFileSizeFormatted(int64(r)) + "/s"
+		}
+	}
+	return fmt.Errorf("%v: shared by every target, already in use with %v instead of %v until a restart",
+		rateLimitSettings[key], format(inUse), format(rate))
+}
+
+// checkRateLimits fails when cfg sets another rate than the one a shared limiter of the process is set up with,
+// which a reload can't change.
+func checkRateLimits(cfg *Config) error {
+	rateLimitersMu.Lock()
+	err := rateLimitMismatch("requests", cfg.MaxDriveQPS)
+	rateLimitersMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for direction, rate := range map[string]string{"upload": cfg.MaxUploadRate, "download": cfg.MaxDownloadRate} {
+		bps, err := parseRate(rate)
+		if err != nil {
+			return err
+		}
+		rateLimitersMu.Lock()
+		err = rateLimitMismatch(direction, float64(bps))
+		rateLimitersMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedRequestLimiter returns the limiter of the drive requests, nil without max_drive_qps. Like the transfer
+// limiters, it is shared by the targets of the process, drive enforcing its limits per user, and fails when the
+// process already limits the requests to another rate.
+func sharedRequestLimiter(qps float64) (*rateLimiter, error) {
+	if qps < 0 {
+		return nil, fmt.Errorf("max_drive_qps: must not be negative")
+	}
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	if err := rateLimitMismatch("requests", qps); err != nil {
+		return nil, err
+	}
+	if _, ok := rateLimits["requests"]; ok {
+		return rateLimiters["requests"], nil
+	}
+	rateLimits["requests"] = qps
+	if qps == 0 {
+		return nil, nil
+	}
+	l := &rateLimiter{mu: &sync.Mutex{}, rate: qps, tokens: qps, last: time.Now()}
+	rateLimiters["requests"] = l
+	return l, nil
+}
+
+// wait blocks until n bytes may be transferred. n must not exceed the bucket size.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	// waiting under the lock queues the other transfers behind this one, which keeps the total under the rate
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+	l.mu.Unlock()
+}
+
+// reader returns r throttled by l, r itself when l is nil.
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, l: l}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > int(t.l.rate) {
+		p = p[:int(t.l.rate)]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.l.wait(n)
+	}
+	return n, err
+}
+
+// requestLimitedTransport holds every http request to drive until the request limiter lets it through.
+type requestLimitedTransport struct {
+	base http.RoundTripper
+	l    *rateLimiter
+}
+
+func (t *requestLimitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.l.wait(1)
+	return t.base.RoundTrip(r)
+}
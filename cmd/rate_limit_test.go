@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+// resetRateLimiters forgets the shared limiters for the duration of the test.
+func resetRateLimiters(t *testing.T) {
+	t.Helper()
+	rateLimitersMu.Lock()
+	limiters, limits := rateLimiters, rateLimits
+	rateLimiters, rateLimits = map[string]*rateLimiter{}, map[string]float64{}
+	rateLimitersMu.Unlock()
+	t.Cleanup(func() {
+		rateLimitersMu.Lock()
+		rateLimiters, rateLimits = limiters, limits
+		rateLimitersMu.Unlock()
+	})
+}
+
+func TestSharedRateLimiterMismatch(t *testing.T) {
+	resetRateLimiters(t)
+	l, err := sharedRateLimiter("upload", "1MB/s")
+	if err != nil || l == nil {
+		t.Fatalf("first limiter: %v, %v", l, err)
+	}
+	if again, err := sharedRateLimiter("upload", "1MB/s"); err != nil || again != l {
+		t.Errorf("the same rate got %v, %v, want the shared limiter", again, err)
+	}
+	for _, rate := range []string{"2MB/s", ""} {
+		if _, err = sharedRateLimiter("upload", rate); err == nil {
+			t.Errorf("max_upload_rate %q accepted while the process limits uploads to 1MB/s", rate)
+		}
+	}
+
+	if _, err = sharedRateLimiter("download", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sharedRateLimiter("download", "1MB/s"); err == nil {
+		t.Error("max_download_rate accepted while the process doesn't limit downloads")
+	}
+
+	if err = checkRateLimits(&Config{MaxUploadRate: "1MB/s"}); err != nil {
+		t.Errorf("reload with the same rates: %v", err)
+	}
+	if err = checkRateLimits(&Config{MaxUploadRate: "5MB/s"}); err == nil {
+		t.Error("reload changing max_upload_rate accepted")
+	}
+}
+
+func TestSharedRequestLimiterMismatch(t *testing.T) {
+	resetRateLimiters(t)
+	l, err := sharedRequestLimiter(5)
+	if err != nil || l == nil {
+		t.Fatalf("first limiter: %v, %v", l, err)
+	}
+	if again, err := sharedRequestLimiter(5); err != nil || again != l {
+		t.Errorf("the same rate got %v, %v, want the shared limiter", again, err)
+	}
+	for _, qps := range []float64{10, 0} {
+		if _, err = sharedRequestLimiter(qps); err == nil {
+			t.Errorf("max_drive_qps %v accepted while the process limits requests to 5/s", qps)
+		}
+	}
+	if err = checkRateLimits(&Config{MaxDriveQPS: 5}); err != nil {
+		t.Errorf("reload with the same rate: %v", err)
+	}
+	if err = checkRateLimits(&Config{MaxDriveQPS: 1}); err == nil {
+		t.Error("reload changing max_drive_qps accepted")
+	}
+}
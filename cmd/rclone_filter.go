@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rcloneFilterRule is a single "+ pattern" or "- pattern" line of an rclone filter file.
+type rcloneFilterRule struct {
+	include bool
+	dirOnly bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// rcloneFilter evaluates rules in order, the first matching rule wins and paths matching no rule are included,
+// same as rclone's --filter-from.
+type rcloneFilter struct {
+	rules []*rcloneFilterRule
+}
+
+func loadRcloneFilter(filePath string) (*rcloneFilter, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rf := &rcloneFilter{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if line == "!" {
+			rf.rules = nil
+			continue
+		}
+		if len(line) < 3 || (line[0] != '+' && line[0] != '-') || line[1] != ' ' {
+			return nil, fmt.Errorf("%v:%v: malformed rule %q, expected \"+ pattern\" or \"- pattern\"", filePath, lineNo, line)
+		}
+
+		rule, err := newRcloneFilterRule(line[0] == '+', strings.TrimSpace(line[2:]))
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", filePath, lineNo, err)
+		}
+		rf.rules = append(rf.rules, rule)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func newRcloneFilterRule(include bool, pattern string) (*rcloneFilterRule, error) {
+	re, err := rcloneGlobToRegexp(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return &rcloneFilterRule{include: include, dirOnly: strings.HasSuffix(pattern, "/"), pattern: pattern, re: re}, nil
+}
+
+// rcloneGlobToRegexp converts rclone's glob syntax: a leading / anchors to the root (otherwise the pattern matches
+// the end of the path at any depth), * and ? don't cross /, ** does, plus [class], {alt,ernatives} and \ escapes.
+func rcloneGlobToRegexp(pattern string) (*regexp.Regexp, error) {
+	sb := &strings.Builder{}
+	if strings.HasPrefix(pattern, "/") {
+		sb.WriteString("^")
+		pattern = pattern[1:]
+	} else {
+		sb.WriteString("(^|/)")
+	}
+
+	inBraces := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			sb.WriteString(".*")
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [")
+			}
+			sb.WriteString(pattern[i : i+end+1])
+			i += end
+		case c == '{' && !inBraces:
+			inBraces = true
+			sb.WriteString("(")
+		case c == '}' && inBraces:
+			inBraces = false
+			sb.WriteString(")")
+		case c == ',' && inBraces:
+			sb.WriteString("|")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if inBraces {
+		return nil, fmt.Errorf("unclosed {")
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// excluded reports whether rel (slash separated, relative to the sync target) is filtered out, and by which rule.
+// Directories are only decided by directory rules ("dir/" or "dir/**"), matched with a trailing slash. Other rules
+// such as "- **" may still let files inside a directory through, so they never prune a subtree on their own.
+func (rf *rcloneFilter) excluded(rel string, isDir bool) (bool, string) {
+	for _, rule := range rf.rules {
+		if isDir {
+			if !rule.dirOnly && !strings.HasSuffix(rule.pattern, "/**") || !rule.re.MatchString(rel+"/") {
+				continue
+			}
+		} else if rule.dirOnly || !rule.re.MatchString(rel) {
+			continue
+		}
+		return !rule.include, rule.pattern
+	}
+	return false, ""
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bearaujus/bworker/pool"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func newReconcileCmd(cf *configFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "reconcile",
+		Short: "Forget the tracked objects that no longer exist on drive, so the next sync uploads them again",
+		Long: "List the remote children of every tracked folder and forget the tracked folders and files that are gone\n" +
+			"from drive (deleted or moved by hand), with everything below them. The next sync uploads what still exists\n" +
+			"locally. The remote modification time of the files whose content on drive is the synced one is read back\n" +
+			"into the object map. Nothing is changed on drive. With --dry-run, only prints what would be forgotten.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			for _, tcfg := range targets {
+				om, err := NewObjectManager(tcfg)
+				if err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+				if err = reconcileTarget(tcfg, om); err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// reconcileTarget forgets the objects of om gone from drive, with everything tracked below them, and reads back the
+// remote modification time of the files still holding the synced content.
+func reconcileTarget(cfg *Config, om *ObjectManager) error {
+	objects := om.CopyObjects()
+	var missing []string
+	remoteMods := map[string]int64{}
+	err := walkTrackedRemote(cfg, om.drive, objects, "", func(_ string, tracked []string, files []*RemoteFile) {
+		present := make(map[string]*RemoteFile, len(files))
+		for _, f := range files {
+			present[f.ID] = f
+		}
+		for _, loc := range tracked {
+			object := objects[loc]
+			if object.GDId == "" {
+				continue // objects left locked by an interrupted cycle are retried by the next one
+			}
+			f, ok := present[object.GDId]
+			switch {
+			case !ok:
+				missing = append(missing, loc)
+			case !f.IsDir && f.MD5 != "" && f.MD5 == object.MD5 && remoteModUnix(f) != 0 && remoteModUnix(f) != object.RemoteMod:
+				remoteMods[loc] = remoteModUnix(f)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(missing)
+	gone := make([]SkippedPath, len(missing))
+	for i, loc := range missing {
+		gone[i] = SkippedPath{Loc: loc}
+	}
+	forgotten := 0
+	for loc := range objects {
+		if isUnderAny(loc, gone) {
+			om.deleteObject(loc)
+			forgotten++
+		}
+	}
+	findings := make([]string, len(missing))
+	for i, loc := range missing {
+		detail := "gone from drive, uploaded again by the next sync"
+		if _, err := os.Lstat(longPath(loc)); errors.Is(err, os.ErrNotExist) {
+			detail = "gone from drive and locally"
+		}
+		printOp("forgot", strings.TrimPrefix(loc, cfg.SyncTargetPath), detail)
+		findings[i] = strings.TrimPrefix(loc, cfg.SyncTargetPath) + ": " + detail
+	}
+	for loc, remoteMod := range remoteMods {
+		if object, ok := om.loadObject(loc); ok {
+			om.updateStoredObject(object, func(o *Object) { o.RemoteMod = remoteMod })
+		}
+	}
+	if err := om.SaveToFile(); err != nil {
+		return err
+	}
+	if err := recordDrift(cfg, findings); err != nil {
+		return err
+	}
+	fmt.Printf("%vreconciled %v tracked objects, %v forgotten, %v remote modification times read back\n", cfg.targetLabel(),
+		len(objects), forgotten, len(remoteMods))
+	return nil
+}
+
+// walkTrackedRemote lists the remote root and every tracked folder still on drive, level by level so a folder gone
+// from drive is not listed itself, and calls visit with each listed folder, the locs of its tracked children and its
+// remote children. With subtree, only the folders in it and on the way to it are listed. visit is not called
+// concurrently.
+func walkTrackedRemote(cfg *Config, drive DriveClient, objects map[string]*Object, subtree string,
+	visit func(dir string, tracked []string, files []*RemoteFile)) error {
+	children := map[string][]string{}
+	for loc := range objects {
+		if loc != cfg.SyncTargetPath {
+			children[filepath.Dir(loc)] = append(children[filepath.Dir(loc)], loc)
+		}
+	}
+
+	var (
+		erw error
+		mu  sync.Mutex
+	)
+	bw := pool.NewBWorkerPool(cfg.poolWorkers(), pool.WithError(&erw))
+	defer bw.Shutdown()
+	subtreeRoot := filepath.Join(cfg.SyncTargetPath, subtree)
+	for level := []string{cfg.SyncTargetPath}; len(level) != 0; {
+		var next []string
+		for _, dir := range level {
+			if !isInSubtree(cfg, dir, subtree) && !isUnderAny(subtreeRoot, []SkippedPath{{Loc: dir}}) {
+				continue
+			}
+			folderID := remoteRootID(cfg)
+			if dir != cfg.SyncTargetPath {
+				folderID = objects[dir].GDId
+			}
+			dirCp := dir
+			bw.Do(func() error {
+				files, err := drive.List(folderID, "")
+				if err != nil {
+					return err
+				}
+				present := make(map[string]bool, len(files))
+				for _, f := range files {
+					present[f.ID] = f.IsDir
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				visit(dirCp, children[dirCp], files)
+				for _, loc := range children[dirCp] {
+					if object := objects[loc]; object.LastMod == 0 && object.GDId != "" && present[object.GDId] {
+						next = append(next, loc)
+					}
+				}
+				return nil
+			})
+		}
+		bw.Wait()
+		if erw != nil {
+			return erw
+		}
+		level = next
+	}
+	return nil
+}
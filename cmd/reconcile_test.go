@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileTarget(t *testing.T) {
+	cfg := newTestTarget(t)
+	cfg.Digest = digestDaily
+	now := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "a", now)
+	writeTestFile(t, cfg, "docs/b.txt", "b", now)
+	writeTestFile(t, cfg, "docs/c.txt", "c", now)
+	writeTestFile(t, cfg, "old/d.txt", "d", now)
+	// sibling folders at the same depth, each listing matched to its own tracked children
+	writeTestFile(t, cfg, "music/e.txt", "e", now)
+	writeTestFile(t, cfg, "pics/f.txt", "f", now)
+	writeTestFile(t, cfg, "pics/g.txt", "g", now)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	// deleted on drive by hand, behind the back of the sync
+	client, err := newFakeDriveClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"docs/b.txt", "old", "pics/g.txt"} {
+		object, _ := om.loadObject(filepath.Join(cfg.SyncTargetPath, filepath.FromSlash(rel)))
+		if err = client.Delete(object.GDId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = reconcileTarget(cfg, om); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	for rel, want := range map[string]bool{
+		"a.txt":       true,
+		"docs":        true,
+		"docs/b.txt":  false,
+		"docs/c.txt":  true,
+		"old":         false,
+		"old/d.txt":   false,
+		"music":       true,
+		"music/e.txt": true,
+		"pics":        true,
+		"pics/f.txt":  true,
+		"pics/g.txt":  false,
+	} {
+		if _, ok := om.loadObject(filepath.Join(cfg.SyncTargetPath, filepath.FromSlash(rel))); ok != want {
+			t.Errorf("%v tracked after reconcile: %v, want %v", rel, ok, want)
+		}
+	}
+
+	// what was found gone from drive is drift of the digest
+	da, err := newDigestAggregator(cfg.Digest, cfg.statePath(digestStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := da.current; d == nil || d.DriftFindings != 3 || len(d.Drift) != 3 {
+		t.Errorf("digest holds drift %+v, want the 3 findings", d)
+	} else if text := d.String(); !strings.Contains(text, "drift: 3\n") || !strings.Contains(text, "pics/g.txt") {
+		t.Errorf("digest renders the drift as\n%v", text)
+	}
+
+	// what was forgotten still exists locally and is uploaded again
+	runTestCycle(t, cfg, om)
+	assertTree(t, fakeTree(t, cfg), map[string]string{
+		"a.txt":       "a",
+		"docs/":       "",
+		"docs/b.txt":  "b",
+		"docs/c.txt":  "c",
+		"old/":        "",
+		"old/d.txt":   "d",
+		"music/":      "",
+		"music/e.txt": "e",
+		"pics/":       "",
+		"pics/f.txt":  "f",
+		"pics/g.txt":  "g",
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const configWatchInterval = 5 * time.Second
+
+// watchConfigReloads reads the config again on SIGHUP, and when config_watch is set whenever the config file
+// changes, and hands the new settings over to the running targets. A config that fails to load is reported and the
+// current one kept.
+func watchConfigReloads(targets []*Config, reload func() ([]*Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changed <-chan time.Time
+	if targets[0].ConfigWatch {
+		t := time.NewTicker(configWatchInterval)
+		changed = t.C
+	}
+
+	go func() {
+		last, _ := os.Stat(configPath)
+		for {
+			select {
+			case <-shutdown:
+				return
+			case <-hup:
+			case <-changed:
+				info, err := os.Stat(configPath)
+				if err != nil || last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+					continue
+				}
+				last = info
+			}
+			reloadTargets(targets, reload)
+		}
+	}()
+}
+
+func reloadTargets(targets []*Config, reload func() ([]*Config, error)) {
+	reloaded, err := reload()
+	if err != nil {
+		fmt.Printf("config reload failed, keeping the current config: %v\n", err)
+		return
+	}
+	byName := map[string]*Config{}
+	for _, tcfg := range reloaded {
+		if err = checkRateLimits(tcfg); err != nil {
+			fmt.Printf("config reload failed, keeping the current config: %v\n", err)
+			return
+		}
+		byName[tcfg.targetName] = tcfg
+	}
+	for _, tcfg := range targets {
+		rcfg, ok := byName[tcfg.targetName]
+		if !ok {
+			fmt.Printf("%vtarget removed from the config, restart to stop syncing it\n", tcfg.targetLabel())
+			continue
+		}
+		delete(byName, tcfg.targetName)
+		liveState(tcfg).reload(rcfg)
+	}
+	for _, rcfg := range byName {
+		fmt.Printf("%vtarget added to the config, restart to start syncing it\n", rcfg.targetLabel())
+	}
+}
+
+// applyReload applies the settings of a pending reload to cfg, between two cycles of its target: schedule, workers,
+// filters and notifications. Anything else needs a restart. It reports whether there was a reload.
+func applyReload(cfg *Config, om *ObjectManager) bool {
+	rcfg := om.live.takeReload()
+	if rcfg == nil {
+		return false
+	}
+	cfg.Schedule, cfg.SyncDelayMinute, cfg.schedule = rcfg.Schedule, rcfg.SyncDelayMinute, rcfg.schedule
+	cfg.SyncWorker = rcfg.SyncWorker
+
+	cfg.FilterFrom, cfg.rcloneFilter = rcfg.FilterFrom, rcfg.rcloneFilter
+	cfg.Include, cfg.includePaths = rcfg.Include, rcfg.includePaths
+	cfg.Exclude, cfg.excludeRules = rcfg.Exclude, rcfg.excludeRules
+	cfg.MaxFileSize, cfg.maxFileSize = rcfg.MaxFileSize, rcfg.maxFileSize
+	cfg.SkipHidden = rcfg.SkipHidden
+
+	cfg.Webhooks = rcfg.Webhooks
+	cfg.Notifiers, cfg.Notify = rcfg.Notifiers, rcfg.Notify
+	cfg.DesktopNotifications, cfg.DesktopNotifyFileFailures = rcfg.DesktopNotifications, rcfg.DesktopNotifyFileFailures
+	cfg.EmailAlert = rcfg.EmailAlert
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteArchiveFolderName is the folder under the remote root delete_mode "archive" moves the objects deleted locally
+// into, under a folder per day and their path in the sync target.
+const remoteArchiveFolderName = ".bgdrive-trash"
+
+// isRemoteMetaName reports the names of the folders bgdrive-sync keeps for itself under the remote root.
+func isRemoteMetaName(name string) bool {
+	return name == remoteMetaFolderName || name == remoteArchiveFolderName
+}
+
+// remoteArchive caches the folders of the remote archive, by their path under it.
+type remoteArchive struct {
+	mu      sync.Mutex
+	folders map[string]string
+}
+
+// archiveFolderID returns the id of the folder rel (e.g. "2024-05-01/photos/2023") under the remote archive, creating
+// the missing ones on the way.
+func (om *ObjectManager) archiveFolderID(rel string) (string, error) {
+	om.archive.mu.Lock()
+	defer om.archive.mu.Unlock()
+	if om.archive.folders == nil {
+		om.archive.folders = map[string]string{}
+	}
+	var (
+		id  = om.rootID()
+		dir string
+	)
+	for _, name := range strings.Split(filepath.Join(remoteArchiveFolderName, rel), string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		if cached, ok := om.archive.folders[dir]; ok {
+			id = cached
+			continue
+		}
+		child, err := findChild(om.drive, id, name)
+		if err != nil {
+			return "", err
+		}
+		if child == "" {
+			if child, err = om.drive.Mkdir(id, name); err != nil {
+				return "", err
+			}
+		}
+		om.archive.folders[dir] = child
+		id = child
+	}
+	return id, nil
+}
+
+// archiveObject moves the remote copy of the deleted local path loc into the remote archive folder of today, under
+// its path in the sync target.
+func (om *ObjectManager) archiveObject(loc string, object *Object) error {
+	rel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+	dir := filepath.Join(time.Now().Format(time.DateOnly), filepath.Dir(rel))
+	folderID, err := om.archiveFolderID(dir)
+	if err != nil {
+		return err
+	}
+	return om.drive.Move(object.GDId, object.GDPId, folderID, remoteName(loc, object))
+}
+
+// forgetNestedDeletions forgets the entries of deletedQueue whose folder is deleted too: they are archived, trashed or
+// deleted along with it.
+func (om *ObjectManager) forgetNestedDeletions(deletedQueue map[string]*Object) {
+	for loc := range deletedQueue {
+		for dir := filepath.Dir(loc); dir != om.cfg.SyncTargetPath && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, ok := deletedQueue[dir]; ok {
+				delete(deletedQueue, loc)
+				om.deleteObject(loc)
+				break
+			}
+		}
+	}
+}
+
+// purgeArchive permanently deletes the folders of the remote archive older than archive_retention_days.
+func (om *ObjectManager) purgeArchive(now time.Time) error {
+	archiveID, err := findChild(om.drive, om.rootID(), remoteArchiveFolderName)
+	if err != nil || archiveID == "" {
+		return err
+	}
+	days, err := om.drive.List(archiveID, "")
+	if err != nil {
+		return err
+	}
+	cutoff := now.AddDate(0, 0, -om.cfg.ArchiveRetentionDays).Format(time.DateOnly)
+	for _, day := range days {
+		if _, err := time.Parse(time.DateOnly, day.Name); err != nil || day.Name >= cutoff {
+			continue
+		}
+		if err = om.drive.Delete(day.ID); err != nil {
+			return err
+		}
+		printOp("pruned", "/"+remoteArchiveFolderName+"/"+day.Name, fmt.Sprintf("archived over %v days ago", om.cfg.ArchiveRetentionDays))
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// remoteChangesStore persists the position in the changes feed of drive the next cycle reads from, in
+// remote_changes.json. A new position is only written along with the object map it was applied to.
+type remoteChangesStore struct {
+	mu        *sync.Mutex
+	filePath  string
+	PageToken string `json:"page_token"`
+	pending   string
+}
+
+func newRemoteChangesStore(filePath string) (*remoteChangesStore, error) {
+	rs := &remoteChangesStore{mu: &sync.Mutex{}, filePath: filePath}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return rs, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, rs); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return rs, nil
+}
+
+// token returns the position to read the changes from, the one not saved yet first.
+func (rs *remoteChangesStore) token() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.pending != "" {
+		return rs.pending
+	}
+	return rs.PageToken
+}
+
+func (rs *remoteChangesStore) advance(token string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.pending = token
+}
+
+func (rs *remoteChangesStore) save() error {
+	if rs == nil {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.pending == "" || rs.pending == rs.PageToken {
+		return nil
+	}
+	rs.PageToken = rs.pending
+	data, err := json.MarshalIndent(rs, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rs.filePath, data, os.ModePerm)
+}
+
+// pullsRemoteChanges reports whether remote changes are applied locally, not only to the object map.
+func (cfg *Config) pullsRemoteChanges() bool {
+	return cfg.SyncDirection == syncDirectionPull || cfg.SyncDirection == syncDirectionBoth ||
+		cfg.SyncDirection == syncDirectionMirror
+}
+
+// applyRemoteChanges reads what changed on drive since the previous cycle from the changes feed and reflects it in
+// the object map. Pulling, the changes are applied locally as well, in place of listing every remote folder. Pushing,
+// a deleted or edited file is uploaded again by the push. Renames are applied as remote_moves says. It returns false
+// when the feed is read for the first time, its position is only taken then.
+func (om *ObjectManager) applyRemoteChanges(report *CycleReport) (bool, error) {
+	token := om.changes.token()
+	if token == "" {
+		token, err := om.drive.StartPageToken()
+		if err != nil {
+			return false, fmt.Errorf("remote changes: %v", err)
+		}
+		om.changes.advance(token)
+		return false, nil
+	}
+	changes, next, err := om.drive.Changes(token)
+	if err != nil {
+		return false, fmt.Errorf("remote changes: %v", err)
+	}
+
+	if len(changes) != 0 {
+		byID := map[string]string{om.rootID(): om.cfg.SyncTargetPath}
+		om.SnapshotObjects().each(func(loc string, object *Object) {
+			if object.GDId != "" {
+				byID[object.GDId] = loc
+			}
+		})
+		var skipped []SkippedPath
+		for _, ch := range changes {
+			if shuttingDown() {
+				return false, errShutdown
+			}
+			loc := byID[ch.ID]
+			if loc == "" && ch.File != nil {
+				loc = filepath.Join(byID[ch.Parent], ch.File.Name)
+			}
+			sp, err := om.applyRemoteChange(report, ch, byID)
+			if err != nil {
+				if !isFileError(err) {
+					return false, err
+				}
+				sp = &SkippedPath{Loc: loc, Reason: skipReasonFailed, Detail: err.Error()}
+			}
+			if sp != nil {
+				skipped = append(skipped, *sp)
+			}
+		}
+		report.addSkipped(om.cfg, skipped)
+	}
+	om.changes.advance(next)
+	return true, nil
+}
+
+// applyRemoteChange reflects ch, byID mapping the ids of the tracked objects to their location, and keeps byID up to
+// date with it.
+func (om *ObjectManager) applyRemoteChange(report *CycleReport, ch *RemoteChange, byID map[string]string) (*SkippedPath, error) {
+	loc, tracked := byID[ch.ID]
+	if loc == om.cfg.SyncTargetPath {
+		return nil, nil
+	}
+	var object *Object
+	if tracked {
+		object, tracked = om.loadObject(loc)
+	}
+	if !tracked || object.GDId != ch.ID {
+		if ch.Removed || !om.cfg.pullsRemoteChanges() {
+			return nil, nil // not tracked, and only pulling brings new remote files
+		}
+		return om.pullNewRemote(report, ch, byID)
+	}
+
+	parentLoc, inTarget := byID[ch.Parent]
+	if ch.Removed || !inTarget {
+		return nil, om.forgetRemoved(loc, byID, !ch.Removed)
+	}
+
+	name := om.localName(ch.File, object, loc)
+	if ch.Parent != object.GDPId || name != filepath.Base(loc) {
+		var (
+			sp  *SkippedPath
+			err error
+		)
+		if loc, sp, err = om.applyRemoteMove(loc, filepath.Join(parentLoc, name), ch.Parent, object); err != nil || sp != nil {
+			return sp, err
+		}
+		for l, o := range om.objectsBelow(loc) {
+			if o.GDId != "" {
+				byID[o.GDId] = l
+			}
+		}
+	}
+	if ch.File.IsDir {
+		return nil, nil
+	}
+
+	remoteMod := remoteModUnix(ch.File)
+	if remoteMod == 0 || remoteMod <= object.RemoteMod || (ch.File.MD5 != "" && strings.EqualFold(ch.File.MD5, object.MD5)) {
+		return nil, nil
+	}
+	if om.cfg.pullsRemoteChanges() {
+		if object.Exported {
+			_, mimeType, ok := googleExportFormat(om.cfg, ch.File)
+			if !ok {
+				return nil, nil
+			}
+			return om.PullExport(loc, ch.Parent, ch.File, mimeType)
+		}
+		return om.PullFile(loc, ch.Parent, ch.File)
+	}
+	if object.Exported || object.Converted || object.RemoteMod == 0 {
+		om.updateStoredObject(object, func(o *Object) { o.RemoteMod = remoteMod })
+		return nil, nil
+	}
+	// edited on drive: the push transfers the local content again
+	om.updateStoredObject(object, func(o *Object) {
+		o.LastMod, o.Size, o.RemoteMod = 1, -1, remoteMod
+	})
+	printOp("forgot", strings.TrimPrefix(loc, om.cfg.SyncTargetPath), "edited on drive, uploaded again")
+	return nil, nil
+}
+
+// localName is the name the remote file f tracked as object at loc has locally.
+func (om *ObjectManager) localName(f *RemoteFile, object *Object, loc string) string {
+	switch {
+	case object.Exported:
+		if name, _, ok := googleExportFormat(om.cfg, f); ok {
+			return name
+		}
+		return filepath.Base(loc)
+	case object.Converted:
+		return f.Name + filepath.Ext(loc)
+	default:
+		return f.Name
+	}
+}
+
+// pullNewRemote pulls the remote file or folder of ch when it was created in a tracked folder.
+func (om *ObjectManager) pullNewRemote(report *CycleReport, ch *RemoteChange, byID map[string]string) (*SkippedPath, error) {
+	parentLoc, ok := byID[ch.Parent]
+	if !ok || (parentLoc == om.cfg.SyncTargetPath && isRemoteMetaName(ch.File.Name)) {
+		return nil, nil
+	}
+	if parent, tracked := om.loadObject(parentLoc); !tracked || parent.LastMod != 0 {
+		return nil, nil // under a folder being created, or the blocks of a delta file
+	}
+	if !ch.File.IsDir {
+		return om.pullRemoteFile(parentLoc, ch.Parent, ch.File)
+	}
+
+	loc := filepath.Join(parentLoc, ch.File.Name)
+	sp, err := om.PullFolder(loc, ch.Parent, ch.File)
+	if err != nil || sp != nil {
+		return sp, err
+	}
+	byID[ch.File.ID] = loc
+	// what the folder already holds may have been reported before it
+	rel, _ := filepath.Rel(om.cfg.SyncTargetPath, loc)
+	return nil, pullFiles(om.cfg, om, report, rel)
+}
+
+// forgetRemoved forgets the object tracked at loc, gone from drive or moved out of the sync target, and what is
+// tracked below it. Pulling, the local copies not changed since their last sync are deleted too, all of them with
+// sync_direction "mirror".
+func (om *ObjectManager) forgetRemoved(loc string, byID map[string]string, movedOut bool) error {
+	objects := om.objectsBelow(loc)
+	locs := make([]string, 0, len(objects))
+	for l := range objects {
+		locs = append(locs, l)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(locs))) // children before their folder
+
+	rel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+	detail := "deleted on drive"
+	if movedOut {
+		detail = "moved out of the synced folder on drive"
+	}
+	pulling := om.cfg.pullsRemoteChanges()
+	mirror := om.cfg.SyncDirection == syncDirectionMirror
+	kept := 0
+	for _, l := range locs {
+		object := objects[l]
+		delete(byID, object.GDId)
+		om.deleteObject(l)
+		if !pulling || om.cfg.DryRun {
+			continue
+		}
+		info, err := os.Lstat(longPath(l))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return err
+		case info.IsDir() && mirror:
+			if err = os.RemoveAll(longPath(l)); err != nil {
+				return err
+			}
+		case info.IsDir():
+			if os.Remove(longPath(l)) != nil {
+				kept++ // still holds files changed or never synced
+			}
+		case mirror || mirrored(info, object):
+			if err = os.Remove(longPath(l)); err != nil {
+				return err
+			}
+		default:
+			kept++
+		}
+	}
+
+	switch {
+	case !pulling:
+		printOp("forgot", rel, detail+", uploaded again")
+	case kept != 0:
+		om.recordOp("removed", loc, objects[loc].GDId, objects[loc].Size)
+		printOp("removed", rel, fmt.Sprintf("%v, %v changed local paths kept", detail, kept))
+	default:
+		om.recordOp("removed", loc, objects[loc].GDId, objects[loc].Size)
+		printOp("removed", rel, detail)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// remoteMetaFolderName is the folder under the remote root holding files generated by bgdrive-sync itself
+// (manifests, journals, ...) rather than replicated from the sync target.
+const remoteMetaFolderName = ".bgdrive-sync"
+
+type remoteMeta struct {
+	mu       sync.Mutex
+	folderID string
+}
+
+// metaFolderID looks up the remote metadata folder under the remote root, creating it when missing.
+func (om *ObjectManager) metaFolderID() (string, error) {
+	om.meta.mu.Lock()
+	defer om.meta.mu.Unlock()
+	if om.meta.folderID != "" {
+		return om.meta.folderID, nil
+	}
+
+	rootID := om.rootID()
+	id, err := findChild(om.drive, rootID, remoteMetaFolderName)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		id, err = om.drive.Mkdir(rootID, remoteMetaFolderName)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	om.meta.folderID = id
+	return id, nil
+}
+
+// uploadMetaFile uploads data as a new file named name into the remote metadata folder.
+func (om *ObjectManager) uploadMetaFile(name string, data []byte) error {
+	return om.writeMetaFile(name, data, false)
+}
+
+// putMetaFile stores data as name in the remote metadata folder, updating the existing file of that name if any.
+func (om *ObjectManager) putMetaFile(name string, data []byte) error {
+	return om.writeMetaFile(name, data, true)
+}
+
+func (om *ObjectManager) writeMetaFile(name string, data []byte, replace bool) error {
+	folderID, err := om.metaFolderID()
+	if err != nil {
+		return err
+	}
+
+	existingID := ""
+	if replace {
+		if existingID, err = findChild(om.drive, folderID, name); err != nil {
+			return err
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "bgdrive-sync-meta-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	loc := filepath.Join(tmpDir, name)
+	if err = os.WriteFile(loc, data, 0o600); err != nil {
+		return err
+	}
+
+	if existingID != "" {
+		_, err = om.drive.Update(existingID, loc)
+		return err
+	}
+	_, err = om.drive.Upload(folderID, loc)
+	return err
+}
+
+// downloadMetaFile returns the content of the file called name in the remote metadata folder.
+func (om *ObjectManager) downloadMetaFile(name string) ([]byte, error) {
+	folderID, err := om.metaFolderID()
+	if err != nil {
+		return nil, err
+	}
+	id, err := findChild(om.drive, folderID, name)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("%v/%v does not exist", remoteMetaFolderName, name)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "bgdrive-sync-meta-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	loc := filepath.Join(tmpDir, name)
+	if err = om.drive.Download(id, loc); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(loc)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	remoteMovesFollow = "follow"
+	remoteMovesRevert = "revert"
+)
+
+func validRemoteMoves(remoteMoves string) error {
+	switch remoteMoves {
+	case "", remoteMovesFollow, remoteMovesRevert:
+		return nil
+	default:
+		return fmt.Errorf("remote_moves: unknown mode %q, expected %q or %q", remoteMoves, remoteMovesFollow, remoteMovesRevert)
+	}
+}
+
+// applyRemoteMove handles the object tracked at loc, renamed or moved on drive to newLoc under the folder
+// newParentID. Following remote moves, the local copy is moved along, along with what the object map tracks below it,
+// and newLoc returned. Reverting them, the remote object is moved back and loc returned. It returns a SkippedPath
+// when the move can't be followed.
+func (om *ObjectManager) applyRemoteMove(loc, newLoc, newParentID string, object *Object) (string, *SkippedPath, error) {
+	rel, newRel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath), strings.TrimPrefix(newLoc, om.cfg.SyncTargetPath)
+	if om.cfg.RemoteMoves == remoteMovesRevert {
+		if object.Exported {
+			return loc, nil, nil
+		}
+		if err := om.drive.Move(object.GDId, newParentID, object.GDPId, remoteName(loc, object)); err != nil {
+			return "", nil, err
+		}
+		om.recordOp("moved", loc, object.GDId, object.Size)
+		printOp("moved", rel, fmt.Sprintf("back, renamed on drive to %v", newRel))
+		return loc, nil, nil
+	}
+
+	if _, tracked := om.loadObject(newLoc); tracked {
+		return "", &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "moved on drive to " + newRel + ", tracked already"}, nil
+	}
+	if !om.cfg.DryRun {
+		if _, err := os.Lstat(longPath(newLoc)); err == nil {
+			return "", &SkippedPath{Loc: loc, Reason: skipReasonConflict, Detail: "moved on drive to " + newRel + ", which exists locally"}, nil
+		}
+		if err := os.Rename(longPath(loc), longPath(newLoc)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", nil, err
+		}
+	}
+	om.rekeyObjects(loc, newLoc)
+	om.updateStoredObject(object, func(o *Object) { o.GDPId = newParentID })
+	om.recordOp("moved", newLoc, object.GDId, object.Size)
+	printOp("moved", newRel, "from "+rel+" on drive")
+	return newLoc, nil, nil
+}
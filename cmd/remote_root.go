@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// remoteRootRecord is the remote root found for gd_root_path or created for gd_root_folder_name, stored in
+// remote_root.json.
+type remoteRootRecord struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+// remoteRootOption returns the option naming the remote root by its path, and that path with {hostname} and
+// {target} replaced, slash separated.
+func remoteRootOption(cfg *Config) (string, string) {
+	option, name := "gd_root_folder_name", cfg.GDRootFolderName
+	if cfg.GDRootPath != "" {
+		option, name = "gd_root_path", cfg.GDRootPath
+	}
+	name = strings.NewReplacer("{hostname}", hostname(), "{target}", cfg.targetName).Replace(name)
+	return option, strings.Trim(name, "/")
+}
+
+// loadRemoteRoot sets gd_root_folder_id to the folder found for gd_root_path, or created for gd_root_folder_name, by
+// an earlier sync, if any.
+func loadRemoteRoot(cfg *Config) error {
+	switch {
+	case cfg.GDRootPath != "" && cfg.GDRootFolderID != "":
+		return errors.New("gd_root_path and gd_root_folder_id can't both be set")
+	case cfg.GDRootPath != "" && cfg.GDRootFolderName != "":
+		return errors.New("gd_root_path and gd_root_folder_name can't both be set")
+	}
+	_, name := remoteRootOption(cfg)
+	if cfg.GDRootFolderID != "" || name == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.statePath("remote_root.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var r remoteRootRecord
+	if err = json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("%v: %v", cfg.statePath("remote_root.json"), err)
+	}
+	if r.Name == name {
+		cfg.GDRootFolderID = r.ID
+	}
+	return nil
+}
+
+// resolveRemoteRoot looks up the folder of gd_root_path in my drive, or gd_drive_id, creating the missing ones on the
+// way, and syncs into it. gd_root_folder_name is only looked up and created when gd_root_folder_id is empty, once:
+// the folder is synced into from then on, wherever it is moved on drive. The id is kept in remote_root.json.
+func resolveRemoteRoot(cfg *Config) error {
+	option, name := remoteRootOption(cfg)
+	if name == "" || (cfg.GDRootPath == "" && cfg.GDRootFolderID != "") {
+		return nil
+	}
+	// the plain client: the remote root is named as is, whatever encrypt_names says
+	drive, err := newPlainDriveClient(cfg)
+	if err != nil {
+		return err
+	}
+	id, created := ".", false
+	if cfg.GDDriveID != "" {
+		id = cfg.GDDriveID
+	}
+	for _, folder := range strings.Split(name, "/") {
+		childID, err := findChildFolder(drive, id, folder)
+		if err != nil {
+			return fmt.Errorf("%v: %v", option, err)
+		}
+		if childID == "" {
+			if cfg.DryRun {
+				printOp("created", name, "remote root")
+				return nil
+			}
+			if childID, err = drive.Mkdir(id, folder); err != nil {
+				return fmt.Errorf("%v: %v", option, err)
+			}
+			created = true
+		}
+		id = childID
+	}
+	if created {
+		printOp("created", name, "remote root")
+	}
+
+	data, err := json.MarshalIndent(remoteRootRecord{Name: name, ID: id}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(cfg.statePath("remote_root.json"), data, 0o644); err != nil {
+		return err
+	}
+	cfg.GDRootFolderID = id
+	return nil
+}
+
+// findChildFolder returns the id of the folder named exactly name in parentID, empty when there is none.
+func findChildFolder(drive DriveClient, parentID, name string) (string, error) {
+	files, err := drive.List(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if f.IsDir && f.Name == name {
+			return f.ID, nil
+		}
+	}
+	return "", nil
+}
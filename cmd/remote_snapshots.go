@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// remoteSnapshotNameFormat names the folder of a remote snapshot after the start of its cycle. Seconds are appended
+// when two cycles start in the same minute.
+const remoteSnapshotNameFormat = "2006-01-02T15:04"
+
+// RemoteSnapshot is a dated folder under the remote root holding the sync target as of the cycle which took it.
+type RemoteSnapshot struct {
+	Name  string    `json:"name"`
+	GDId  string    `json:"gd_id"`
+	Taken time.Time `json:"taken"`
+}
+
+// remoteSnapshotStore persists the remote snapshots taken so far, oldest first, in remote_snapshots.json.
+type remoteSnapshotStore struct {
+	mu        *sync.Mutex
+	filePath  string
+	snapshots []*RemoteSnapshot
+	dirty     bool
+}
+
+func newRemoteSnapshotStore(filePath string) (*remoteSnapshotStore, error) {
+	ss := &remoteSnapshotStore{mu: &sync.Mutex{}, filePath: filePath}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ss, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &ss.snapshots); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return ss, nil
+}
+
+// last returns the latest snapshot, nil before the first one.
+func (ss *remoteSnapshotStore) last() *RemoteSnapshot {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.snapshots) == 0 {
+		return nil
+	}
+	return ss.snapshots[len(ss.snapshots)-1]
+}
+
+func (ss *remoteSnapshotStore) add(s *RemoteSnapshot) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.snapshots = append(ss.snapshots, s)
+	ss.dirty = true
+}
+
+// prune returns the snapshots policy doesn't keep, oldest first.
+func (ss *remoteSnapshotStore) prune(policy RetentionPolicy) []*RemoteSnapshot {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	times := make([]time.Time, len(ss.snapshots))
+	for i, s := range ss.snapshots {
+		times[len(times)-1-i] = s.Taken
+	}
+	kept := policy.keep(times)
+	var expired []*RemoteSnapshot
+	for i, s := range ss.snapshots {
+		if !kept[len(kept)-1-i] {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+func (ss *remoteSnapshotStore) forget(s *RemoteSnapshot) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.snapshots = slices.DeleteFunc(ss.snapshots, func(o *RemoteSnapshot) bool { return o == s })
+	ss.dirty = true
+}
+
+func (ss *remoteSnapshotStore) save() error {
+	if ss == nil {
+		return nil
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(ss.snapshots, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(ss.filePath, data, os.ModePerm); err != nil {
+		return err
+	}
+	ss.dirty = false
+	return nil
+}
+
+// validRemoteSnapshots checks remote_snapshots only comes with the options it works with: a snapshot is taken of the
+// whole target by a push, and delta files share their blocks between copies.
+func validRemoteSnapshots(cfg *Config) error {
+	switch {
+	case !cfg.RemoteSnapshots:
+		return nil
+	case cfg.SyncDirection != "" && cfg.SyncDirection != syncDirectionPush:
+		return fmt.Errorf("remote_snapshots requires sync_direction %q", syncDirectionPush)
+	case cfg.WatchMode:
+		return errors.New("remote_snapshots can't be used with watch_mode")
+	case cfg.RemoteChanges:
+		return errors.New("remote_snapshots can't be used with remote_changes")
+	case cfg.DeltaMinSize != "":
+		return errors.New("remote_snapshots can't be used with delta_min_size")
+	}
+	if err := cfg.SnapshotRetention.valid(); err != nil {
+		return fmt.Errorf("snapshot_retention: %v", err)
+	}
+	return nil
+}
+
+// remoteSnapshotRun is the remote snapshot taken by the current cycle.
+type remoteSnapshotRun struct {
+	snapshot *RemoteSnapshot
+	// last is the object map of the previous snapshot, whose files are copied on drive's side when unchanged
+	last     *objectTree
+	lastName string
+	copied   atomic.Int64
+}
+
+// beginRemoteSnapshot creates the folder of a new remote snapshot under the remote root and makes it the folder the
+// cycle uploads to, starting from an empty object map. It returns a func to call once the cycle is over.
+func (om *ObjectManager) beginRemoteSnapshot(start time.Time) (func(), error) {
+	name := start.Format(remoteSnapshotNameFormat)
+	last := om.snapshots.last()
+	if last != nil && last.Name == name {
+		name = start.Format(remoteSnapshotNameFormat + ":05")
+	}
+	id, err := om.drive.Mkdir(om.rootID(), name)
+	if err != nil {
+		return nil, err
+	}
+	run := &remoteSnapshotRun{snapshot: &RemoteSnapshot{Name: name, GDId: id, Taken: start}}
+	if last != nil {
+		run.lastName = last.Name
+	}
+	om.objectMapRWMu.Lock()
+	run.last, om.objectMap = om.objectMap, newObjectTree()
+	om.objectMapRWMu.Unlock()
+	if !om.cfg.DryRun {
+		om.snapshots.add(run.snapshot)
+	}
+	om.snapshotRun = run
+	printOp("mkdir", "/"+name, "remote snapshot")
+
+	return func() {
+		om.snapshotRun = nil
+		if n := run.copied.Load(); n != 0 {
+			printOp("copied", "/"+name, fmt.Sprintf("%v unchanged files from %v", n, run.lastName))
+		}
+	}, nil
+}
+
+// remoteTargetID is the id of the remote folder the sync target maps to, the folder of the latest remote snapshot
+// with remote_snapshots.
+func (om *ObjectManager) remoteTargetID() string {
+	if run := om.snapshotRun; run != nil {
+		return run.snapshot.GDId
+	}
+	if om.snapshots != nil {
+		if last := om.snapshots.last(); last != nil {
+			return last.GDId
+		}
+	}
+	return om.rootID()
+}
+
+// unchangedSinceLastSnapshot returns the object of the previous remote snapshot for the local file at loc, nil when
+// the file changed since or there is none.
+func (om *ObjectManager) unchangedSinceLastSnapshot(loc string, size, lastMod int64) *Object {
+	run := om.snapshotRun
+	if run == nil || run.last == nil {
+		return nil
+	}
+	object, ok := run.last.get(loc)
+	if !ok || object.GDId == "" || object.Size != size || object.LastMod != lastMod {
+		return nil
+	}
+	return object
+}
+
+// copyFromLastSnapshot copies the remote file of the previous snapshot into the new one when the local file at loc,
+// whose placeholder lockedNObj is stored already under pObj, didn't change since. It returns a nil object when the
+// file is to be uploaded.
+func (om *ObjectManager) copyFromLastSnapshot(loc string, pObj, lockedNObj *Object) *Object {
+	last := om.unchangedSinceLastSnapshot(loc, lockedNObj.Size, lockedNObj.LastMod)
+	if last == nil {
+		return nil
+	}
+	rf, err := om.drive.Copy(last.GDId, pObj.GDId, remoteName(loc, last))
+	if err != nil {
+		fmt.Printf("failed to copy %v from the last snapshot, uploading it instead: %v\n",
+			strings.TrimPrefix(loc, om.cfg.SyncTargetPath), err)
+		return nil
+	}
+	om.snapshotRun.copied.Add(1)
+	return om.updateStoredObject(lockedNObj, func(o *Object) {
+		o.GDId = rf.ID
+		o.RemoteMod = remoteModUnix(rf)
+		o.MD5 = last.MD5
+		o.Converted = last.Converted
+		o.CompressedSize = last.CompressedSize
+	})
+}
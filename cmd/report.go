@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	skipReasonUnreadable       = "unreadable"
+	skipReasonPermissionDenied = "permission denied"
+	skipReasonSpecialFile      = "special file"
+	skipReasonGoogleNative     = "google native document"
+)
+
+// SkippedPath is a local path left out of a cycle, together with why.
+type SkippedPath struct {
+	Loc    string `json:"loc"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (sp SkippedPath) String() string {
+	if sp.Detail == "" {
+		return sp.Reason
+	}
+	return sp.Reason + ": " + sp.Detail
+}
+
+// CycleReport summarizes a single sync cycle.
+type CycleReport struct {
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Err        string        `json:"err,omitempty"`
+	Operations []Operation   `json:"operations,omitempty"`
+	Skipped    []SkippedPath `json:"skipped,omitempty"`
+	// skippedLocs indexes Skipped by location
+	skippedLocs map[string]struct{}
+}
+
+func newCycleReport() *CycleReport {
+	return &CycleReport{Start: time.Now()}
+}
+
+func (r *CycleReport) finish(err error) {
+	r.End = time.Now()
+	if err != nil {
+		r.Err = err.Error()
+	}
+}
+
+// addSkipped records and prints the skipped paths not reported yet in this cycle.
+func (r *CycleReport) addSkipped(cfg *Config, skipped []SkippedPath) {
+	for _, sp := range skipped {
+		if r.hasSkipped(sp.Loc) {
+			continue
+		}
+		r.Skipped = append(r.Skipped, sp)
+		r.skippedLocs[sp.Loc] = struct{}{}
+		printOp("skipped", strings.TrimPrefix(sp.Loc, cfg.SyncTargetPath), sp.String())
+	}
+}
+
+// merge adds the operations and skipped paths of other, a later cycle, to r. r failed when either did, with the
+// last error.
+func (r *CycleReport) merge(other *CycleReport) {
+	r.End = other.End
+	if other.Err != "" {
+		r.Err = other.Err
+	}
+	r.Operations = append(r.Operations, other.Operations...)
+	for _, sp := range other.Skipped {
+		if !r.hasSkipped(sp.Loc) {
+			r.Skipped = append(r.Skipped, sp)
+			r.skippedLocs[sp.Loc] = struct{}{}
+		}
+	}
+}
+
+func (r *CycleReport) hasSkipped(loc string) bool {
+	if r.skippedLocs == nil {
+		r.skippedLocs = make(map[string]struct{}, len(r.Skipped))
+		for _, sp := range r.Skipped {
+			r.skippedLocs[sp.Loc] = struct{}{}
+		}
+	}
+	_, ok := r.skippedLocs[loc]
+	return ok
+}
+
+// failedFiles returns the number of files which failed to sync in the cycle or are quarantined.
+func (r *CycleReport) failedFiles() int {
+	n := 0
+	for _, sp := range r.Skipped {
+		if sp.Reason == skipReasonFailed || sp.Reason == skipReasonQuarantined {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *CycleReport) Failed() bool {
+	return r.Err != ""
+}
+
+// Counts returns the number of created (files and folders), updated and deleted (or trashed, archived) objects.
+func (r *CycleReport) Counts() (created, updated, deleted int) {
+	for _, op := range r.Operations {
+		switch op.Op {
+		case "mkdir", "created":
+			created++
+		case "updated":
+			updated++
+		case "deleted", "trashed", "archived":
+			deleted++
+		}
+	}
+	return
+}
+
+// BytesTransferred returns the bytes uploaded by created and updated files and downloaded by pulled ones.
+func (r *CycleReport) BytesTransferred() int64 {
+	var total int64
+	for _, op := range r.Operations {
+		if op.Op == "created" || op.Op == "updated" || op.Op == "downloaded" {
+			total += op.Size
+		}
+	}
+	return total
+}
+
+// biggestOperations returns the n operations moving the most bytes, biggest first.
+func biggestOperations(ops []Operation, n int) []Operation {
+	sorted := append([]Operation(nil), ops...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// saveReport writes the report as JSON to filePath, which is what the status of the last cycle is read from.
+func saveReport(report *CycleReport, filePath string) error {
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, os.ModePerm)
+}
+
+// appendSkippedLog appends one tab separated line (time, reason, path, detail) per skipped path to filePath.
+func appendSkippedLog(report *CycleReport, filePath string) error {
+	if len(report.Skipped) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, sp := range report.Skipped {
+		if _, err = fmt.Fprintf(f, "%v\t%v\t%v\t%v\n", report.Start.Format(time.DateTime), sp.Reason, sp.Loc, sp.Detail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
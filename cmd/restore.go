@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bearaujus/bworker/pool"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// restoreAtLayouts are the accepted forms of restore --at, in local time unless they carry a zone.
+var restoreAtLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", time.DateOnly}
+
+func newRestoreCmd(cf *configFlags) *cobra.Command {
+	var (
+		remotePath string
+		to         string
+		snapshot   string
+		at         string
+		target     string
+	)
+	cmd := &cobra.Command{
+		Use:   "restore --to <dir>",
+		Short: "Download a remote folder of the target, or of a remote snapshot, into a local folder",
+		Long: "Download the folder --remote-path (relative to the remote root, everything by default) into --to,\n" +
+			"recreating its folders with the remote modification times. With remote_snapshots, the latest snapshot is\n" +
+			"restored, or the one named by --snapshot. With --at (drive_client \"api\" only), every file is downloaded\n" +
+			"as of that time from its revisions: files created since are left out, files deleted since can't be listed.\n" +
+			"Google native documents are exported per google_export as they are now. Files already in --to are left as\n" +
+			"they are. Neither the object map nor drive is changed.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if to == "" {
+				return errors.New("--to is required")
+			}
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			tcfg, err := restoreTarget(targets, target)
+			if err != nil {
+				return err
+			}
+			if at != "" {
+				if tcfg.restoreAt, err = parseRestoreAt(at); err != nil {
+					return err
+				}
+				if tcfg.DriveClient != driveClientAPI {
+					return fmt.Errorf("--at requires drive_client %q, to read the revisions of the files", driveClientAPI)
+				}
+			}
+			if err = restoreRemote(tcfg, remotePath, snapshot, to); err != nil {
+				return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&remotePath, "remote-path", "", "folder or file to restore, relative to the remote root (default: everything)")
+	cmd.Flags().StringVar(&to, "to", "", "local folder to restore into, created when missing")
+	cmd.Flags().StringVar(&snapshot, "snapshot", "", "remote snapshot to restore from, by name (default: the latest one)")
+	cmd.Flags().StringVar(&at, "at", "", "restore the files as they were at this time, e.g. 2024-05-01 or 2024-05-01T18:30")
+	cmd.Flags().StringVar(&target, "target", "", "target to restore from, by name, when there are several")
+	return cmd
+}
+
+// restoreTarget returns the target named name, which is only needed with several targets.
+func restoreTarget(targets []*Config, name string) (*Config, error) {
+	if name == "" {
+		if len(targets) != 1 {
+			return nil, errors.New("--target is required with several targets")
+		}
+		return targets[0], nil
+	}
+	for _, t := range targets {
+		if t.targetName == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no target named %q", name)
+}
+
+func parseRestoreAt(s string) (time.Time, error) {
+	for _, layout := range restoreAtLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			if layout == time.DateOnly {
+				t = t.AddDate(0, 0, 1).Add(-time.Second) // the end of that day
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --at %q, expected e.g. 2024-05-01, 2024-05-01T18:30 or an RFC 3339 time", s)
+}
+
+// restoreRemote downloads remotePath of the remote root of cfg, or of its remote snapshot named snapshot, into to.
+func restoreRemote(cfg *Config, remotePath, snapshot, to string) error {
+	rootID, err := restoreRootID(cfg, snapshot)
+	if err != nil {
+		return err
+	}
+	drive, err := newDriveClient(cfg)
+	if err != nil {
+		return err
+	}
+	var revisions *apiDriveClient // reads the revision times of the files changed since --at
+	if !cfg.restoreAt.IsZero() {
+		if revisions, err = newAPIDriveClient(cfg); err != nil {
+			return err
+		}
+	}
+
+	f := &RemoteFile{ID: rootID, IsDir: true}
+	if remotePath = strings.Trim(filepath.ToSlash(remotePath), "/"); remotePath != "" {
+		if f, err = findRemotePath(drive, rootID, remotePath); err != nil {
+			return err
+		}
+	}
+	if !cfg.DryRun {
+		if err = os.MkdirAll(to, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	r := &restore{cfg: cfg, drive: drive, revisions: revisions, to: to}
+	var erw error
+	bw := pool.NewBWorkerPool(cfg.poolWorkers(), pool.WithError(&erw))
+	if f.IsDir {
+		err = r.folder(bw, f.ID, to, remotePath == "")
+	} else {
+		r.file(bw, f, filepath.Join(to, f.Name))
+	}
+	bw.Shutdown()
+	if err == nil {
+		err = erw
+	}
+	if err != nil {
+		return err
+	}
+	if f.IsDir {
+		r.folders = append(r.folders, restoredFolder{to, f.ModTime})
+	}
+	for _, folder := range r.folders {
+		if folder.modTime.IsZero() || cfg.DryRun {
+			continue
+		}
+		if err = os.Chtimes(folder.loc, folder.modTime, folder.modTime); err != nil {
+			return err
+		}
+	}
+
+	summary := fmt.Sprintf("%v files (%v) into %v", r.files.Load(), getFileSizeFormatted(r.size.Load()), to)
+	if n := r.existing.Load(); n != 0 {
+		summary += fmt.Sprintf(", %v already there", n)
+	}
+	if n := r.newer.Load(); n != 0 {
+		summary += fmt.Sprintf(", %v created after %v", n, cfg.restoreAt.Format(time.DateTime))
+	}
+	fmt.Println(colorize(colorGreen, "Restored!") + " " + summary)
+	return nil
+}
+
+// restoreRootID returns the id of the remote folder restore starts from: the remote snapshot named snapshot, else the
+// latest one with remote_snapshots, else the remote root.
+func restoreRootID(cfg *Config, snapshot string) (string, error) {
+	snapshots, err := newRemoteSnapshotStore(cfg.statePath("remote_snapshots.json"))
+	if err != nil {
+		return "", err
+	}
+	if snapshot == "" {
+		if last := snapshots.last(); last != nil && cfg.RemoteSnapshots {
+			return last.GDId, nil
+		}
+		return remoteRootID(cfg), nil
+	}
+	for _, s := range snapshots.snapshots {
+		if s.Name == snapshot {
+			return s.GDId, nil
+		}
+	}
+	return "", fmt.Errorf("no remote snapshot named %q in remote_snapshots.json", snapshot)
+}
+
+// findRemotePath returns the remote file or folder at the slash separated path p under the folder rootID.
+func findRemotePath(drive DriveClient, rootID, p string) (*RemoteFile, error) {
+	f := &RemoteFile{ID: rootID, IsDir: true}
+	for _, name := range strings.Split(p, "/") {
+		if !f.IsDir {
+			return nil, fmt.Errorf("%v: not a folder on drive", p)
+		}
+		// listed in full rather than by name, which drive can't match once encrypt_names is on
+		files, err := drive.List(f.ID, "")
+		if err != nil {
+			return nil, err
+		}
+		parent := f
+		for _, child := range files {
+			if child.Name == name {
+				f = child
+				break
+			}
+		}
+		if f == parent {
+			return nil, fmt.Errorf("%v: not found on drive", p)
+		}
+	}
+	return f, nil
+}
+
+type restoredFolder struct {
+	loc     string
+	modTime time.Time
+}
+
+// restore is a restore in progress.
+type restore struct {
+	cfg       *Config
+	drive     DriveClient
+	revisions *apiDriveClient
+	to        string
+
+	// folders are the restored folders, children first, whose modification time is set once their files are there
+	folders []restoredFolder
+
+	files    atomic.Int64
+	size     atomic.Int64
+	existing atomic.Int64
+	newer    atomic.Int64
+}
+
+// folder restores the children of the remote folder id into the local folder loc, leaving out the folders bgdrive-sync
+// keeps for itself under the remote root.
+func (r *restore) folder(bw pool.BWorkerPool, id, loc string, root bool) error {
+	if shuttingDown() {
+		return errShutdown
+	}
+	files, err := r.drive.List(id, "")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if root && isRemoteMetaName(f.Name) {
+			continue
+		}
+		childLoc := filepath.Join(loc, f.Name)
+		if !f.IsDir {
+			r.file(bw, f, childLoc)
+			continue
+		}
+		if !r.cfg.DryRun {
+			if err = os.MkdirAll(childLoc, os.ModePerm); err != nil {
+				return err
+			}
+		}
+		if err = r.folder(bw, f.ID, childLoc, false); err != nil {
+			return err
+		}
+		r.folders = append(r.folders, restoredFolder{childLoc, f.ModTime})
+	}
+	return nil
+}
+
+// file queues the download of the remote file f to loc, exported per google_export when a google native document.
+func (r *restore) file(bw pool.BWorkerPool, f *RemoteFile, loc string) {
+	mimeType := ""
+	if f.IsGoogleNative() {
+		name, exportType, ok := googleExportFormat(r.cfg, f)
+		if !ok {
+			printOp("skipped", r.rel(loc), skipReasonGoogleNative)
+			return
+		}
+		loc, mimeType = filepath.Join(filepath.Dir(loc), name), exportType
+	}
+	if _, err := os.Lstat(longPath(loc)); err == nil {
+		r.existing.Add(1)
+		return
+	}
+	bw.Do(func() error {
+		f, err := r.asOfRestoreAt(f)
+		if err != nil || f == nil {
+			return err
+		}
+		if r.cfg.DryRun {
+			r.files.Add(1)
+			r.size.Add(f.Size)
+			printOp("restored", r.rel(loc), getFileSizeFormatted(f.Size))
+			return nil
+		}
+		get := func(tmpLoc string) error { return r.drive.Download(f.ID, tmpLoc) }
+		if mimeType != "" {
+			get = func(tmpLoc string) error { return r.drive.Export(f.ID, mimeType, tmpLoc) }
+		}
+		info, err := fetch(loc, f, get)
+		if err != nil {
+			return fmt.Errorf("%v: %v", r.rel(loc), err)
+		}
+		r.files.Add(1)
+		r.size.Add(info.Size())
+		printOp("restored", r.rel(loc), getFileSizeFormatted(info.Size()))
+		return nil
+	})
+}
+
+// asOfRestoreAt returns f with the modification time of its revision at restore --at, nil when it was created after.
+// Files unchanged since keep theirs.
+func (r *restore) asOfRestoreAt(f *RemoteFile) (*RemoteFile, error) {
+	if r.revisions == nil || f.IsGoogleNative() || !f.ModTime.After(r.cfg.restoreAt) {
+		return f, nil
+	}
+	rev, err := r.revisions.revisionAt(f.ID, r.cfg.restoreAt)
+	if err != nil {
+		return nil, err
+	}
+	if rev == nil {
+		r.newer.Add(1)
+		return nil, nil
+	}
+	at := *f
+	at.ModTime, _ = time.Parse(time.RFC3339, rev.ModifiedTime)
+	return &at, nil
+}
+
+func (r *restore) rel(loc string) string {
+	return strings.TrimPrefix(loc, filepath.Clean(r.to))
+}
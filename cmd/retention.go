@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy keeps the latest backup of each of the last Daily days, Weekly weeks and Monthly months, the
+// grandfather-father-son way. A backup kept by one of them is kept. A policy of zeros keeps everything.
+type RetentionPolicy struct {
+	Daily   int `yaml:"daily"`
+	Weekly  int `yaml:"weekly"`
+	Monthly int `yaml:"monthly"`
+}
+
+func (p RetentionPolicy) valid() error {
+	if p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 {
+		return errors.New("expected positive numbers")
+	}
+	return nil
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.Daily != 0 || p.Weekly != 0 || p.Monthly != 0
+}
+
+// keep reports which of the backups taken at times, newest first, the policy keeps. The newest one is always kept.
+func (p RetentionPolicy) keep(times []time.Time) []bool {
+	kept := make([]bool, len(times))
+	if !p.enabled() {
+		for i := range kept {
+			kept[i] = true
+		}
+		return kept
+	}
+	if len(times) != 0 {
+		kept[0] = true
+	}
+	buckets := []struct {
+		n   int
+		key func(t time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%v-%v", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		last, n := "", 0
+		for i, t := range times {
+			if n == b.n {
+				break
+			}
+			if key := b.key(t.Local()); key != last {
+				kept[i] = true
+				last = key
+				n++
+			}
+		}
+	}
+	return kept
+}
+
+// pruneRemoteSnapshots deletes the remote snapshots snapshot_retention doesn't keep any longer.
+func (om *ObjectManager) pruneRemoteSnapshots() {
+	if !om.cfg.SnapshotRetention.enabled() {
+		return
+	}
+	for _, s := range om.snapshots.prune(om.cfg.SnapshotRetention) {
+		if err := om.drive.Delete(s.GDId); err != nil {
+			fmt.Printf("failed to prune remote snapshot %v: %v\n", s.Name, err)
+			continue
+		}
+		if !om.cfg.DryRun {
+			om.snapshots.forget(s)
+		}
+		printOp("pruned", "/"+s.Name, "remote snapshot, not among the "+retentionSummary(om.cfg.SnapshotRetention)+" kept")
+	}
+}
+
+// retentionSummary describes p for messages, e.g. "7 daily, 4 weekly".
+func retentionSummary(p RetentionPolicy) string {
+	var parts []string
+	for _, c := range []struct {
+		n    int
+		name string
+	}{{p.Daily, "daily"}, {p.Weekly, "weekly"}, {p.Monthly, "monthly"}} {
+		if c.n != 0 {
+			parts = append(parts, fmt.Sprintf("%v %v", c.n, c.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
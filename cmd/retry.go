@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 64 * time.Second
+)
+
+// gdriveRetryableOutput matches what the gdrive binary prints for rate limits and server side failures.
+var gdriveRetryableOutput = regexp.MustCompile(`(?i)rateLimitExceeded|userRateLimitExceeded|backendError|internalError|` +
+	`too many requests|service unavailable|bad gateway|gateway timeout|\b(status|code|error)\W{0,3}(429|5\d\d)\b`)
+
+// isRetryableDriveError reports errors worth retrying after a pause: rate limits (403 rateLimitExceeded and
+// userRateLimitExceeded, 429), server errors (5xx) and network failures. Anything else, such as a missing file or
+// an exhausted daily quota, fails the same way on every attempt.
+func isRetryableDriveError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests, apiErr.Code >= 500:
+			return true
+		case apiErr.Code == http.StatusForbidden:
+			for _, e := range apiErr.Errors {
+				if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode == http.StatusTooManyRequests || s3Err.StatusCode >= 500 || s3Err.Code == "SlowDown"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return gdriveRetryableOutput.MatchString(err.Error())
+}
+
+// gdriveRateLimitOutput matches what the gdrive binary prints for rate limits.
+var gdriveRateLimitOutput = regexp.MustCompile(`(?i)rateLimitExceeded|userRateLimitExceeded|too many requests|\b(status|code|error)\W{0,3}429\b`)
+
+// isRateLimitError reports drive answering that it is called too often: 429, or 403 rateLimitExceeded and
+// userRateLimitExceeded.
+func isRateLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == http.StatusTooManyRequests {
+			return true
+		}
+		for _, e := range apiErr.Errors {
+			if apiErr.Code == http.StatusForbidden && (e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded") {
+				return true
+			}
+		}
+		return false
+	}
+	return gdriveRateLimitOutput.MatchString(err.Error())
+}
+
+// isUnsentDriveError reports errors proving drive didn't carry out the request: drive refused it for a rate limit, or
+// the connection to drive couldn't even be established.
+func isUnsentDriveError(err error) bool {
+	if isRateLimitError(err) {
+		return true
+	}
+	var (
+		opErr  *net.OpError
+		dnsErr *net.DNSError
+	)
+	return (errors.As(err, &opErr) && opErr.Op == "dial") || errors.As(err, &dnsErr)
+}
+
+// retryDelay is the pause before retry attempt (starting at 1): exponential from retryBaseDelay up to
+// retryMaxDelay, with full jitter so concurrent workers hitting the same limit don't retry in lockstep.
+func retryDelay(attempt int) time.Duration {
+	d := retryBaseDelay << (attempt - 1)
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// withDriveRetry runs op and retries it up to retry times while it fails with a retryable error.
+func withDriveRetry[T any](retry int, name string, op func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := op()
+		if err == nil || attempt > retry || !isRetryableDriveError(err) {
+			return v, err
+		}
+		d := retryDelay(attempt)
+		fmt.Printf("%v failed (%v), retry %v/%v in %v\n", name, err, attempt, retry, d.Round(time.Millisecond))
+		if !sleepOrShutdown(d) {
+			return v, fmt.Errorf("%w: %v", errShutdown, err)
+		}
+	}
+}
+
+// withCreateRetry is withDriveRetry for the operations creating a file on drive, which aren't idempotent: a request
+// failing otherwise than unsent, such as with a lost response or a server error, may have created the file anyway.
+// Before retrying such a request, created looks the file up and returns it when found. Without created, only the
+// unsent requests are retried.
+func withCreateRetry[T any](retry int, name string, op func() (T, error), created func() (T, bool, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := op()
+		if err == nil || attempt > retry || !isRetryableDriveError(err) {
+			return v, err
+		}
+		if !isUnsentDriveError(err) {
+			if created == nil {
+				return v, err
+			}
+			found, ok, lookupErr := created()
+			if lookupErr != nil {
+				return v, err
+			}
+			if ok {
+				fmt.Printf("%v failed (%v) but created it, not retried\n", name, err)
+				return found, nil
+			}
+		}
+		d := retryDelay(attempt)
+		fmt.Printf("%v failed (%v), retry %v/%v in %v\n", name, err, attempt, retry, d.Round(time.Millisecond))
+		if !sleepOrShutdown(d) {
+			return v, fmt.Errorf("%w: %v", errShutdown, err)
+		}
+	}
+}
+
+// retryingDriveClient retries the operations of a DriveClient failing with a rate limit, quota burst or server
+// error, backing off exponentially. Other errors are returned right away. The operations creating files are retried
+// without creating them twice, see withCreateRetry.
+type retryingDriveClient struct {
+	DriveClient
+	retry int
+}
+
+func (c *retryingDriveClient) Mkdir(parentID, name string) (string, error) {
+	return withCreateRetry(c.retry, "mkdir "+name, func() (string, error) { return c.DriveClient.Mkdir(parentID, name) },
+		func() (string, bool, error) {
+			id, err := findChildFolder(c.DriveClient, parentID, name)
+			return id, id != "", err
+		})
+}
+
+func (c *retryingDriveClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	return withCreateRetry(c.retry, "upload "+loc, func() (*RemoteFile, error) { return c.DriveClient.Upload(parentID, loc) },
+		func() (*RemoteFile, bool, error) { return c.uploaded(parentID, loc) })
+}
+
+// uploaded looks up the file an upload of loc into parentID created: a file of its name holding its content, as far
+// as drive reports size and md5.
+func (c *retryingDriveClient) uploaded(parentID, loc string) (*RemoteFile, bool, error) {
+	info, err := os.Stat(loc)
+	if err != nil {
+		return nil, false, err
+	}
+	files, err := c.DriveClient.List(parentID, filepath.Base(loc))
+	if err != nil {
+		return nil, false, err
+	}
+	sum := ""
+	for _, f := range files {
+		if f.IsDir || f.Name != filepath.Base(loc) || ((f.Size != 0 || f.MD5 != "") && f.Size != info.Size()) {
+			continue
+		}
+		if f.MD5 != "" && sum == "" {
+			if sum, err = md5File(loc); err != nil {
+				return nil, false, err
+			}
+		}
+		if f.MD5 == "" || strings.EqualFold(f.MD5, sum) {
+			return f, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (c *retryingDriveClient) Update(id, loc string) (*RemoteFile, error) {
+	return withDriveRetry(c.retry, "update "+loc, func() (*RemoteFile, error) { return c.DriveClient.Update(id, loc) })
+}
+
+func (c *retryingDriveClient) Import(parentID, id, loc, mimeType string) (*RemoteFile, error) {
+	op := func() (*RemoteFile, error) { return c.DriveClient.Import(parentID, id, loc, mimeType) }
+	if id != "" {
+		return withDriveRetry(c.retry, "import "+loc, op) // into an existing document
+	}
+	return withCreateRetry(c.retry, "import "+loc, op, nil)
+}
+
+func (c *retryingDriveClient) Copy(id, parentID, name string) (*RemoteFile, error) {
+	return withCreateRetry(c.retry, "copy "+name, func() (*RemoteFile, error) { return c.DriveClient.Copy(id, parentID, name) }, nil)
+}
+
+func (c *retryingDriveClient) UploadFolder(parentID, name string, locs []string) (string, []*RemoteFile, error) {
+	var files []*RemoteFile
+	id, err := withCreateRetry(c.retry, "upload folder "+name, func() (string, error) {
+		id, f, err := c.DriveClient.UploadFolder(parentID, name, locs)
+		files = f
+		return id, err
+	}, nil)
+	return id, files, err
+}
+
+func (c *retryingDriveClient) StartPageToken() (string, error) {
+	return withDriveRetry(c.retry, "start page token", c.DriveClient.StartPageToken)
+}
+
+func (c *retryingDriveClient) Changes(pageToken string) ([]*RemoteChange, string, error) {
+	var next string
+	changes, err := withDriveRetry(c.retry, "changes "+pageToken, func() ([]*RemoteChange, error) {
+		changes, n, err := c.DriveClient.Changes(pageToken)
+		next = n
+		return changes, err
+	})
+	return changes, next, err
+}
+
+func (c *retryingDriveClient) Share(id, email, role string) error {
+	_, err := withDriveRetry(c.retry, "share "+id, func() (struct{}, error) {
+		return struct{}{}, c.DriveClient.Share(id, email, role)
+	})
+	return err
+}
+
+func (c *retryingDriveClient) Move(id, oldParentID, newParentID, name string) error {
+	_, err := withDriveRetry(c.retry, "move "+name, func() (struct{}, error) {
+		return struct{}{}, c.DriveClient.Move(id, oldParentID, newParentID, name)
+	})
+	return err
+}
+
+func (c *retryingDriveClient) Delete(id string) error {
+	_, err := withDriveRetry(c.retry, "delete "+id, func() (struct{}, error) { return struct{}{}, c.DriveClient.Delete(id) })
+	return err
+}
+
+func (c *retryingDriveClient) Trash(id string) error {
+	_, err := withDriveRetry(c.retry, "trash "+id, func() (struct{}, error) { return struct{}{}, c.DriveClient.Trash(id) })
+	return err
+}
+
+func (c *retryingDriveClient) List(parentID, nameContains string) ([]*RemoteFile, error) {
+	return withDriveRetry(c.retry, "list "+parentID, func() ([]*RemoteFile, error) {
+		return c.DriveClient.List(parentID, nameContains)
+	})
+}
+
+func (c *retryingDriveClient) Download(id, loc string) error {
+	_, err := withDriveRetry(c.retry, "download "+loc, func() (struct{}, error) {
+		return struct{}{}, c.DriveClient.Download(id, loc)
+	})
+	return err
+}
+
+func (c *retryingDriveClient) Export(id, mimeType, loc string) error {
+	_, err := withDriveRetry(c.retry, "export "+loc, func() (struct{}, error) {
+		return struct{}{}, c.DriveClient.Export(id, mimeType, loc)
+	})
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lostResponseClient fails its next failures uploads and mkdirs with err. With sent, it creates the file first, as if
+// only the response was lost, without, as if the request never reached drive.
+type lostResponseClient struct {
+	DriveClient
+	failures int
+	err      error
+	sent     bool
+}
+
+func (c *lostResponseClient) Upload(parentID, loc string) (*RemoteFile, error) {
+	if c.failures == 0 {
+		return c.DriveClient.Upload(parentID, loc)
+	}
+	c.failures--
+	if c.sent {
+		if _, err := c.DriveClient.Upload(parentID, loc); err != nil {
+			return nil, err
+		}
+	}
+	return nil, c.err
+}
+
+func (c *lostResponseClient) Mkdir(parentID, name string) (string, error) {
+	if c.failures == 0 {
+		return c.DriveClient.Mkdir(parentID, name)
+	}
+	c.failures--
+	if c.sent {
+		if _, err := c.DriveClient.Mkdir(parentID, name); err != nil {
+			return "", err
+		}
+	}
+	return "", c.err
+}
+
+func TestRetryCreatesOnce(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	cases := []struct {
+		name string
+		err  error
+		sent bool
+	}{
+		{"lost response", io.ErrUnexpectedEOF, true},
+		{"never sent", dialErr, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestTarget(t)
+			fake, err := newFakeDriveClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loc := filepath.Join(t.TempDir(), "a.txt")
+			if err = os.WriteFile(loc, []byte("a"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			c := &retryingDriveClient{DriveClient: &lostResponseClient{DriveClient: fake, failures: 1, err: tc.err, sent: tc.sent}, retry: 3}
+			if _, err = c.Upload(fakeDriveRootID, loc); err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			c.DriveClient.(*lostResponseClient).failures = 1
+			if _, err = c.Mkdir(fakeDriveRootID, "docs"); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			assertTree(t, fakeTree(t, cfg), map[string]string{"a.txt": "a", "docs/": ""})
+		})
+	}
+}
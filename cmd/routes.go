@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RouteConfig sends the folder Path of a target to another account or drive folder. The folder is synced as a target
+// of its own, named after the target and the route, with its own object map and state files, and is left out of the
+// target it is in.
+type RouteConfig struct {
+	Name string `yaml:"name"`
+	// Path is relative to the sync target path
+	Path         string `yaml:"path"`
+	Account      string `yaml:"account"`
+	APITokenFile string `yaml:"api_token_file"`
+	RootFolderID string `yaml:"root_folder_id"`
+	DriveID      string `yaml:"drive_id"`
+}
+
+// expandRoutes adds a target for every route of targets, after the target it is in.
+func expandRoutes(targets []*Config) ([]*Config, error) {
+	names := map[string]bool{}
+	for _, tcfg := range targets {
+		names[tcfg.targetName] = true
+	}
+	var expanded []*Config
+	for _, tcfg := range targets {
+		expanded = append(expanded, tcfg)
+		routes := tcfg.Routes
+		tcfg.Routes = nil
+		for i, r := range routes {
+			rcfg, err := routeTarget(tcfg, r)
+			if err != nil {
+				return nil, fmt.Errorf("%vroutes[%v]: %v", tcfg.targetLabel(), i, err)
+			}
+			if names[rcfg.targetName] {
+				return nil, fmt.Errorf("%vroutes[%v]: duplicate name %q, set a distinct name", tcfg.targetLabel(), i, rcfg.targetName)
+			}
+			names[rcfg.targetName] = true
+			for _, p := range tcfg.routedPaths {
+				if p == rcfg.routePath || strings.HasPrefix(rcfg.routePath, p+"/") || strings.HasPrefix(p, rcfg.routePath+"/") {
+					return nil, fmt.Errorf("%vroutes[%v]: %q overlaps the route of %q", tcfg.targetLabel(), i, r.Path, p)
+				}
+			}
+			tcfg.routedPaths = append(tcfg.routedPaths, rcfg.routePath)
+			expanded = append(expanded, rcfg)
+		}
+	}
+	return expanded, nil
+}
+
+// routeTarget returns the config of the target syncing the route r of tcfg. A route to another account starts from
+// the root of its drive unless root_folder_id or drive_id say otherwise, the folders of tcfg belong to its account.
+func routeTarget(tcfg *Config, r RouteConfig) (*Config, error) {
+	p := path.Clean(strings.Trim(filepath.ToSlash(r.Path), "/"))
+	switch {
+	case r.Path == "":
+		return nil, errors.New("path is required")
+	case p == "." || p == ".." || strings.HasPrefix(p, "../"):
+		return nil, fmt.Errorf("path %q is not a folder inside the sync target", r.Path)
+	case r.Account == "" && r.RootFolderID == "" && r.DriveID == "":
+		return nil, errors.New("account, root_folder_id or drive_id is required")
+	case r.Account != "" && tcfg.DriveClient == driveClientAPI && r.APITokenFile == "" && tcfg.GDServiceAccountFile == "":
+		return nil, fmt.Errorf("api_token_file is required with drive_client %q", driveClientAPI)
+	}
+	name := r.Name
+	if name == "" {
+		name = path.Base(p)
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	if tcfg.targetName != "" {
+		name = tcfg.targetName + "-" + name
+	}
+
+	rcfg := *tcfg
+	rcfg.targetName = name
+	rcfg.routePath = p
+	rcfg.routedPaths = nil
+	rcfg.SyncTargetPath = filepath.Join(tcfg.SyncTargetPath, filepath.FromSlash(p))
+	// include paths are relative to the sync target the route is in
+	rcfg.Include, rcfg.includePaths = nil, nil
+	if r.Account != "" {
+		rcfg.GDAccountName = r.Account
+		rcfg.GDRootFolderID, rcfg.GDDriveID = "", ""
+		rcfg.GDFallbackAccounts = nil
+		if r.APITokenFile != "" {
+			rcfg.GDAPITokenFile = r.APITokenFile
+		}
+	}
+	if r.RootFolderID != "" {
+		rcfg.GDRootFolderID, rcfg.GDRootPath = r.RootFolderID, ""
+	}
+	if r.DriveID != "" {
+		rcfg.GDDriveID = r.DriveID
+	}
+	return &rcfg, nil
+}
+
+// routedAway reports whether rel, slash separated and relative to the sync target, is synced by one of its routes.
+func routedAway(cfg *Config, rel string) bool {
+	for _, p := range cfg.routedPaths {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// routeFor returns the route of target syncing the path subtree of target (relative, empty for everything) and the
+// path relative to that route, or target and subtree when no route syncs it.
+func routeFor(targets []*Config, target *Config, subtree string) (*Config, string) {
+	rel := filepath.ToSlash(subtree)
+	if !routedAway(target, rel) {
+		return target, subtree
+	}
+	for _, t := range targets {
+		if t.routePath == "" || t.SyncTargetPath != filepath.Join(target.SyncTargetPath, filepath.FromSlash(t.routePath)) {
+			continue // not a route of target
+		}
+		if rel == t.routePath || strings.HasPrefix(rel, t.routePath+"/") {
+			return t, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(rel, t.routePath), "/"))
+		}
+	}
+	return target, subtree
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+// parseSchedule returns when a target syncs: at the times of the cron expression schedule ("0 */4 * * *",
+// "@daily", ...), or every delayMinute minutes when schedule is empty.
+func parseSchedule(schedule string, delayMinute int) (cron.Schedule, error) {
+	if schedule == "" {
+		return cron.ConstantDelaySchedule{Delay: time.Duration(delayMinute) * time.Minute}, nil
+	}
+	s, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("schedule: invalid cron expression %q: %v", schedule, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultWatchdogStallMinutes = 60
+
+// sdNotify sends state (e.g. "READY=1") to the service manager of a systemd Type=notify unit. Outside of one, where
+// NOTIFY_SOCKET is not set, it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func underSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// sdWatchdogInterval returns how often systemd expects WATCHDOG=1 (half of WatchdogSec=), or 0 when the unit has no
+// watchdog for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifySystemdReady checks that every target can reach its remote root with its credentials, then tells systemd
+// the daemon is up and, when the unit sets WatchdogSec=, keeps sending heartbeats until shutdown. Heartbeats stop
+// while a target is stalled: busy in a cycle without any progress for stall, so systemd restarts the wedged daemon.
+func notifySystemdReady(oms []*ObjectManager, stall time.Duration) error {
+	if !underSystemd() {
+		return nil
+	}
+	for _, om := range oms {
+		if err := om.CheckAuth(); err != nil {
+			return fmt.Errorf("%vdrive auth check failed: %w", om.cfg.targetLabel(), err)
+		}
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nSTATUS=syncing\nMAINPID=%v", os.Getpid())); err != nil {
+		fmt.Printf("sd_notify failed: %v\n", err)
+	}
+
+	go func() {
+		<-shutdown
+		_ = sdNotify("STOPPING=1")
+	}()
+
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return nil
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-shutdown:
+				return
+			case <-t.C:
+			}
+			if stalled := stalledTarget(stall); stalled != nil {
+				fmt.Printf("%vno progress for %v, holding back the systemd watchdog\n", stalled.label(), stall)
+				_ = sdNotify("STATUS=stalled")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				fmt.Printf("sd_notify failed: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func stalledTarget(stall time.Duration) *targetState {
+	for _, s := range allLiveStates() {
+		if s.stalled(stall) {
+			return s
+		}
+	}
+	return nil
+}
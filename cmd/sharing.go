@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// sharing roles: what the people a folder is shared with may do with it.
+var sharingRoles = map[string]bool{"reader": true, "commenter": true, "writer": true}
+
+// SharingConfig shares the remote root (empty path) or the folders matching path with emails and, with
+// anyone_with_link, with anyone who has the link.
+type SharingConfig struct {
+	Path           string   `yaml:"path"`
+	Emails         []string `yaml:"emails"`
+	AnyoneWithLink bool     `yaml:"anyone_with_link"`
+	Role           string   `yaml:"role"`
+
+	rule *gdriveIgnoreRule
+}
+
+// loadSharing checks the sharing entries of cfg and parses their paths.
+func loadSharing(cfg *Config) error {
+	for i := range cfg.Sharing {
+		sc := &cfg.Sharing[i]
+		if sc.Role == "" {
+			sc.Role = "reader"
+		}
+		if !sharingRoles[sc.Role] {
+			return fmt.Errorf("sharing %q: unknown role %q, expected reader, commenter or writer", sc.Path, sc.Role)
+		}
+		if len(sc.Emails) == 0 && !sc.AnyoneWithLink {
+			return fmt.Errorf("sharing %q: emails or anyone_with_link is required", sc.Path)
+		}
+		if strings.Trim(sc.Path, "/") == "" {
+			continue
+		}
+		rule, err := parseGDriveIgnoreLine(sc.Path)
+		if err != nil || rule == nil || rule.negate {
+			return fmt.Errorf("sharing %q: not a folder pattern", sc.Path)
+		}
+		sc.rule = rule
+	}
+	return nil
+}
+
+// shareFolder applies the sharing entries matching the folder loc, of id on drive. The remote root matches the
+// entries without a path.
+func (om *ObjectManager) shareFolder(loc, id string) error {
+	rel, err := filepath.Rel(om.cfg.SyncTargetPath, loc)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	for _, sc := range om.cfg.Sharing {
+		if rel == "." && sc.rule != nil || rel != "." && (sc.rule == nil || !sc.rule.re.MatchString(rel)) {
+			continue
+		}
+		for _, email := range sc.Emails {
+			if err = om.drive.Share(id, email, sc.Role); err != nil {
+				return fmt.Errorf("share %v with %v: %v", loc, email, err)
+			}
+		}
+		if sc.AnyoneWithLink {
+			if err = om.drive.Share(id, "", sc.Role); err != nil {
+				return fmt.Errorf("share %v with anyone with the link: %v", loc, err)
+			}
+		}
+		who := strings.Join(sc.Emails, ", ")
+		if sc.AnyoneWithLink {
+			who = strings.TrimPrefix(who+", anyone with the link", ", ")
+		}
+		printOp("shared", strings.TrimPrefix(loc, om.cfg.SyncTargetPath)+"/", fmt.Sprintf("%v as %v", who, sc.Role))
+	}
+	return nil
+}
+
+// shareRoot applies the sharing entries without a path to the remote root. Sharing is idempotent on drive, so it
+// runs on every start and picks up entries added since.
+func (om *ObjectManager) shareRoot() error {
+	for _, sc := range om.cfg.Sharing {
+		if sc.rule != nil {
+			continue
+		}
+		if om.rootID() == "." {
+			return fmt.Errorf("sharing: my drive itself can't be shared, set gd_root_folder_id to share the remote root")
+		}
+		return om.shareFolder(om.cfg.SyncTargetPath, om.rootID())
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os/exec"
+
+// shellCommand runs a user supplied command line through cmd.exe, there is no sh on windows.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
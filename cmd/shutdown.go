@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errShutdown ends a cycle interrupted by SIGINT or SIGTERM after its in-flight operations finished and the state
+// was saved.
+var errShutdown = errors.New("interrupted by shutdown")
+
+var (
+	shutdown     = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// handleShutdownSignals closes shutdown on the first SIGINT or SIGTERM so no new drive operation is started and
+// the running ones can finish. A second signal exits right away.
+func handleShutdownSignals() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		fmt.Printf("received %v, finishing in-flight operations and saving state (send it again to exit right away)\n", s)
+		requestShutdown()
+		s = <-sig
+		fmt.Printf("received %v again, exiting without saving state\n", s)
+		os.Exit(130)
+	}()
+}
+
+// requestShutdown starts the same graceful shutdown as a first SIGINT.
+func requestShutdown() {
+	shutdownOnce.Do(func() { close(shutdown) })
+}
+
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepOrShutdown sleeps for d and reports false when it was cut short by a shutdown.
+func sleepOrShutdown(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-shutdown:
+		return false
+	}
+}
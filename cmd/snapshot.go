@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// snapshot is a point-in-time view of the sync target that a cycle walks and uploads from.
+type snapshot struct {
+	path    string
+	release func() error
+}
+
+type SnapshotHookConfig struct {
+	// Create is a shell command that creates the snapshot (e.g. lvcreate, btrfs subvolume snapshot, zfs snapshot)
+	// and mounts it when needed.
+	Create string `yaml:"create"`
+	// Path is the location of the sync target inside the snapshot. When empty, the last line printed by Create is used.
+	Path string `yaml:"path"`
+	// Destroy is a shell command that unmounts and removes the snapshot after the cycle.
+	Destroy string `yaml:"destroy"`
+}
+
+// createSnapshot prepares the source the current cycle reads from. Without any snapshot option enabled it simply
+// points at cfg.SyncTargetPath.
+func createSnapshot(cfg *Config) (*snapshot, error) {
+	if cfg.VSSSnapshot {
+		return createVSSSnapshot(cfg.SyncTargetPath)
+	}
+	if cfg.SnapshotHook.Create != "" {
+		return createHookSnapshot(cfg)
+	}
+	return &snapshot{path: cfg.SyncTargetPath, release: func() error { return nil }}, nil
+}
+
+func createHookSnapshot(cfg *Config) (*snapshot, error) {
+	hook := cfg.SnapshotHook
+	out, err := runHook(cfg, hook.Create)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot create hook: %v", err)
+	}
+
+	destroy := func() error {
+		if hook.Destroy == "" {
+			return nil
+		}
+		if _, err := runHook(cfg, hook.Destroy); err != nil {
+			return fmt.Errorf("snapshot destroy hook: %v", err)
+		}
+		return nil
+	}
+
+	path := hook.Path
+	if path == "" {
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		path = strings.TrimSpace(lines[len(lines)-1])
+	}
+	if path == "" {
+		return nil, errors.Join(errors.New("snapshot create hook did not report a path"), destroy())
+	}
+	if _, err = os.Stat(path); err != nil {
+		return nil, errors.Join(err, destroy())
+	}
+
+	return &snapshot{path: path, release: destroy}, nil
+}
+
+// runHook executes a user supplied shell command (cmd.exe on windows) with the sync target exposed as BGDRIVE_SYNC_TARGET_PATH.
+func runHook(cfg *Config, command string) (string, error) {
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), "BGDRIVE_SYNC_TARGET_PATH="+cfg.SyncTargetPath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New(strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func createVSSSnapshot(_ string) (*snapshot, error) {
+	return nil, errors.New("vss_snapshot is only supported on windows")
+}
@@ -0,0 +1,57 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// createVSSSnapshot creates a client accessible Volume Shadow Copy of the volume holding targetPath and exposes it
+// through a temporary directory symlink, so locked or in-use files can be read consistently.
+func createVSSSnapshot(targetPath string) (*snapshot, error) {
+	absTargetPath, err := filepath.Abs(targetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	vol := filepath.VolumeName(absTargetPath)
+	if vol == "" {
+		return nil, fmt.Errorf("cannot determine volume of %v", absTargetPath)
+	}
+
+	script := fmt.Sprintf(`$s = (Get-WmiObject -List Win32_ShadowCopy).Create('%v\', 'ClientAccessible'); `+
+		`if ($s.ReturnValue -ne 0) { throw "shadow copy creation failed with code $($s.ReturnValue)" }; `+
+		`$c = Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq $s.ShadowID }; `+
+		`Write-Output $c.ID; Write-Output $c.DeviceObject`, strings.ReplaceAll(vol, "'", "''")) // quoted as a powershell literal
+	out, err := runCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	if err != nil {
+		return nil, fmt.Errorf("vss: %v", err)
+	}
+
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("vss: unexpected output: %v", out)
+	}
+	shadowID, deviceObject := lines[0], lines[1]
+
+	deleteShadow := func() error {
+		_, err := runCommand("vssadmin", "delete", "shadows", "/Shadow="+shadowID, "/Quiet")
+		return err
+	}
+
+	linkPath := filepath.Join(os.TempDir(), "bgdrive-sync-vss-"+strings.Trim(shadowID, "{}"))
+	if err = os.Symlink(deviceObject+`\`, linkPath); err != nil {
+		return nil, errors.Join(err, deleteShadow())
+	}
+
+	return &snapshot{
+		path: filepath.Join(linkPath, strings.TrimPrefix(absTargetPath, vol)),
+		release: func() error {
+			return errors.Join(os.Remove(linkPath), deleteShadow())
+		},
+	}, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recoverStaleLocks resolves the objects left locked (GDId == "") by a process which died while creating them. It
+// must run before the first cycle, when no operation of this process is in flight. The remote parent of each one is
+// searched for an object of the same name created before the crash: when found and the local side still exists it
+// is adopted, so it isn't uploaded a second time, else the lock is purged and the next sync starts over.
+func (om *ObjectManager) recoverStaleLocks() error {
+	var locked []string
+	om.SnapshotObjects().each(func(loc string, object *Object) {
+		if object.GDId == "" {
+			locked = append(locked, loc)
+		}
+	})
+	if len(locked) == 0 {
+		return nil
+	}
+	sort.Strings(locked) // parents before their children
+
+	adopted, purged := 0, 0
+	for _, loc := range locked {
+		object, _ := om.loadObject(loc)
+		rel := strings.TrimPrefix(loc, om.cfg.SyncTargetPath)
+		f, err := om.findStaleLockRemote(loc, object)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			om.deleteObject(loc)
+			purged++
+			printOp("purged", rel, "stale lock, nothing to adopt on drive, synced again")
+			continue
+		}
+
+		info, err := os.Stat(longPath(loc))
+		if err != nil {
+			return err
+		}
+		adoptedObject := &Object{GDId: f.ID, GDPId: object.GDPId, Size: info.Size(), Converted: f.IsGoogleNative()}
+		detail := "stale lock, adopted the folder found on drive"
+		if !f.IsDir {
+			adoptedObject.LastMod, adoptedObject.RemoteMod, adoptedObject.Inode = info.ModTime().Unix(), remoteModUnix(f), fileInode(info)
+			same := f.Size == info.Size()
+			if same && f.MD5 != "" {
+				sum, err := om.hashes.md5(loc)
+				if err != nil {
+					return err
+				}
+				same = strings.EqualFold(sum, f.MD5)
+				adoptedObject.MD5 = sum
+			}
+			detail = "stale lock, adopted the file found on drive"
+			if !same {
+				// older and of another size than the local file: the next sync updates drive
+				adoptedObject.LastMod, adoptedObject.Size, adoptedObject.MD5 = 1, -1, ""
+				detail = "stale lock, adopted the partial file found on drive, updated by the next sync"
+			}
+		}
+		om.updateStoredObject(object, func(o *Object) { *o = *adoptedObject })
+		adopted++
+		printOp("recovered", rel, detail)
+	}
+	if err := om.SaveToFile(); err != nil {
+		return err
+	}
+	fmt.Printf("%vrecovered %v stale locks: %v adopted, %v purged\n", om.cfg.targetLabel(), len(locked), adopted, purged)
+	return nil
+}
+
+// findStaleLockRemote returns the remote counterpart of the locked object at loc, or nil when there is none or loc
+// is gone locally.
+func (om *ObjectManager) findStaleLockRemote(loc string, object *Object) (*RemoteFile, error) {
+	info, err := os.Stat(longPath(loc))
+	if err != nil || object.GDPId == "" {
+		// the parent was locked too, or the local side is gone: nothing to adopt
+		return nil, nil
+	}
+	if parent, ok := om.loadObject(filepath.Dir(loc)); !ok || parent.GDId != object.GDPId {
+		return nil, nil
+	}
+	name, converted := filepath.Base(loc), false
+	if _, ok := googleConvertType(om.cfg, loc); ok && !info.IsDir() {
+		name, converted = convertedName(loc), true
+	}
+	files, err := om.drive.List(object.GDPId, name)
+	if err != nil {
+		return nil, err
+	}
+	var found *RemoteFile
+	for _, f := range files {
+		if f.Name != name || f.IsDir != info.IsDir() || f.IsGoogleNative() != converted {
+			continue
+		}
+		if found == nil || (!info.IsDir() && f.Size == info.Size() && found.Size != info.Size()) {
+			found = f // prefer a complete upload among several attempts
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stateBackupMagic prefixes every encrypted state snapshot so incompatible formats are rejected early.
+const stateBackupMagic = "BGDS1"
+
+const (
+	stateBackupSaltSize = 16
+	stateBackupKeySize  = 32
+)
+
+// stateSnapshot is the portable form of the object map and the intent journal. Keys are relative to the sync target
+// path so the snapshot can be restored on a machine that keeps the target somewhere else. Journal holds the remote
+// changes the object map doesn't reflect yet, replayed over it once restored.
+type stateSnapshot struct {
+	Host       string             `json:"host"`
+	TargetPath string             `json:"target_path"`
+	CreatedAt  time.Time          `json:"created_at"`
+	Objects    map[string]*Object `json:"objects"`
+	Journal    []intentRecord     `json:"journal,omitempty"`
+}
+
+func stateBackupFileName(host string) string {
+	return fmt.Sprintf("state-%v.json.enc", host)
+}
+
+// PublishStateBackup uploads an encrypted copy of the object map and the intent journal into the remote metadata
+// folder, replacing the previous copy of this host.
+func (om *ObjectManager) PublishStateBackup() error {
+	passphrase, err := readStateBackupPassphrase(om.cfg)
+	if err != nil {
+		return err
+	}
+
+	objects := map[string]*Object{}
+	om.SnapshotObjects().each(func(loc string, object *Object) {
+		objects[strings.TrimPrefix(loc, om.cfg.SyncTargetPath)] = object
+	})
+	var journal []intentRecord
+	if om.journal != nil {
+		journal = om.journal.snapshot()
+	}
+	plain, err := json.Marshal(stateSnapshot{
+		Host:       hostname(),
+		TargetPath: om.cfg.SyncTargetPath,
+		CreatedAt:  time.Now(),
+		Objects:    objects,
+		Journal:    journal,
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := encryptStateBackup(plain, passphrase)
+	if err != nil {
+		return err
+	}
+	if err = om.putMetaFile(stateBackupFileName(hostname()), data); err != nil {
+		return fmt.Errorf("publish state backup: %v", err)
+	}
+	return nil
+}
+
+// BootstrapStateBackup pulls the encrypted state snapshot published by host and replaces the local object map
+// with it, so a fresh machine can resume syncing without re-uploading everything. The journal of the snapshot
+// replaces the leftover of the local one, replayIntentJournal applies it next.
+func (om *ObjectManager) BootstrapStateBackup(host string) error {
+	passphrase, err := readStateBackupPassphrase(om.cfg)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = hostname()
+	}
+
+	data, err := om.downloadMetaFile(stateBackupFileName(host))
+	if err != nil {
+		return fmt.Errorf("bootstrap state backup: %v", err)
+	}
+	plain, err := decryptStateBackup(data, passphrase)
+	if err != nil {
+		return fmt.Errorf("bootstrap state backup: %v", err)
+	}
+
+	snap := stateSnapshot{}
+	if err = json.Unmarshal(plain, &snap); err != nil {
+		return err
+	}
+
+	objectMap := newObjectTree()
+	for rel, object := range snap.Objects {
+		objectMap.put(filepath.Join(om.cfg.SyncTargetPath, rel), object)
+	}
+
+	om.objectMapRWMu.Lock()
+	om.objectMap = objectMap
+	om.objectMapRWMu.Unlock()
+	if om.journal != nil {
+		om.journal.adoptLeftover(snap.Journal)
+	}
+
+	fmt.Printf("bootstrapped %v objects and %v journal records from the state backup of %v (%v)\n", objectMap.len(),
+		len(snap.Journal), snap.Host, snap.CreatedAt.Format(time.DateTime))
+	return om.SaveToFile()
+}
+
+func readStateBackupPassphrase(cfg *Config) ([]byte, error) {
+	if cfg.StateBackupKeyFile == "" {
+		return nil, errors.New("state_backup_key_file is required to encrypt the state backup")
+	}
+	passphrase, err := os.ReadFile(cfg.StateBackupKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	passphrase = bytes.TrimSpace(passphrase)
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("%v is empty", cfg.StateBackupKeyFile)
+	}
+	return passphrase, nil
+}
+
+func stateBackupGCM(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, stateBackupKeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptStateBackup seals plain with AES-256-GCM using a scrypt derived key. Layout: magic | salt | nonce | sealed.
+func encryptStateBackup(plain, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, stateBackupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := stateBackupGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(stateBackupMagic), salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, []byte(stateBackupMagic)), nil
+}
+
+func decryptStateBackup(data, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(stateBackupMagic)) {
+		return nil, errors.New("not a bgdrive-sync state backup")
+	}
+	data = data[len(stateBackupMagic):]
+	if len(data) < stateBackupSaltSize {
+		return nil, errors.New("state backup is truncated")
+	}
+	salt, data := data[:stateBackupSaltSize], data[stateBackupSaltSize:]
+
+	gcm, err := stateBackupGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("state backup is truncated")
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, sealed, []byte(stateBackupMagic))
+	if err != nil {
+		return nil, errors.New("cannot decrypt state backup, wrong key?")
+	}
+	return plain, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateBackupRestoresJournal(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "state.key")
+	if err := os.WriteFile(keyFile, []byte("passphrase\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestTarget(t)
+	cfg.StateBackupKeyFile = keyFile
+	now := time.Now().Add(-time.Hour)
+	writeTestFile(t, cfg, "a.txt", "a", now)
+	writeTestFile(t, cfg, "docs/b.txt", "b", now)
+	om := newTestObjectManager(t, cfg)
+	runTestCycle(t, cfg, om)
+
+	// an update still in flight when the backup is published
+	a, _ := om.loadObject(filepath.Join(cfg.SyncTargetPath, "a.txt"))
+	if _, err := om.journal.begin(intentRecord{Op: intentUpdate, ID: a.GDId}); err != nil {
+		t.Fatal(err)
+	}
+	if err := om.PublishStateBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh machine keeping the target somewhere else, syncing to the same drive
+	fresh := newTestTarget(t)
+	fresh.StateBackupKeyFile = keyFile
+	freshOM := newTestObjectManager(t, fresh)
+	if err := freshOM.BootstrapStateBackup(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := freshOM.replayIntentJournal(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"a.txt", "docs", "docs/b.txt"} {
+		object, ok := freshOM.loadObject(filepath.Join(fresh.SyncTargetPath, filepath.FromSlash(rel)))
+		if !ok || object.GDId == "" {
+			t.Errorf("%v not restored from the state backup", rel)
+		}
+	}
+	restored, _ := freshOM.loadObject(filepath.Join(fresh.SyncTargetPath, "a.txt"))
+	if restored.Size != -1 {
+		t.Errorf("a.txt whose update was in flight was not replayed to be updated again: size %v", restored.Size)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// objectMapBackupSuffix names the previous object map, kept to fall back on when the current one is unreadable.
+const objectMapBackupSuffix = ".bak"
+
+// writeFileAtomic replaces filePath with data so a crash leaves either the old or the new content, never a mix:
+// data is written to a temporary file in the same directory, synced to disk and renamed over filePath.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(filePath))
+	return nil
+}
+
+// syncDir flushes a rename in dir to disk. It is best effort, not every platform can sync a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+// saveObjectMap writes data as the new object map, turning the current one into the backup first.
+func saveObjectMap(filePath string, data []byte) error {
+	if err := os.Rename(filePath, filePath+objectMapBackupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(filePath, data, os.ModePerm)
+}
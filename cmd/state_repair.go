@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func newStateCmd(cf *configFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Inspect and maintain the object map",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "repair",
+		Short: "Fix orphaned, misparented and duplicated entries of the object map",
+		Long: "Fix the inconsistencies the object map can accumulate, and print what was changed:\n" +
+			"  - entries tracked twice for the same drive id keep only one path, the others are forgotten\n" +
+			"  - entries whose parent folder is not tracked are forgotten, with everything below them\n" +
+			"  - entries whose parent id is not the id of their tracked parent folder take that id\n" +
+			"Forgotten files which still exist locally are uploaded again by the next sync. Nothing is changed on\n" +
+			"drive. Stop a running daemon first, it would overwrite the repaired object map. With --dry-run, only\n" +
+			"prints what would be changed.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			for _, tcfg := range targets {
+				if err = repairState(tcfg); err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+			}
+			return nil
+		},
+	})
+	cmd.AddCommand(newStateQuarantineCmd(cf))
+	return cmd
+}
+
+func newStateQuarantineCmd(cf *configFlags) *cobra.Command {
+	var clear bool
+	cmd := &cobra.Command{
+		Use:   "quarantine [path]",
+		Short: "List the files skipped after failing quarantine_after_failures times in a row",
+		Long: "List the quarantined files with their last error. With --clear, release them (or only path and what is\n" +
+			"below it) so the next sync tries them again. A quarantined file is also released once it changes.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			subtrees := make([]string, len(targets))
+			if len(args) == 1 {
+				tcfg, subtree, err := findTarget(targets, args[0])
+				if err != nil {
+					return err
+				}
+				targets, subtrees = []*Config{tcfg}, []string{subtree}
+			}
+			for i, tcfg := range targets {
+				qs, err := newQuarantineStore(tcfg.statePath("quarantine.json"))
+				if err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+				if !clear {
+					printQuarantine(tcfg, qs)
+					continue
+				}
+				if err = acquireInstanceLock(tcfg); err != nil {
+					return err
+				}
+				loc := ""
+				if subtrees[i] != "" {
+					loc = filepath.Join(tcfg.SyncTargetPath, subtrees[i])
+				}
+				released := qs.release(loc)
+				if err = qs.save(); err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+				fmt.Printf("%vreleased %v files, synced again by the next cycle\n", tcfg.targetLabel(), released)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&clear, "clear", false, "release the quarantined files instead of listing them")
+	return cmd
+}
+
+// repairState fixes the duplicated, orphaned and misparented entries of the object map of cfg, in that order since
+// forgetting a duplicated folder orphans what is tracked below it.
+func repairState(cfg *Config) error {
+	if err := acquireInstanceLock(cfg); err != nil {
+		return err
+	}
+	state, err := openStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	tree, err := state.Load()
+	if err != nil {
+		return err
+	}
+	objectMap := tree.toMap()
+
+	locs := make([]string, 0, len(objectMap))
+	for loc := range objectMap {
+		locs = append(locs, loc)
+	}
+	sort.Strings(locs) // parents before their children
+	rel := func(loc string) string {
+		return strings.TrimPrefix(loc, cfg.SyncTargetPath)
+	}
+	parentID := func(loc string) (string, bool) {
+		dir := filepath.Dir(loc)
+		if dir == cfg.SyncTargetPath {
+			return remoteRootID(cfg), true
+		}
+		parent, ok := objectMap[dir]
+		if !ok {
+			return "", false
+		}
+		return parent.GDId, true
+	}
+
+	byID := map[string][]string{}
+	for _, loc := range locs {
+		if id := objectMap[loc].GDId; id != "" {
+			byID[id] = append(byID[id], loc)
+		}
+	}
+	duplicates := 0
+	for _, loc := range locs {
+		object, ok := objectMap[loc]
+		if !ok {
+			continue
+		}
+		dups := byID[object.GDId]
+		if len(dups) < 2 || dups[0] != loc {
+			continue
+		}
+		keep := keptDuplicate(objectMap, dups, parentID)
+		for _, dup := range dups {
+			if dup == keep {
+				continue
+			}
+			delete(objectMap, dup)
+			duplicates++
+			printOp("forgot", rel(dup), "same drive id as "+rel(keep))
+		}
+	}
+
+	orphans := 0
+	for _, loc := range locs {
+		if _, ok := objectMap[loc]; !ok {
+			continue
+		}
+		if _, ok := parentID(loc); ok && strings.HasPrefix(loc, cfg.SyncTargetPath+string(filepath.Separator)) {
+			continue
+		}
+		// locs are sorted, so the children of loc come later and are orphaned in turn
+		delete(objectMap, loc)
+		orphans++
+		printOp("forgot", rel(loc), "parent folder is not tracked")
+	}
+
+	reparented := 0
+	for _, loc := range locs {
+		object, ok := objectMap[loc]
+		if !ok || object.GDId == "" {
+			continue
+		}
+		if id, _ := parentID(loc); id != "" && id != object.GDPId {
+			printOp("reparented", rel(loc), fmt.Sprintf("parent id %q, was %q", id, object.GDPId))
+			object.GDPId = id
+			reparented++
+		}
+	}
+
+	if !cfg.DryRun && duplicates+orphans+reparented != 0 {
+		if err = state.Save(objectTreeOf(objectMap)); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%vrepaired %v tracked objects: %v duplicates and %v orphans forgotten, %v reparented\n",
+		cfg.targetLabel(), len(locs), duplicates, orphans, reparented)
+	return nil
+}
+
+// keptDuplicate picks which of the locs tracked for the same drive id keeps it: preferably one whose parent id
+// matches its tracked parent folder and which still exists locally, else the first one.
+func keptDuplicate(objectMap map[string]*Object, dups []string, parentID func(loc string) (string, bool)) string {
+	best, bestScore := dups[0], -1
+	for _, loc := range dups {
+		score := 0
+		if id, ok := parentID(loc); ok && id == objectMap[loc].GDPId {
+			score += 2
+		}
+		if _, err := os.Lstat(longPath(loc)); !errors.Is(err, os.ErrNotExist) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = loc, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"strings"
+)
+
+const (
+	stateBackendJSON   = "json"
+	stateBackendSQLite = "sqlite"
+)
+
+// StateStore persists the object map between runs.
+type StateStore interface {
+	// Load returns the stored object map, empty when nothing was stored yet.
+	Load() (*objectTree, error)
+	// Save stores objectMap, which the caller keeps from changing for the duration of the call.
+	Save(objectMap *objectTree) error
+	Close() error
+}
+
+// openStateStore opens the store selected by state_backend.
+func openStateStore(cfg *Config) (StateStore, error) {
+	switch cfg.StateBackend {
+	case "", stateBackendJSON:
+		return &jsonStateStore{filePath: cfg.statePath("object_map.json")}, nil
+	case stateBackendSQLite:
+		return openSQLiteStateStore(cfg.statePath("state.db"), cfg.statePath("object_map.json"))
+	default:
+		return nil, fmt.Errorf("state_backend: unknown backend %q, expected %q or %q", cfg.StateBackend, stateBackendJSON, stateBackendSQLite)
+	}
+}
+
+// jsonStateStore keeps the whole object map in a single json file, rewritten on every save.
+type jsonStateStore struct {
+	filePath string
+}
+
+func (s *jsonStateStore) Load() (*objectTree, error) {
+	return loadObjectMap(s.filePath)
+}
+
+func (s *jsonStateStore) Save(objectMap *objectTree) error {
+	data, err := encodeObjectMap(objectMap)
+	if err != nil {
+		return err
+	}
+	return saveObjectMap(s.filePath, data)
+}
+
+func (s *jsonStateStore) Close() error {
+	return nil
+}
+
+// sqliteStateStore keeps one row per object, keyed by path. A save only writes the rows that changed since the
+// previous load or save, which keeps large trees cheap to persist.
+type sqliteStateStore struct {
+	db *sql.DB
+	// importFrom is the json object map taken over when the database is still empty
+	importFrom string
+	// saved holds where the objects of tree were last loaded or saved and their fingerprint then
+	tree  *objectTree
+	saved map[*Object]savedObject
+}
+
+type savedObject struct {
+	dir  *objectNode
+	name string
+	sum  uint64
+}
+
+func openSQLiteStateStore(filePath, importFrom string) (*sqliteStateStore, error) {
+	db, err := sql.Open("sqlite", filePath)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA synchronous = NORMAL`,
+		`CREATE TABLE IF NOT EXISTS objects (
+			path       TEXT PRIMARY KEY,
+			gd_id      TEXT NOT NULL,
+			gdp_id     TEXT NOT NULL,
+			last_mod   INTEGER NOT NULL,
+			size       INTEGER NOT NULL,
+			remote_mod INTEGER NOT NULL,
+			inode      INTEGER NOT NULL,
+			md5        TEXT NOT NULL
+		)`,
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("%v: %v", filePath, err)
+		}
+	}
+	// columns added since the table was first created
+	for _, column := range []string{
+		`exported INTEGER NOT NULL DEFAULT 0`,
+		`converted INTEGER NOT NULL DEFAULT 0`,
+		`compressed_size INTEGER NOT NULL DEFAULT 0`,
+	} {
+		if err = addSQLiteColumn(db, "objects", column); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("%v: %v", filePath, err)
+		}
+	}
+	return &sqliteStateStore{db: db, importFrom: importFrom, saved: map[*Object]savedObject{}}, nil
+}
+
+func (s *sqliteStateStore) Load() (*objectTree, error) {
+	rows, err := s.db.Query(`SELECT path, gd_id, gdp_id, last_mod, size, remote_mod, inode, md5, exported, converted, compressed_size FROM objects`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objectMap := newObjectTree()
+	for rows.Next() {
+		var (
+			loc   string
+			o     Object
+			inode int64
+		)
+		if err = rows.Scan(&loc, &o.GDId, &o.GDPId, &o.LastMod, &o.Size, &o.RemoteMod, &inode, &o.MD5, &o.Exported, &o.Converted, &o.CompressedSize); err != nil {
+			return nil, err
+		}
+		o.Inode = uint64(inode)
+		objectMap.put(loc, &o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	s.tree = objectMap
+	objectMap.eachEntry(func(dir *objectNode, name string, o *Object) {
+		s.saved[o] = savedObject{dir: dir, name: name, sum: objectFingerprint(o)}
+	})
+
+	if objectMap.len() == 0 && s.importFrom != "" {
+		// first run on sqlite, take over the json state. It is written to the database by the next save
+		return loadObjectMap(s.importFrom)
+	}
+	return objectMap, nil
+}
+
+func (s *sqliteStateStore) Save(objectMap *objectTree) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsert, err := tx.Prepare(`INSERT INTO objects (path, gd_id, gdp_id, last_mod, size, remote_mod, inode, md5, exported,
+			converted, compressed_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET gd_id = excluded.gd_id, gdp_id = excluded.gdp_id, last_mod = excluded.last_mod,
+			size = excluded.size, remote_mod = excluded.remote_mod, inode = excluded.inode, md5 = excluded.md5,
+			exported = excluded.exported, converted = excluded.converted,
+			compressed_size = excluded.compressed_size`)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	del, err := tx.Prepare(`DELETE FROM objects WHERE path = ?`)
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+
+	// the objects saved before which are no longer tracked where they were, or all of them when the tree was replaced.
+	// Their rows are deleted first, a path tracked again as another object is written back by the upserts
+	var deleted []*Object
+	for o, saved := range s.saved {
+		if s.tree == objectMap && saved.dir.lookup(saved.name) == o {
+			continue
+		}
+		if loc := saved.dir.join(saved.name); !objectMap.has(loc) {
+			if _, err = del.Exec(loc); err != nil {
+				return err
+			}
+		}
+		deleted = append(deleted, o)
+	}
+	changed := map[*Object]savedObject{}
+	objectMap.eachEntry(func(dir *objectNode, name string, o *Object) {
+		if err != nil {
+			return
+		}
+		sum := objectFingerprint(o)
+		if saved, ok := s.saved[o]; ok && saved.sum == sum && saved.dir == dir && saved.name == name {
+			return
+		}
+		if _, err = upsert.Exec(dir.join(name), o.GDId, o.GDPId, o.LastMod, o.Size, o.RemoteMod, int64(o.Inode), o.MD5, o.Exported, o.Converted, o.CompressedSize); err != nil {
+			return
+		}
+		changed[o] = savedObject{dir: dir, name: name, sum: sum}
+	})
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	s.tree = objectMap
+	for _, o := range deleted {
+		delete(s.saved, o)
+	}
+	for o, saved := range changed {
+		s.saved[o] = saved
+	}
+	return nil
+}
+
+func (s *sqliteStateStore) Close() error {
+	return s.db.Close()
+}
+
+// addSQLiteColumn adds column (a column definition) to table unless a column of that name exists already.
+func addSQLiteColumn(db *sql.DB, table, column string) error {
+	var exists bool
+	err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, strings.Fields(column)[0]).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column)
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func newStatusCmd(cf *configFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Print what is tracked and how the last cycle went, from the local state only",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			for i, tcfg := range targets {
+				if i != 0 {
+					fmt.Println()
+				}
+				if err = printStatus(tcfg); err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func printStatus(cfg *Config) error {
+	state, err := openStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	objectMap, err := state.Load()
+	if err != nil {
+		return err
+	}
+	var (
+		folders, files, pending, compressed int
+		size, compressedFrom, compressedTo  int64
+	)
+	objectMap.each(func(_ string, object *Object) {
+		switch {
+		case object.GDId == "":
+			pending++
+		case object.LastMod == 0:
+			folders++
+		default:
+			files++
+			size += object.Size
+			if object.CompressedSize != 0 {
+				compressed++
+				compressedFrom, compressedTo = compressedFrom+object.Size, compressedTo+object.CompressedSize
+			}
+		}
+	})
+
+	fmt.Printf("%vtarget:    %v\n", cfg.targetLabel(), cfg.SyncTargetPath)
+	fmt.Printf("tracked:   %v folders, %v files, %v\n", folders, files, getFileSizeFormatted(size))
+	if compressed != 0 {
+		fmt.Printf("           %v files compressed from %v to %v on drive\n", compressed, getFileSizeFormatted(compressedFrom),
+			getFileSizeFormatted(compressedTo))
+	}
+	if pending != 0 {
+		fmt.Printf("pending:   %v objects left locked by an interrupted cycle\n", pending)
+	}
+	if qs, err := newQuarantineStore(cfg.statePath("quarantine.json")); err == nil && len(qs.list()) != 0 {
+		fmt.Printf("failing:   %v files quarantined, see state quarantine\n", len(qs.list()))
+	}
+
+	var report CycleReport
+	data, err := os.ReadFile(cfg.statePath("last_report.json"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Println("last sync: never")
+	case err != nil:
+		return err
+	default:
+		if err = json.Unmarshal(data, &report); err != nil {
+			return err
+		}
+		result := colorize(colorGreen, "ok")
+		if report.Failed() {
+			result = colorize(colorRed, "failed: "+report.Err)
+		}
+		created, updated, deleted := report.Counts()
+		fmt.Printf("last sync: %v (took %v) %v\n", report.Start.Format(time.DateTime), report.End.Sub(report.Start).Round(time.Second), result)
+		fmt.Printf("           %v created, %v updated, %v deleted, %v skipped, %v transferred\n",
+			created, updated, deleted, len(report.Skipped), getFileSizeFormatted(report.BytesTransferred()))
+	}
+
+	limit, err := parseByteSize(cfg.DailyUploadCap)
+	if err != nil || limit <= 0 {
+		return nil
+	}
+	uploads, err := newUploadAccounting(uploadAccountingFile, limit)
+	if err != nil {
+		return err
+	}
+	used, _ := uploads.Usage(cfg.GDAccountName)
+	fmt.Printf("uploaded:  %v of %v in the last 24h by %v\n", getFileSizeFormatted(used), getFileSizeFormatted(limit), cfg.GDAccountName)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TargetConfig is one entry of targets: a local folder synced to its own drive folder. Empty fields fall back to the
+// top level gd_account_name, gd_root_folder_id, schedule (or sync_delay_minute), sync_worker, delete_mode and notify.
+type TargetConfig struct {
+	Name         string   `yaml:"name"`
+	Account      string   `yaml:"account"`
+	RootFolderID string   `yaml:"root_folder_id"`
+	Path         string   `yaml:"path"`
+	Schedule     string   `yaml:"schedule"` // minutes between syncs, or a cron expression
+	Workers      int      `yaml:"workers"`
+	DeleteMode   string   `yaml:"delete_mode"`
+	Notify       []string `yaml:"notify"`
+	// Routes send folders of the target to other accounts or drive folders
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// expandTargets returns the config of every sync target. Without targets, that is cfg itself and the state files
+// keep their plain names. Otherwise each target gets a copy of cfg with its own settings applied and its state files
+// (object map, decisions, reports, digest) suffixed with the target name.
+func expandTargets(cfg *Config) ([]*Config, error) {
+	if len(cfg.Targets) == 0 {
+		return []*Config{cfg}, nil
+	}
+	if len(cfg.Routes) != 0 {
+		return nil, errors.New("routes: set them on the entry of targets they belong to")
+	}
+
+	var (
+		targets []*Config
+		names   = map[string]bool{}
+	)
+	for i, t := range cfg.Targets {
+		if t.Path == "" {
+			return nil, fmt.Errorf("targets[%v]: path is required", i)
+		}
+		name := t.Name
+		if name == "" {
+			name = filepath.Base(filepath.Clean(t.Path))
+		}
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return nil, fmt.Errorf("targets[%v]: invalid name %q", i, name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("targets[%v]: duplicate name %q, set a distinct name", i, name)
+		}
+		names[name] = true
+
+		tcfg := *cfg
+		tcfg.Targets = nil
+		tcfg.targetName = name
+		tcfg.Routes = t.Routes
+		tcfg.SyncTargetPath = stripLongPathPrefix(t.Path)
+		if t.Account != "" {
+			tcfg.GDAccountName = t.Account
+		}
+		if t.RootFolderID != "" {
+			tcfg.GDRootFolderID, tcfg.GDRootPath = t.RootFolderID, ""
+		}
+		if minutes, err := strconv.Atoi(t.Schedule); err == nil {
+			tcfg.SyncDelayMinute = minutes
+			tcfg.Schedule = ""
+		} else if t.Schedule != "" {
+			tcfg.Schedule = t.Schedule
+		}
+		if t.Workers != 0 {
+			tcfg.SyncWorker = t.Workers
+		}
+		if t.DeleteMode != "" {
+			tcfg.DeleteMode = t.DeleteMode
+		}
+		if len(t.Notify) != 0 {
+			tcfg.Notify = t.Notify
+			if err := loadNotifiers(&tcfg); err != nil {
+				return nil, fmt.Errorf("targets[%v]: %v", i, err)
+			}
+		}
+		targets = append(targets, &tcfg)
+	}
+	return targets, nil
+}
+
+// statePath returns where the local state file fileName of this target lives.
+func (cfg *Config) statePath(fileName string) string {
+	if cfg.targetName == "" {
+		return fileName
+	}
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "." + cfg.targetName + ext
+}
+
+// targetLabel prefixes the messages of a target when several of them run in the same process.
+func (cfg *Config) targetLabel() string {
+	if cfg.targetName == "" {
+		return ""
+	}
+	return "[" + cfg.targetName + "] "
+}
+
+// findTarget returns the target containing p, which is relative to the current directory or absolute. With a
+// single target, p may also be relative to its sync target path as before. A path inside a route is found in the
+// target of the route.
+func findTarget(targets []*Config, p string) (*Config, string, error) {
+	var roots []*Config
+	for _, t := range targets {
+		if t.routePath == "" {
+			roots = append(roots, t)
+		}
+	}
+	if len(roots) == 1 {
+		subtree, err := cleanSubtree(roots[0], p)
+		if err != nil {
+			return nil, "", err
+		}
+		t, subtree := routeFor(targets, roots[0], subtree)
+		return t, subtree, nil
+	}
+
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, t := range roots {
+		if abs == filepath.Clean(t.SyncTargetPath) || isUnderAny(abs, []SkippedPath{{Loc: filepath.Clean(t.SyncTargetPath)}}) {
+			subtree, err := cleanSubtree(t, abs)
+			if err != nil {
+				return nil, "", err
+			}
+			t, subtree := routeFor(targets, t, subtree)
+			return t, subtree, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%v is not inside any of the sync targets", p)
+}
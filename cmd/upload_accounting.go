@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const uploadAccountingWindow = 24 * time.Hour
+
+// uploadAccountingFile is where the upload accounting lives. Unlike the other state files it isn't one per target
+// (see Config.statePath): the cap of drive applies per account, whatever target the uploads come from, so the targets
+// share it, as they share daily_upload_cap which is only set at the top level.
+const uploadAccountingFile = "upload_accounting.json"
+
+// uploadBucket aggregates the bytes uploaded within one minute.
+type uploadBucket struct {
+	Minute int64 `json:"minute"` // unix time truncated to the minute
+	Bytes  int64 `json:"bytes"`
+}
+
+// uploadAccounting tracks uploaded bytes per account over a rolling 24 hours window, so uploads can be paused
+// before Drive's daily upload cap (750 GB) is hit instead of failing for the rest of the day.
+type uploadAccounting struct {
+	mu       *sync.Mutex
+	filePath string
+	limit    int64
+	Accounts map[string][]uploadBucket `json:"accounts"`
+}
+
+var (
+	uploadAccountingsMu = &sync.Mutex{}
+	uploadAccountings   = map[string]*uploadAccounting{}
+)
+
+// openUploadAccounting returns the accounting stored at filePath. Targets of the same process share one instance
+// since the cap applies per account, whatever folder the upload comes from, which makes it fail for a limit other
+// than the one of the shared instance.
+func openUploadAccounting(filePath string, limit int64) (*uploadAccounting, error) {
+	uploadAccountingsMu.Lock()
+	defer uploadAccountingsMu.Unlock()
+	if ua, ok := uploadAccountings[filePath]; ok {
+		if ua.limit != limit {
+			return nil, fmt.Errorf("daily_upload_cap: %v is shared by every target, already in use with a cap of %v instead of %v",
+				filePath, getFileSizeFormatted(ua.limit), getFileSizeFormatted(limit))
+		}
+		return ua, nil
+	}
+	ua, err := newUploadAccounting(filePath, limit)
+	if err != nil {
+		return nil, err
+	}
+	uploadAccountings[filePath] = ua
+	return ua, nil
+}
+
+func newUploadAccounting(filePath string, limit int64) (*uploadAccounting, error) {
+	ua := &uploadAccounting{
+		mu:       &sync.Mutex{},
+		filePath: filePath,
+		limit:    limit,
+		Accounts: map[string][]uploadBucket{},
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ua, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, ua); err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	if ua.Accounts == nil {
+		ua.Accounts = map[string][]uploadBucket{}
+	}
+	return ua, nil
+}
+
+// used prunes buckets outside the window and returns the bytes uploaded by account in the last 24 hours.
+// The caller must hold ua.mu.
+func (ua *uploadAccounting) used(account string, now time.Time) int64 {
+	var (
+		kept  []uploadBucket
+		total int64
+	)
+	for _, b := range ua.Accounts[account] {
+		if now.Sub(time.Unix(b.Minute, 0)) >= uploadAccountingWindow {
+			continue
+		}
+		kept = append(kept, b)
+		total += b.Bytes
+	}
+	ua.Accounts[account] = kept
+	return total
+}
+
+// reserve blocks until size bytes can be uploaded by account without crossing the limit and records them. The
+// returned function gives the reservation back when the upload did not happen.
+func (ua *uploadAccounting) reserve(account string, size int64) (func(), error) {
+	if ua.limit <= 0 || size <= 0 {
+		return func() {}, nil
+	}
+	if size > ua.limit {
+		return nil, fmt.Errorf("file of %v exceeds the daily upload cap of %v", getFileSizeFormatted(size), getFileSizeFormatted(ua.limit))
+	}
+
+	paused := false
+	for {
+		ua.mu.Lock()
+		now := time.Now()
+		used := ua.used(account, now)
+		if used+size <= ua.limit {
+			minute := now.Truncate(time.Minute).Unix()
+			buckets := ua.Accounts[account]
+			if n := len(buckets); n != 0 && buckets[n-1].Minute == minute {
+				buckets[n-1].Bytes += size
+			} else {
+				ua.Accounts[account] = append(buckets, uploadBucket{Minute: minute, Bytes: size})
+			}
+			ua.mu.Unlock()
+			if paused {
+				printOp("resumed", fmt.Sprintf("uploads for account %v", account), "daily upload cap freed up")
+			}
+			return func() { ua.release(account, minute, size) }, nil
+		}
+
+		resumeAt := ua.resumeAt(account, size, now)
+		ua.mu.Unlock()
+		if !paused {
+			paused = true
+			_ = ua.save()
+			printOp("paused", fmt.Sprintf("uploads for account %v", account),
+				fmt.Sprintf("%v of %v used in the last 24h, resuming around %v",
+					getFileSizeFormatted(used), getFileSizeFormatted(ua.limit), resumeAt.Format(time.DateTime)))
+		}
+		if !sleepOrShutdown(min(time.Until(resumeAt), time.Minute) + time.Second) {
+			return nil, errShutdown
+		}
+	}
+}
+
+// fits reports whether size more bytes can be uploaded by account right away.
+func (ua *uploadAccounting) fits(account string, size int64) bool {
+	if ua.limit <= 0 {
+		return true
+	}
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return ua.used(account, time.Now())+size <= ua.limit
+}
+
+// resumeAt estimates when enough old buckets leave the window to fit size more bytes. The caller must hold ua.mu.
+func (ua *uploadAccounting) resumeAt(account string, size int64, now time.Time) time.Time {
+	need := ua.used(account, now) + size - ua.limit
+	for _, b := range ua.Accounts[account] {
+		need -= b.Bytes
+		if need <= 0 {
+			return time.Unix(b.Minute, 0).Add(uploadAccountingWindow)
+		}
+	}
+	return now.Add(uploadAccountingWindow)
+}
+
+func (ua *uploadAccounting) release(account string, minute, size int64) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	for i, b := range ua.Accounts[account] {
+		if b.Minute == minute {
+			ua.Accounts[account][i].Bytes = max(b.Bytes-size, 0)
+			return
+		}
+	}
+}
+
+// Usage returns the bytes uploaded by account in the last 24 hours and the configured cap.
+func (ua *uploadAccounting) Usage(account string) (used, limit int64) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return ua.used(account, time.Now()), ua.limit
+}
+
+func (ua *uploadAccounting) save() error {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	data, err := json.MarshalIndent(ua, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ua.filePath, data, os.ModePerm)
+}
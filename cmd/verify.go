@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// verifyDifference is a mismatch between the local tree, the object map and drive found by verify.
+type verifyDifference struct {
+	Target string `json:"target,omitempty"`
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func newVerifyCmd(cf *configFlags) *cobra.Command {
+	var (
+		remote bool
+		output string
+	)
+	cmd := &cobra.Command{
+		Use:   "verify [path]",
+		Short: "Compare the local tree, the object map and drive without changing anything",
+		Long: "Compare the local tree (or only path) with the object map and with the files on drive, and list the\n" +
+			"differences: untracked or changed local files, tracked files missing locally or on drive, files on drive\n" +
+			"which aren't tracked and files whose size or md5 on drive drifted from the synced one. Exits with 1 when\n" +
+			"there are any. Nothing is changed locally or on drive.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown --output %q, expected \"table\" or \"json\"", output)
+			}
+			targets, err := loadConfig(cf)
+			if err != nil {
+				return err
+			}
+			subtrees := make([]string, len(targets))
+			if len(args) == 1 {
+				tcfg, subtree, err := findTarget(targets, args[0])
+				if err != nil {
+					return err
+				}
+				targets, subtrees = []*Config{tcfg}, []string{subtree}
+			}
+
+			differences := []verifyDifference{}
+			for i, tcfg := range targets {
+				diffs, err := verifyTarget(tcfg, subtrees[i], remote)
+				if err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+				if err = recordDrift(tcfg, driftFindings(diffs)); err != nil {
+					return fmt.Errorf("%v%v", tcfg.targetLabel(), err)
+				}
+				differences = append(differences, diffs...)
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err = enc.Encode(differences); err != nil {
+					return err
+				}
+			} else if len(differences) != 0 {
+				printDifferences(differences)
+			}
+			if len(differences) != 0 {
+				return fmt.Errorf("%v differences found", len(differences))
+			}
+			if output == "table" {
+				compared := "local tree and object map match"
+				if remote {
+					compared = "local tree, object map and drive match"
+				}
+				fmt.Println(colorize(colorGreen, "Verified!") + " " + compared)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&remote, "remote", true, "also compare with the files on drive, --remote=false only checks the local tree")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "print the differences as a \"table\" or as \"json\"")
+	return cmd
+}
+
+// printDifferences prints differences as an aligned table.
+func printDifferences(differences []verifyDifference) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tPATH\tKIND\tDETAIL")
+	for _, d := range differences {
+		target := d.Target
+		if target == "" {
+			target = "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", target, d.Path, colorize(opColor(d.Kind), d.Kind), d.Detail)
+	}
+	_ = w.Flush()
+}
+
+// driftFindings returns the differences between drive and the object map among differences, for the digest.
+func driftFindings(differences []verifyDifference) []string {
+	var findings []string
+	for _, d := range differences {
+		if d.Kind == "drift" || d.Kind == "missing-remote" {
+			findings = append(findings, fmt.Sprintf("%v: %v", d.Path, d.Detail))
+		}
+	}
+	return findings
+}
+
+// verifyTarget returns the differences between the local tree of cfg, its object map and, with remote, drive.
+func verifyTarget(cfg *Config, subtree string, remote bool) ([]verifyDifference, error) {
+	state, err := openStateStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer state.Close()
+	tree, err := state.Load()
+	if err != nil {
+		return nil, err
+	}
+	objectMap := tree.toMap()
+
+	var differences []verifyDifference
+	report := func(kind, loc, detail string) {
+		differences = append(differences, verifyDifference{Target: cfg.targetName,
+			Path: strings.TrimPrefix(loc, cfg.SyncTargetPath), Kind: kind, Detail: detail})
+	}
+
+	seen := map[string]bool{}
+	skipped, err := walkSource(cfg, cfg.SyncTargetPath, subtree, func(loc string, info os.FileInfo) error {
+		if loc == cfg.SyncTargetPath {
+			return nil
+		}
+		seen[loc] = true
+		object, ok := objectMap[loc]
+		switch {
+		case !ok:
+			report("untracked", loc, "not uploaded yet")
+		case object.GDId == "":
+			report("pending", loc, "left locked by an interrupted cycle")
+		case info.IsDir() != (object.LastMod == 0):
+			report("changed", loc, "switched between file and folder")
+		case !info.IsDir() && info.Size() != object.Size:
+			report("changed", loc, fmt.Sprintf("size %v, synced %v", getFileSizeFormatted(info.Size()), getFileSizeFormatted(object.Size)))
+		case !info.IsDir() && info.ModTime().Unix() != object.LastMod:
+			report("changed", loc, "modification time differs from the synced one")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for loc := range objectMap {
+		if seen[loc] || !isInSubtree(cfg, loc, subtree) || isUnderAny(loc, skipped) {
+			continue
+		}
+		report("missing-local", loc, "tracked but gone locally")
+	}
+
+	if remote {
+		drive, err := newDriveClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		err = walkTrackedRemote(cfg, drive, objectMap, subtree, func(dir string, tracked []string, files []*RemoteFile) {
+			verifyRemoteFolder(cfg, objectMap, dir, tracked, files, subtree, report)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(differences, func(i, j int) bool { return differences[i].Path < differences[j].Path })
+	return differences, nil
+}
+
+// verifyRemoteFolder reports the differences between the tracked children of dir and its children on drive.
+func verifyRemoteFolder(cfg *Config, objectMap map[string]*Object, dir string, tracked []string, files []*RemoteFile,
+	subtree string, report func(kind, loc, detail string)) {
+	byID := make(map[string]*RemoteFile, len(files))
+	for _, f := range files {
+		byID[f.ID] = f
+	}
+	for _, loc := range tracked {
+		object := objectMap[loc]
+		if object.GDId == "" || !isInSubtree(cfg, loc, subtree) {
+			continue
+		}
+		f, ok := byID[object.GDId]
+		delete(byID, object.GDId)
+		switch {
+		case !ok:
+			report("missing-remote", loc, "tracked but gone from drive")
+		case f.IsDir != (object.LastMod == 0):
+			report("drift", loc, "switched between file and folder on drive")
+		case f.IsDir:
+		case (f.Size != 0 || f.MD5 != "") && f.Size != object.Size: // the gdrive client reports neither
+			report("drift", loc, fmt.Sprintf("size on drive %v, synced %v", getFileSizeFormatted(f.Size), getFileSizeFormatted(object.Size)))
+		case f.MD5 != "" && object.MD5 != "" && f.MD5 != object.MD5:
+			report("drift", loc, "md5 on drive differs from the synced one")
+		}
+	}
+	for _, f := range byID {
+		loc := filepath.Join(dir, f.Name)
+		if (dir == cfg.SyncTargetPath && isRemoteMetaName(f.Name)) || f.IsGoogleNative() || !isInSubtree(cfg, loc, subtree) {
+			continue
+		}
+		report("remote-only", loc, "on drive but not tracked")
+	}
+}
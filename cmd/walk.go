@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultWalkRetry        = 3
+	defaultWalkRetryDelayMs = 500
+)
+
+// walkSource walks subtree (relative, empty for everything) of sourceRoot and reports every entry by its logical
+// location under cfg.SyncTargetPath, which is what the object map is keyed by.
+//
+// Directory reads and stats that fail with a transient error (stale NFS handle, SMB timeouts, ...) are retried with
+// backoff. Entries that keep failing, can't be read for lack of permission, are special files (devices, pipes,
+// sockets) or are filtered out are not passed to fn but returned in skipped with their reason, so callers can report them and leave their
+// remote counterpart untouched instead of aborting the whole sync. The .gdriveignore file of every directory is read
+// from sourceRoot before its entries are walked.
+func walkSource(cfg *Config, sourceRoot, subtree string, fn func(loc string, info os.FileInfo) error) (skipped []SkippedPath, err error) {
+	toLoc := func(src string) (string, error) {
+		if sourceRoot == cfg.SyncTargetPath {
+			return src, nil
+		}
+		rel, err := filepath.Rel(sourceRoot, src)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(cfg.SyncTargetPath, rel), nil
+	}
+
+	// skipOnErr records loc as skipped when err is one the walk can survive
+	skipOnErr := func(loc string, err error) bool {
+		switch {
+		case isTransientFSError(err):
+			skipped = append(skipped, SkippedPath{Loc: loc, Reason: skipReasonUnreadable, Detail: err.Error()})
+		case errors.Is(err, os.ErrPermission):
+			skipped = append(skipped, SkippedPath{Loc: loc, Reason: skipReasonPermissionDenied})
+		default:
+			return false
+		}
+		return true
+	}
+
+	gi := newGDriveIgnore()
+	var walk func(src string, info os.FileInfo) error
+	walk = func(src string, info os.FileInfo) error {
+		loc, err := toLoc(src)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket|os.ModeIrregular) != 0 {
+			skipped = append(skipped, SkippedPath{Loc: loc, Reason: skipReasonSpecialFile, Detail: info.Mode().Type().String()})
+			return nil
+		}
+		if sp, skip := filterPath(cfg, gi, loc, info); skip {
+			skipped = append(skipped, sp)
+			return nil
+		}
+		if err = fn(loc, info); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if shuttingDown() {
+			return errShutdown
+		}
+
+		if rel, err := filepath.Rel(cfg.SyncTargetPath, loc); err == nil {
+			if err = gi.load(cfg, relDirKey(rel), src); err != nil {
+				if skipOnErr(loc, err) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		names, err := withWalkRetry(cfg, func() ([]string, error) { return readDirNames(longPath(src)) })
+		if err != nil {
+			if skipOnErr(loc, err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, name := range names {
+			child := filepath.Join(src, name)
+			childInfo, err := withWalkRetry(cfg, func() (os.FileInfo, error) { return os.Lstat(longPath(child)) })
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				childLoc, _ := toLoc(child)
+				if skipOnErr(childLoc, err) {
+					continue
+				}
+				return err
+			}
+			if err = walk(child, childInfo); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start := filepath.Join(sourceRoot, subtree)
+	if subtree == "" {
+		start = sourceRoot
+	}
+	// the rules of the directories above subtree apply to it as well
+	for dir := filepath.Dir(subtree); subtree != "" && dir != "."; dir = filepath.Dir(dir) {
+		if err = gi.load(cfg, relDirKey(dir), filepath.Join(sourceRoot, dir)); err != nil {
+			return nil, err
+		}
+	}
+	if subtree != "" {
+		if err = gi.load(cfg, "", sourceRoot); err != nil {
+			return nil, err
+		}
+	}
+	info, err := withWalkRetry(cfg, func() (os.FileInfo, error) { return os.Lstat(longPath(start)) })
+	if err != nil {
+		return nil, err
+	}
+	if err = walk(start, info); err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// withWalkRetry retries f with exponential backoff as long as it fails with a transient filesystem error.
+func withWalkRetry[T any](cfg *Config, f func() (T, error)) (T, error) {
+	retry := cfg.WalkRetry
+	if retry <= 0 {
+		retry = defaultWalkRetry
+	}
+	delay := time.Duration(cfg.WalkRetryDelayMillis) * time.Millisecond
+	if delay <= 0 {
+		delay = defaultWalkRetryDelayMs * time.Millisecond
+	}
+
+	var (
+		v   T
+		err error
+	)
+	for i := 0; i <= retry; i++ {
+		if i != 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		v, err = f()
+		if err == nil || !isTransientFSError(err) {
+			return v, err
+		}
+	}
+	return v, fmt.Errorf("giving up after %v retries: %w", retry, err)
+}
+
+// isTransientFSError reports errors typically caused by network filesystem hiccups rather than by the local tree.
+func isTransientFSError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.ESTALE, syscall.EIO, syscall.ETIMEDOUT, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY,
+		syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EHOSTDOWN, syscall.EHOSTUNREACH, syscall.ENETDOWN,
+		syscall.ENETUNREACH, syscall.ENETRESET,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	for _, errno := range platformTransientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// isUnderAny reports whether loc is one of the skipped paths or inside one of them.
+func isUnderAny(loc string, skipped []SkippedPath) bool {
+	for _, sp := range skipped {
+		if loc == sp.Loc || strings.HasPrefix(loc, sp.Loc+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInSubtree reports whether loc is inside subtree (relative to the sync target, empty for everything).
+func isInSubtree(cfg *Config, loc, subtree string) bool {
+	return subtree == "" || isUnderAny(loc, []SkippedPath{{Loc: filepath.Join(cfg.SyncTargetPath, subtree)}})
+}
+
+// cleanSubtree validates a path given relative to the sync target (or absolute inside it) and returns it relative.
+func cleanSubtree(cfg *Config, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		rel, err := filepath.Rel(cfg.SyncTargetPath, p)
+		if err != nil {
+			return "", err
+		}
+		p = rel
+	}
+	p = filepath.Clean(p)
+	if p == "." {
+		return "", nil
+	}
+	if p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%v is outside of the sync target path %v", p, cfg.SyncTargetPath)
+	}
+	return p, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// platformTransientErrnos are the transient errors of the platform on top of the POSIX ones, none here.
+var platformTransientErrnos []syscall.Errno
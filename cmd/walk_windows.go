@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// Windows network errors, which package syscall doesn't name.
+const (
+	errorBadNetpath     syscall.Errno = 53
+	errorUnexpNetErr    syscall.Errno = 59
+	errorNetnameDeleted syscall.Errno = 64
+	errorSemTimeout     syscall.Errno = 121
+)
+
+// platformTransientErrnos are the errors a share dropping or timing out yields on Windows, where the POSIX ones
+// isTransientFSError checks never show up.
+var platformTransientErrnos = []syscall.Errno{errorBadNetpath, errorUnexpNetErr, errorNetnameDeleted, errorSemTimeout}
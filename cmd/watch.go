@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchDebounceSeconds = 5
+	// watchBatchInterval is how long the subtree cycles of the watcher are gathered before being announced
+	watchBatchInterval = 15 * time.Minute
+)
+
+// watcher keeps an fsnotify watch on every directory of the sync target, adding watches for directories created
+// later, and collects the changed paths until they are drained.
+type watcher struct {
+	cfg *Config
+	fw  *fsnotify.Watcher
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+func newWatcher(cfg *Config) (*watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// the watcher keeps the filters it started with, a reload can't change them under its feet
+	cfgCopy := *cfg
+	w := &watcher{cfg: &cfgCopy, fw: fw, pending: map[string]struct{}{}}
+	if err = w.addRecursive(cfg.SyncTargetPath); err != nil {
+		_ = fw.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// addRecursive watches dir and every directory below it that isn't filtered out.
+func (w *watcher) addRecursive(dir string) error {
+	gi := newGDriveIgnore()
+	// the .gdriveignore files above dir apply to it as well
+	for parent := dir; parent != w.cfg.SyncTargetPath; {
+		parent = filepath.Dir(parent)
+		rel, err := filepath.Rel(w.cfg.SyncTargetPath, parent)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			break
+		}
+		_ = gi.load(w.cfg, relDirKey(rel), parent)
+	}
+	return filepath.WalkDir(dir, func(loc string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			if _, skip := filterPath(w.cfg, gi, loc, info); skip {
+				return filepath.SkipDir
+			}
+		}
+		if rel, err := filepath.Rel(w.cfg.SyncTargetPath, loc); err == nil {
+			_ = gi.load(w.cfg, relDirKey(rel), loc)
+		}
+		if err = w.fw.Add(loc); err != nil {
+			return fmt.Errorf("watch %v: %v", loc, err)
+		}
+		return nil
+	})
+}
+
+func (w *watcher) run() {
+	for {
+		select {
+		case event, ok := <-w.fw.Events:
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(filepath.Base(event.Name), ".bgdrive-sync-") {
+				continue // our own temporary files
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err = w.addRecursive(event.Name); err != nil {
+						fmt.Printf("watch error: %v\n", err)
+					}
+				}
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			w.mu.Lock()
+			w.pending[event.Name] = struct{}{}
+			w.mu.Unlock()
+		case err, ok := <-w.fw.Errors:
+			if !ok {
+				return
+			}
+			// e.g. the kernel event queue overflowed, the next full sync reconciles what was missed
+			fmt.Printf("watch error: %v\n", err)
+		}
+	}
+}
+
+// drain returns the subtrees (relative to the sync target) touched since the last call. Removed paths are
+// reported through their parent directory so the removal is picked up by the deletion pass, and subtrees nested in
+// another returned subtree are dropped.
+func (w *watcher) drain() []string {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = map[string]struct{}{}
+	w.mu.Unlock()
+
+	set := map[string]struct{}{}
+	for loc := range pending {
+		if _, err := os.Lstat(loc); err != nil {
+			loc = filepath.Dir(loc)
+		}
+		subtree, err := cleanSubtree(w.cfg, loc)
+		if err != nil {
+			continue
+		}
+		set[subtree] = struct{}{}
+	}
+	if _, ok := set[""]; ok {
+		return []string{""}
+	}
+
+	var subtrees []string
+	for subtree := range set {
+		subtrees = append(subtrees, subtree)
+	}
+	sort.Strings(subtrees)
+
+	var result []string
+	for _, subtree := range subtrees {
+		if n := len(result); n != 0 && strings.HasPrefix(subtree, result[n-1]+string(filepath.Separator)) {
+			continue
+		}
+		result = append(result, subtree)
+	}
+	return result
+}
+
+func (w *watcher) Close() error {
+	return w.fw.Close()
+}
+
+// watchBatch gathers the reports of the subtree cycles run for the watcher, whose metadata is published and which
+// are announced as a single cycle every watchBatchInterval and before a full sync, so a busy folder doesn't flood
+// the webhooks, notifiers and digest nor rewrite the metadata on drive after every change. Failure streaks are still
+// alerted right away.
+type watchBatch struct {
+	report *CycleReport
+}
+
+// add runs a cycle of subtree into the batch.
+func (b *watchBatch) add(cfg *Config, om *ObjectManager, subtree string) error {
+	report := newCycleReport()
+	err := syncFiles(cfg, om, report, subtree)
+	recordCycle(cfg, om, report, err)
+	if b.report == nil {
+		b.report = &CycleReport{Start: report.Start}
+	}
+	b.report.merge(report)
+	return err
+}
+
+// due reports whether the batch has been gathering for watchBatchInterval.
+func (b *watchBatch) due() bool {
+	return b.report != nil && time.Since(b.report.Start) >= watchBatchInterval
+}
+
+// flush publishes the metadata of the gathered cycles and announces them, and starts a new batch.
+func (b *watchBatch) flush(cfg *Config, om *ObjectManager, digests *digestAggregator) {
+	report := b.report
+	if report == nil {
+		return
+	}
+	b.report = nil
+	if !cfg.DryRun && len(report.Operations) != 0 {
+		if err := publishCycleMeta(cfg, om, report.Operations, report.Start); err != nil {
+			fmt.Printf("%vfailed to publish the metadata of the watched changes: %v\n", cfg.targetLabel(), err)
+		}
+	}
+	announceCycle(cfg, report, digests)
+}
+
+// watchLoop syncs the subtrees reported by the watcher in debounced batches, and still runs a full sync on the
+// target schedule to reconcile anything the watcher missed, until shutdown.
+func watchLoop(cfg *Config, om *ObjectManager, digests *digestAggregator) error {
+	w, err := newWatcher(cfg)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	batch := &watchBatch{}
+	defer batch.flush(cfg, om, digests)
+
+	debounce := time.Duration(cfg.WatchDebounceSeconds) * time.Second
+	if debounce <= 0 {
+		debounce = defaultWatchDebounceSeconds * time.Second
+	}
+	ticker := time.NewTicker(debounce)
+	defer ticker.Stop()
+
+	nextFullSync := time.Now()
+	for {
+		if applyReload(cfg, om) {
+			nextFullSync = cfg.schedule.Next(om.live.lastCycleEnd())
+			fmt.Printf("%vconfig reloaded, next full sync: %v\n", cfg.targetLabel(), nextFullSync.Format(time.DateTime))
+		}
+		if om.live.takeSyncRequest() || (!om.live.isPaused() && !time.Now().Before(nextFullSync)) {
+			w.drain() // the full walk covers everything queued so far
+			batch.flush(cfg, om, digests)
+			fmt.Printf("%vSyncing...\n", cfg.targetLabel())
+			err = runCycle(cfg, om, "", digests)
+			nextFullSync = cfg.schedule.Next(time.Now())
+			om.live.setNext(nextFullSync)
+			printCycleResult(cfg, err, fmt.Sprintf("next full sync: %v", nextFullSync.Format(time.DateTime)))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-om.live.wake:
+			continue
+		case <-shutdown:
+			return nil
+		}
+		if om.live.isPaused() {
+			continue // the events are kept queued until the resume
+		}
+		for _, subtree := range w.drain() {
+			if shuttingDown() {
+				return nil
+			}
+			fmt.Printf("%vSyncing %v...\n", cfg.targetLabel(), filepath.Join(cfg.SyncTargetPath, subtree))
+			printCycleResult(cfg, batch.add(cfg, om, subtree), "")
+		}
+		if batch.due() {
+			batch.flush(cfg, om, digests)
+		}
+	}
+}
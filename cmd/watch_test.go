@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchBatch(t *testing.T) {
+	cfg := newTestTarget(t)
+	cfg.UploadJournal = true
+	cfg.Digest = digestDaily
+	digests, err := newDigestAggregator(cfg.Digest, cfg.statePath(digestStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	om := newTestObjectManager(t, cfg)
+	journals := func() []string {
+		var contents []string
+		for p, content := range fakeTree(t, cfg) {
+			if strings.HasPrefix(p, remoteMetaFolderName+"/journal-") {
+				contents = append(contents, content)
+			}
+		}
+		return contents
+	}
+
+	now := time.Now().Add(-time.Hour)
+	batch := &watchBatch{}
+	writeTestFile(t, cfg, "docs/a.txt", "a", now)
+	if err = batch.add(cfg, om, "docs"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, cfg, "pics/b.txt", "b", now)
+	if err = batch.add(cfg, om, "pics"); err != nil {
+		t.Fatal(err)
+	}
+	if got := journals(); len(got) != 0 {
+		t.Fatalf("watched cycles published %v journals before the batch was flushed", len(got))
+	}
+
+	batch.flush(cfg, om, digests)
+	got := journals()
+	if len(got) != 1 {
+		t.Fatalf("flushed batch published %v journals, want one", len(got))
+	}
+	for _, p := range []string{`docs/a.txt"`, `pics/b.txt"`} {
+		if !strings.Contains(got[0], p) {
+			t.Errorf("journal of the batch misses %v:\n%v", p, got[0])
+		}
+	}
+	if digests.current == nil || digests.current.Cycles != 1 {
+		t.Errorf("digest holds %+v, want the batch as one cycle", digests.current)
+	}
+
+	batch.flush(cfg, om, digests) // nothing gathered since
+	if got = journals(); len(got) != 1 {
+		t.Errorf("flushing an empty batch published %v journals, want still one", len(got))
+	}
+}
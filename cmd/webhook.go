@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhooks on values: which cycles fire the webhook.
+const (
+	webhookOnAlways  = "always"
+	webhookOnFailure = "failure"
+	webhookOnSuccess = "success"
+)
+
+// WebhookConfig is one entry of webhooks: an http POST fired when a cycle finishes.
+type WebhookConfig struct {
+	URL         string `yaml:"url"`
+	On          string `yaml:"on"`
+	Template    string `yaml:"template"`
+	ContentType string `yaml:"content_type"`
+	tmpl        *template.Template
+}
+
+// cycleEvent describes a finished cycle to webhooks, and is the data their templates are executed with.
+type cycleEvent struct {
+	Host             string    `json:"host"`
+	Target           string    `json:"target,omitempty"`
+	Path             string    `json:"path"`
+	Status           string    `json:"status"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	DurationSeconds  float64   `json:"duration_seconds"`
+	Created          int       `json:"created"`
+	Updated          int       `json:"updated"`
+	Deleted          int       `json:"deleted"`
+	Skipped          int       `json:"skipped"`
+	BytesTransferred int64     `json:"bytes_transferred"`
+	Errors           int       `json:"errors"`
+	Error            string    `json:"error,omitempty"`
+}
+
+func newCycleEvent(cfg *Config, report *CycleReport) *cycleEvent {
+	created, updated, deleted := report.Counts()
+	e := &cycleEvent{Host: hostname(), Target: cfg.targetName, Path: cfg.SyncTargetPath, Status: webhookOnSuccess,
+		Start: report.Start, End: report.End, DurationSeconds: report.End.Sub(report.Start).Seconds(), Created: created,
+		Updated: updated, Deleted: deleted, Skipped: len(report.Skipped), BytesTransferred: report.BytesTransferred()}
+	if report.Failed() {
+		e.Status = webhookOnFailure
+		e.Errors = 1
+		e.Error = report.Err
+	}
+	return e
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"size": getFileSizeFormatted,
+}
+
+// loadWebhooks validates the webhooks configured in cfg and parses their templates. It must run once after the
+// config is loaded.
+func loadWebhooks(cfg *Config) error {
+	for i := range cfg.Webhooks {
+		wh := &cfg.Webhooks[i]
+		if wh.URL == "" {
+			return fmt.Errorf("webhooks[%v]: url is required", i)
+		}
+		switch wh.On {
+		case "", webhookOnAlways, webhookOnFailure, webhookOnSuccess:
+		default:
+			return fmt.Errorf("webhooks[%v]: unknown on %q, expected %q, %q or %q", i, wh.On, webhookOnAlways,
+				webhookOnFailure, webhookOnSuccess)
+		}
+		if wh.Template != "" {
+			tmpl, err := template.New(fmt.Sprintf("webhooks[%v]", i)).Funcs(webhookFuncs).Parse(wh.Template)
+			if err != nil {
+				return err
+			}
+			wh.tmpl = tmpl
+		}
+	}
+	return nil
+}
+
+// fireWebhooks posts the finished cycle to every webhook interested in its outcome. A failing webhook is reported
+// and doesn't stop the others.
+func fireWebhooks(cfg *Config, report *CycleReport) {
+	e := newCycleEvent(cfg, report)
+	for _, wh := range cfg.Webhooks {
+		if wh.On != "" && wh.On != webhookOnAlways && wh.On != e.Status {
+			continue
+		}
+		if err := fireWebhook(wh, e); err != nil {
+			fmt.Printf("%vwebhook %v failed: %v\n", cfg.targetLabel(), wh.URL, err)
+		}
+	}
+}
+
+// fireWebhook posts e to wh, as json or rendered by its template.
+func fireWebhook(wh WebhookConfig, e *cycleEvent) error {
+	buf := bytes.NewBuffer(nil)
+	if wh.tmpl != nil {
+		if err := wh.tmpl.Execute(buf, e); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(buf).Encode(e); err != nil {
+		return err
+	}
+
+	contentType := wh.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return postHook(wh.URL, contentType, buf)
+}
+
+// postHook posts body to url and fails unless it responded with a 2xx status.
+func postHook(url, contentType string, body io.Reader) error {
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Post(url, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("responded %v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}